@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"securemqtt/internal/audit"
+)
+
+const (
+	auditLogFile  = "audit.jsonl"
+	auditHeadFile = "audit_head.json"
+
+	// Type of the signed document pinning the last audit event, so truncating the log is detected
+	auditHeadDocument = "audit-head"
+)
+
+// Who runs this command, recorded with every audit event (--operator)
+var operator string
+
+// Last event of the audit log, signed by the authority after every append
+type auditHead struct {
+	Seq  int    `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+func auditLog() *audit.Log {
+	return audit.Open(filepath.Join(keysDir, auditLogFile))
+}
+
+// Default operator identity: the invoking user, also through sudo
+func defaultOperator() string {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		return name
+	}
+	if current, err := user.Current(); err == nil {
+		return current.Username
+	}
+	return "unknown"
+}
+
+// Appends an event to the audit log & signs the new head while the log is still locked, commands
+// that record events without holding the keys directory lock must not leave an older head behind
+func recordAudit(event audit.Event) error {
+	event.Operator = operator
+	_, err := auditLog().AppendThen(event, func(appended *audit.Event) error {
+		return writeSigned(auditHeadFile, auditHeadDocument, auditHead{Seq: appended.Seq, Hash: appended.Hash})
+	})
+	return err
+}
+
+// Audit event describing an issued or revoked key
+func keyEvent(operation string, entry *registryEntry, details map[string]string) audit.Event {
+	return audit.Event{
+		Operation:   operation,
+		Subject:     entry.Subject,
+		KeyFile:     entry.KeyFile,
+		DeviceID:    entry.DeviceID,
+		Attributes:  entry.Attributes,
+		KeyID:       entry.KeyID,
+		Fingerprint: entry.Fingerprint,
+		Details:     details,
+	}
+}
+
+// Records one event per subject, taking the key details from the registry
+func recordKeyEvents(operation string, subjects []string, details map[string]string) error {
+	reg, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+	for _, subject := range subjects {
+		entry := reg.Find(subject)
+		if entry == nil {
+			return fmt.Errorf("audit: %s is not in the registry", subject)
+		}
+		if err := recordAudit(keyEvent(operation, entry, details)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Verifies the hash chain & that it ends at the signed head. Returns the number of events.
+func verifyAuditLog() (int, error) {
+	last, err := auditLog().Verify()
+	if err != nil {
+		return 0, err
+	}
+
+	var head auditHead
+	found, err := readSigned(auditHeadFile, auditHeadDocument, &head)
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case !found && last == nil:
+		return 0, nil
+	case !found:
+		return 0, fmt.Errorf("audit log has %d events but no signed head", last.Seq)
+	case last == nil:
+		return 0, fmt.Errorf("audit log is missing, signed head is at event %d", head.Seq)
+	case last.Seq != head.Seq || last.Hash != head.Hash:
+		return 0, fmt.Errorf("audit log ends at event %d, signed head is at event %d: events were removed or rewritten", last.Seq, head.Seq)
+	}
+	return last.Seq, nil
+}
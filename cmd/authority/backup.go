@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"securemqtt/internal/audit"
+	"securemqtt/internal/backup"
+	"securemqtt/internal/epoch"
+	"securemqtt/internal/escrow"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/keystore"
+	"securemqtt/internal/signed"
+)
+
+// Outcome of one integrity check on a keys directory
+type backupCheck struct {
+	Name   string
+	Status string // ok, skipped or failed
+	Detail string
+}
+
+// What a backup or restore found, one line per check
+type backupReport struct {
+	Files  int
+	Signer ed25519.PublicKey
+	Checks []backupCheck
+}
+
+func (strct *backupReport) add(name, status, detail string, args ...any) {
+	strct.Checks = append(strct.Checks, backupCheck{Name: name, Status: status, Detail: fmt.Sprintf(detail, args...)})
+}
+
+// Failed reports whether any check failed
+func (strct *backupReport) Failed() bool {
+	for _, check := range strct.Checks {
+		if check.Status == "failed" {
+			return true
+		}
+	}
+	return false
+}
+
+func (strct *backupReport) Print() {
+	for _, check := range strct.Checks {
+		fmt.Printf("%-8s %-17s %s\n", check.Status, check.Name, check.Detail)
+	}
+	if strct.Files > 0 {
+		fmt.Printf("%d file(s), signed by authority key %s\n", strct.Files, signed.Fingerprint(strct.Signer))
+	}
+}
+
+// Checks the current keys directory, then writes it as an encrypted archive signed by the authority.
+// A directory that fails its checks is only archived with force.
+func backupKeys(archivePath string, passphrase []byte, shareFiles []string, force bool) (*backupReport, error) {
+	report := checkKeysDir(keysDir, shareFiles)
+	if report.Failed() && !force {
+		return report, fmt.Errorf("keys directory failed its checks, fix it or rerun with --force")
+	}
+
+	signingKey, err := loadOrCreateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	contents, err := backup.Collect(keysDir, currentNamespace, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	data, err := backup.Seal(contents, passphrase, signingKey)
+	if err != nil {
+		return nil, err
+	}
+	if err := keystore.WriteFile(archivePath, data, keystore.SecretPerm); err != nil {
+		return nil, err
+	}
+	report.Files = len(contents.Files)
+
+	return report, recordAudit(audit.Event{Operation: "backup", Details: map[string]string{
+		"archive": filepath.Base(archivePath),
+		"files":   strconv.Itoa(report.Files),
+		"signer":  signed.Fingerprint(report.Signer),
+	}})
+}
+
+// Verifies & decrypts an archive, checks its contents in a scratch directory and, unless
+// dryRun, writes them to the keys directory & removes the files the archive does not hold.
+// Existing system keys are only replaced with force.
+// The archive must be signed by trustedPath, by the current authority_sign.pub if there is
+// one, or otherwise by the key it names, whose fingerprint the operator compares.
+func restoreKeys(archivePath string, passphrase []byte, trustedPath string, shareFiles []string, dryRun, force bool) (*backupReport, error) {
+	data, err := os.ReadFile(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", archivePath, err)
+	}
+	trusted, err := backupSigner(data, trustedPath)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := backup.Open(data, passphrase, trusted)
+	if err != nil {
+		return nil, err
+	}
+	if contents.Namespace != currentNamespace {
+		return nil, fmt.Errorf("archive is of namespace %q, not %q", contents.Namespace, currentNamespace)
+	}
+
+	scratch, err := os.MkdirTemp("", "authority-restore-")
+	if err != nil {
+		return nil, fmt.Errorf("create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(scratch)
+	if err := contents.Extract(scratch); err != nil {
+		return nil, err
+	}
+	report := checkKeysDir(scratch, shareFiles)
+	report.Files = len(contents.Files)
+	if !report.Signer.Equal(trusted) {
+		report.add("archive signer", "failed", "archive is signed by %s but holds signing key %s",
+			signed.Fingerprint(trusted), signed.Fingerprint(report.Signer))
+	}
+	if dryRun {
+		return report, nil
+	}
+	if report.Failed() {
+		return report, fmt.Errorf("archive failed its checks, nothing was restored")
+	}
+
+	if !force && (fileExists(filepath.Join(keysDir, publicKeyFile)) || fileExists(filepath.Join(keysDir, masterKeyFile)) ||
+		fileExists(filepath.Join(keysDir, sealedMasterKeyFile)) || fileExists(filepath.Join(keysDir, sharesMetaFile))) {
+		return report, fmt.Errorf("%s already holds system keys, rerun with --force to replace them", keysDir)
+	}
+	if err := contents.Extract(keysDir); err != nil {
+		return report, err
+	}
+	removed, err := contents.Prune(keysDir)
+	if err != nil {
+		return report, err
+	}
+	return report, recordAudit(audit.Event{Operation: "restore", Details: map[string]string{
+		"archive":    filepath.Base(archivePath),
+		"created_at": contents.CreatedAt.Format(time.RFC3339),
+		"files":      strconv.Itoa(report.Files),
+		"removed":    strconv.Itoa(len(removed)),
+		"forced":     strconv.FormatBool(force),
+	}})
+}
+
+// Signing key an archive must verify with
+func backupSigner(data []byte, trustedPath string) (ed25519.PublicKey, error) {
+	if trustedPath == "" {
+		trustedPath = filepath.Join(keysDir, signingPublicKeyFile)
+		if !fileExists(trustedPath) {
+			return backup.Signer(data)
+		}
+	}
+	key, err := os.ReadFile(trustedPath)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", trustedPath, err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%s: invalid signing key size %d", trustedPath, len(key))
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// Runs the integrity checks on a keys directory: the signing key pair, the public/master key
+// pair, registry fingerprints against the issued key files, signed documents & the audit chain.
+// The directory stands in for the keys directory while checking.
+func checkKeysDir(dir string, shareFiles []string) *backupReport {
+	previous := keysDir
+	keysDir = dir
+	defer func() { keysDir = previous }()
+
+	report := &backupReport{}
+
+	// Without its signing key nothing signed can be verified, & loading it would create a new one
+	if !fileExists(filepath.Join(keysDir, signingKeyFile)) {
+		report.add("signing key", "failed", "%s is missing", signingKeyFile)
+		return report
+	}
+	signingKey, err := loadOrCreateSigningKey()
+	if err != nil {
+		report.add("signing key", "failed", "%v", err)
+		return report
+	}
+	report.Signer = signingKey.Public().(ed25519.PublicKey)
+	if published, err := os.ReadFile(filepath.Join(keysDir, signingPublicKeyFile)); err != nil || !bytes.Equal(published, report.Signer) {
+		report.add("signing key", "failed", "%s does not match %s", signingPublicKeyFile, signingKeyFile)
+	} else {
+		report.add("signing key", "ok", "%s", signed.Fingerprint(report.Signer))
+	}
+
+	checkSystemKeyPair(report, shareFiles)
+	checkRegistryFingerprints(report)
+
+	docsOK := true
+	for _, load := range []func() error{
+		func() error { _, err := loadVersionTable(); return err },
+		func() error { _, err := loadSchema(); return err },
+		func() error { _, err := loadPeriodConfig(); return err },
+		func() error { _, err := loadDelegations(); return err },
+		func() error { _, err := readSigned(escrow.File, escrow.Document, &escrow.Escrow{}); return err },
+		func() error { _, err := loadMasterStoreConfig(); return err },
+	} {
+		if err := load(); err != nil {
+			report.add("signed documents", "failed", "%v", err)
+			docsOK = false
+		}
+	}
+	if docsOK {
+		report.add("signed documents", "ok", "versions, schema, periods, delegations, escrow & master store verify")
+	}
+
+	if events, err := verifyAuditLog(); err != nil {
+		report.add("audit log", "failed", "%v", err)
+	} else {
+		report.add("audit log", "ok", "%d event(s), chain intact", events)
+	}
+	return report
+}
+
+// Issues a throwaway key with the master key & decrypts with it what the public key encrypted.
+// A split master key is only checked when its shares are presented, a sealed one is not checked.
+// A key-holder daemon issues the throwaway key itself.
+func checkSystemKeyPair(report *backupReport, shareFiles []string) {
+	public, err := keyfile.Read(filepath.Join(keysDir, publicKeyFile), keyfile.Public)
+	if err != nil {
+		report.add("system key pair", "failed", "%v", err)
+		return
+	}
+	split := fileExists(filepath.Join(keysDir, sharesMetaFile))
+	if split && len(shareFiles) == 0 {
+		report.add("system key pair", "skipped", "master key is split into custodian shares, pass --share-files to check it")
+		return
+	}
+	// The passphrase given here is the archive's, not the master key's
+	if !split && fileExists(filepath.Join(keysDir, sealedMasterKeyFile)) {
+		report.add("system key pair", "skipped", "master key is sealed under its own passphrase")
+		return
+	}
+	masterKey, err := loadMasterKey(shareFiles)
+	if err != nil {
+		report.add("system key pair", "failed", "%v", err)
+		return
+	}
+
+	attributeKey, err := generateAttributeKey(masterKey, map[string]string{"pair_check": "ok"}, "pair check")
+	if err != nil {
+		report.add("system key pair", "failed", "%v", err)
+		return
+	}
+	if err := canaryCheck(public.Key, attributeKey, "(pair_check: ok)"); err != nil {
+		report.add("system key pair", "failed", "master key does not match public.key: %v", err)
+		return
+	}
+	report.add("system key pair", "ok", "system %s, epoch %s", keyfile.SystemID(public.Key), orNone(public.KeyID))
+}
+
+// Every active registry entry with a key file must match the fingerprint of that file.
+// Files of retired epochs, or removed after delivery, are reported but do not fail the check.
+func checkRegistryFingerprints(report *backupReport) {
+	reg, err := loadRegistry()
+	if err != nil {
+		report.add("registry", "failed", "%v", err)
+		return
+	}
+	currentKeyID, err := currentEpochKeyID()
+	if err != nil {
+		report.add("registry", "failed", "%v", err)
+		return
+	}
+
+	checked := 0
+	var missing, mismatched []string
+	for _, entry := range reg.Active() {
+		if entry.KeyFile == "" || entry.Fingerprint == "" {
+			continue
+		}
+		dir := keysDir
+		if entry.KeyID != "" && entry.KeyID != currentKeyID {
+			dir = epoch.ArchivePath(keysDir, entry.KeyID)
+		}
+		file, err := keyfile.Read(filepath.Join(dir, entry.KeyFile), keyfile.Attribute)
+		if os.IsNotExist(err) {
+			missing = append(missing, entry.Subject)
+			continue
+		}
+		if err != nil || keyfile.Fingerprint(file.Key) != entry.Fingerprint {
+			mismatched = append(mismatched, entry.Subject)
+			continue
+		}
+		checked++
+	}
+
+	switch {
+	case len(mismatched) > 0:
+		report.add("registry", "failed", "key files of %v do not match their registry fingerprints", mismatched)
+	case len(missing) > 0:
+		report.add("registry", "ok", "%d fingerprint(s) match, no key file for %v", checked, missing)
+	default:
+		report.add("registry", "ok", "%d fingerprint(s) match", checked)
+	}
+}
+
+// Reads a passphrase from a file, or asks for it on stdin (twice with confirm, when creating
+// what it protects). what names it in the prompt, e.g. backup.
+func readPassphrase(path, what string, confirm bool) ([]byte, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read passphrase: %w", err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+
+	reader := bufio.NewReader(os.Stdin)
+	prompts := []string{"Enter " + what + " passphrase: "}
+	if confirm {
+		prompts = append(prompts, "Repeat "+what+" passphrase: ")
+	}
+	var entered []string
+	for _, prompt := range prompts {
+		fmt.Fprint(os.Stderr, prompt)
+		line, err := reader.ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("read passphrase: %w", err)
+		}
+		entered = append(entered, strings.TrimRight(line, "\r\n"))
+	}
+	if confirm && entered[0] != entered[1] {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return []byte(entered[0]), nil
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
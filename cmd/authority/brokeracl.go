@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"securemqtt/internal/accessreview"
+	"securemqtt/internal/brokeracl"
+)
+
+// Regenerates the mosquitto ACL file & dynamic security configuration under /keys/broker from
+// the registry & the topic policies. Writes nothing & returns false while no topic policies exist.
+func generateBrokerACLs(topicsPath string) (bool, error) {
+	config, _, err := loadTopicPolicies(topicsPath)
+	if err != nil || config == nil {
+		return false, err
+	}
+	holders, err := accessreview.LoadHolders(filepath.Join(keysDir, registryFile))
+	if err != nil {
+		return false, err
+	}
+	keyID, err := currentEpochKeyID()
+	if err != nil {
+		return false, err
+	}
+	rules, err := brokeracl.Generate(config, holders, keyID, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	dynamicSecurity, err := rules.DynamicSecurity()
+	if err != nil {
+		return false, err
+	}
+
+	dir := filepath.Join(keysDir, brokeracl.Dir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return false, fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	for name, data := range map[string][]byte{
+		brokeracl.ACLFile:             rules.MosquittoACL(),
+		brokeracl.DynamicSecurityFile: dynamicSecurity,
+	} {
+		if err := writeKey(filepath.Join(brokeracl.Dir, name), data); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Keeps the broker ACLs in step after issuance & revocation, logging instead of failing the command
+func generateBrokerACLsQuietly() {
+	generated, err := generateBrokerACLs("")
+	if err != nil {
+		log.Printf("Broker ACL generation failed: %v", err)
+		return
+	}
+	if generated {
+		log.Printf("Regenerated broker ACLs in %s, reload the broker to apply them", filepath.Join(keysDir, brokeracl.Dir))
+	}
+}
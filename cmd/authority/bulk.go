@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/manifest"
+	"securemqtt/internal/masterkey"
+)
+
+// Checks manifest rows against the authority's rules & attribute schema
+type manifestChecker struct {
+	schema *accesspolicy.Schema
+}
+
+func (strct *manifestChecker) KeyFile(name string) error {
+	return validateKeyFilename(name)
+}
+
+func (strct *manifestChecker) ParseAttributes(raw json.RawMessage) (map[string]string, error) {
+	return parseAttrsJSON(string(raw))
+}
+
+func (strct *manifestChecker) CheckAttributes(attrs map[string]string) error {
+	if err := validateAttrs(attrs); err != nil {
+		return err
+	}
+	return strct.schema.CheckAttributes(attrs)
+}
+
+func (strct *manifestChecker) Validity(period, validFrom, validUntil string) (*accesspolicy.Validity, error) {
+	return resolveValidity(period, validFrom, validUntil)
+}
+
+// Issues manifest keys with the master key & records them in reg
+type manifestIssuer struct {
+	masterKey masterkey.IMasterKey
+	reg       *registry
+	versions  *accesspolicy.VersionTable
+	pending   map[*manifest.Item]*pendingKey
+}
+
+func (strct *manifestIssuer) Prepare(item *manifest.Item) (string, error) {
+	key, err := prepareSubjectKey(strct.masterKey, strct.reg, strct.versions,
+		item.Row.Subject, item.Row.Attrs, item.Validity, item.Row.Out)
+	if err != nil {
+		return "", err
+	}
+	strct.pending[item] = key
+	return key.entry.Fingerprint, nil
+}
+
+func (strct *manifestIssuer) Commit(items []*manifest.Item) error {
+	keys := make([]*pendingKey, 0, len(items))
+	for _, item := range items {
+		keys = append(keys, strct.pending[item])
+	}
+	return commitKeys(strct.reg, keys)
+}
+
+// Issues keys for all valid manifest rows, see manifest.Issue
+func issueManifest(masterKey masterkey.IMasterKey, items []*manifest.Item, partial bool) error {
+	reg, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+	versions, err := loadVersionTable()
+	if err != nil {
+		return err
+	}
+
+	issuer := &manifestIssuer{masterKey: masterKey, reg: reg, versions: versions, pending: make(map[*manifest.Item]*pendingKey)}
+	if err := manifest.Issue(items, partial, issuer); err != nil {
+		return err
+	}
+
+	var issued []*manifest.Item
+	for _, item := range items {
+		if item.Result.Status == manifest.StatusIssued {
+			issued = append(issued, item)
+		}
+	}
+	if len(issued) == 0 {
+		return nil
+	}
+	if err := saveRegistry(reg); err != nil {
+		return err
+	}
+	for _, item := range issued {
+		if err := announcePeriods(item.Validity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Default index location: next to the keys, named after the manifest
+func defaultIndexPath(manifestPath string) string {
+	base := strings.TrimSuffix(filepath.Base(manifestPath), filepath.Ext(manifestPath))
+	return filepath.Join(keysDir, base+".index.json")
+}
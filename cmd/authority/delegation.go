@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"securemqtt/internal"
+	"securemqtt/internal/audit"
+	"securemqtt/internal/clientmqtt"
+	"securemqtt/internal/delegation"
+	"securemqtt/internal/enrollment"
+	"securemqtt/internal/masterkey"
+)
+
+const (
+	// Every credential granted, so serving can refuse revoked ones
+	delegationsFile     = "delegations.json"
+	delegationsDocument = "delegation-list"
+
+	// Request IDs already answered, one empty file each, so a request is never served twice
+	delegationDir         = "delegation"
+	answeredDelegationDir = "delegation/answered"
+
+	// Credentials are written next to the keys, e.g. rome-site.credential.json
+	credentialSuffix = ".credential.json"
+)
+
+// A granted credential, as recorded by the authority
+type delegationEntry struct {
+	Credential delegation.Credential `json:"credential"`
+	Revoked    bool                  `json:"revoked,omitempty"`
+	RevokedAt  *time.Time            `json:"revoked_at,omitempty"`
+}
+
+type delegationList struct {
+	Entries []delegationEntry `json:"entries"`
+}
+
+func loadDelegations() (*delegationList, error) {
+	list := &delegationList{}
+	if _, err := readSigned(delegationsFile, delegationsDocument, list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (strct *delegationList) find(id string) *delegationEntry {
+	for i := range strct.Entries {
+		if strct.Entries[i].Credential.ID == id {
+			return &strct.Entries[i]
+		}
+	}
+	return nil
+}
+
+// Parses --scope-json, e.g. {"site":["rome"],"role":["operator","guest"]}; single strings are accepted too
+func parseScopeJSON(raw string) (delegation.Scope, error) {
+	attrs, err := parseAttrsJSON(raw)
+	if err != nil {
+		return nil, err
+	}
+	scope := make(delegation.Scope, len(attrs))
+	for name, value := range attrs {
+		scope[name] = strings.Split(value, ",")
+	}
+	return scope, scope.Check()
+}
+
+// Reads the delegate's Ed25519 public key, base64 as printed by the site service
+func parseDelegateKey(raw string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(raw))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("delegate key must be a base64 Ed25519 public key")
+	}
+	return key, nil
+}
+
+// Signs a credential allowing delegate to issue keys within scope until notAfter & records it.
+// The credential is written to /keys/<delegate>.credential.json for the site to pick up.
+func grantDelegation(delegate string, delegateKey ed25519.PublicKey, scope delegation.Scope, notAfter time.Time) (*delegation.Credential, string, error) {
+	if delegate == "" || strings.ContainsAny(delegate, "/+#") {
+		return nil, "", fmt.Errorf("invalid delegate name %q", delegate)
+	}
+	if !notAfter.After(time.Now()) {
+		return nil, "", fmt.Errorf("credential would already be expired")
+	}
+	filename := delegate + credentialSuffix
+	if err := validatePlainFilename(filename); err != nil {
+		return nil, "", err
+	}
+
+	id, err := delegation.NewCredentialID()
+	if err != nil {
+		return nil, "", err
+	}
+	credential := &delegation.Credential{
+		ID:          id,
+		Delegate:    delegate,
+		DelegateKey: delegateKey,
+		Namespace:   currentNamespace,
+		Scope:       scope,
+		NotAfter:    notAfter.UTC(),
+		IssuedAt:    time.Now().UTC(),
+	}
+
+	signingKey, err := loadOrCreateSigningKey()
+	if err != nil {
+		return nil, "", err
+	}
+	data, err := credential.Sign(signingKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	list, err := loadDelegations()
+	if err != nil {
+		return nil, "", err
+	}
+	list.Entries = append(list.Entries, delegationEntry{Credential: *credential})
+	if err := writeSigned(delegationsFile, delegationsDocument, list); err != nil {
+		return nil, "", err
+	}
+	if err := writeKey(filename, data); err != nil {
+		return nil, "", err
+	}
+	return credential, filename, recordAudit(audit.Event{Operation: "delegate", Details: map[string]string{
+		"credential": id, "delegate": delegate, "scope": scope.String(), "not_after": credential.NotAfter.Format(time.RFC3339),
+	}})
+}
+
+// Stops serving a credential. Keys it already issued stay valid until revoked one by one.
+func revokeDelegation(id string) (*delegation.Credential, error) {
+	list, err := loadDelegations()
+	if err != nil {
+		return nil, err
+	}
+	entry := list.find(id)
+	if entry == nil {
+		return nil, fmt.Errorf("unknown credential %q", id)
+	}
+	if entry.Revoked {
+		return nil, fmt.Errorf("credential %q is already revoked", id)
+	}
+	now := time.Now().UTC()
+	entry.Revoked, entry.RevokedAt = true, &now
+	if err := writeSigned(delegationsFile, delegationsDocument, list); err != nil {
+		return nil, err
+	}
+	return &entry.Credential, recordAudit(audit.Event{Operation: "delegate-revoke", Details: map[string]string{
+		"credential": id, "delegate": entry.Credential.Delegate,
+	}})
+}
+
+// Serves issue requests of sub-authorities until interrupted. Requests within the scope of a
+// valid credential are issued without an operator; everything else is refused & audited.
+func serveDelegations(masterKey masterkey.IMasterKey, brokerURL string) error {
+	client, err := clientmqtt.NewMQTT(brokerURL, "authority-delegation-serve")
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", brokerURL, err)
+	}
+
+	if err := client.Subscribe(delegation.RequestTopicFilter, 1, func(msg internal.Message) {
+		// Empty retained messages are requests the authority already answered
+		if len(msg.Envelope) == 0 {
+			return
+		}
+		lock, err := lockKeysDir(true)
+		if err != nil {
+			log.Printf("Cannot serve request on %s: %v", msg.Topic, err)
+			return
+		}
+		defer lock.Unlock()
+
+		entry, err := issueDelegated(masterKey, client, msg)
+		if err != nil {
+			log.Printf("Refused request on %s: %v", msg.Topic, err)
+			if err := recordAudit(audit.Event{Operation: "delegated-refuse", Details: map[string]string{
+				"topic": msg.Topic, "reason": err.Error(),
+			}}); err != nil {
+				log.Printf("Failed to write the audit log: %v", err)
+			}
+			// Refused requests would be refused again, drop them from the broker
+			if err := client.Publish(msg.Topic, 1, true, nil); err != nil {
+				log.Printf("Failed to clear %s: %v", msg.Topic, err)
+			}
+			return
+		}
+		if entry == nil {
+			return
+		}
+		log.Printf("Issued key for %s on behalf of %s (fingerprint %s)", entry.Subject, entry.Delegate, entry.Fingerprint)
+		generateBrokerACLsQuietly()
+	}); err != nil {
+		return fmt.Errorf("subscribe %s: %w", delegation.RequestTopicFilter, err)
+	}
+
+	log.Printf("Serving delegated issuance on %s", delegation.RequestTopicFilter)
+	select {}
+}
+
+// Authorizes one request & delivers the key, sealed to the request's reply key.
+// Returns nil without error for requests already answered.
+func issueDelegated(masterKey masterkey.IMasterKey, client clientmqtt.IMQTT, msg internal.Message) (*registryEntry, error) {
+	signingKey, err := loadOrCreateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	authorized, err := delegation.Authorize(msg.Envelope, signingKey.Public().(ed25519.PublicKey), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	credential, request := authorized.Credential, authorized.Request
+	if msg.Topic != delegation.RequestTopic(credential.Delegate, authorized.EnrollmentID) {
+		return nil, fmt.Errorf("request of %s published on %s", credential.Delegate, msg.Topic)
+	}
+
+	answered := filepath.Join(keysDir, answeredDelegationDir, authorized.EnrollmentID)
+	if fileExists(answered) {
+		return nil, nil
+	}
+
+	list, err := loadDelegations()
+	if err != nil {
+		return nil, err
+	}
+	entry := list.find(credential.ID)
+	if entry == nil || entry.Revoked {
+		return nil, fmt.Errorf("credential %s of %s is unknown or revoked", credential.ID, credential.Delegate)
+	}
+	if credential.Namespace != currentNamespace {
+		return nil, fmt.Errorf("credential %s is for namespace %q", credential.ID, credential.Namespace)
+	}
+
+	if err := validateAttrs(request.Attributes); err != nil {
+		return nil, err
+	}
+	if err := checkSchema(request.Attributes); err != nil {
+		return nil, err
+	}
+	validity, err := resolveValidity(request.Period, request.ValidFrom, request.ValidUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	// A site may re-issue its own subjects, never take over anyone else's
+	if existing := reg.Find(request.Subject); existing != nil && existing.Delegate != credential.Delegate {
+		return nil, fmt.Errorf("subject %q was not issued by %s", request.Subject, credential.Delegate)
+	}
+	versions, err := loadVersionTable()
+	if err != nil {
+		return nil, err
+	}
+	key, err := prepareSubjectKey(masterKey, reg, versions, request.Subject, request.Attributes, validity, "")
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key.keyBytes)
+	key.entry.Delegate = credential.Delegate
+
+	statement, err := key.statement()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := currentPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	delivery, err := enrollment.Seal(authorized.Enrollment, authorized.EnrollmentID, enrollment.KeyBundle{
+		Subject:      request.Subject,
+		KeyID:        key.entry.KeyID,
+		AttributeKey: key.keyBytes,
+		Validity:     validity,
+		Statement:    statement,
+		PublicKey:    publicKey,
+	}, signingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the key before it leaves, so it can always be revoked
+	if err := key.saveVersions(); err != nil {
+		return nil, err
+	}
+	reg.Put(key.entry)
+	if err := saveRegistry(reg); err != nil {
+		return nil, err
+	}
+	if err := announcePeriods(validity); err != nil {
+		return nil, err
+	}
+	if err := markDelegationAnswered(answered); err != nil {
+		return nil, err
+	}
+
+	if err := client.Publish(delegation.ReplyTopic(credential.Delegate, authorized.EnrollmentID), 1, true, delivery); err != nil {
+		return nil, fmt.Errorf("deliver key: %w", err)
+	}
+	if err := client.Publish(msg.Topic, 1, true, nil); err != nil {
+		return nil, fmt.Errorf("clear retained request: %w", err)
+	}
+	event := keyEvent("delegated-issue", &key.entry, map[string]string{
+		"credential": credential.ID, "delegate": credential.Delegate, "request": authorized.EnrollmentID,
+	})
+	return &key.entry, recordAudit(event)
+}
+
+func markDelegationAnswered(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("mkdir %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		return fmt.Errorf("write %s: %w", path, err)
+	}
+	return nil
+}
+
+// Lists granted credentials as JSON lines
+func listDelegations() error {
+	list, err := loadDelegations()
+	if err != nil {
+		return err
+	}
+	for _, entry := range list.Entries {
+		data, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+	}
+	return nil
+}
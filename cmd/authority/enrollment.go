@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"securemqtt/internal"
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/audit"
+	"securemqtt/internal/clientmqtt"
+	"securemqtt/internal/enrollment"
+	"securemqtt/internal/keystore"
+	"securemqtt/internal/masterkey"
+)
+
+// Verified requests waiting for an operator, one file per request ID holding the signed request
+const pendingEnrollmentDir = "enrollment/pending"
+
+// A queued request, as listed to the operator
+type enrollmentRequest struct {
+	ID         string
+	Request    *enrollment.Request
+	ReceivedAt time.Time
+}
+
+// Listens for key requests until interrupted & queues every valid one for approval.
+// Requests are retained on the broker, so devices that asked while no listener ran are picked up too.
+// The keys directory is locked per request, so other commands can run between them.
+func listenForEnrollments(brokerURL string) error {
+	lock, err := lockKeysDir(false)
+	if err != nil {
+		return err
+	}
+	signingKey, err := loadOrCreateSigningKey()
+	lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	client, err := clientmqtt.NewMQTT(brokerURL, "authority-enroll-listen")
+	if err != nil {
+		return fmt.Errorf("connect to %s: %w", brokerURL, err)
+	}
+
+	if err := client.Subscribe(enrollment.RequestTopicFilter, 1, func(msg internal.Message) {
+		// Empty retained messages are requests the authority already answered
+		if len(msg.Envelope) == 0 {
+			return
+		}
+		lock, err := lockKeysDir(false)
+		if err != nil {
+			log.Printf("Cannot queue request on %s: %v", msg.Topic, err)
+			return
+		}
+		defer lock.Unlock()
+
+		request, err := queueEnrollment(msg)
+		if err != nil {
+			log.Printf("Rejected request on %s: %v", msg.Topic, err)
+			return
+		}
+		if request == nil {
+			return
+		}
+		if err := recordAudit(enrollmentEvent("enroll-request", request)); err != nil {
+			log.Printf("Failed to write the audit log: %v", err)
+		}
+		log.Printf("Queued request %s from %s, identity %s", request.ID, request.Request.DeviceID, request.Request.IdentityFingerprint())
+	}); err != nil {
+		return fmt.Errorf("subscribe %s: %w", enrollment.RequestTopicFilter, err)
+	}
+
+	log.Printf("Listening for enrollment requests on %s", enrollment.RequestTopicFilter)
+	log.Printf("Devices verify deliveries with the authority key %s", base64.StdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)))
+	select {}
+}
+
+// Verifies a request & stores it under its ID. Returns nil without error for requests already queued.
+func queueEnrollment(msg internal.Message) (*enrollmentRequest, error) {
+	request, id, err := enrollment.VerifyRequest(msg.Envelope)
+	if err != nil {
+		return nil, err
+	}
+	// A device may only ask for itself
+	if msg.Topic != enrollment.RequestTopic(request.DeviceID) {
+		return nil, fmt.Errorf("request for %q published on %s", request.DeviceID, msg.Topic)
+	}
+
+	dir := filepath.Join(keysDir, pendingEnrollmentDir)
+	path := filepath.Join(dir, id+".json")
+	if fileExists(path) {
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("mkdir %s: %w", dir, err)
+	}
+	if err := keystore.WriteFile(path, msg.Envelope, keystore.SecretPerm); err != nil {
+		return nil, err
+	}
+	return &enrollmentRequest{ID: id, Request: request, ReceivedAt: time.Now().UTC()}, nil
+}
+
+// Lists queued requests, oldest first
+func pendingEnrollments() ([]*enrollmentRequest, error) {
+	dir := filepath.Join(keysDir, pendingEnrollmentDir)
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", dir, err)
+	}
+
+	var requests []*enrollmentRequest
+	for _, file := range files {
+		id, ok := strings.CutSuffix(file.Name(), ".json")
+		if !ok {
+			continue
+		}
+		request, err := loadEnrollment(id)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].ReceivedAt.Before(requests[j].ReceivedAt) })
+	return requests, nil
+}
+
+// Loads & re-verifies a queued request
+func loadEnrollment(id string) (*enrollmentRequest, error) {
+	if _, err := hex.DecodeString(id); err != nil || id == "" {
+		return nil, fmt.Errorf("invalid request ID %q", id)
+	}
+
+	path := filepath.Join(keysDir, pendingEnrollmentDir, id+".json")
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no pending request %s", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("stat %s: %w", path, err)
+	}
+	message, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	request, verifiedID, err := enrollment.VerifyRequest(message)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if verifiedID != id {
+		return nil, fmt.Errorf("%s: content does not match request ID", path)
+	}
+	return &enrollmentRequest{ID: id, Request: request, ReceivedAt: info.ModTime().UTC()}, nil
+}
+
+// Issues a key for a queued request & delivers it to the device, encrypted to the request's
+// ephemeral HPKE key. No key file is written: the registry records the issuance with the
+// device ID instead. The request stays queued if delivery fails, so approval can be retried.
+func approveEnrollment(masterKey masterkey.IMasterKey, brokerURL, id, subject string,
+	attrs map[string]string, validity *accesspolicy.Validity) (*registryEntry, error) {
+
+	request, err := loadEnrollment(id)
+	if err != nil {
+		return nil, err
+	}
+	if subject == "" {
+		subject = request.Request.DeviceID
+	}
+
+	client, err := clientmqtt.NewMQTT(brokerURL, "authority-enroll-approve")
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", brokerURL, err)
+	}
+	entry, err := deliverEnrolledKey(masterKey, client, request, subject, attrs, validity)
+	if err != nil {
+		return nil, err
+	}
+	return entry, recordAudit(keyEvent("enroll-approve", entry, map[string]string{"request": request.ID}))
+}
+
+// Issues subject's key for a verified request, records it with the device's identity &
+// publishes the sealed delivery, then closes the request
+func deliverEnrolledKey(masterKey masterkey.IMasterKey, client clientmqtt.IMQTT, request *enrollmentRequest,
+	subject string, attrs map[string]string, validity *accesspolicy.Validity) (*registryEntry, error) {
+
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := loadVersionTable()
+	if err != nil {
+		return nil, err
+	}
+	key, err := prepareSubjectKey(masterKey, reg, versions, subject, attrs, validity, "")
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key.keyBytes)
+	key.entry.DeviceID = request.Request.DeviceID
+	key.entry.Identity = request.Request.IdentityFingerprint()
+
+	signingKey, err := loadOrCreateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	statement, err := key.statement()
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := currentPublicKey()
+	if err != nil {
+		return nil, err
+	}
+	delivery, err := enrollment.Seal(request.Request, request.ID, enrollment.KeyBundle{
+		Subject:      subject,
+		KeyID:        key.entry.KeyID,
+		AttributeKey: key.keyBytes,
+		Validity:     validity,
+		Statement:    statement,
+		PublicKey:    publicKey,
+	}, signingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the key before it leaves, so it can always be revoked
+	if err := key.saveVersions(); err != nil {
+		return nil, err
+	}
+	reg.Put(key.entry)
+	if err := saveRegistry(reg); err != nil {
+		return nil, err
+	}
+	if err := announcePeriods(validity); err != nil {
+		return nil, err
+	}
+
+	// Retained, so the device gets its key even if it reconnects after approval
+	if err := client.Publish(enrollment.ReplyTopic(request.Request.DeviceID), 1, true, delivery); err != nil {
+		return nil, fmt.Errorf("deliver key: %w", err)
+	}
+	if err := closeEnrollment(client, request); err != nil {
+		return nil, err
+	}
+	return &key.entry, nil
+}
+
+// Drops a queued request without issuing anything
+func rejectEnrollment(brokerURL, id string) (*enrollmentRequest, error) {
+	request, err := loadEnrollment(id)
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientmqtt.NewMQTT(brokerURL, "authority-enroll-reject")
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", brokerURL, err)
+	}
+	if err := closeEnrollment(client, request); err != nil {
+		return nil, err
+	}
+	return request, recordAudit(enrollmentEvent("enroll-reject", request))
+}
+
+// Audit event for a request that did not result in a key
+func enrollmentEvent(operation string, request *enrollmentRequest) audit.Event {
+	return audit.Event{
+		Operation: operation,
+		DeviceID:  request.Request.DeviceID,
+		Details: map[string]string{
+			"request":  request.ID,
+			"identity": request.Request.IdentityFingerprint(),
+		},
+	}
+}
+
+// Clears the retained request on the broker & removes it from the queue
+func closeEnrollment(client clientmqtt.IMQTT, request *enrollmentRequest) error {
+	if err := client.Publish(enrollment.RequestTopic(request.Request.DeviceID), 1, true, nil); err != nil {
+		return fmt.Errorf("clear retained request: %w", err)
+	}
+	path := filepath.Join(keysDir, pendingEnrollmentDir, request.ID+".json")
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove %s: %w", path, err)
+	}
+	return nil
+}
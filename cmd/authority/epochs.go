@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"securemqtt/internal/audit"
+	"securemqtt/internal/epoch"
+)
+
+// Loads the epoch index, nil if the system predates epochs
+func loadEpochIndex() (*epoch.Index, error) {
+	return epoch.Load(keysDir)
+}
+
+// Persists the epoch index next to the current system keys
+func saveEpochIndex(index *epoch.Index) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal epoch index: %w", err)
+	}
+	return writeKey(epoch.IndexFile, data)
+}
+
+// Records a freshly set up system key pair as a new epoch.
+// With reset, all previous epochs are forgotten (setup --force), otherwise they are kept for rotation.
+func startEpoch(index *epoch.Index, reset bool) (*epoch.Index, error) {
+	next := nextEpochNumber(index)
+
+	if index == nil || reset {
+		if err := os.RemoveAll(filepath.Join(keysDir, epoch.ArchiveDir)); err != nil {
+			return nil, fmt.Errorf("remove archived epochs: %w", err)
+		}
+		index = &epoch.Index{}
+	}
+
+	index.Epochs = append(index.Epochs, epoch.Epoch{
+		Number:    next,
+		KeyID:     epoch.KeyID(next),
+		CreatedAt: time.Now().UTC(),
+	})
+	index.Current = next
+
+	return index, saveEpochIndex(index)
+}
+
+// Number of the epoch the next setup or rotation starts, numbers are never reused
+func nextEpochNumber(index *epoch.Index) int {
+	next := 1
+	if index != nil {
+		for _, e := range index.Epochs {
+			next = max(next, e.Number+1)
+		}
+	}
+	return next
+}
+
+// Rotates to a new system key pair.
+// The current public key and the keys issued under it move to the epoch archive so
+// subscribers can still read older messages, the old master key is destroyed, and the
+// old epoch is scheduled for retirement after retireAfter.
+func rotateEpoch(retireAfter time.Duration, shares, threshold int, sharesDir string) (*epoch.Epoch, error) {
+	index, err := loadEpochIndex()
+	if err != nil {
+		return nil, err
+	}
+	config, err := loadMasterStoreConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := config.allowsShares(shares); err != nil {
+		return nil, err
+	}
+
+	// Systems set up before epochs existed: adopt the current pair as the first epoch
+	if index == nil {
+		if !fileExists(filepath.Join(keysDir, publicKeyFile)) {
+			return nil, fmt.Errorf("no system keys to rotate, run --setup first")
+		}
+		if index, err = startEpoch(nil, true); err != nil {
+			return nil, err
+		}
+	}
+
+	current, err := index.CurrentEpoch()
+	if err != nil {
+		return nil, err
+	}
+
+	// The new pair is staged before anything moves, if generating it fails the current epoch stays as it is
+	staged, err := stageSystemKeys(config, shares, threshold, sharesDir, epoch.KeyID(nextEpochNumber(index)), true)
+	if err != nil {
+		return nil, err
+	}
+	if err := archiveEpoch(current); err != nil {
+		staged.abort()
+		return nil, err
+	}
+
+	if retireAfter > 0 {
+		retireAt := time.Now().UTC().Add(retireAfter)
+		current.RetireAt = &retireAt
+	}
+
+	// Old epochs only ever decrypt, nothing may issue keys for them anymore
+	if err := staged.commit(); err != nil {
+		return nil, err
+	}
+	if index, err = startEpoch(index, false); err != nil {
+		return nil, err
+	}
+
+	return index.CurrentEpoch()
+}
+
+// Moves the public key & issued keys of epoch e to its archive. If one cannot be moved, the
+// ones already moved are put back.
+func archiveEpoch(e *epoch.Epoch) error {
+	archive := epoch.ArchivePath(keysDir, e.KeyID)
+	if err := os.MkdirAll(archive, 0755); err != nil {
+		return fmt.Errorf("mkdir %s: %w", archive, err)
+	}
+	var moved []string
+	for _, name := range append([]string{publicKeyFile}, e.Issued...) {
+		from := filepath.Join(keysDir, name)
+		err := os.Rename(from, filepath.Join(archive, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			for _, name := range moved {
+				os.Rename(filepath.Join(archive, name), filepath.Join(keysDir, name))
+			}
+			return fmt.Errorf("archive %s: %w", from, err)
+		}
+		moved = append(moved, name)
+	}
+	return nil
+}
+
+// Retires every archived epoch whose retirement date has passed by deleting its files
+func retireDueEpochs(now time.Time) ([]string, error) {
+	index, err := loadEpochIndex()
+	if err != nil || index == nil {
+		return nil, err
+	}
+
+	var retired []string
+	for i := range index.Epochs {
+		e := &index.Epochs[i]
+		if e.Number == index.Current || !e.Due(now) {
+			continue
+		}
+		if err := os.RemoveAll(epoch.ArchivePath(keysDir, e.KeyID)); err != nil {
+			return retired, fmt.Errorf("remove epoch %s: %w", e.KeyID, err)
+		}
+		e.Retired = true
+		e.Issued = nil
+		retired = append(retired, e.KeyID)
+	}
+
+	if len(retired) == 0 {
+		return nil, nil
+	}
+	if err := saveEpochIndex(index); err != nil {
+		return retired, err
+	}
+	return retired, recordAudit(audit.Event{Operation: "retire", Details: map[string]string{"epochs": strings.Join(retired, ",")}})
+}
+
+// Remembers which key files belong to the current epoch, so rotation can archive them
+func recordIssuedKey(filename string) error {
+	index, err := loadEpochIndex()
+	if err != nil || index == nil {
+		return err
+	}
+
+	current, err := index.CurrentEpoch()
+	if err != nil {
+		return err
+	}
+	if slices.Contains(current.Issued, filename) {
+		return nil
+	}
+	current.Issued = append(current.Issued, filename)
+	return saveEpochIndex(index)
+}
+
+// Runs the retirement schedule, logging instead of failing the surrounding command
+func retireDueEpochsQuietly() {
+	retired, err := retireDueEpochs(time.Now().UTC())
+	if err != nil {
+		log.Printf("Epoch retirement failed: %v", err)
+		return
+	}
+	for _, keyID := range retired {
+		log.Printf("Retired epoch %s", keyID)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"securemqtt/internal"
+	"securemqtt/internal/abe"
+	aescryptography "securemqtt/internal/aes"
+	"securemqtt/internal/audit"
+	"securemqtt/internal/escrow"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/secureclient"
+)
+
+// Publishes the escrow clause publishers OR into every policy, except on the opt-out topic filters.
+// Returns how many issued keys satisfy the clause, so a clause nobody can use is noticed.
+func setEscrow(clause string, optOut []string) (*escrow.Escrow, int, error) {
+	config := &escrow.Escrow{Clause: clause, OptOut: optOut, UpdatedAt: time.Now().UTC()}
+	if err := config.Check(); err != nil {
+		return nil, 0, err
+	}
+	schema, err := loadSchema()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := schema.CheckPolicy(config.Node()); err != nil {
+		return nil, 0, err
+	}
+	readers, err := reviewAccess(clause, time.Now().UTC())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := writeSigned(escrow.File, escrow.Document, config); err != nil {
+		return nil, 0, err
+	}
+	return config, len(readers), recordAudit(audit.Event{Operation: "escrow-set", Details: map[string]string{
+		"clause": clause, "opt_out": strings.Join(optOut, ","),
+	}})
+}
+
+// Publishes an empty clause, so publishers stop adding one
+func clearEscrow() error {
+	config := &escrow.Escrow{UpdatedAt: time.Now().UTC()}
+	if err := writeSigned(escrow.File, escrow.Document, config); err != nil {
+		return err
+	}
+	return recordAudit(audit.Event{Operation: "escrow-clear"})
+}
+
+// Break-glass access: decrypts one captured envelope with the escrow key. Every attempt is
+// audited with its reason, and the plaintext is only returned once the audit event is written.
+func escrowDecrypt(keyPath, envelopePath, topic, reason string) ([]byte, error) {
+	file, err := keyfile.Read(keyPath, keyfile.Attribute)
+	if err != nil {
+		return nil, err
+	}
+	var envelope []byte
+	if envelopePath == "-" {
+		envelope, err = io.ReadAll(os.Stdin)
+	} else {
+		envelope, err = os.ReadFile(envelopePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read envelope: %w", err)
+	}
+
+	details := map[string]string{"topic": topic, "reason": reason, "key_file": filepath.Base(keyPath)}
+	client := secureclient.NewSecureClient(&replayMQTT{topic: topic, envelope: envelope},
+		&abe.PublisherABE{}, &abe.SubscriberABE{}, &aescryptography.AESCryptography{}, nil, file.Key)
+	if file.KeyID != "" || file.Namespace != "" {
+		client.AddNamespacePrivateKey(file.Namespace, file.KeyID, file.Key)
+	}
+	client.SetDecryptAuditor(secureclient.DecryptAuditorFunc(func(topic string, envelope *internal.Envelope) error {
+		details["policy"] = envelope.Policy
+		details["namespace"] = envelope.Namespace
+		return recordAudit(audit.Event{Operation: "escrow-decrypt", KeyID: envelope.KeyID,
+			Fingerprint: file.Fingerprint, Details: details})
+	}))
+
+	var plaintext []byte
+	if err := client.SubscribeSecure(topic, 0, func(_ string, decrypted []byte) { plaintext = decrypted }); err != nil {
+		return nil, err
+	}
+	if plaintext == nil {
+		if err := recordAudit(audit.Event{Operation: "escrow-decrypt-failed", KeyID: file.KeyID,
+			Fingerprint: file.Fingerprint, Details: details}); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("the escrow key cannot decrypt this envelope on %s", topic)
+	}
+	return plaintext, nil
+}
+
+// Delivers one captured envelope to the first subscriber, so it is decrypted exactly like live traffic
+type replayMQTT struct {
+	topic    string
+	envelope []byte
+}
+
+func (strct *replayMQTT) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	return fmt.Errorf("replay client cannot publish")
+}
+
+func (strct *replayMQTT) Subscribe(topic string, qos byte, handler func(internal.Message)) error {
+	handler(internal.Message{Topic: strct.topic, Envelope: strct.envelope})
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"securemqtt/internal/identity"
+)
+
+// Trusted identity provider & claim rules, see identity.Config
+const identityConfigFile = "oidc.json"
+
+// How long fetching the provider's JWKS may take
+const jwksTimeout = 10 * time.Second
+
+// Who a verified ID token says the key is for
+type tokenIdentity struct {
+	subject    string
+	attributes map[string]string
+	details    map[string]string
+}
+
+// Verifies the ID token in tokenPath ("-" reads stdin) against the configured provider &
+// maps its claims to attributes. configPath defaults to /keys/oidc.json.
+func identityFromToken(tokenPath, configPath string) (*tokenIdentity, error) {
+	if configPath == "" {
+		configPath = filepath.Join(keysDir, identityConfigFile)
+	}
+	config, err := identity.LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var token []byte
+	if tokenPath == "-" {
+		token, err = io.ReadAll(os.Stdin)
+	} else {
+		token, err = os.ReadFile(tokenPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read id token: %w", err)
+	}
+
+	verifier, err := config.Verifier(jwksTimeout)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := verifier.Verify(string(token), time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	subject, err := config.Subject(claims)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := config.Attributes(claims)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateAttrs(attrs); err != nil {
+		return nil, err
+	}
+
+	details := map[string]string{"token_issuer": config.Issuer, "token_subject": subject}
+	if jti := claims.Strings("jti"); len(jti) == 1 {
+		details["token_id"] = jti[0]
+	}
+	return &tokenIdentity{subject: subject, attributes: attrs, details: details}, nil
+}
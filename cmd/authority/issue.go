@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/keystore"
+	"securemqtt/internal/masterkey"
+	"securemqtt/internal/statement"
+	"securemqtt/internal/tracing"
+)
+
+// Write issued keys in the armored text format instead of the binary container (--armor)
+var armorKeys bool
+
+// A generated key that has not been written yet.
+// versions is set when the key holds several values of an attribute, the table is written with the key.
+type pendingKey struct {
+	entry    registryEntry
+	systemID string
+	keyBytes []byte
+	versions *accesspolicy.VersionTable
+}
+
+// Issues a key for subject with the current attribute versions & records it in the registry.
+// Time-bound keys also get one attribute per validity period, permanent keys the permanent
+// period attribute; neither is ever versioned.
+func issueSubjectKey(masterKey masterkey.IMasterKey, reg *registry, versions *accesspolicy.VersionTable,
+	subject string, attrs map[string]string, validity *accesspolicy.Validity, filename string) error {
+
+	key, err := prepareSubjectKey(masterKey, reg, versions, subject, attrs, validity, filename)
+	if err != nil {
+		return err
+	}
+	return commitKeys(reg, []*pendingKey{key})
+}
+
+// Runs KeyGen for subject in memory, nothing is written until commitKeys.
+// Every key carries the subject's identifier, see subjectAttributes.
+func prepareSubjectKey(masterKey masterkey.IMasterKey, reg *registry, versions *accesspolicy.VersionTable,
+	subject string, attrs map[string]string, validity *accesspolicy.Validity, filename string) (*pendingKey, error) {
+
+	attrs, err := subjectAttributes(reg, subject, attrs)
+	if err != nil {
+		return nil, err
+	}
+	if err := reg.checkReplace(subject, filename, attrs); err != nil {
+		return nil, err
+	}
+	traceID, err := subjectTraceID(reg, subject)
+	if err != nil {
+		return nil, err
+	}
+	marked := markMultiValued(versions, attrs)
+	keyAttrs := versions.EncodeAll(attrs)
+	maps.Copy(keyAttrs, accesspolicy.PeriodAttributes(validity))
+	keyAttrs[tracing.Attribute] = traceID
+	keyBytes, err := generateAttributeKey(masterKey, keyAttrs, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, err := currentEpochKeyID()
+	if err != nil {
+		return nil, err
+	}
+	systemID, err := currentSystemID()
+	if err != nil {
+		return nil, err
+	}
+	key := &pendingKey{
+		entry: registryEntry{
+			Subject:     subject,
+			KeyFile:     filename,
+			Attributes:  attrs,
+			KeyID:       keyID,
+			Validity:    validity,
+			Permanent:   validity == nil,
+			Fingerprint: keyfile.Fingerprint(keyBytes),
+			TraceID:     traceID,
+			IssuedAt:    time.Now().UTC(),
+		},
+		systemID: systemID,
+		keyBytes: keyBytes,
+	}
+	if marked {
+		key.versions = versions
+	}
+	return key, nil
+}
+
+// Signs what the authority attests about the key, so holders can learn & prove their attributes
+func (strct *pendingKey) statement() ([]byte, error) {
+	signingKey, err := loadOrCreateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	attributes := &statement.Statement{
+		Subject:        strct.entry.Subject,
+		Namespace:      currentNamespace,
+		KeyID:          strct.entry.KeyID,
+		KeyFingerprint: strct.entry.Fingerprint,
+		Attributes:     strct.entry.Attributes,
+		Validity:       strct.entry.Validity,
+		IssuedAt:       strct.entry.IssuedAt,
+	}
+	return attributes.Sign(signingKey)
+}
+
+// Adds the subject identifier to attrs, unless they already carry one (re-issue from the registry).
+// A subject keeps its identifier across re-issues; revoked subjects get a new one, identifiers
+// are never reused.
+func subjectAttributes(reg *registry, subject string, attrs map[string]string) (map[string]string, error) {
+	if attrs[accesspolicy.SubjectAttribute] != "" {
+		return attrs, nil
+	}
+	subjectID := ""
+	if existing := reg.Find(subject); existing != nil && !existing.Revoked {
+		subjectID = existing.Attributes[accesspolicy.SubjectAttribute]
+	}
+	for subjectID == "" || reg.subjectIDUsed(subject, subjectID) {
+		var err error
+		if subjectID, err = accesspolicy.NewSubjectID(); err != nil {
+			return nil, err
+		}
+	}
+
+	out := maps.Clone(attrs)
+	out[accesspolicy.SubjectAttribute] = subjectID
+	return out, nil
+}
+
+// Hidden tracing identifier for subject's key. A subject keeps it for good, also after
+// revocation, so any key it ever held traces back to it.
+func subjectTraceID(reg *registry, subject string) (string, error) {
+	if existing := reg.Find(subject); existing != nil && existing.TraceID != "" {
+		return existing.TraceID, nil
+	}
+	return tracing.NewTraceID()
+}
+
+// Files a pending key consists of: the key in its container, its attribute statement
+// & the validity sidecar of time-bound keys
+func (strct *pendingKey) files() (map[string][]byte, error) {
+	file := keyfile.New(keyfile.Attribute, strct.keyBytes)
+	file.Namespace = currentNamespace
+	file.SystemID = strct.systemID
+	file.KeyID = strct.entry.KeyID
+	file.CreatedAt = strct.entry.IssuedAt
+	file.Subject = strct.entry.Subject
+	file.Attributes = strct.entry.Attributes
+
+	encode := file.Encode
+	if armorKeys {
+		encode = file.Armor
+	}
+	keyData, err := encode()
+	if err != nil {
+		return nil, err
+	}
+
+	statementData, err := strct.statement()
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string][]byte{
+		strct.entry.KeyFile:                        keyData,
+		strct.entry.KeyFile + statement.FileSuffix: statementData,
+	}
+	if strct.entry.Validity != nil {
+		data, err := json.MarshalIndent(strct.entry.Validity, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("marshal validity: %w", err)
+		}
+		files[strct.entry.KeyFile+validitySuffix] = data
+	}
+	return files, nil
+}
+
+// Writes all pending keys or none of them: if any write fails, files written so far are
+// restored to their previous content. On success the keys are added to the registry
+// (the caller saves it) and recorded in the current epoch.
+func commitKeys(reg *registry, keys []*pendingKey) error {
+	tx := newFileTransaction()
+	if err := writePendingKeys(tx, keys); err != nil {
+		tx.rollback()
+		return err
+	}
+	return registerKeys(reg, keys)
+}
+
+// Writes the files of the pending keys through tx, & the version table if they marked
+// attributes multi-valued
+func writePendingKeys(tx *fileTransaction, keys []*pendingKey) error {
+	for _, key := range keys {
+		files, err := key.files()
+		if err != nil {
+			return err
+		}
+		for name, data := range files {
+			perm := keystore.PublicPerm
+			if name == key.entry.KeyFile {
+				perm = keystore.SecretPerm
+			}
+			if err := tx.write(name, data, perm); err != nil {
+				return err
+			}
+		}
+		if key.versions != nil {
+			if err := tx.replace(versionTableFile, key.saveVersions); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Re-signs the version table with the attributes the key made multi-valued, publishers must
+// match member attributes before the key can read anything under those names
+func (strct *pendingKey) saveVersions() error {
+	if strct.versions == nil {
+		return nil
+	}
+	return writeSigned(versionTableFile, accesspolicy.VersionTableDocument, strct.versions)
+}
+
+// Adds written keys to the registry & records their files in the current epoch
+func registerKeys(reg *registry, keys []*pendingKey) error {
+	for _, key := range keys {
+		reg.Put(key.entry)
+		files, _ := key.files()
+		for name := range files {
+			if err := recordIssuedKey(name); err != nil {
+				return fmt.Errorf("record %s in epoch index: %w", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Files of the keys directory changed as one unit: rollback restores everything written or
+// removed through the transaction to its previous content
+type fileTransaction struct {
+	store   *keystore.Store
+	written map[string]fileBackup
+}
+
+// Content of a file before a transaction first touched it
+type fileBackup struct {
+	data   []byte
+	perm   fs.FileMode
+	exists bool
+}
+
+func newFileTransaction() *fileTransaction {
+	return &fileTransaction{store: keystore.New(keysDir), written: make(map[string]fileBackup)}
+}
+
+// Backs up name, unless the transaction already did, & changes it through change
+func (strct *fileTransaction) replace(name string, change func() error) error {
+	if _, seen := strct.written[name]; !seen {
+		path := filepath.Join(keysDir, name)
+		previous, err := os.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		restore := fileBackup{data: previous, perm: keystore.PublicPerm, exists: err == nil}
+		if info, err := os.Stat(path); err == nil {
+			restore.perm = info.Mode().Perm()
+		}
+		strct.written[name] = restore
+	}
+	return change()
+}
+
+func (strct *fileTransaction) write(name string, data []byte, perm fs.FileMode) error {
+	return strct.replace(name, func() error {
+		return strct.store.Write(name, data, perm)
+	})
+}
+
+func (strct *fileTransaction) remove(name string) error {
+	return strct.replace(name, func() error {
+		if err := os.Remove(filepath.Join(keysDir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove %s: %w", filepath.Join(keysDir, name), err)
+		}
+		return nil
+	})
+}
+
+func (strct *fileTransaction) rollback() {
+	for name, b := range strct.written {
+		if b.exists {
+			_ = strct.store.Write(name, b.data, b.perm)
+		} else {
+			_ = os.Remove(filepath.Join(keysDir, name))
+		}
+	}
+}
+
+// Records attributes this key holds several values of in versions, in memory only.
+// Reports whether it holds any: the table is then written with the key, see pendingKey.saveVersions,
+// also when an earlier key marked them & was never written.
+func markMultiValued(versions *accesspolicy.VersionTable, attrs map[string]string) bool {
+	marked := false
+	for name, value := range attrs {
+		if len(accesspolicy.Values(value)) > 1 {
+			versions.MarkMultiValued(name)
+			marked = true
+		}
+	}
+	return marked
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/keystore"
+	"securemqtt/internal/masterkey"
+)
+
+// Takes the keys directory lock, then recovers from interrupted commands: leftover temporary
+// files are removed & secrets readable by others are tightened. With checkSystemKeys, a
+// public.key & master.key of different setups are refused instead of being used.
+func lockKeysDir(checkSystemKeys bool) (*keystore.Lock, error) {
+	store := keystore.New(keysDir)
+	lock, err := store.Lock()
+	if err != nil {
+		return nil, err
+	}
+	removed, err := store.Recover()
+	if err == nil {
+		for _, name := range removed {
+			log.Printf("Removed %s, left by an interrupted write", name)
+		}
+		err = tightenSecrets()
+	}
+	if err == nil && checkSystemKeys {
+		err = checkSystemKeyFiles()
+	}
+	if err != nil {
+		lock.Unlock()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Restricts system secrets written by earlier versions to their owner
+func tightenSecrets() error {
+	for _, name := range []string{masterKeyFile, signingKeyFile} {
+		path := filepath.Join(keysDir, name)
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", path, err)
+		}
+		if info.Mode().Perm()&^keystore.SecretPerm == 0 {
+			continue
+		}
+		if err := os.Chmod(path, keystore.SecretPerm); err != nil {
+			return fmt.Errorf("chmod %s: %w", path, err)
+		}
+		log.Printf("Restricted %s to its owner (was %v)", name, info.Mode().Perm())
+	}
+	return nil
+}
+
+// Checks that public.key & master.key (or its sealed form) can be read & belong to the same system and epoch.
+// A setup or rotation interrupted between the two writes leaves a pair that issues useless keys.
+func checkSystemKeyFiles() error {
+	publicPath := filepath.Join(keysDir, publicKeyFile)
+	if !fileExists(publicPath) {
+		return nil
+	}
+	const fix = "rerun --setup --force or --restore a backup"
+
+	// The sealed master key names its system & epoch outside the encryption
+	var name, systemID, keyID string
+	switch {
+	case fileExists(filepath.Join(keysDir, masterKeyFile)):
+		master, err := keyfile.Read(filepath.Join(keysDir, masterKeyFile), keyfile.Master)
+		if err != nil {
+			return fmt.Errorf("%s is unreadable, %s: %w", masterKeyFile, fix, err)
+		}
+		name, systemID, keyID = masterKeyFile, master.SystemID, master.KeyID
+	case fileExists(filepath.Join(keysDir, sealedMasterKeyFile)):
+		header, err := masterkey.ReadSealedHeader(filepath.Join(keysDir, sealedMasterKeyFile))
+		if err != nil {
+			return fmt.Errorf("%s is unreadable, %s: %w", sealedMasterKeyFile, fix, err)
+		}
+		name, systemID, keyID = sealedMasterKeyFile, header.SystemID, header.KeyID
+	default:
+		return nil
+	}
+
+	public, err := keyfile.Read(publicPath, keyfile.Public)
+	if err != nil {
+		return fmt.Errorf("%s is unreadable, %s: %w", publicKeyFile, fix, err)
+	}
+	// Raw key files of older versions carry no system ID to compare
+	if systemID == "" {
+		return nil
+	}
+	if publicID := keyfile.SystemID(public.Key); systemID != publicID || keyID != public.KeyID {
+		return fmt.Errorf("%s (system %s, epoch %s) and %s (system %s, epoch %s) are from different setups, "+
+			"an earlier setup or rotation was interrupted; %s", publicKeyFile, publicID, orNone(public.KeyID),
+			name, systemID, orNone(keyID), fix)
+	}
+	return nil
+}
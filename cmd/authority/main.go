@@ -1,24 +1,46 @@
 package main
 
 import (
-	"crypto/rand"
+	"crypto/ed25519"
 	"encoding/base64"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/cloudflare/circl/abe/cpabe/tkn20"
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/audit"
+	"securemqtt/internal/brokeracl"
+	"securemqtt/internal/epoch"
+	"securemqtt/internal/escrow"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/keystore"
+	"securemqtt/internal/manifest"
+	"securemqtt/internal/masterkey"
+	"securemqtt/internal/namespace"
+	"securemqtt/internal/provisioning"
+	"securemqtt/internal/tracing"
 )
 
 const (
-	keysDir       = "/keys"
+	keysRoot      = "/keys"
 	publicKeyFile = "public.key"
 	masterKeyFile = "master.key"
 )
 
+// Directory of the namespace this command works on, keysRoot for the default namespace (--namespace)
+var (
+	keysDir          = keysRoot
+	currentNamespace = ""
+)
+
 func main() {
 	log.SetPrefix("[AUTHORITY] ")
 	log.SetFlags(0)
@@ -27,24 +49,766 @@ func main() {
 	var (
 		doSetup   = flag.Bool("setup", false, "generate and persist public.key and master.key in /keys")
 		doIssue   = flag.Bool("issue", false, "issue a private key using /keys/master.key")
-		force     = flag.Bool("force", false, "overwrite existing public.key/master.key (setup only)")
-		outFile   = flag.String("out", "", "output key filename to write under /keys (issue only), e.g. sub1.key")
-		attrsJSON = flag.String("attrs-json", "", `attributes as JSON object, e.g. {"role":"operator","site":"rome"} (issue only)`)
+		force     = flag.Bool("force", false, "overwrite existing public.key/master.key (setup/restore), back up a keys directory that fails its checks (backup), or also re-issue keys of the current epoch (reissue)")
+		outFile   = flag.String("out", "", "output key filename to write under /keys (issue, or provision with --attrs-json: default <subject>.key), e.g. sub1.key")
+		attrsJSON = flag.String("attrs-json", "", `attributes as JSON object, e.g. {"role":"operator","site":"rome"} (issue, or provision to issue the bundled key)`)
+		idToken   = flag.String("id-token", "", "file holding an OIDC ID token to take the subject and attributes from instead of --attrs-json, - reads stdin (issue only)")
+		oidcIn    = flag.String("oidc-config", "", "trusted identity provider, JWKS and claim rules (issue with --id-token only, default /keys/oidc.json)")
+		shares    = flag.Int("shares", 0, "split master.key into this many custodian shares instead of writing it (setup only)")
+		threshold = flag.Int("threshold", 0, "number of shares required to reconstruct the master key (setup only, with --shares)")
+		sharesDir = flag.String("shares-dir", "", "directory outside /keys to write custodian share files to (setup/rotate with --shares, required)")
+		shareList = flag.String("share-files", "", "comma separated share files to reconstruct a split master key; prompts on stdin if empty (issue only)")
+		doRotate  = flag.Bool("rotate", false, "start a new system key epoch, archiving the current public key and issued keys")
+		doRetire  = flag.Bool("retire", false, "delete archived epochs whose retirement date has passed")
+		retireIn  = flag.Duration("retire-after", 30*24*time.Hour, "how long the previous epoch stays readable after --rotate (0 keeps it until retired by hand)")
+		doRevoke  = flag.Bool("revoke", false, "revoke the key of --subject and re-issue keys to the other holders of its attributes")
+		validFrom = flag.String("valid-from", "", "start of the key's validity window, YYYY-MM-DD or RFC 3339 (issue only, default now)")
+		validTo   = flag.String("valid-until", "", "end of the key's validity window, YYYY-MM-DD or RFC 3339; makes the key time-bound (issue only)")
+		period    = flag.String("period", "", "validity bucket size for time-bound keys: month or week (issue only, default month)")
+		doBulk    = flag.Bool("bulk", false, "issue keys for every subject listed in --manifest")
+		bulkFile  = flag.String("manifest", "", "CSV or JSON manifest of subjects and attributes (bulk only)")
+		partial   = flag.Bool("partial", false, "issue the valid rows even if others fail, instead of all-or-nothing (bulk only)")
+		indexOut  = flag.String("index-out", "", "where to write the subject/key file/fingerprint index (bulk only, default /keys/<manifest>.index.json)")
+		subject   = flag.String("subject", "", "subject the key is issued to (issue: defaults to --out without extension, enroll-approve: to the device ID; required for revoke and provision, where it is also the MQTT client ID)")
+		doListen  = flag.Bool("enroll-listen", false, "queue key requests devices publish over MQTT until interrupted")
+		doList    = flag.Bool("enroll-list", false, "list queued enrollment requests")
+		doApprove = flag.Bool("enroll-approve", false, "issue a key for --request and deliver it encrypted to the requesting device")
+		doReject  = flag.Bool("enroll-reject", false, "drop --request without issuing a key")
+		requestID = flag.String("request", "", "enrollment request ID, as shown by --enroll-list (enroll-approve/enroll-reject only)")
+		broker    = flag.String("broker", "tcp://broker:1883", "MQTT broker for enrollment, delegation and re-issuance; comma separated endpoints devices connect to (provision)")
+		doSchema  = flag.Bool("schema-set", false, "validate, sign and publish the attribute schema in --schema")
+		schemaIn  = flag.String("schema", "", "JSON attribute schema: allowed names, values, patterns and required attributes (schema-set only)")
+		doVerify  = flag.Bool("audit-verify", false, "verify the hash chain of the audit log")
+		doExport  = flag.Bool("audit-export", false, "export the audit log as JSON Lines")
+		since     = flag.String("since", "", "only export events at or after this date, YYYY-MM-DD or RFC 3339 (audit-export only)")
+		exportOut = flag.String("audit-out", "", "file to export the audit log to (audit-export only, default stdout)")
+		inspect   = flag.String("inspect", "", "show the type, system, epoch, fingerprint and attributes of a key file")
+		verifyIn  = flag.String("verify-key", "", "check that a key file can decrypt for the system public key of its epoch")
+		statement = flag.String("verify-statement", "", "verify an attribute statement against the authority signing key and the key it describes")
+		stmtKey   = flag.String("key", "", "key file the statement must describe (verify-statement, default the key next to the statement) or the escrow key (escrow-decrypt)")
+		authKey   = flag.String("authority-key", "", "authority signing public key to verify with (verify-statement/restore, default /keys/authority_sign.pub)")
+		doReview  = flag.Bool("review-access", false, "list the keys that can read --policy or --topic")
+		doReverse = flag.Bool("review-subject", false, "list the configured topic policies the key of --subject satisfies")
+		policy    = flag.String("policy", "", "policy to review, e.g. \"(role: operator) and (site: rome)\" (review-access), or to publish --topic under (provision)")
+		topic     = flag.String("topic", "", "topic whose configured policy to review (review-access), or comma separated topics to put in the bundle instead of the configured ones (provision)")
+		topicsIn  = flag.String("topics", "", "topic to policy configuration (review-access/review-subject/acl-generate/provision only, default /keys/topic_policies.json)")
+		doTrace   = flag.Bool("trace", false, "find which issued key a decoder uses, by sending probe envelopes to --oracle-cmd")
+		oracleCmd = flag.String("oracle-cmd", "", "decoder command: reads an envelope on stdin, exits 0 with the plaintext on stdout if it decrypts (trace only)")
+		oracleTTL = flag.Duration("oracle-timeout", 30*time.Second, "how long the decoder may take per probe (trace only)")
+		doACL     = flag.Bool("acl-generate", false, "write the mosquitto ACL file and dynamic security configuration for the issued keys to /keys/broker")
+		doGrant   = flag.Bool("delegate", false, "grant --delegate-name a credential to issue keys within --scope-json until --valid-until")
+		delegate  = flag.String("delegate-name", "", "name of the site sub-authority (delegate only)")
+		delegKey  = flag.String("delegate-key", "", "base64 Ed25519 public key of the site's issuance service (delegate only)")
+		scopeJSON = flag.String("scope-json", "", `attribute values the delegate may issue, e.g. {"site":["rome"],"role":["operator","guest"]} (delegate only)`)
+		doServe   = flag.Bool("delegation-serve", false, "issue keys requested over MQTT by holders of a valid credential, until interrupted")
+		doDelList = flag.Bool("delegation-list", false, "list granted delegation credentials")
+		doDelRev  = flag.Bool("delegation-revoke", false, "stop serving the credential --credential")
+		credID    = flag.String("credential", "", "delegation credential ID, as shown by --delegation-list (delegation-revoke only)")
+		doEscrow  = flag.Bool("escrow-set", false, "publish --policy as the escrow clause publishers OR into every policy")
+		optOut    = flag.String("escrow-opt-out", "", "comma separated topic filters published without the escrow clause (escrow-set only)")
+		doNoEsc   = flag.Bool("escrow-clear", false, "stop publishers from adding an escrow clause")
+		doEscDec  = flag.Bool("escrow-decrypt", false, "decrypt --envelope received on --topic with the escrow key --key, audited with --reason")
+		envelope  = flag.String("envelope", "", "captured envelope JSON to decrypt, - reads stdin (escrow-decrypt only)")
+		reason    = flag.String("reason", "", "why escrow access is needed, recorded in the audit log (escrow-decrypt only)")
+		doReissue = flag.Bool("reissue", false, "re-issue the registry's active keys under the current system keys, filtered by --subject and --attrs-json")
+		reissueIn = flag.Duration("reissue-wait", 5*time.Minute, "how long to wait for enrolled devices to request their re-issued key (reissue only)")
+		doBackup  = flag.Bool("backup", false, "check the keys directory and write it to --archive, encrypted and signed")
+		doRestore = flag.Bool("restore", false, "verify --archive and restore the keys directory from it")
+		archive   = flag.String("archive", "", "backup archive to write (backup) or read (restore)")
+		dryRun    = flag.Bool("dry-run", false, "only verify the archive and report its checks, write nothing (restore only)")
+		mstore    = flag.String("master-store", "", "where setup keeps the master key: file, sealed (encrypted under --passphrase-file) or keyholder (a separate daemon); default keeps the current one (setup only)")
+		mSocket   = flag.String("keyholder-socket", "", "Unix socket of the key-holder daemon (setup with --master-store keyholder, default "+defaultKeyholderSocket+")")
+		doProv    = flag.Bool("provision", false, "write a signed bundle with the broker, keys and topics a generic publisher or subscriber needs to --bundle-out")
+		role      = flag.String("role", "", "device the bundle provisions: publisher or subscriber (provision only)")
+		bundleOut = flag.String("bundle-out", "", "file to write the provisioning bundle to, readable by its owner only (provision only)")
+		caFile    = flag.String("ca-file", "", "PEM CA certificate devices verify a TLS broker with (provision only)")
+		ns        = flag.String("namespace", "", "namespace (tenant) to work on, each with its own system keys, issued keys and registry under /keys/namespaces/<name>")
 	)
+	flag.StringVar(&passphraseFile, "passphrase-file", "", "file holding the archive passphrase (backup/restore) or the sealed master key's (any mode using the master key); prompts on stdin if empty")
+	flag.BoolVar(&armorKeys, "armor", false, "write issued keys in the armored text format (issue, bulk and revoke)")
+	flag.StringVar(&operator, "operator", defaultOperator(), "operator identity recorded in the audit log")
 	flag.Parse()
 
-	// This will enforce that exactly one of --setup or --issue is chosen
-	if (*doSetup && *doIssue) || (!*doSetup && !*doIssue) {
-		usageAndExit("choose exactly one: --setup or --issue")
+	// This will enforce that exactly one mode is chosen
+	if countSet(*doSetup, *doIssue, *doRotate, *doRetire, *doRevoke, *doBulk, *doListen, *doList, *doApprove, *doReject, *doSchema, *doVerify, *doExport, *inspect != "", *verifyIn != "", *statement != "", *doReview, *doReverse, *doACL, *doTrace,
+		*doGrant, *doServe, *doDelList, *doDelRev, *doEscrow, *doNoEsc, *doEscDec, *doBackup, *doRestore, *doReissue, *doProv) != 1 {
+		usageAndExit("choose exactly one: --setup, --issue, --bulk, --rotate, --retire, --revoke, --enroll-listen, --enroll-list, --enroll-approve, --enroll-reject, --schema-set, --audit-verify, --audit-export, --inspect, --verify-key, --verify-statement, --review-access, --review-subject, --acl-generate, --trace, --delegate, --delegation-serve, --delegation-list, --delegation-revoke, --escrow-set, --escrow-clear, --escrow-decrypt, --reissue, --backup, --restore or --provision")
+	}
+	if (*shares == 0) != (*threshold == 0) {
+		usageAndExit("--shares and --threshold must be used together")
+	}
+	if (*mstore != "" || *mSocket != "") && !*doSetup {
+		usageAndExit("--master-store and --keyholder-socket are only valid with --setup")
+	}
+	if err := namespace.Validate(*ns); err != nil {
+		usageAndExit(err.Error())
+	}
+	keysDir = namespace.Path(keysRoot, *ns)
+	currentNamespace = *ns
+	if *shares > 0 {
+		if err := validateSharesDir(*sharesDir); err != nil {
+			usageAndExit(err.Error())
+		}
+	} else if *sharesDir != "" {
+		usageAndExit("--shares-dir is only valid with --shares")
+	}
+
+	// Commands that change the keys directory run one at a time, each after recovering from
+	// an interrupted one. Only commands replacing the system keys accept a mismatched pair.
+	if *doSetup || *doIssue || *doBulk || *doRotate || *doRetire || *doRevoke || *doReissue || *doApprove || *doReject ||
+		*doSchema || *doACL || *doGrant || *doDelRev || *doEscrow || *doNoEsc || *doBackup || *doRestore || *doProv {
+		lock, err := lockKeysDir(!(*doSetup && *force) && !*doRestore && !(*doBackup && *force))
+		if err != nil {
+			log.Fatalf("Keys directory check failed: %v", err)
+		}
+		defer lock.Unlock()
 	}
 
 	// Setup mode generate & persist the public and master key.
 	// If they already exist the command will be ignored.
 	if *doSetup {
-		if err := setupPersisted(*force); err != nil {
+		created, err := setupPersisted(*force, *shares, *threshold, *sharesDir, *mstore, *mSocket)
+		if err != nil {
 			log.Fatalf("Setup failed: %v", err)
 		}
-		log.Println("Setup complete. Wrote /keys/public.key and /keys/master.key.")
+		if !created {
+			log.Println("System keys already exist, nothing to do. Use --force to regenerate them.")
+			return
+		}
+		keyID, err := currentEpochKeyID()
+		if err == nil {
+			err = recordAudit(audit.Event{Operation: "setup", KeyID: keyID, Details: map[string]string{
+				"forced":    strconv.FormatBool(*force),
+				"shares":    strconv.Itoa(*shares),
+				"threshold": strconv.Itoa(*threshold),
+			}})
+		}
+		if err != nil {
+			log.Fatalf("Setup complete, but failed to write the audit log: %v", err)
+		}
+		if *shares > 0 {
+			log.Printf("Setup complete. Wrote %s/public.key and %d master key shares to %s (%d required).", keysDir, *shares, *sharesDir, *threshold)
+			log.Println("Hand one share file to each custodian and remove them from this host.")
+			return
+		}
+		config, err := loadMasterStoreConfig()
+		if err != nil {
+			log.Fatalf("Setup complete, but failed to read the master key store: %v", err)
+		}
+		log.Printf("Setup complete. Wrote %s/public.key, %s.", keysDir, config.describe())
+		return
+	}
+
+	// Rotate mode moves to a new epoch; publishers pick up the new public key,
+	// subscribers keep the archived keys until the old epoch is retired.
+	if *doRotate {
+		current, err := rotateEpoch(*retireIn, *shares, *threshold, *sharesDir)
+		if err != nil {
+			log.Fatalf("Rotation failed: %v", err)
+		}
+		if err := recordAudit(audit.Event{Operation: "rotate", KeyID: current.KeyID, Details: map[string]string{
+			"retire_after": retireIn.String(),
+		}}); err != nil {
+			log.Fatalf("Rotation complete, but failed to write the audit log: %v", err)
+		}
+		log.Printf("Rotation complete. Current epoch is %s, re-issue subscriber keys for it.", current.KeyID)
+		retireDueEpochsQuietly()
+		return
+	}
+
+	if *doRetire {
+		retired, err := retireDueEpochs(time.Now().UTC())
+		if err != nil {
+			log.Fatalf("Retirement failed: %v", err)
+		}
+		log.Printf("Retired %d epoch(s) %v", len(retired), retired)
+		return
+	}
+
+	// Revoke mode cuts off a single key by moving its attributes to new versions
+	if *doRevoke {
+		if *subject == "" {
+			usageAndExit("--subject is required in --revoke mode")
+		}
+		masterKey, err := loadMasterKey(splitList(*shareList))
+		if err != nil {
+			log.Fatalf("Failed to load master key: %v", err)
+		}
+		reissued, reenroll, err := revokeSubject(masterKey, *subject)
+		if err != nil {
+			log.Fatalf("Revocation failed: %v", err)
+		}
+		if err := recordKeyEvents("revoke", []string{*subject}, nil); err != nil {
+			log.Fatalf("Revocation complete, but failed to write the audit log: %v", err)
+		}
+		if err := recordKeyEvents("reissue", reissued, map[string]string{"revoked": *subject}); err != nil {
+			log.Fatalf("Revocation complete, but failed to write the audit log: %v", err)
+		}
+		log.Printf("Revoked %s. Re-issued %d key(s) %v and published %s.", *subject, len(reissued), reissued, versionTableFile)
+		if len(reenroll) > 0 {
+			log.Printf("Enrolled device(s) %v lost access to the revoked attributes and must enroll again.", reenroll)
+		}
+		generateBrokerACLsQuietly()
+		return
+	}
+
+	// Reissue mode replaces every selected key after a forced setup, a rotation or a compromise
+	if *doReissue {
+		filter := reissueFilter{Subjects: splitList(*subject), Force: *force}
+		if *attrsJSON != "" {
+			attrs, err := parseAttrsJSON(*attrsJSON)
+			if err != nil {
+				log.Fatalf("Invalid --attrs-json: %v", err)
+			}
+			filter.Attrs = attrs
+		}
+		masterKey, err := loadMasterKey(splitList(*shareList))
+		if err != nil {
+			log.Fatalf("Failed to load master key: %v", err)
+		}
+		results, err := reissueKeys(masterKey, filter, *broker, *reissueIn)
+		counts := make(map[string]int)
+		for _, result := range results {
+			fmt.Printf("%-9s %-20s %s\n", result.Status, result.Subject, result.Detail)
+			counts[result.Status]++
+		}
+		if err != nil {
+			log.Fatalf("Re-issuance failed: %v", err)
+		}
+		log.Printf("Re-issued %d key file(s), delivered %d enrolled key(s); %d waiting, %d skipped, %d failed.",
+			counts["reissued"], counts["delivered"], counts["waiting"], counts["skipped"], counts["failed"])
+		generateBrokerACLsQuietly()
+		if counts["failed"] > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Inspect mode describes any key file, containers as well as legacy raw keys
+	if *inspect != "" {
+		data, err := os.ReadFile(*inspect)
+		if err != nil {
+			log.Fatalf("Inspect failed: %v", err)
+		}
+		file, err := keyfile.Decode(data)
+		if err != nil {
+			log.Fatalf("Inspect failed: %v", err)
+		}
+		fmt.Print(file.Describe())
+		return
+	}
+
+	// Verify mode tells a key of an old setup apart from a policy the key does not satisfy
+	if *verifyIn != "" {
+		check, err := verifyKey(*verifyIn)
+		if err != nil {
+			log.Fatalf("Key verification failed: %v", err)
+		}
+		status := "active"
+		if check.Revoked {
+			status = "revoked"
+		}
+		fmt.Printf("Subject: %s (%s)\nSystem:  %s\nEpoch:   %s\nCanary:  %s\n", orNone(check.Subject), status, check.SystemID, orNone(check.KeyID), check.Policy)
+		log.Printf("%s belongs to the system public key.", *verifyIn)
+		return
+	}
+
+	// Statement mode checks what the authority attests about a key, without the master key
+	if *statement != "" {
+		verified, checkedKey, err := verifyStatement(*statement, *stmtKey, *authKey)
+		if err != nil {
+			log.Fatalf("Statement verification failed: %v", err)
+		}
+		data, err := json.MarshalIndent(verified, "", "  ")
+		if err != nil {
+			log.Fatalf("Statement verification failed: %v", err)
+		}
+		fmt.Println(string(data))
+		if checkedKey == "" {
+			log.Printf("Statement for %s is signed by the authority, no key file was checked.", verified.Subject)
+			return
+		}
+		log.Printf("Statement for %s is signed by the authority and describes %s.", verified.Subject, checkedKey)
+		return
+	}
+
+	// Review modes answer who can read what, from the registry & the topic policies
+	if *doReview {
+		if (*policy == "") == (*topic == "") {
+			usageAndExit("--review-access needs exactly one of --policy or --topic")
+		}
+		reviewed, err := reviewPolicy(*policy, *topic, *topicsIn)
+		if err != nil {
+			log.Fatalf("Access review failed: %v", err)
+		}
+		readers, err := reviewAccess(reviewed, time.Now().UTC())
+		if err != nil {
+			log.Fatalf("Access review failed: %v", err)
+		}
+		for _, reader := range readers {
+			fmt.Printf("%s  %s  key_id=%s  fingerprint=%s\n", reader.Subject, holderLocation(&reader), reader.KeyID, reader.Fingerprint)
+		}
+		if len(readers) == 0 {
+			log.Printf("No issued key can read %q.", reviewed)
+			return
+		}
+		log.Printf("%d key(s) can read %q", len(readers), reviewed)
+		return
+	}
+
+	if *doReverse {
+		if *subject == "" {
+			usageAndExit("--subject is required in --review-subject mode")
+		}
+		holder, access, err := reviewSubject(*subject, *topicsIn, time.Now().UTC())
+		if err != nil {
+			log.Fatalf("Subject review failed: %v", err)
+		}
+		for _, entry := range access {
+			fmt.Printf("%s  %s\n", entry.Topic, entry.Policy)
+		}
+		keyID, err := currentEpochKeyID()
+		if err != nil {
+			log.Fatalf("Subject review failed: %v", err)
+		}
+		if !holder.Usable(keyID, time.Now().UTC()) {
+			log.Printf("The key of %s is revoked, outside its validity window or of an archived epoch, it satisfies no policy.", *subject)
+			return
+		}
+		log.Printf("%s satisfies %d configured topic policy(ies)", *subject, len(access))
+		return
+	}
+
+	// Trace mode narrows down which key a leaked decoder is built from
+	if *doTrace {
+		if *oracleCmd == "" {
+			usageAndExit("--oracle-cmd is required in --trace mode")
+		}
+		probePolicy := *policy
+		if probePolicy == "" && *topic != "" {
+			resolved, err := reviewPolicy("", *topic, *topicsIn)
+			if err != nil {
+				log.Fatalf("Trace failed: %v", err)
+			}
+			probePolicy = resolved
+		}
+		oracle := &tracing.ProcessOracle{Command: strings.Fields(*oracleCmd), Timeout: *oracleTTL}
+		result, untraceable, err := traceDecoder(oracle, *topic, probePolicy)
+		if err != nil {
+			log.Fatalf("Trace failed: %v", err)
+		}
+		for i, probe := range result.Probes {
+			fmt.Printf("probe %d  decrypted=%t  suspects=%v\n", i+1, probe.Decrypted, probe.Subjects)
+		}
+		if len(untraceable) > 0 {
+			log.Printf("Keys issued before tracing cannot be traced: %v", untraceable)
+		}
+		details := map[string]string{"probes": strconv.Itoa(len(result.Probes)), "oracle": *oracleCmd}
+		event := audit.Event{Operation: "trace", Details: details}
+		if result.Suspect != nil {
+			event.Subject = result.Suspect.Subject
+		}
+		if err := recordAudit(event); err != nil {
+			log.Fatalf("Trace complete, but failed to write the audit log: %v", err)
+		}
+		if result.Suspect == nil {
+			log.Fatalf("No suspect's key explains the decoder's answers after %d probe(s).", len(result.Probes))
+		}
+		log.Printf("The decoder uses the key of %s (%d probe(s)).", result.Suspect.Subject, len(result.Probes))
+		return
+	}
+
+	if *doACL {
+		generated, err := generateBrokerACLs(*topicsIn)
+		if err != nil {
+			log.Fatalf("Broker ACL generation failed: %v", err)
+		}
+		if !generated {
+			log.Fatalf("Broker ACL generation failed: no topic policies configured")
+		}
+		log.Printf("Wrote %s and %s to %s.", brokeracl.ACLFile, brokeracl.DynamicSecurityFile, filepath.Join(keysDir, brokeracl.Dir))
+		return
+	}
+
+	// Schema mode publishes the attribute names & values keys and policies may use
+	if *doSchema {
+		if *schemaIn == "" {
+			usageAndExit("--schema is required in --schema-set mode")
+		}
+		violations, err := setSchema(*schemaIn)
+		if err != nil {
+			log.Fatalf("Invalid schema: %v", err)
+		}
+		for _, violation := range violations {
+			log.Printf("Already issued key outside the schema: %s", violation)
+		}
+		log.Printf("Published %s.", schemaFile)
+		return
+	}
+
+	// Audit modes check & export the log every other mode appends to
+	if *doVerify {
+		events, err := verifyAuditLog()
+		if err != nil {
+			log.Fatalf("Audit log verification FAILED: %v", err)
+		}
+		log.Printf("Audit log OK: %d event(s), chain intact and matching the signed head.", events)
+		return
+	}
+
+	if *doExport {
+		var from time.Time
+		if *since != "" {
+			t, err := time.Parse(time.DateOnly, *since)
+			if err != nil {
+				t, err = time.Parse(time.RFC3339, *since)
+			}
+			if err != nil {
+				usageAndExit("--since must be YYYY-MM-DD or RFC 3339")
+			}
+			from = t
+		}
+		out := os.Stdout
+		if *exportOut != "" {
+			file, err := os.Create(*exportOut)
+			if err != nil {
+				log.Fatalf("Export failed: %v", err)
+			}
+			defer file.Close()
+			out = file
+		}
+		count, err := auditLog().Export(out, from)
+		if err != nil {
+			log.Fatalf("Export failed: %v", err)
+		}
+		log.Printf("Exported %d event(s).", count)
+		return
+	}
+
+	// Backup modes: an encrypted, signed archive of the keys directory, checked before it is written or restored
+	if *doBackup || *doRestore {
+		if *archive == "" {
+			usageAndExit("--archive is required in --backup and --restore mode")
+		}
+		passphrase, err := readPassphrase(passphraseFile, "backup", *doBackup)
+		if err != nil {
+			log.Fatalf("Failed to read the passphrase: %v", err)
+		}
+		defer clear(passphrase)
+
+		if *doBackup {
+			report, err := backupKeys(*archive, passphrase, splitList(*shareList), *force)
+			if report != nil {
+				report.Print()
+			}
+			if err != nil {
+				log.Fatalf("Backup failed: %v", err)
+			}
+			log.Printf("Wrote %s. Keep it off this host, with the passphrase stored separately.", *archive)
+			return
+		}
+
+		report, err := restoreKeys(*archive, passphrase, *authKey, splitList(*shareList), *dryRun, *force)
+		if report != nil {
+			report.Print()
+		}
+		if err != nil {
+			log.Fatalf("Restore failed: %v", err)
+		}
+		switch {
+		case *dryRun && report.Failed():
+			log.Fatalf("Archive verification FAILED, see the checks above.")
+		case *dryRun:
+			log.Printf("Archive OK, nothing was written. Compare the signing key fingerprint with the one recorded at backup.")
+		default:
+			log.Printf("Restored %d file(s) to %s.", report.Files, keysDir)
+		}
+		return
+	}
+
+	// Enrollment modes: devices request keys over MQTT, an operator approves each request
+	if *doListen {
+		if err := listenForEnrollments(*broker); err != nil {
+			log.Fatalf("Enrollment listener failed: %v", err)
+		}
+		return
+	}
+
+	if *doList {
+		requests, err := pendingEnrollments()
+		if err != nil {
+			log.Fatalf("Failed to list enrollment requests: %v", err)
+		}
+		for _, request := range requests {
+			fmt.Printf("%s  device=%s  identity=%s  received=%s\n", request.ID, request.Request.DeviceID,
+				request.Request.IdentityFingerprint(), request.ReceivedAt.Format(time.RFC3339))
+		}
+		log.Printf("%d pending request(s)", len(requests))
+		return
+	}
+
+	if *doReject {
+		if *requestID == "" {
+			usageAndExit("--request is required in --enroll-reject mode")
+		}
+		request, err := rejectEnrollment(*broker, *requestID)
+		if err != nil {
+			log.Fatalf("Rejection failed: %v", err)
+		}
+		log.Printf("Rejected request %s from %s.", request.ID, request.Request.DeviceID)
+		return
+	}
+
+	if *doApprove {
+		if *requestID == "" || *attrsJSON == "" {
+			usageAndExit("--request and --attrs-json are required in --enroll-approve mode")
+		}
+		attrs, err := parseAttrsJSON(*attrsJSON)
+		if err != nil {
+			log.Fatalf("Invalid --attrs-json: %v", err)
+		}
+		if err := checkSchema(attrs); err != nil {
+			log.Fatalf("Invalid --attrs-json: %v", err)
+		}
+		validity, err := resolveValidity(*period, *validFrom, *validTo)
+		if err != nil {
+			log.Fatalf("Invalid validity window: %v", err)
+		}
+		masterKey, err := loadMasterKey(splitList(*shareList))
+		if err != nil {
+			log.Fatalf("Failed to load master key: %v", err)
+		}
+		entry, err := approveEnrollment(masterKey, *broker, *requestID, *subject, attrs, validity)
+		if err != nil {
+			log.Fatalf("Approval failed: %v", err)
+		}
+		log.Printf("Delivered key for %s to device %s (fingerprint %s).", entry.Subject, entry.DeviceID, entry.Fingerprint)
+		generateBrokerACLsQuietly()
+		return
+	}
+
+	// Escrow modes: an auditor identity that can read every message, & audited break-glass access
+	if *doEscrow {
+		if *policy == "" {
+			usageAndExit("--policy is required in --escrow-set mode")
+		}
+		config, readers, err := setEscrow(*policy, splitList(*optOut))
+		if err != nil {
+			log.Fatalf("Escrow failed: %v", err)
+		}
+		if readers == 0 {
+			log.Printf("Warning: no issued key satisfies %q yet, issue the escrow key next.", config.Clause)
+		}
+		log.Printf("Published escrow clause %q (opted out: %v) to %s.", config.Clause, config.OptOut, escrow.File)
+		return
+	}
+
+	if *doNoEsc {
+		if err := clearEscrow(); err != nil {
+			log.Fatalf("Escrow failed: %v", err)
+		}
+		log.Printf("Cleared the escrow clause, publishers stop adding it.")
+		return
+	}
+
+	if *doEscDec {
+		if *stmtKey == "" || *envelope == "" || *topic == "" || *reason == "" {
+			usageAndExit("--key, --envelope, --topic and --reason are required in --escrow-decrypt mode")
+		}
+		plaintext, err := escrowDecrypt(*stmtKey, *envelope, *topic, *reason)
+		if err != nil {
+			log.Fatalf("Escrow decryption failed: %v", err)
+		}
+		os.Stdout.Write(plaintext)
+		return
+	}
+
+	// Delegation modes: site sub-authorities issue keys within a scope the root authority granted
+	if *doGrant {
+		if *delegate == "" || *delegKey == "" || *scopeJSON == "" || *validTo == "" {
+			usageAndExit("--delegate-name, --delegate-key, --scope-json and --valid-until are required in --delegate mode")
+		}
+		delegateKey, err := parseDelegateKey(*delegKey)
+		if err != nil {
+			usageAndExit(err.Error())
+		}
+		scope, err := parseScopeJSON(*scopeJSON)
+		if err != nil {
+			log.Fatalf("Invalid --scope-json: %v", err)
+		}
+		notAfter, err := parseDate(*validTo)
+		if err != nil {
+			log.Fatalf("Invalid --valid-until: %v", err)
+		}
+		credential, filename, err := grantDelegation(*delegate, delegateKey, scope, notAfter)
+		if err != nil {
+			log.Fatalf("Delegation failed: %v", err)
+		}
+		log.Printf("Granted credential %s to %s: %s, until %s. Wrote %s.", credential.ID, credential.Delegate,
+			credential.Scope, credential.NotAfter.Format(time.RFC3339), filepath.Join(keysDir, filename))
+		return
+	}
+
+	if *doDelList {
+		if err := listDelegations(); err != nil {
+			log.Fatalf("Failed to list delegations: %v", err)
+		}
+		return
+	}
+
+	if *doDelRev {
+		if *credID == "" {
+			usageAndExit("--credential is required in --delegation-revoke mode")
+		}
+		credential, err := revokeDelegation(*credID)
+		if err != nil {
+			log.Fatalf("Delegation revocation failed: %v", err)
+		}
+		log.Printf("Revoked credential %s of %s. Keys it issued stay valid until revoked with --revoke.", credential.ID, credential.Delegate)
+		return
+	}
+
+	if *doServe {
+		lock, err := lockKeysDir(true)
+		if err != nil {
+			log.Fatalf("Keys directory check failed: %v", err)
+		}
+		masterKey, err := loadMasterKey(splitList(*shareList))
+		lock.Unlock()
+		if err != nil {
+			log.Fatalf("Failed to load master key: %v", err)
+		}
+		if err := serveDelegations(masterKey, *broker); err != nil {
+			log.Fatalf("Delegation service failed: %v", err)
+		}
+		return
+	}
+
+	// Provision mode packages a device's broker, keys & topics into one bundle signed by the authority
+	if *doProv {
+		if *subject == "" || *bundleOut == "" {
+			usageAndExit("--subject and --bundle-out are required in --provision mode")
+		}
+		if *role != provisioning.RolePublisher && *role != provisioning.RoleSubscriber {
+			usageAndExit("--role must be publisher or subscriber in --provision mode")
+		}
+		if *policy != "" && (*role != provisioning.RolePublisher || *topic == "") {
+			usageAndExit("--policy is only valid with --topic for publisher bundles")
+		}
+		if *role == provisioning.RolePublisher && *topic != "" && *policy == "" {
+			usageAndExit("--topic needs --policy for publisher bundles")
+		}
+
+		// With --attrs-json a fresh key is issued for the subscriber, otherwise its current key is bundled
+		if *attrsJSON != "" {
+			if *role != provisioning.RoleSubscriber {
+				usageAndExit("--attrs-json is only valid for subscriber bundles, publishers hold no key")
+			}
+			if *outFile == "" {
+				*outFile = *subject + ".key"
+			}
+			if err := validateKeyFilename(*outFile); err != nil {
+				usageAndExit(err.Error())
+			}
+			attrs, err := parseAttrsJSON(*attrsJSON)
+			if err != nil {
+				log.Fatalf("Invalid --attrs-json: %v", err)
+			}
+			if err := checkSchema(attrs); err != nil {
+				log.Fatalf("Invalid attributes: %v", err)
+			}
+			validity, err := resolveValidity(*period, *validFrom, *validTo)
+			if err != nil {
+				log.Fatalf("Invalid validity window: %v", err)
+			}
+			masterKey, err := loadMasterKey(splitList(*shareList))
+			if err != nil {
+				log.Fatalf("Failed to load master key: %v", err)
+			}
+			if err := issueProvisionedKey(masterKey, *subject, attrs, validity, *outFile); err != nil {
+				log.Fatalf("Provisioning failed: %v", err)
+			}
+			log.Printf("Issued %s for %s.", filepath.Join(keysDir, *outFile), *subject)
+			retireDueEpochsQuietly()
+			generateBrokerACLsQuietly()
+		}
+
+		bundle, err := provisionDevice(provisionOptions{
+			Role:       *role,
+			Subject:    *subject,
+			Brokers:    splitList(*broker),
+			CAFile:     *caFile,
+			Topics:     splitList(*topic),
+			Policy:     *policy,
+			TopicsPath: *topicsIn,
+		}, *bundleOut)
+		if err != nil {
+			log.Fatalf("Provisioning failed: %v", err)
+		}
+		signingKey, err := loadOrCreateSigningKey()
+		if err != nil {
+			log.Fatalf("Provisioning failed: %v", err)
+		}
+		for _, entry := range bundle.Topics {
+			fmt.Printf("%s  %s\n", entry.Topic, entry.Policy)
+		}
+		log.Printf("Wrote %s bundle for %s to %s: system %s, epoch %s, %d topic(s), broker %v.", bundle.Role, bundle.Subject, *bundleOut,
+			bundle.SystemID, orNone(bundle.KeyID), len(bundle.Topics), bundle.Broker.URLs)
+		log.Printf("Devices verify it with the authority key %s", base64.StdEncoding.EncodeToString(signingKey.Public().(ed25519.PublicKey)))
+		return
+	}
+
+	// Bulk mode validates the whole manifest up front, then issues all keys (or each valid one with --partial)
+	if *doBulk {
+		if *bulkFile == "" {
+			usageAndExit("--manifest is required in --bulk mode")
+		}
+		rows, err := manifest.Parse(*bulkFile)
+		if err != nil {
+			log.Fatalf("Invalid manifest: %v", err)
+		}
+		if *indexOut == "" {
+			*indexOut = defaultIndexPath(*bulkFile)
+		}
+
+		schema, err := loadSchema()
+		if err != nil {
+			log.Fatalf("Failed to load attribute schema: %v", err)
+		}
+		items, results := manifest.Validate(rows, &manifestChecker{schema: schema})
+		if len(items) < len(rows) && !*partial {
+			manifest.Finish(results)
+			if err := manifest.WriteIndex(*indexOut, results); err != nil {
+				log.Printf("Failed to write index: %v", err)
+			}
+			log.Fatalf("Manifest has %d invalid row(s), nothing issued. See %s", len(rows)-len(items), *indexOut)
+		}
+
+		masterKey, err := loadMasterKey(splitList(*shareList))
+		if err != nil {
+			log.Fatalf("Failed to load master key: %v", err)
+		}
+		issueErr := issueManifest(masterKey, items, *partial)
+
+		issued := manifest.Finish(results)
+		if err := manifest.WriteIndex(*indexOut, results); err != nil {
+			log.Fatalf("Failed to write index: %v", err)
+		}
+		if issueErr != nil {
+			log.Fatalf("Bulk issuance failed, nothing issued: %v. See %s", issueErr, *indexOut)
+		}
+		var subjects []string
+		for _, result := range results {
+			if result.Status == manifest.StatusIssued {
+				subjects = append(subjects, result.Subject)
+			}
+		}
+		if err := recordKeyEvents("issue", subjects, map[string]string{"manifest": *bulkFile}); err != nil {
+			log.Fatalf("Issued %d key(s), but failed to write the audit log: %v", issued, err)
+		}
+		log.Printf("Issued %d of %d key(s). Index written to %s", issued, len(rows), *indexOut)
+		retireDueEpochsQuietly()
+		generateBrokerACLsQuietly()
 		return
 	}
 
@@ -52,107 +816,225 @@ func main() {
 	if *outFile == "" {
 		usageAndExit("--out is required in --issue mode")
 	}
-	if *attrsJSON == "" {
-		usageAndExit("--attrs-json is required in --issue mode")
+	if (*attrsJSON == "") == (*idToken == "") {
+		usageAndExit("exactly one of --attrs-json or --id-token is required in --issue mode")
+	}
+	if err := validateKeyFilename(*outFile); err != nil {
+		usageAndExit(err.Error())
 	}
 
-	// Parse the attributes JSON into a map[string]string
-	attrs, err := parseAttrsJSON(*attrsJSON)
-	if err != nil {
-		log.Fatalf("Invalid --attrs-json: %v", err)
+	// Parse the attributes JSON into a map[string]string, or take them from a verified ID token
+	var attrs map[string]string
+	var issueDetails map[string]string
+	if *idToken != "" {
+		verified, err := identityFromToken(*idToken, *oidcIn)
+		if err != nil {
+			log.Fatalf("Invalid --id-token: %v", err)
+		}
+		attrs, issueDetails = verified.attributes, verified.details
+		if *subject == "" {
+			*subject = verified.subject
+		}
+		log.Printf("ID token of %s verified, attributes %v", verified.subject, attrs)
+	} else {
+		parsed, err := parseAttrsJSON(*attrsJSON)
+		if err != nil {
+			log.Fatalf("Invalid --attrs-json: %v", err)
+		}
+		attrs = parsed
+	}
+	if err := checkSchema(attrs); err != nil {
+		log.Fatalf("Invalid attributes: %v", err)
 	}
 
 	// Load the master secret key
-	masterSecretKey, err := loadMasterSecretKey()
+	masterKey, err := loadMasterKey(splitList(*shareList))
 	if err != nil {
 		log.Fatalf("Failed to load master key: %v", err)
 	}
 
-	// Generate and save the private keys for the given attributes
-	if err := issueKey(masterSecretKey, attrs, *outFile); err != nil {
+	if *subject == "" {
+		*subject = subjectFromFile(*outFile)
+	}
+	reg, err := loadRegistry()
+	if err != nil {
+		log.Fatalf("Failed to load registry: %v", err)
+	}
+	versions, err := loadVersionTable()
+	if err != nil {
+		log.Fatalf("Failed to load attribute versions: %v", err)
+	}
+	validity, err := resolveValidity(*period, *validFrom, *validTo)
+	if err != nil {
+		log.Fatalf("Invalid validity window: %v", err)
+	}
+
+	// Generate and save the private keys for the given attributes, at their current versions
+	if err := issueSubjectKey(masterKey, reg, versions, *subject, attrs, validity, *outFile); err != nil {
 		log.Fatalf("%v", err)
 	}
+	if err := saveRegistry(reg); err != nil {
+		log.Fatalf("Issued key written, but failed to record it in the registry: %v", err)
+	}
+	if err := announcePeriods(validity); err != nil {
+		log.Fatalf("Issued key written, but failed to publish the period configuration: %v", err)
+	}
+	if err := recordKeyEvents("issue", []string{*subject}, issueDetails); err != nil {
+		log.Fatalf("Issued key written, but failed to write the audit log: %v", err)
+	}
+	retireDueEpochsQuietly()
+	generateBrokerACLsQuietly()
 
 	// Read the generated key back to print in the CLI
 	keyPath := filepath.Join(keysDir, *outFile)
-	keyBytes, err := os.ReadFile(keyPath)
+	keyFile, err := keyfile.Read(keyPath, keyfile.Attribute)
 	if err != nil {
 		log.Fatalf("Issued key written, but failed to read back for base64 printing: %v", err)
 	}
 
 	fmt.Printf("WROTE: %s\n", keyPath)
-	fmt.Printf("PRIVATE_KEY_BASE64: %s\n", base64.StdEncoding.EncodeToString(keyBytes))
+	fmt.Printf("FINGERPRINT: %s\n", keyFile.Fingerprint)
+	if validity != nil {
+		fmt.Printf("VALID: %s until %s (%d %s periods)\n", validity.NotBefore.Format(time.RFC3339), validity.NotAfter.Format(time.RFC3339), len(validity.Periods), validity.Granularity)
+	}
+	fmt.Printf("PRIVATE_KEY_BASE64: %s\n", base64.StdEncoding.EncodeToString(keyFile.Key))
 }
 
 // setupPersisted generates system keys and writes them to disk.
-// It avoids overwriting existing keys unless --force flag is used.
-func setupPersisted(force bool) error {
+// It avoids overwriting existing keys unless --force flag is used, and reports whether it generated any.
+// With shares > 0 the master key is split into custodian shares and never written as a whole.
+// A non-empty backend moves the master key to that store, otherwise the configured one is kept.
+func setupPersisted(force bool, shares, threshold int, sharesDir, backend, socket string) (bool, error) {
 	if err := os.MkdirAll(keysDir, 0755); err != nil {
-		return fmt.Errorf("mkdir %s: %w", keysDir, err)
+		return false, fmt.Errorf("mkdir %s: %w", keysDir, err)
 	}
 
-	publicPath := filepath.Join(keysDir, publicKeyFile)
-	masterPath := filepath.Join(keysDir, masterKeyFile)
+	current, err := loadMasterStoreConfig()
+	if err != nil {
+		return false, err
+	}
+	config := current
+	if backend != "" {
+		if config, err = newMasterStoreConfig(backend, socket); err != nil {
+			return false, err
+		}
+	}
+	if err := config.allowsShares(shares); err != nil {
+		return false, err
+	}
 
-	publicExists := fileExists(publicPath)
-	masterExists := fileExists(masterPath)
+	publicExists := fileExists(filepath.Join(keysDir, publicKeyFile))
+	masterExists := current.exists()
 
 	// Check if the --force flag has been passed to prevent overwrites of the keys
 	if !force {
 		if publicExists && masterExists {
-			return nil
+			return false, nil
 		}
 
 		if publicExists || masterExists {
-			return fmt.Errorf("partial key material exists (public.key/master.key). Delete both or rerun with --force")
+			return false, fmt.Errorf("partial key material exists (public.key/master.key). Delete both or rerun with --force")
 		}
 	}
 
-	// Generate the public and master secret keys
-	publicKey, masterSecretKey, err := tkn20.Setup(rand.Reader)
+	// A forced setup starts a fresh epoch history, keys from earlier epochs are dead
+	index, err := loadEpochIndex()
 	if err != nil {
-		return fmt.Errorf("Setup failed: %w", err)
+		return false, err
 	}
-
-	// Serialize & store the public key
-	publicKeyBytes, err := publicKey.MarshalBinary()
+	staged, err := stageSystemKeys(config, shares, threshold, sharesDir, epoch.KeyID(nextEpochNumber(index)), force)
 	if err != nil {
-		return fmt.Errorf("Failed to marshal public key: %w", err)
+		return false, err
 	}
-	if err := writeKey(publicKeyFile, publicKeyBytes); err != nil {
-		return err
-	}
-
-	// Serialize & store the master secret key
-	masterBytes, err := masterSecretKey.MarshalBinary()
-	if err != nil {
-		return fmt.Errorf("Failed to marshal master secret key: %w", err)
-	}
-	if err := writeKey(masterKeyFile, masterBytes); err != nil {
-		return err
+	if err := staged.commit(); err != nil {
+		return false, err
 	}
+	_, err = startEpoch(index, true)
+	return err == nil, err
+}
 
-	return nil
+// A system key pair generated for epoch keyID but not in effect yet. Its public & master key
+// files (or custodian shares) are written under staging names until commit renames them into
+// place, so a failure before commit leaves the current keys untouched.
+type stagedSystemKeys struct {
+	config *masterStoreConfig
+	keep   string
+	paths  []string
 }
 
-// Loads master key from disk and deserializes it.
-func loadMasterSecretKey() (tkn20.SystemSecretKey, error) {
-	var masterSecretKey tkn20.SystemSecretKey
+// Generates a system key pair for epoch keyID in the master key store of config & stages its
+// public half as the next public.key. With shares > 0 the master key is split into custodian
+// shares instead. Replace allows a key holder to replace a master key it holds; the key holder
+// swaps its key in one step, so for it the new master key is in effect once this returns.
+func stageSystemKeys(config *masterStoreConfig, shares, threshold int, sharesDir, keyID string, replace bool) (*stagedSystemKeys, error) {
+	staged := &stagedSystemKeys{config: config, keep: config.file()}
+	var publicKeyBytes []byte
+
+	// Threshold custody: only shares leave this branch, the whole key is never written
+	if shares > 0 {
+		publicKey, masterBytes, _, err := masterkey.Generate()
+		if err != nil {
+			return nil, err
+		}
+		defer clear(masterBytes)
+		if err := splitMasterKey(masterBytes, shares, threshold, sharesDir, staged); err != nil {
+			staged.abort()
+			return nil, err
+		}
+		publicKeyBytes, staged.keep = publicKey, sharesMetaFile
+	} else {
+		var stagingPath string
+		if config.file() != "" {
+			path := filepath.Join(keysDir, config.file())
+			staged.paths, stagingPath = append(staged.paths, path), keystore.StagingPath(path)
+		}
+		var err error
+		if publicKeyBytes, err = config.storeAt(stagingPath, replace).Setup(keyID); err != nil {
+			staged.abort()
+			return nil, err
+		}
+	}
 
-	path := filepath.Join(keysDir, masterKeyFile)
-	data, err := os.ReadFile(path)
+	data, err := encodeKeyFile(keyfile.Public, publicKeyBytes, keyfile.SystemID(publicKeyBytes), keyID)
+	if err == nil {
+		err = staged.write(filepath.Join(keysDir, publicKeyFile), data, keystore.PublicPerm)
+	}
 	if err != nil {
-		return masterSecretKey, fmt.Errorf("read %s: %w", path, err)
+		staged.abort()
+		return nil, err
 	}
+	return staged, nil
+}
+
+// Writes data under the staging name of path, for commit to rename into place
+func (strct *stagedSystemKeys) write(path string, data []byte, perm fs.FileMode) error {
+	strct.paths = append(strct.paths, path)
+	return keystore.WriteFile(keystore.StagingPath(path), data, perm)
+}
 
-	if err := masterSecretKey.UnmarshalBinary(data); err != nil {
-		return masterSecretKey, fmt.Errorf("unmarshal master secret key: %w", err)
+// Puts the staged keys in place, records their master key store & removes master key files
+// of the previous setup. The old master key is gone only once the new one is in place.
+func (strct *stagedSystemKeys) commit() error {
+	for _, path := range strct.paths {
+		if err := keystore.Commit(path); err != nil {
+			return err
+		}
+	}
+	if err := writeSigned(masterStoreFile, masterStoreDocument, strct.config); err != nil {
+		return err
 	}
+	return removeMasterKeyFiles(strct.keep)
+}
 
-	return masterSecretKey, nil
+// Removes the staged files, the current keys stay in effect
+func (strct *stagedSystemKeys) abort() {
+	for _, path := range strct.paths {
+		os.Remove(keystore.StagingPath(path))
+	}
 }
 
 // Parses JSON attribute string into map[string]string. Will validate that keys and values are non-empty strings.
+// Several values are given as an array; a "," inside a value would silently split it, so it is rejected.
 func parseAttrsJSON(raw string) (map[string]string, error) {
 	var m map[string]any
 	if err := json.Unmarshal([]byte(raw), &m); err != nil {
@@ -160,68 +1042,189 @@ func parseAttrsJSON(raw string) (map[string]string, error) {
 	}
 	out := make(map[string]string, len(m))
 	for k, v := range m {
-		s, ok := v.(string)
-		if !ok {
-			return nil, fmt.Errorf("attribute %q must be a string", k)
-		}
-		if k == "" || s == "" {
-			return nil, fmt.Errorf("attribute keys and values must be non-empty strings")
+		switch v := v.(type) {
+		case string:
+			if strings.Contains(v, accesspolicy.ValueSeparator) {
+				return nil, fmt.Errorf("attribute %q: %q holds a %q, list several values as an array", k, v, accesspolicy.ValueSeparator)
+			}
+			out[k] = v
+		case []any:
+			// Multi-valued attribute, e.g. "site": ["rome", "milan"]
+			values := make([]string, 0, len(v))
+			for _, item := range v {
+				s, ok := item.(string)
+				if !ok || s == "" {
+					return nil, fmt.Errorf("attribute %q must hold non-empty strings", k)
+				}
+				if strings.Contains(s, accesspolicy.ValueSeparator) {
+					return nil, fmt.Errorf("attribute %q: value %q holds a %q", k, s, accesspolicy.ValueSeparator)
+				}
+				values = append(values, s)
+			}
+			if len(values) == 0 {
+				return nil, fmt.Errorf("attribute %q has no values", k)
+			}
+			out[k] = accesspolicy.JoinValues(values)
+		default:
+			return nil, fmt.Errorf("attribute %q must be a string or an array of strings", k)
 		}
-		out[k] = s
 	}
-	if len(out) == 0 {
-		return nil, fmt.Errorf("empty attribute set")
+	if err := validateAttrs(out); err != nil {
+		return nil, err
 	}
 	return out, nil
 }
 
+// Validates that keys and values (each value of multi-valued attributes) are non-empty strings,
+// that no reserved attribute is requested and that the set is not empty.
+func validateAttrs(attrs map[string]string) error {
+	for k, v := range attrs {
+		if k == "" || slices.Contains(accesspolicy.Values(v), "") {
+			return fmt.Errorf("attribute keys and values must be non-empty strings")
+		}
+		if accesspolicy.IsReserved(k) {
+			return fmt.Errorf("attribute %q is reserved, the authority sets it", k)
+		}
+	}
+	if len(attrs) == 0 {
+		return fmt.Errorf("empty attribute set")
+	}
+	return nil
+}
+
+// Accepts only issued key names: one plain file name ending in .key that no system key uses.
+// Everything else in the keys directory (sidecars, sealed keys, lock & bookkeeping files,
+// subdirectories) is out of reach by construction.
+func validateKeyFilename(name string) error {
+	if err := validatePlainFilename(name); err != nil {
+		return err
+	}
+	if filepath.Ext(name) != ".key" || name == ".key" {
+		return fmt.Errorf("key file %q must be named <name>.key", name)
+	}
+	switch name {
+	case publicKeyFile, masterKeyFile, signingKeyFile:
+		return fmt.Errorf("key file %q would overwrite a system file", name)
+	}
+	return nil
+}
+
+// Accepts a file name directly in the keys directory that is not hidden (lock & temporary files)
+func validatePlainFilename(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.ContainsRune(name, '\\') {
+		return fmt.Errorf("file %q must be a plain file name under %s", name, keysDir)
+	}
+	return nil
+}
+
+// Counts how many of the mode flags are set
+func countSet(modes ...bool) int {
+	n := 0
+	for _, m := range modes {
+		if m {
+			n++
+		}
+	}
+	return n
+}
+
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
 	return err == nil
 }
 
 // Generates a subscriber private key from given attributes
-// and writes it to the specified file.
-func issueKey(masterSecretKey tkn20.SystemSecretKey, attributeList map[string]string, filename string) error {
-
-	var attributes tkn20.Attributes
-	attributes.FromMap(attributeList)
-
-	privateKey, err := masterSecretKey.KeyGen(rand.Reader, attributes)
+// and returns it serialized, without writing it.
+func generateAttributeKey(masterKey masterkey.IMasterKey, attributeList map[string]string, filename string) ([]byte, error) {
+	privateKeyBytes, err := masterKey.KeyGen(attributeList)
 	if err != nil {
-		return fmt.Errorf("KeyGen for %s failed: %w", filename, err)
+		return nil, fmt.Errorf("KeyGen for %s failed: %w", filename, err)
 	}
+	return privateKeyBytes, nil
+}
 
-	privateKeyBytes, err := privateKey.MarshalBinary()
+// Wraps a system key in the typed key file container & writes it
+func writeKeyFile(name string, keyType keyfile.Type, key []byte, systemID, keyID string) error {
+	data, err := encodeKeyFile(keyType, key, systemID, keyID)
 	if err != nil {
-		return fmt.Errorf("marshal AttributeKey for %s: %w", filename, err)
-	}
-
-	if err := writeKey(filename, privateKeyBytes); err != nil {
 		return err
 	}
-
-	return nil
+	if keyType == keyfile.Public {
+		return writeKey(name, data)
+	}
+	return writeSecret(name, data)
 }
 
-// Writes the key to the specified file
-func writeKey(name string, data []byte) error {
+// Wraps a system key in the typed key file container of this namespace
+func encodeKeyFile(keyType keyfile.Type, key []byte, systemID, keyID string) ([]byte, error) {
+	file := keyfile.New(keyType, key)
+	file.Namespace, file.SystemID, file.KeyID = currentNamespace, systemID, keyID
+	return file.Encode()
+}
 
-	if err := os.MkdirAll(keysDir, 0755); err != nil {
-		return fmt.Errorf("mkdir %s: %w", keysDir, err)
+// Current system ID, derived from public.key
+func currentSystemID() (string, error) {
+	publicKey, err := currentPublicKey()
+	if err != nil {
+		return "", err
 	}
+	return keyfile.SystemID(publicKey), nil
+}
 
-	path := filepath.Join(keysDir, name)
-	if err := os.WriteFile(path, data, 0644); err != nil {
-		return fmt.Errorf("write %s: %w", path, err)
+// Serialized current system public key, without its container
+func currentPublicKey() ([]byte, error) {
+	file, err := keyfile.Read(filepath.Join(keysDir, publicKeyFile), keyfile.Public)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	return file.Key, nil
+}
+
+// Writes the key to the specified file, replacing it atomically
+func writeKey(name string, data []byte) error {
+	return keystore.New(keysDir).Write(name, data, keystore.PublicPerm)
+}
+
+// Like writeKey, readable by the owner only
+func writeSecret(name string, data []byte) error {
+	return keystore.New(keysDir).Write(name, data, keystore.SecretPerm)
 }
 
 func usageAndExit(msg string) {
 	fmt.Fprintf(os.Stderr, "error: %s\n\n", msg)
-	fmt.Fprintf(os.Stderr, "usage:\n")
-	fmt.Fprintf(os.Stderr, "  authority --setup [--force]\n")
-	fmt.Fprintf(os.Stderr, "  authority --issue --out <file.key> --attrs-json '{\"role\":\"operator\",\"site\":\"rome\"}'\n")
+	fmt.Fprintf(os.Stderr, "usage (every mode accepts --namespace <name> to work on a tenant's own keys):\n")
+	fmt.Fprintf(os.Stderr, "  authority --setup [--force] [--shares <n> --threshold <k> --shares-dir <dir>] [--master-store file|sealed|keyholder [--keyholder-socket <path>]] [--passphrase-file <file>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --issue --out <file.key> --attrs-json '{\"role\":\"operator\",\"site\":\"rome\"}' [--subject <name>] [--valid-until <date> [--valid-from <date>] [--period month|week]] [--share-files <a.share,b.share>] [--armor]\n")
+	fmt.Fprintf(os.Stderr, "  authority --issue --out <file.key> --id-token <token.jwt|-> [--oidc-config <oidc.json>] [--subject <name>] [...same as above]\n")
+	fmt.Fprintf(os.Stderr, "  authority --bulk --manifest <devices.csv|devices.json> [--partial] [--index-out <index.json>] [--armor]\n")
+	fmt.Fprintf(os.Stderr, "  authority --rotate [--retire-after <duration>] [--shares <n> --threshold <k> --shares-dir <dir>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --retire\n")
+	fmt.Fprintf(os.Stderr, "  authority --revoke --subject <name> [--share-files <a.share,b.share>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --reissue [--subject <a,b>] [--attrs-json '{\"site\":\"rome\"}'] [--force] [--reissue-wait <duration>] [--broker <url>] [--share-files <a.share,b.share>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --schema-set --schema <schema.json>\n")
+	fmt.Fprintf(os.Stderr, "  authority --inspect <file.key>\n")
+	fmt.Fprintf(os.Stderr, "  authority --verify-key <file.key>\n")
+	fmt.Fprintf(os.Stderr, "  authority --verify-statement <file.key.statement.json> [--key <file.key>] [--authority-key <authority_sign.pub>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --review-access --policy '(role: operator)' | --topic <topic> [--topics <topic_policies.json>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --review-subject --subject <name> [--topics <topic_policies.json>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --trace --oracle-cmd '<decoder command>' [--topic <topic>] [--policy '(role: operator)'] [--oracle-timeout <duration>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --acl-generate [--topics <topic_policies.json>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --audit-verify\n")
+	fmt.Fprintf(os.Stderr, "  authority --audit-export [--since <date>] [--audit-out <file.jsonl>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --backup --archive <file> [--passphrase-file <file>] [--share-files <a.share,b.share>] [--force]\n")
+	fmt.Fprintf(os.Stderr, "  authority --restore --archive <file> [--dry-run] [--passphrase-file <file>] [--authority-key <authority_sign.pub>] [--share-files <a.share,b.share>] [--force]\n")
+	fmt.Fprintf(os.Stderr, "  authority --provision --role subscriber --subject <name> --bundle-out <file> [--attrs-json '{\"role\":\"operator\"}' [--out <file.key>] [--valid-until <date>]] [--topic <filter,...>] [--broker <url,...>] [--ca-file <ca.pem>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --provision --role publisher --subject <name> --bundle-out <file> [--topic <topic,...> --policy '(role: operator)'] [--topics <topic_policies.json>] [--broker <url,...>] [--ca-file <ca.pem>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --enroll-listen [--broker <url>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --enroll-list\n")
+	fmt.Fprintf(os.Stderr, "  authority --enroll-approve --request <id> --attrs-json '{\"role\":\"operator\"}' [--subject <name>] [--valid-until <date>] [--broker <url>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --escrow-set --policy '(role: auditor)' [--escrow-opt-out <topic filter,...>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --escrow-clear\n")
+	fmt.Fprintf(os.Stderr, "  authority --escrow-decrypt --key <escrow.key> --envelope <envelope.json|-> --topic <topic> --reason <text>\n")
+	fmt.Fprintf(os.Stderr, "  authority --delegate --delegate-name <site> --delegate-key <base64 Ed25519 key> --scope-json '{\"site\":[\"rome\"],\"role\":[\"operator\",\"guest\"]}' --valid-until <date>\n")
+	fmt.Fprintf(os.Stderr, "  authority --delegation-serve [--broker <url>] [--share-files <a.share,b.share>]\n")
+	fmt.Fprintf(os.Stderr, "  authority --delegation-list\n")
+	fmt.Fprintf(os.Stderr, "  authority --delegation-revoke --credential <id>\n")
+	fmt.Fprintf(os.Stderr, "  authority --enroll-reject --request <id> [--broker <url>]\n")
 	os.Exit(2)
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"securemqtt/internal/masterkey"
+)
+
+const (
+	masterStoreFile     = "master_store.json"
+	masterStoreDocument = "master-store"
+	sealedMasterKeyFile = "master.key.sealed"
+
+	// Master key backends, chosen at setup with --master-store
+	masterBackendFile      = "file"
+	masterBackendSealed    = "sealed"
+	masterBackendKeyholder = "keyholder"
+	defaultKeyholderSocket = "/run/keyholder/keyholder.sock"
+)
+
+// File with the passphrase of a sealed master key (or of a backup archive), stdin if empty
+var passphraseFile string
+
+// Where the master key of the current system is kept. Signed, so nobody with write access to
+// /keys alone can point issuance at another key holder.
+type masterStoreConfig struct {
+	Backend string `json:"backend"`
+	Socket  string `json:"socket,omitempty"`
+}
+
+// Loads the master key backend, the file backend for systems set up before backends existed
+func loadMasterStoreConfig() (*masterStoreConfig, error) {
+	config := &masterStoreConfig{}
+	found, err := readSigned(masterStoreFile, masterStoreDocument, config)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		config.Backend = masterBackendFile
+	}
+	return config, nil
+}
+
+// Master key backend for a --master-store choice
+func newMasterStoreConfig(backend, socket string) (*masterStoreConfig, error) {
+	switch backend {
+	case masterBackendFile, masterBackendSealed:
+		return &masterStoreConfig{Backend: backend}, nil
+	case masterBackendKeyholder:
+		if socket == "" {
+			socket = defaultKeyholderSocket
+		}
+		return &masterStoreConfig{Backend: backend, Socket: socket}, nil
+	default:
+		return nil, fmt.Errorf("unknown master key store %q, expected file, sealed or keyholder", backend)
+	}
+}
+
+// Store of the configured backend. Replace lets a key holder destroy the master key it holds,
+// set for --setup --force & --rotate only.
+func (strct *masterStoreConfig) store(replace bool) masterkey.IMasterKeyStore {
+	return strct.storeAt(filepath.Join(keysDir, strct.file()), replace)
+}
+
+// Like store, file & sealed keys are kept at path instead of their place under /keys
+func (strct *masterStoreConfig) storeAt(path string, replace bool) masterkey.IMasterKeyStore {
+	switch strct.Backend {
+	case masterBackendSealed:
+		return &masterkey.SealedStore{
+			Path:      path,
+			Namespace: currentNamespace,
+			Passphrase: func(confirm bool) ([]byte, error) {
+				return readPassphrase(passphraseFile, "master key", confirm)
+			},
+		}
+	case masterBackendKeyholder:
+		store := &masterkey.SocketStore{Path: strct.Socket, Namespace: currentNamespace, Replace: replace}
+		if replace {
+			// The key holder only replaces the master key of the system public.key belongs to,
+			// any when there is no public.key yet
+			store.SystemID, _ = currentSystemID()
+		}
+		return store
+	default:
+		return &masterkey.FileStore{Path: path, Namespace: currentNamespace}
+	}
+}
+
+// Where the master key is, for messages
+func (strct *masterStoreConfig) describe() string {
+	switch strct.Backend {
+	case masterBackendSealed:
+		return "the master key is sealed in " + filepath.Join(keysDir, sealedMasterKeyFile)
+	case masterBackendKeyholder:
+		return "the master key stays with the key holder at " + strct.Socket
+	default:
+		return "the master key is in " + filepath.Join(keysDir, masterKeyFile)
+	}
+}
+
+// Custodian shares split a master key the authority generates itself, only the file backend does
+func (strct *masterStoreConfig) allowsShares(shares int) error {
+	if shares > 0 && strct.Backend != masterBackendFile {
+		return fmt.Errorf("--shares cannot be used with the %s master key store", strct.Backend)
+	}
+	return nil
+}
+
+// File the backend keeps under /keys, "" for the key holder
+func (strct *masterStoreConfig) file() string {
+	switch strct.Backend {
+	case masterBackendSealed:
+		return sealedMasterKeyFile
+	case masterBackendKeyholder:
+		return ""
+	default:
+		return masterKeyFile
+	}
+}
+
+// Reports whether the configured backend (or custodian shares) holds a master key
+func (strct *masterStoreConfig) exists() bool {
+	if fileExists(filepath.Join(keysDir, sharesMetaFile)) {
+		return true
+	}
+	if strct.Backend == masterBackendKeyholder {
+		return true
+	}
+	return fileExists(filepath.Join(keysDir, strct.file()))
+}
+
+// Opens the master key for issuance: reconstructed from custodian shares if it was split,
+// otherwise from the configured backend. Rejects a master key of another system.
+func loadMasterKey(shareFiles []string) (masterkey.IMasterKey, error) {
+	meta, err := loadSharesMeta()
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		masterSecretKey, err := reconstructMasterSecretKey(meta, shareFiles)
+		if err != nil {
+			return nil, err
+		}
+		return masterkey.FromKey(masterSecretKey, ""), nil
+	}
+
+	config, err := loadMasterStoreConfig()
+	if err != nil {
+		return nil, err
+	}
+	master, err := config.store(false).Open()
+	if err != nil {
+		return nil, err
+	}
+	if master.SystemID() == "" {
+		return master, nil
+	}
+	systemID, err := currentSystemID()
+	if err != nil {
+		return nil, err
+	}
+	if master.SystemID() != systemID {
+		return nil, fmt.Errorf("%s master key belongs to system %s, public.key to %s", config.Backend, master.SystemID(), systemID)
+	}
+	return master, nil
+}
+
+// Removes master key files no backend uses anymore, except keep
+func removeMasterKeyFiles(keep string) error {
+	for _, name := range []string{masterKeyFile, sealedMasterKeyFile, sharesMetaFile} {
+		if name == keep {
+			continue
+		}
+		if err := os.Remove(filepath.Join(keysDir, name)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove old %s: %w", name, err)
+		}
+	}
+	return nil
+}
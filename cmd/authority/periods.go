@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+)
+
+const periodConfigFile = "periods.json"
+
+// Suffix of the public sidecar describing a time-bound key's validity window, e.g. sub1.key.validity.json
+const validitySuffix = ".validity.json"
+
+// Loads the signed period configuration, nil while no time-bound key was ever issued
+func loadPeriodConfig() (*accesspolicy.PeriodConfig, error) {
+	var config accesspolicy.PeriodConfig
+	found, err := readSigned(periodConfigFile, accesspolicy.PeriodConfigDocument, &config)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Works out the validity window of a key from the issue flags, nil for a permanent key.
+// Once time-bound keys are in use publishers AND the current period into all policies;
+// permanent keys keep reading through their permanent period attribute.
+func resolveValidity(period, validFrom, validUntil string) (*accesspolicy.Validity, error) {
+	config, err := loadPeriodConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	if validUntil == "" {
+		return nil, nil
+	}
+	if config == nil {
+		if err := checkPermanentKeys(); err != nil {
+			return nil, err
+		}
+	}
+
+	granularity := accesspolicy.Month
+	if config != nil {
+		granularity = config.Granularity
+	}
+	if period != "" {
+		if granularity, err = accesspolicy.ParseGranularity(period); err != nil {
+			return nil, err
+		}
+	}
+	if config != nil && config.Granularity != granularity {
+		return nil, fmt.Errorf("system uses %s periods, cannot issue %s periods", config.Granularity, granularity)
+	}
+
+	from := time.Now().UTC()
+	if validFrom != "" {
+		if from, err = parseDate(validFrom); err != nil {
+			return nil, fmt.Errorf("--valid-from: %w", err)
+		}
+	}
+	until, err := parseDate(validUntil)
+	if err != nil {
+		return nil, fmt.Errorf("--valid-until: %w", err)
+	}
+
+	return accesspolicy.NewValidity(granularity, from, until)
+}
+
+// Permanent keys issued before the permanent period attribute existed would stop matching
+// once the first time-bound key enables period clauses, they must be re-issued first
+func checkPermanentKeys() error {
+	reg, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+	keyID, err := currentEpochKeyID()
+	if err != nil {
+		return err
+	}
+	var legacy []string
+	for _, entry := range reg.Active() {
+		if lacksPermanentPeriod(entry) && entry.KeyID == keyID {
+			legacy = append(legacy, entry.Subject)
+		}
+	}
+	if len(legacy) > 0 {
+		return fmt.Errorf("permanent key(s) of %s would lose access once time-bound keys are enabled, --reissue them first", strings.Join(legacy, ", "))
+	}
+	return nil
+}
+
+// Reports whether a permanent key was issued before the permanent period attribute existed
+func lacksPermanentPeriod(entry *registryEntry) bool {
+	return entry.Validity == nil && !entry.Permanent
+}
+
+// Announces the period granularity after the first time-bound key was issued,
+// so publishers start adding period clauses
+func announcePeriods(validity *accesspolicy.Validity) error {
+	if validity == nil {
+		return nil
+	}
+	config, err := loadPeriodConfig()
+	if err != nil || config != nil {
+		return err
+	}
+	return writeSigned(periodConfigFile, accesspolicy.PeriodConfigDocument, accesspolicy.PeriodConfig{Granularity: validity.Granularity})
+}
+
+// Accepts a plain date (2026-12-31, end of that day) or an RFC 3339 timestamp
+func parseDate(raw string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", raw); err == nil {
+		return t.Add(24*time.Hour - time.Nanosecond), nil
+	}
+	return time.Parse(time.RFC3339, raw)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/audit"
+	"securemqtt/internal/brokeracl"
+	"securemqtt/internal/escrow"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/keystore"
+	"securemqtt/internal/masterkey"
+	"securemqtt/internal/provisioning"
+	"securemqtt/internal/statement"
+)
+
+// Suffix of bundles kept in the keys directory
+const bundleSuffix = ".bundle.json"
+
+// Signed documents publishers apply, copied into publisher bundles as they are
+var publisherDocuments = []string{versionTableFile, schemaFile, escrow.File, periodConfigFile}
+
+// What --provision packages for one device
+type provisionOptions struct {
+	Role       string
+	Subject    string
+	Brokers    []string
+	CAFile     string
+	Topics     []string
+	Policy     string
+	TopicsPath string
+}
+
+// Issues the key a subscriber bundle carries, as --issue would, & records it in the registry
+func issueProvisionedKey(masterKey masterkey.IMasterKey, subject string, attrs map[string]string,
+	validity *accesspolicy.Validity, filename string) error {
+
+	reg, err := loadRegistry()
+	if err != nil {
+		return err
+	}
+	versions, err := loadVersionTable()
+	if err != nil {
+		return err
+	}
+	if err := issueSubjectKey(masterKey, reg, versions, subject, attrs, validity, filename); err != nil {
+		return err
+	}
+	if err := saveRegistry(reg); err != nil {
+		return fmt.Errorf("issued key written, but failed to record it in the registry: %w", err)
+	}
+	if err := announcePeriods(validity); err != nil {
+		return fmt.Errorf("issued key written, but failed to publish the period configuration: %w", err)
+	}
+	return recordKeyEvents("issue", []string{subject}, map[string]string{"provision": provisioning.RoleSubscriber})
+}
+
+// Builds & signs the bundle of a device, writes it to out & records it in the audit log.
+// Subscriber bundles carry the subject's current key file; it must belong to the current epoch.
+func provisionDevice(options provisionOptions, out string) (*provisioning.Bundle, error) {
+	if err := checkBundlePath(out); err != nil {
+		return nil, err
+	}
+	public, err := keyfile.Read(filepath.Join(keysDir, publicKeyFile), keyfile.Public)
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := currentEpochKeyID()
+	if err != nil {
+		return nil, err
+	}
+
+	bundle := &provisioning.Bundle{
+		Version:   provisioning.Version,
+		Role:      options.Role,
+		Subject:   options.Subject,
+		Namespace: currentNamespace,
+		SystemID:  keyfile.SystemID(public.Key),
+		KeyID:     keyID,
+		PublicKey: public.Key,
+		Broker:    provisioning.Broker{URLs: options.Brokers, ClientID: options.Subject},
+		CreatedAt: time.Now().UTC(),
+	}
+	if options.CAFile != "" {
+		if bundle.Broker.CACert, err = os.ReadFile(options.CAFile); err != nil {
+			return nil, fmt.Errorf("read CA certificate: %w", err)
+		}
+	}
+
+	var entry *registryEntry
+	if options.Role == provisioning.RoleSubscriber {
+		if entry, err = subscriberKey(bundle); err != nil {
+			return nil, err
+		}
+		defer clear(bundle.AttributeKey)
+	} else if err := publisherDocumentsInto(bundle); err != nil {
+		return nil, err
+	}
+	if bundle.Topics, err = provisionTopics(options, entry); err != nil {
+		return nil, err
+	}
+
+	signingKey, err := loadOrCreateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	data, err := provisioning.Sign(signingKey, bundle)
+	if err != nil {
+		return nil, err
+	}
+	if err := keystore.WriteFile(out, data, keystore.SecretPerm); err != nil {
+		return nil, err
+	}
+
+	details := map[string]string{"role": options.Role, "bundle": out}
+	if entry != nil {
+		return bundle, recordAudit(keyEvent("provision", entry, details))
+	}
+	return bundle, recordAudit(audit.Event{Operation: "provision", Subject: options.Subject, KeyID: keyID, Details: details})
+}
+
+// Adds the subject's active key of the current epoch, its statement & validity to bundle
+func subscriberKey(bundle *provisioning.Bundle) (*registryEntry, error) {
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	entry := reg.Find(bundle.Subject)
+	switch {
+	case entry == nil:
+		return nil, fmt.Errorf("no key was issued to %q, pass --attrs-json to issue one", bundle.Subject)
+	case entry.Revoked:
+		return nil, fmt.Errorf("the key of %s is revoked", bundle.Subject)
+	case entry.Validity != nil && time.Now().After(entry.Validity.NotAfter):
+		return nil, fmt.Errorf("the key of %s expired on %s", bundle.Subject, entry.Validity.NotAfter.Format(time.RFC3339))
+	case entry.KeyFile == "":
+		return nil, fmt.Errorf("the key of %s was delivered to an enrolled device, it has no key file to bundle", bundle.Subject)
+	case entry.KeyID != bundle.KeyID:
+		return nil, fmt.Errorf("the key of %s belongs to epoch %s, re-issue it for epoch %s first", bundle.Subject, orNone(entry.KeyID), orNone(bundle.KeyID))
+	}
+
+	file, err := keyfile.Read(filepath.Join(keysDir, entry.KeyFile), keyfile.Attribute)
+	if err != nil {
+		return nil, err
+	}
+	if file.Fingerprint != entry.Fingerprint {
+		return nil, fmt.Errorf("%s is not the key the registry records for %s", entry.KeyFile, bundle.Subject)
+	}
+	statementData, err := os.ReadFile(filepath.Join(keysDir, entry.KeyFile+statement.FileSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("read attribute statement: %w", err)
+	}
+	bundle.AttributeKey, bundle.Statement, bundle.Validity = file.Key, statementData, entry.Validity
+	return entry, nil
+}
+
+// Copies the signed documents publishers apply, as far as the authority has published them
+func publisherDocumentsInto(bundle *provisioning.Bundle) error {
+	for _, name := range publisherDocuments {
+		data, err := os.ReadFile(filepath.Join(keysDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("read %s: %w", name, err)
+		}
+		if bundle.Documents == nil {
+			bundle.Documents = make(map[string][]byte)
+		}
+		bundle.Documents[name] = data
+	}
+	return nil
+}
+
+// Topics of the bundle: the ones given, otherwise from the topic policies. Publishers get the
+// topics they are listed as publisher of, subscribers the topics their key can read now.
+func provisionTopics(options provisionOptions, entry *registryEntry) ([]provisioning.Topic, error) {
+	var topics []provisioning.Topic
+	if len(options.Topics) > 0 {
+		for _, topic := range options.Topics {
+			topics = append(topics, provisioning.Topic{Topic: topic, Policy: options.Policy})
+		}
+		return topics, nil
+	}
+
+	if options.Role == provisioning.RoleSubscriber {
+		_, access, err := reviewSubject(entry.Subject, options.TopicsPath, time.Now().UTC())
+		if err != nil {
+			return nil, err
+		}
+		for _, readable := range access {
+			topics = append(topics, provisioning.Topic{Topic: readable.Topic})
+		}
+		if len(topics) == 0 {
+			return nil, fmt.Errorf("the key of %s can read no configured topic, pass --topic", entry.Subject)
+		}
+		return topics, nil
+	}
+
+	config, path, err := loadTopicPolicies(options.TopicsPath)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, fmt.Errorf("no topic policies configured in %s, pass --topic and --policy", path)
+	}
+	for _, entry := range config.Topics {
+		publishers := entry.Publishers
+		if len(publishers) == 0 {
+			publishers = []string{brokeracl.DefaultPublisher}
+		}
+		if entry.Publishable() && slices.Contains(publishers, options.Subject) {
+			topics = append(topics, provisioning.Topic{Topic: entry.Topic, Policy: entry.Policy})
+		}
+	}
+	if len(topics) == 0 {
+		return nil, fmt.Errorf("%s lists no topic %s publishes to, pass --topic and --policy", path, options.Subject)
+	}
+	return topics, nil
+}
+
+// Bundles hold secrets & are written anywhere. In the keys directory itself only under a name
+// ending in .bundle.json, so no key or system file is overwritten.
+func checkBundlePath(out string) error {
+	abs, err := filepath.Abs(out)
+	if err != nil {
+		return err
+	}
+	keys, err := filepath.Abs(keysDir)
+	if err != nil {
+		return err
+	}
+	if filepath.Dir(abs) == keys && !strings.HasSuffix(abs, bundleSuffix) {
+		return fmt.Errorf("bundles written to %s must be named <name>%s", keysDir, bundleSuffix)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+)
+
+const registryFile = "registry.json"
+
+// One issued subscriber key. Attributes are the logical values, without versions.
+// Keys delivered through enrollment have no KeyFile, DeviceID names the device instead &
+// Identity the fingerprint of its identity key, which later re-issues are delivered to.
+// TraceID is the key's hidden tracing attribute, kept out of Attributes. Permanent marks keys
+// without validity that carry the permanent period attribute, keys issued before it existed lack it.
+type registryEntry struct {
+	Subject     string                 `json:"subject"`
+	KeyFile     string                 `json:"key_file,omitempty"`
+	DeviceID    string                 `json:"device_id,omitempty"`
+	Identity    string                 `json:"identity,omitempty"`
+	Attributes  map[string]string      `json:"attributes"`
+	KeyID       string                 `json:"key_id,omitempty"`
+	Validity    *accesspolicy.Validity `json:"validity,omitempty"`
+	Permanent   bool                   `json:"permanent,omitempty"`
+	Fingerprint string                 `json:"fingerprint,omitempty"`
+	TraceID     string                 `json:"trace_id,omitempty"`
+	Delegate    string                 `json:"delegate,omitempty"`
+	IssuedAt    time.Time              `json:"issued_at"`
+	Revoked     bool                   `json:"revoked,omitempty"`
+	RevokedAt   *time.Time             `json:"revoked_at,omitempty"`
+}
+
+// Every key the authority has issued, one entry per subject
+type registry struct {
+	Entries []registryEntry `json:"entries"`
+}
+
+func loadRegistry() (*registry, error) {
+	path := filepath.Join(keysDir, registryFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &registry{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	var reg registry
+	if err := json.Unmarshal(data, &reg); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &reg, nil
+}
+
+func saveRegistry(reg *registry) error {
+	data, err := json.MarshalIndent(reg, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal registry: %w", err)
+	}
+	return writeKey(registryFile, data)
+}
+
+// Find returns the entry for subject, nil if it was never issued
+func (strct *registry) Find(subject string) *registryEntry {
+	for i := range strct.Entries {
+		if strct.Entries[i].Subject == subject {
+			return &strct.Entries[i]
+		}
+	}
+	return nil
+}
+
+// Put records an issuance, replacing any previous entry for the same subject.
+// Issuers call checkReplace first, so an active key is only ever replaced by one revoking it would cover.
+func (strct *registry) Put(entry registryEntry) {
+	if existing := strct.Find(entry.Subject); existing != nil {
+		*existing = entry
+		return
+	}
+	strct.Entries = append(strct.Entries, entry)
+}
+
+// Refuses to issue subject a key with other attributes or another key file while it holds an
+// active key: the old key would stay valid & revoking the subject would only bump the new values.
+// attrs carry the subject identifier, see subjectAttributes.
+func (strct *registry) checkReplace(subject, keyFile string, attrs map[string]string) error {
+	existing := strct.Find(subject)
+	if existing == nil || existing.Revoked {
+		return nil
+	}
+	if existing.KeyFile != keyFile || !maps.Equal(existing.Attributes, attrs) {
+		return fmt.Errorf("subject %q holds an active key with other attributes or another key file, revoke it first", subject)
+	}
+	return nil
+}
+
+// Active returns entries that have not been revoked
+func (strct *registry) Active() []*registryEntry {
+	var active []*registryEntry
+	for i := range strct.Entries {
+		if !strct.Entries[i].Revoked {
+			active = append(active, &strct.Entries[i])
+		}
+	}
+	return active
+}
+
+// Reports whether a subject other than subject holds, or ever held, subjectID
+func (strct *registry) subjectIDUsed(subject, subjectID string) bool {
+	for _, entry := range strct.Entries {
+		if entry.Subject != subject && entry.Attributes[accesspolicy.SubjectAttribute] == subjectID {
+			return true
+		}
+	}
+	return false
+}
+
+// Default subject for a key file: its name without extension, e.g. sub1.key -> sub1
+func subjectFromFile(filename string) string {
+	return strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+}
+
+// Key ID of the current epoch, "" for systems without epochs
+func currentEpochKeyID() (string, error) {
+	index, err := loadEpochIndex()
+	if err != nil || index == nil {
+		return "", err
+	}
+	current, err := index.CurrentEpoch()
+	if err != nil {
+		return "", err
+	}
+	return current.KeyID, nil
+}
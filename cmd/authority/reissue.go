@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"securemqtt/internal"
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/clientmqtt"
+	"securemqtt/internal/enrollment"
+	"securemqtt/internal/masterkey"
+)
+
+// Which active registry entries --reissue covers. Empty Subjects & Attrs select every subject.
+type reissueFilter struct {
+	Subjects []string
+	Attrs    map[string]string
+
+	// Also re-issue subjects that already hold a key of the current epoch
+	Force bool
+}
+
+// Outcome for one subject: reissued, delivered, waiting, skipped or failed
+type reissueResult struct {
+	Subject string
+	Status  string
+	Detail  string
+}
+
+// Re-issues the selected subjects' keys under the current system keys, with the attributes &
+// validity the registry recorded. Key files are written in place; enrolled devices get a signed,
+// retained re-issue notice & their new key once they request it, for up to wait. Subjects issued
+// by a delegate are left to the site. Every subject gets a result, failures do not stop the run.
+// Keys of the current epoch are skipped unless forced or lacking the permanent period attribute.
+func reissueKeys(masterKey masterkey.IMasterKey, filter reissueFilter, brokerURL string, wait time.Duration) ([]reissueResult, error) {
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	versions, err := loadVersionTable()
+	if err != nil {
+		return nil, err
+	}
+	epochStart, keyID, err := currentEpochStart()
+	if err != nil {
+		return nil, err
+	}
+	for _, subject := range filter.Subjects {
+		if entry := reg.Find(subject); entry == nil || entry.Revoked {
+			return nil, fmt.Errorf("%s has no active key in the registry", subject)
+		}
+	}
+
+	var selected []registryEntry
+	for _, entry := range reg.Active() {
+		if filter.matches(entry) {
+			selected = append(selected, *entry)
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Subject < selected[j].Subject })
+
+	now := time.Now().UTC()
+	results := make([]reissueResult, 0, len(selected))
+	enrolled := make(map[string]registryEntry)
+	for i, entry := range selected {
+		result := reissueResult{Subject: entry.Subject}
+		switch {
+		case !filter.Force && entry.KeyID == keyID && !entry.IssuedAt.Before(epochStart) && !lacksPermanentPeriod(&entry):
+			result.Status, result.Detail = "skipped", "already holds a key of the current epoch"
+		case entry.Validity != nil && !now.Before(entry.Validity.NotAfter):
+			result.Status, result.Detail = "failed", "validity ended "+entry.Validity.NotAfter.Format(time.RFC3339)
+		case entry.KeyFile != "":
+			if err := reissueKeyFile(masterKey, reg, versions, &entry, keyID); err != nil {
+				result.Status, result.Detail = "failed", err.Error()
+			} else {
+				result.Status, result.Detail = "reissued", "wrote "+entry.KeyFile
+			}
+		case entry.DeviceID != "":
+			enrolled[entry.DeviceID] = entry
+			continue
+		case entry.Delegate != "":
+			result.Status, result.Detail = "skipped", "issued by delegate "+entry.Delegate+", the site re-issues it"
+		default:
+			result.Status, result.Detail = "failed", "no key file or device to deliver to"
+		}
+		log.Printf("[%d/%d] %s: %s %s", i+1, len(selected), result.Subject, result.Status, result.Detail)
+		results = append(results, result)
+	}
+
+	if len(enrolled) > 0 {
+		log.Printf("Asking %d enrolled device(s) to request their new key, waiting up to %s", len(enrolled), wait)
+		delivered, err := reissueEnrolled(masterKey, enrolled, brokerURL, keyID, wait)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, delivered...)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Subject < results[j].Subject })
+	return results, nil
+}
+
+// Reports whether an active entry is selected: listed by subject (if any are) & holding every filter attribute
+func (strct *reissueFilter) matches(entry *registryEntry) bool {
+	if len(strct.Subjects) > 0 && !slices.Contains(strct.Subjects, entry.Subject) {
+		return false
+	}
+	for name, value := range strct.Attrs {
+		held := accesspolicy.Values(entry.Attributes[name])
+		for _, want := range accesspolicy.Values(value) {
+			if !slices.Contains(held, want) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Start & key ID of the current epoch; the zero time & "" for systems without epochs
+func currentEpochStart() (time.Time, string, error) {
+	index, err := loadEpochIndex()
+	if err != nil || index == nil {
+		return time.Time{}, "", err
+	}
+	current, err := index.CurrentEpoch()
+	if err != nil {
+		return time.Time{}, "", err
+	}
+	return current.CreatedAt, current.KeyID, nil
+}
+
+// Writes a new key file for one subject & saves the registry right away, so an interrupted
+// run resumes where it stopped
+func reissueKeyFile(masterKey masterkey.IMasterKey, reg *registry, versions *accesspolicy.VersionTable,
+	entry *registryEntry, keyID string) error {
+
+	key, err := prepareSubjectKey(masterKey, reg, versions, entry.Subject, entry.Attributes, entry.Validity, entry.KeyFile)
+	if err != nil {
+		return err
+	}
+	defer clear(key.keyBytes)
+	key.entry.Delegate = entry.Delegate
+	if err := commitKeys(reg, []*pendingKey{key}); err != nil {
+		return err
+	}
+	if err := saveRegistry(reg); err != nil {
+		return err
+	}
+	return recordAudit(keyEvent("reissue", &key.entry, map[string]string{"epoch": orNone(keyID)}))
+}
+
+// Publishes a re-issue notice to each enrolled device & delivers a new key for every request
+// that comes from the device's recorded identity. Devices without a recorded identity are
+// queued for --enroll-approve instead; notices of devices that did not ask in time stay retained.
+func reissueEnrolled(masterKey masterkey.IMasterKey, enrolled map[string]registryEntry, brokerURL, keyID string,
+	wait time.Duration) ([]reissueResult, error) {
+
+	signingKey, err := loadOrCreateSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	client, err := clientmqtt.NewMQTT(brokerURL, "authority-reissue")
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", brokerURL, err)
+	}
+
+	var mu sync.Mutex
+	results := make(map[string]reissueResult)
+	done := make(chan struct{})
+	finish := func(deviceID string, result reissueResult) {
+		results[deviceID] = result
+		log.Printf("[%d/%d] %s: %s %s", len(results), len(enrolled), result.Subject, result.Status, result.Detail)
+		if len(results) == len(enrolled) {
+			close(done)
+		}
+	}
+
+	// Subscribing first also picks up requests devices left retained after an earlier notice
+	if err := client.Subscribe(enrollment.RequestTopicFilter, 1, func(msg internal.Message) {
+		if len(msg.Envelope) == 0 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+
+		request, id, err := enrollment.VerifyRequest(msg.Envelope)
+		if err != nil || msg.Topic != enrollment.RequestTopic(request.DeviceID) {
+			return
+		}
+		entry, ok := enrolled[request.DeviceID]
+		if _, answered := results[request.DeviceID]; !ok || answered {
+			return
+		}
+		// Leftovers from before the key being replaced was issued cannot be what the notice asked for
+		if request.CreatedAt.Before(entry.IssuedAt) {
+			return
+		}
+		result := reissueResult{Subject: entry.Subject}
+		if entry.Identity == "" || entry.Identity != request.IdentityFingerprint() {
+			if _, err := queueEnrollment(msg); err != nil {
+				log.Printf("Failed to queue request %s: %v", id, err)
+			}
+			result.Status = "waiting"
+			result.Detail = fmt.Sprintf("request %s from identity %s does not match the recorded identity, approve it with --enroll-approve",
+				id, request.IdentityFingerprint())
+			finish(request.DeviceID, result)
+			return
+		}
+
+		newEntry, err := deliverEnrolledKey(masterKey, client, &enrollmentRequest{ID: id, Request: request, ReceivedAt: time.Now().UTC()},
+			entry.Subject, entry.Attributes, entry.Validity)
+		if err == nil {
+			err = recordAudit(keyEvent("reissue", newEntry, map[string]string{"epoch": orNone(keyID), "request": id}))
+		}
+		if err == nil {
+			err = client.Publish(enrollment.ReissueTopic(request.DeviceID), 1, true, nil)
+		}
+		if err != nil {
+			result.Status, result.Detail = "failed", err.Error()
+		} else {
+			result.Status, result.Detail = "delivered", "to device "+request.DeviceID
+		}
+		finish(request.DeviceID, result)
+	}); err != nil {
+		return nil, fmt.Errorf("subscribe %s: %w", enrollment.RequestTopicFilter, err)
+	}
+
+	for deviceID, entry := range enrolled {
+		notice, err := enrollment.SignNotice(enrollment.Notice{
+			DeviceID: deviceID,
+			KeyID:    keyID,
+			Replaces: entry.Fingerprint,
+			IssuedAt: time.Now().UTC(),
+		}, signingKey)
+		if err == nil {
+			err = client.Publish(enrollment.ReissueTopic(deviceID), 1, true, notice)
+		}
+		if err != nil {
+			mu.Lock()
+			finish(deviceID, reissueResult{Subject: entry.Subject, Status: "failed", Detail: "publish notice: " + err.Error()})
+			mu.Unlock()
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(wait):
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	out := make([]reissueResult, 0, len(enrolled))
+	for deviceID, entry := range enrolled {
+		result, ok := results[deviceID]
+		if !ok {
+			result = reissueResult{Subject: entry.Subject, Status: "waiting",
+				Detail: "device " + deviceID + " did not request its key in time, the notice stays retained; run --reissue again"}
+			// Later requests are answered by the next run, not by this handler
+			results[deviceID] = result
+		}
+		out = append(out, result)
+	}
+	return out, nil
+}
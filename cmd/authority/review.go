@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/accessreview"
+)
+
+// One policy a subject's key satisfies, with the configured topic it protects if any
+type subjectAccess struct {
+	Topic  string
+	Policy string
+}
+
+// Loads the topic policies, from /keys/topic_policies.json unless path is set
+func loadTopicPolicies(path string) (*accessreview.TopicPolicies, string, error) {
+	if path == "" {
+		path = filepath.Join(keysDir, accessreview.TopicPoliciesFile)
+	}
+	config, err := accessreview.LoadTopicPolicies(path)
+	return config, path, err
+}
+
+// Resolves what to review: the policy itself, or the one configured for topic
+func reviewPolicy(rawPolicy, topic, topicsPath string) (string, error) {
+	if rawPolicy != "" {
+		return rawPolicy, nil
+	}
+	config, path, err := loadTopicPolicies(topicsPath)
+	if err != nil {
+		return "", err
+	}
+	if config == nil {
+		return "", fmt.Errorf("no topic policies configured in %s", path)
+	}
+	entry, ok := config.PolicyFor(topic)
+	if !ok {
+		return "", fmt.Errorf("no policy configured for topic %s in %s", topic, path)
+	}
+	return entry.Policy, nil
+}
+
+// Lists every non-revoked, currently valid key of the current epoch that can read messages published under policy
+func reviewAccess(rawPolicy string, now time.Time) ([]accessreview.Holder, error) {
+	node, err := accesspolicy.Parse(rawPolicy)
+	if err != nil {
+		return nil, err
+	}
+	holders, err := accessreview.LoadHolders(filepath.Join(keysDir, registryFile))
+	if err != nil {
+		return nil, err
+	}
+	keyID, err := currentEpochKeyID()
+	if err != nil {
+		return nil, err
+	}
+	return accessreview.Readers(node, holders, keyID, now), nil
+}
+
+// Lists every configured topic policy the subject's key satisfies
+func reviewSubject(subject, topicsPath string, now time.Time) (*accessreview.Holder, []subjectAccess, error) {
+	holders, err := accessreview.LoadHolders(filepath.Join(keysDir, registryFile))
+	if err != nil {
+		return nil, nil, err
+	}
+	var holder *accessreview.Holder
+	for i := range holders {
+		if holders[i].Subject == subject {
+			holder = &holders[i]
+		}
+	}
+	if holder == nil {
+		return nil, nil, fmt.Errorf("no key was issued to %q", subject)
+	}
+
+	config, path, err := loadTopicPolicies(topicsPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if config == nil {
+		return nil, nil, fmt.Errorf("no topic policies configured in %s", path)
+	}
+
+	keyID, err := currentEpochKeyID()
+	if err != nil {
+		return nil, nil, err
+	}
+	var access []subjectAccess
+	for _, entry := range config.Topics {
+		if holder.CanRead(entry.Node(), keyID, now) {
+			access = append(access, subjectAccess{Topic: entry.Topic, Policy: entry.Policy})
+		}
+	}
+	return holder, access, nil
+}
+
+// Describes where a key lives, its file or the enrolled device
+func holderLocation(holder *accessreview.Holder) string {
+	if holder.KeyFile == "" {
+		return "device=" + holder.DeviceID
+	}
+	return "key_file=" + holder.KeyFile
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/masterkey"
+	"securemqtt/internal/statement"
+)
+
+const versionTableFile = "attribute_versions.json"
+
+// Loads the signed attribute version table, empty if nothing was ever revoked
+func loadVersionTable() (*accesspolicy.VersionTable, error) {
+	table := &accesspolicy.VersionTable{}
+	if _, err := readSigned(versionTableFile, accesspolicy.VersionTableDocument, table); err != nil {
+		return nil, err
+	}
+	return table, nil
+}
+
+// Revokes a single subscriber key.
+// Every attribute value the subject holds moves to a new version, all other current-epoch
+// holders of those values get a re-issued key, and the new version table is signed so
+// publishers rewrite their policies and the revoked key stops matching.
+// Holders enrolled over MQTT have no key file to replace, they are returned separately
+// and must enroll again.
+func revokeSubject(masterKey masterkey.IMasterKey, subject string) ([]string, []string, error) {
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, nil, err
+	}
+	revoked := reg.Find(subject)
+	if revoked == nil {
+		return nil, nil, fmt.Errorf("unknown subject %q", subject)
+	}
+	if revoked.Revoked {
+		return nil, nil, fmt.Errorf("subject %q is already revoked", subject)
+	}
+
+	versions, err := loadVersionTable()
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, value := range revoked.Attributes {
+		for _, v := range accesspolicy.Values(value) {
+			versions.Bump(name, v)
+		}
+	}
+
+	now := time.Now().UTC()
+	revoked.Revoked = true
+	revoked.RevokedAt = &now
+
+	keyID, err := currentEpochKeyID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Re-issue keys to everyone else sharing a bumped attribute value
+	var pending []*pendingKey
+	var reissued, reenroll []string
+	for _, holder := range reg.Active() {
+		if !sharesAttribute(holder.Attributes, revoked.Attributes) {
+			continue
+		}
+		if holder.KeyID != keyID {
+			// Master keys of archived epochs are gone, those keys simply age out with their epoch
+			continue
+		}
+		if holder.KeyFile == "" {
+			reenroll = append(reenroll, holder.Subject)
+			continue
+		}
+		key, err := prepareSubjectKey(masterKey, reg, versions, holder.Subject, holder.Attributes, holder.Validity, holder.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("re-issue %s: %w", holder.Subject, err)
+		}
+		pending = append(pending, key)
+		reissued = append(reissued, holder.Subject)
+	}
+
+	// Re-issued keys, the version table & the registry change together: if any of them cannot
+	// be written, all files are restored and the subject is not revoked
+	tx := newFileTransaction()
+	if err := revokeFiles(tx, reg, versions, revoked, pending); err != nil {
+		tx.rollback()
+		return nil, nil, err
+	}
+	return reissued, reenroll, nil
+}
+
+// Writes the re-issued keys, removes the revoked key's files & saves the version table and
+// the registry, all through tx
+func revokeFiles(tx *fileTransaction, reg *registry, versions *accesspolicy.VersionTable,
+	revoked *registryEntry, pending []*pendingKey) error {
+
+	if err := writePendingKeys(tx, pending); err != nil {
+		return err
+	}
+	// The leaked key file & its statement must not keep sitting on the shared volume
+	if revoked.KeyFile != "" {
+		for _, name := range []string{revoked.KeyFile, revoked.KeyFile + statement.FileSuffix} {
+			if err := tx.remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	if err := registerKeys(reg, pending); err != nil {
+		return err
+	}
+	if err := tx.replace(versionTableFile, func() error {
+		return writeSigned(versionTableFile, accesspolicy.VersionTableDocument, versions)
+	}); err != nil {
+		return err
+	}
+	return tx.replace(registryFile, func() error {
+		return saveRegistry(reg)
+	})
+}
+
+// Reports whether both attribute sets hold at least one identical name=value pair,
+// any value of multi-valued attributes counts
+func sharesAttribute(a, b map[string]string) bool {
+	for name, value := range a {
+		other, ok := b[name]
+		if !ok {
+			continue
+		}
+		for _, v := range accesspolicy.Values(value) {
+			if slices.Contains(accesspolicy.Values(other), v) {
+				return true
+			}
+		}
+	}
+	return false
+}
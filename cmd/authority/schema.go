@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/audit"
+)
+
+const schemaFile = "attribute_schema.json"
+
+// Loads the signed attribute schema, nil if none was set: then any attribute is accepted
+func loadSchema() (*accesspolicy.Schema, error) {
+	var schema accesspolicy.Schema
+	found, err := readSigned(schemaFile, accesspolicy.SchemaDocument, &schema)
+	if err != nil || !found {
+		return nil, err
+	}
+	if err := schema.Compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", schemaFile, err)
+	}
+	return &schema, nil
+}
+
+// Validates a plain JSON schema file, then signs & publishes it for issuance & publishers.
+// Returns the active registry entries that do not conform to the new schema, they keep working.
+func setSchema(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+	var schema accesspolicy.Schema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	if err := schema.Compile(); err != nil {
+		return nil, err
+	}
+	schema.UpdatedAt = time.Now().UTC()
+
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	var violations []string
+	for _, entry := range reg.Active() {
+		if err := schema.CheckAttributes(entry.Attributes); err != nil {
+			violations = append(violations, fmt.Sprintf("%s: %v", entry.Subject, err))
+		}
+	}
+
+	if err := writeSigned(schemaFile, accesspolicy.SchemaDocument, &schema); err != nil {
+		return nil, err
+	}
+	names := slices.Sorted(maps.Keys(schema.Attributes))
+	return violations, recordAudit(audit.Event{Operation: "schema-set", Details: map[string]string{"attributes": strings.Join(names, ",")}})
+}
+
+// Checks a key's attributes against the published schema, if any
+func checkSchema(attrs map[string]string) error {
+	schema, err := loadSchema()
+	if err != nil {
+		return err
+	}
+	return schema.CheckAttributes(attrs)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"securemqtt/internal/keystore"
+	"securemqtt/internal/shamir"
+
+	"github.com/cloudflare/circl/abe/cpabe/tkn20"
+)
+
+const (
+	sharesMetaFile  = "master.shares.json"
+	shareFilePrefix = "share-"
+	shareFileSuffix = ".share"
+)
+
+// Describes a master key that only exists as custodian shares.
+// The hash lets issuance detect wrong or mixed shares without storing the key.
+type sharesMeta struct {
+	Shares       int       `json:"shares"`
+	Threshold    int       `json:"threshold"`
+	MasterSHA256 string    `json:"master_sha256"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Shares must leave the host, so they are never written under the keys they unlock.
+// Symlinks are resolved as far as the paths exist.
+func validateSharesDir(dir string) error {
+	if dir == "" {
+		return fmt.Errorf("--shares requires --shares-dir, a directory outside %s", keysRoot)
+	}
+	root, err := resolvePath(keysRoot)
+	if err != nil {
+		return err
+	}
+	target, err := resolvePath(dir)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(root, target)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("--shares-dir %s is inside %s, custodian shares must be kept apart from the keys", dir, keysRoot)
+	}
+	return nil
+}
+
+// Absolute path with the symlinks of its longest existing prefix resolved
+func resolvePath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var rest []string
+	for dir := abs; ; dir = filepath.Dir(dir) {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if dir == filepath.Dir(dir) {
+			return abs, nil
+		}
+		rest = append([]string{filepath.Base(dir)}, rest...)
+	}
+}
+
+// Splits the serialized master key into n shares (k needed) & stages one file per custodian.
+// Only the metadata is kept under /keys, the master key itself is never written.
+func splitMasterKey(masterBytes []byte, n, k int, sharesDir string, staged *stagedSystemKeys) error {
+	shares, err := shamir.Split(masterBytes, n, k)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(sharesDir, 0700); err != nil {
+		return fmt.Errorf("mkdir %s: %w", sharesDir, err)
+	}
+	for _, share := range shares {
+		path := filepath.Join(sharesDir, fmt.Sprintf("%s%d%s", shareFilePrefix, share.Index, shareFileSuffix))
+		if err := staged.write(path, []byte(share.String()+"\n"), keystore.SecretPerm); err != nil {
+			return err
+		}
+	}
+
+	sum := sha256.Sum256(masterBytes)
+	meta := sharesMeta{
+		Shares:       n,
+		Threshold:    k,
+		MasterSHA256: hex.EncodeToString(sum[:]),
+		CreatedAt:    time.Now().UTC(),
+	}
+	metaBytes, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal shares metadata: %w", err)
+	}
+	return staged.write(filepath.Join(keysDir, sharesMetaFile), metaBytes, keystore.PublicPerm)
+}
+
+// Loads the shares metadata, returns nil if the master key is not split.
+func loadSharesMeta() (*sharesMeta, error) {
+	path := filepath.Join(keysDir, sharesMetaFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	var meta sharesMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return &meta, nil
+}
+
+// Reconstructs the master key in memory from the presented shares.
+// Shares come from the given files or, if none are given, are read interactively from stdin.
+func reconstructMasterSecretKey(meta *sharesMeta, shareFiles []string) (tkn20.SystemSecretKey, error) {
+	var masterSecretKey tkn20.SystemSecretKey
+
+	var shares []shamir.Share
+	var err error
+	if len(shareFiles) > 0 {
+		shares, err = readShareFiles(shareFiles)
+	} else {
+		shares, err = promptShares(meta.Threshold)
+	}
+	if err != nil {
+		return masterSecretKey, err
+	}
+
+	masterBytes, err := shamir.Combine(shares)
+	if err != nil {
+		return masterSecretKey, fmt.Errorf("combine shares: %w", err)
+	}
+	defer clear(masterBytes)
+
+	// Make sure the shares really belong to this system's master key
+	sum := sha256.Sum256(masterBytes)
+	expected, err := hex.DecodeString(meta.MasterSHA256)
+	if err != nil || subtle.ConstantTimeCompare(sum[:], expected) != 1 {
+		return masterSecretKey, fmt.Errorf("shares do not reconstruct this system's master key")
+	}
+
+	if err := masterSecretKey.UnmarshalBinary(masterBytes); err != nil {
+		return masterSecretKey, fmt.Errorf("unmarshal master secret key: %w", err)
+	}
+	return masterSecretKey, nil
+}
+
+func readShareFiles(paths []string) ([]shamir.Share, error) {
+	shares := make([]shamir.Share, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read share %s: %w", path, err)
+		}
+		share, err := shamir.ParseShare(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("share %s: %w", path, err)
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// Asks custodians to paste their shares one per line
+func promptShares(threshold int) ([]shamir.Share, error) {
+	reader := bufio.NewReader(os.Stdin)
+	shares := make([]shamir.Share, 0, threshold)
+
+	for i := 1; i <= threshold; i++ {
+		fmt.Fprintf(os.Stderr, "Enter master key share %d/%d: ", i, threshold)
+		line, err := reader.ReadString('\n')
+		if err != nil && strings.TrimSpace(line) == "" {
+			return nil, fmt.Errorf("read share %d: %w", i, err)
+		}
+		share, err := shamir.ParseShare(line)
+		if err != nil {
+			return nil, fmt.Errorf("share %d: %w", i, err)
+		}
+		shares = append(shares, share)
+	}
+	return shares, nil
+}
+
+// Splits a comma separated flag value, dropping empty entries
+func splitList(raw string) []string {
+	var out []string
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"securemqtt/internal/signed"
+)
+
+const (
+	signingKeyFile       = "authority_sign.key"
+	signingPublicKeyFile = "authority_sign.pub"
+)
+
+// Loads the authority's Ed25519 signing key, creating it on first use.
+// The public half is written next to public.key so publishers can verify signed documents.
+func loadOrCreateSigningKey() (ed25519.PrivateKey, error) {
+	path := filepath.Join(keysDir, signingKeyFile)
+	seed, err := os.ReadFile(path)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("%s: invalid signing key size %d", path, len(seed))
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	publicKey, privateKey, err := signed.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := writeSecret(signingKeyFile, privateKey.Seed()); err != nil {
+		return nil, err
+	}
+	if err := writeKey(signingPublicKeyFile, publicKey); err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+// Signs payload with the authority key & writes it under /keys
+func writeSigned(name, docType string, payload any) error {
+	signingKey, err := loadOrCreateSigningKey()
+	if err != nil {
+		return err
+	}
+	data, err := signed.Sign(signingKey, docType, payload)
+	if err != nil {
+		return err
+	}
+	return writeKey(name, data)
+}
+
+// Reads a signed document the authority wrote earlier, verifying it against its own key.
+// Returns false if the document does not exist yet.
+func readSigned(name, docType string, out any) (bool, error) {
+	path := filepath.Join(keysDir, name)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	signingKey, err := loadOrCreateSigningKey()
+	if err != nil {
+		return false, err
+	}
+	if err := signed.Verify(signingKey.Public().(ed25519.PublicKey), docType, data, out); err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	return true, nil
+}
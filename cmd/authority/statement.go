@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/statement"
+)
+
+// Verifies an attribute statement offline against the authority's signing key (default
+// authority_sign.pub under /keys) & checks it describes keyPath. Without keyPath the key
+// next to the statement is checked if it exists. Returns the key file checked, if any.
+func verifyStatement(path, keyPath, authorityKeyPath string) (*statement.Statement, string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("read %s: %w", path, err)
+	}
+	if authorityKeyPath == "" {
+		authorityKeyPath = filepath.Join(keysDir, signingPublicKeyFile)
+	}
+	authorityKey, err := os.ReadFile(authorityKeyPath)
+	if err != nil {
+		return nil, "", fmt.Errorf("read %s: %w", authorityKeyPath, err)
+	}
+	verified, err := statement.Verify(authorityKey, data)
+	if err != nil {
+		return nil, "", fmt.Errorf("%s: %w", path, err)
+	}
+
+	if keyPath == "" {
+		sibling, ok := strings.CutSuffix(path, statement.FileSuffix)
+		if !ok || !fileExists(sibling) {
+			return verified, "", nil
+		}
+		keyPath = sibling
+	}
+	file, err := keyfile.Read(keyPath, keyfile.Attribute)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := verified.CheckKey(file.Key); err != nil {
+		return nil, "", fmt.Errorf("%s: %w", keyPath, err)
+	}
+	return verified, keyPath, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"securemqtt/internal/abe"
+	"securemqtt/internal/accesspolicy"
+	aescryptography "securemqtt/internal/aes"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/secureclient"
+	"securemqtt/internal/tracing"
+)
+
+// Topic probes are published for when the decoder's topic is unknown
+const defaultProbeTopic = "trace/probe"
+
+// Traces which current-epoch key a decoder is built from, by asking the oracle to decrypt
+// probe envelopes. With a policy, only keys satisfying it are suspects and every probe carries it.
+// Returns the subjects that could not be traced because their keys predate tracing.
+func traceDecoder(oracle tracing.IOracle, topic, policy string) (*tracing.Result, []string, error) {
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, nil, err
+	}
+	keyID, err := currentEpochKeyID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var restriction accesspolicy.Node
+	if policy != "" {
+		if restriction, err = accesspolicy.Parse(policy); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Probes are encrypted under the current public key, keys of other epochs cannot read them.
+	// Without a policy revoked keys are suspects too, a leaked key is often a revoked one.
+	var suspects []tracing.Suspect
+	var untraceable []string
+	for _, entry := range reg.Entries {
+		if entry.KeyID != keyID {
+			continue
+		}
+		if restriction != nil && (entry.Revoked || !accesspolicy.Satisfies(restriction, entry.Attributes)) {
+			continue
+		}
+		if entry.TraceID == "" {
+			untraceable = append(untraceable, entry.Subject)
+			continue
+		}
+		suspects = append(suspects, tracing.Suspect{Subject: entry.Subject, TraceID: entry.TraceID})
+	}
+
+	encrypt, err := probeEncrypter(keyID, topic)
+	if err != nil {
+		return nil, nil, err
+	}
+	result, err := tracing.Trace(oracle, encrypt, suspects, policy)
+	return result, untraceable, err
+}
+
+// Builds probe envelopes with a SecureClient, exactly like a publisher of this namespace on topic
+func probeEncrypter(keyID, topic string) (tracing.Encrypter, error) {
+	file, err := keyfile.Read(filepath.Join(keysDir, publicKeyFile), keyfile.Public)
+	if err != nil {
+		return nil, err
+	}
+	versions, err := loadVersionTable()
+	if err != nil {
+		return nil, err
+	}
+	if topic == "" {
+		topic = defaultProbeTopic
+	}
+
+	capture := &tracing.CaptureMQTT{}
+	client := secureclient.NewSecureClient(capture, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, nil, nil)
+	client.SetNamespacePublicKey(currentNamespace, keyID, file.Key)
+	client.AddNamespacePolicyRewriter(currentNamespace, accesspolicy.NewVersionRewriter(versions))
+
+	return func(plaintext []byte, policy string) ([]byte, error) {
+		if err := client.PublishSecureNamespace(currentNamespace, topic, 0, false, plaintext, policy); err != nil {
+			return nil, err
+		}
+		if capture.Envelope == nil {
+			return nil, fmt.Errorf("no envelope produced")
+		}
+		return capture.Envelope, nil
+	}, nil
+}
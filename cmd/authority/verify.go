@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"path/filepath"
+
+	"securemqtt/internal/abe"
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/epoch"
+	"securemqtt/internal/keyfile"
+)
+
+// What --verify-key found out about a key file
+type keyCheck struct {
+	Subject  string
+	SystemID string
+	KeyID    string
+	Policy   string
+	Revoked  bool
+}
+
+// Checks that an attribute key belongs to the system public key of its epoch, by encrypting a
+// canary to the key's attributes & decrypting it with the key. The attributes come from the
+// registry entry with the key's fingerprint, or from the key file's header.
+func verifyKey(path string) (*keyCheck, error) {
+	file, err := keyfile.Read(path, keyfile.Attribute)
+	if err != nil {
+		return nil, err
+	}
+
+	currentKeyID, err := currentEpochKeyID()
+	if err != nil {
+		return nil, err
+	}
+	publicPath := filepath.Join(keysDir, publicKeyFile)
+	if file.KeyID != "" && file.KeyID != currentKeyID {
+		publicPath = filepath.Join(epoch.ArchivePath(keysDir, file.KeyID), publicKeyFile)
+		if !fileExists(publicPath) {
+			return nil, fmt.Errorf("%s is of epoch %s of system %s, which this authority does not hold (current epoch %s of system %s): "+
+				"the epoch was retired, or the key was issued by an earlier setup or another authority; issue a new key",
+				path, file.KeyID, orNone(file.SystemID), orNone(currentKeyID), currentSystemIDOrNone())
+		}
+	}
+	public, err := keyfile.Read(publicPath, keyfile.Public)
+	if err != nil {
+		return nil, err
+	}
+
+	check := &keyCheck{Subject: file.Subject, SystemID: keyfile.SystemID(public.Key), KeyID: public.KeyID}
+	attrs := file.Attributes
+	reg, err := loadRegistry()
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := keyfile.Fingerprint(file.Key)
+	for _, entry := range reg.Entries {
+		if entry.Fingerprint == fingerprint {
+			check.Subject, check.Revoked, attrs = entry.Subject, entry.Revoked, entry.Attributes
+			break
+		}
+	}
+	if len(attrs) == 0 {
+		return nil, fmt.Errorf("%s is not in the registry & its file names no attributes, nothing to test it with", path)
+	}
+
+	versions, err := loadVersionTable()
+	if err != nil {
+		return nil, err
+	}
+	if check.Policy, err = accesspolicy.CanaryPolicy(attrs, versions); err != nil {
+		return nil, err
+	}
+	if err := canaryCheck(public.Key, file.Key, check.Policy); err != nil {
+		detail := ""
+		if file.SystemID != "" && file.SystemID != check.SystemID {
+			detail = fmt.Sprintf(" (its file names system %s)", file.SystemID)
+		}
+		return check, fmt.Errorf("%s does not belong to system %s, epoch %s%s: it was issued by an earlier setup or another authority, "+
+			"or its attributes were re-versioned since; issue a new key", path, check.SystemID, orNone(check.KeyID), detail)
+	}
+	return check, nil
+}
+
+// Encrypts a random canary to policy with publicKey & decrypts it with attributeKey
+func canaryCheck(publicKey, attributeKey []byte, policy string) error {
+	canary := make([]byte, 16)
+	if _, err := rand.Read(canary); err != nil {
+		return err
+	}
+	ciphertext, err := (&abe.PublisherABE{}).EncryptKey(publicKey, policy, canary)
+	if err != nil {
+		return err
+	}
+	decrypted, err := (&abe.SubscriberABE{}).DecryptKey(attributeKey, ciphertext)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(decrypted, canary) {
+		return fmt.Errorf("decrypted canary differs")
+	}
+	return nil
+}
+
+func currentSystemIDOrNone() string {
+	systemID, err := currentSystemID()
+	if err != nil {
+		return "none"
+	}
+	return systemID
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"securemqtt/internal/masterkey"
+	"securemqtt/internal/namespace"
+)
+
+const (
+	masterKeyFile       = "master.key"
+	sealedMasterKeyFile = "master.key.sealed"
+)
+
+// Holds the master keys, one per namespace, in its own process & answers the authority's setup & issuance
+// requests over a Unix socket, so the authority never reads the key itself
+func main() {
+	log.SetPrefix("[KEYHOLDER] ")
+	log.SetFlags(0)
+
+	var (
+		socket   = flag.String("socket", "/run/keyholder/keyholder.sock", "Unix socket the authority connects to")
+		dir      = flag.String("dir", "/keyholder", "directory the master key is kept in, never shared with the authority")
+		sealed   = flag.Bool("sealed", false, "keep the master key encrypted under the passphrase in --passphrase-file")
+		passFile = flag.String("passphrase-file", "", "file holding the passphrase of the sealed master key (sealed only)")
+	)
+	flag.Parse()
+
+	if *sealed && *passFile == "" {
+		log.Fatalf("--sealed requires --passphrase-file")
+	}
+	if err := os.MkdirAll(*dir, 0700); err != nil {
+		log.Fatalf("Failed to create %s: %v", *dir, err)
+	}
+
+	// Each namespace keeps its master key in its own directory, laid out like the keys volume
+	stores := func(ns string) masterkey.IMasterKeyStore {
+		nsDir := namespace.Path(*dir, ns)
+		if !*sealed {
+			return &masterkey.FileStore{Path: filepath.Join(nsDir, masterKeyFile), Namespace: ns}
+		}
+		return &masterkey.SealedStore{
+			Path:      filepath.Join(nsDir, sealedMasterKeyFile),
+			Namespace: ns,
+			Passphrase: func(bool) ([]byte, error) {
+				data, err := os.ReadFile(*passFile)
+				if err != nil {
+					return nil, fmt.Errorf("read passphrase: %w", err)
+				}
+				return bytes.TrimRight(data, "\r\n"), nil
+			},
+		}
+	}
+
+	server, err := masterkey.NewServer(stores, log.Printf)
+	if err != nil {
+		log.Fatalf("Failed to open the master key: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(*socket), 0700); err != nil {
+		log.Fatalf("Failed to create %s: %v", filepath.Dir(*socket), err)
+	}
+	listener, err := masterkey.Listen(*socket)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+
+	// Remove the socket on shutdown, so the authority fails fast instead of connecting to nothing
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stop
+		listener.Close()
+	}()
+
+	log.Printf("Holding the master key in %s, serving %s", *dir, *socket)
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("Serve failed: %v", err)
+	}
+}
@@ -1,31 +1,128 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 
 	"securemqtt/internal/abe"
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/accessreview"
 	aescryptography "securemqtt/internal/aes"
 	"securemqtt/internal/clientmqtt"
+	"securemqtt/internal/epoch"
+	"securemqtt/internal/escrow"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/provisioning"
 	"securemqtt/internal/secureclient"
+	"securemqtt/internal/signed"
 )
 
 const (
-	publicKeyPath = "/keys/public.key"
-	brokerURL     = "tcp://broker:1883"
-	clientID      = "publisher-client"
-	topic         = "topicX"
-	policy        = "(role: operator) and (site: rome)"
+	keysDir        = "/keys"
+	publicKeyPath  = "/keys/public.key"
+	signingKeyPath = "/keys/authority_sign.pub"
+	versionsPath   = "/keys/attribute_versions.json"
+	periodsPath    = "/keys/periods.json"
+	schemaPath     = "/keys/attribute_schema.json"
+	topicsPath     = "/keys/" + accessreview.TopicPoliciesFile
+	registryPath   = "/keys/" + accessreview.RegistryFile
+	escrowPath     = "/keys/" + escrow.File
+	brokerURL      = "tcp://broker:1883"
+	clientID       = "publisher-client"
+
+	// Published to when no topic policies are configured
+	topic  = "topicX"
+	policy = "(role: operator) and (site: rome)"
 )
 
+// Bundle the publisher was provisioned with (PROVISION_BUNDLE), nil when it runs from /keys
+var provisioned *provisioning.Bundle
+
 func main() {
 
+	// With a bundle, broker, public key, topics & signed documents all come from it
+	var err error
+	if provisioned, err = provisioning.FromEnv(); err != nil {
+		log.Fatalf("[PUBLISHER] Failed to load provisioning bundle: %v", err)
+	}
+	var secureClient *secureclient.SecureClient
+	if provisioned != nil {
+		secureClient = connectProvisioned()
+	} else {
+		secureClient = connect()
+	}
+
+	// Reject policies outside the authority's attribute schema, before any other rewrite
+	schema, err := loadSchema()
+	if err != nil {
+		log.Fatalf("[PUBLISHER] Failed to load attribute schema: %v", err)
+	}
+	schemaValidator := accesspolicy.NewSchemaValidator(schema)
+	secureClient.AddNamespacePolicyRewriter(publishNamespace(), schemaValidator)
+	go watchSchema(schemaValidator)
+
+	// Warn about policies no issued key satisfies, while they are still logical
+	warner := accessreview.NewUnreachableWarner()
+	secureClient.AddNamespacePolicyRewriter(publishNamespace(), warner)
+	if provisioned == nil {
+		go watchRegistry(warner)
+	}
+
+	// OR the authority's escrow clause into every policy, except on opted-out topics
+	escrowPolicy, err := loadEscrow()
+	if err != nil {
+		log.Fatalf("[PUBLISHER] Failed to load escrow clause: %v", err)
+	}
+	escrowRewriter := escrow.NewRewriter(escrowPolicy)
+	secureClient.AddNamespacePolicyRewriter(publishNamespace(), escrowRewriter)
+	go watchEscrow(escrowRewriter)
+
+	// Rewrite policies to the current attribute versions, so revoked keys stop matching
+	versions, err := loadVersionTable()
+	if err != nil {
+		log.Fatalf("[PUBLISHER] Failed to load attribute versions: %v", err)
+	}
+	versionRewriter := accesspolicy.NewVersionRewriter(versions)
+	secureClient.AddNamespacePolicyRewriter(publishNamespace(), versionRewriter)
+	go watchVersions(versionRewriter)
+
+	// Once the authority issues time-bound keys, AND the current period into every policy
+	if !enablePeriods(secureClient) {
+		go watchPeriods(secureClient)
+	}
+
+	topics, err := publishTopics()
+	if err != nil {
+		log.Fatalf("[PUBLISHER] Failed to load topic policies: %v", err)
+	}
+
+	for {
+		plaintext := []byte(fmt.Sprintf("Message at %s", time.Now().Format(time.RFC3339)))
+
+		// Publish payload to every topic under its policy
+		for _, entry := range topics {
+			if err := secureClient.PublishSecureNamespace(publishNamespace(), entry.Topic, 0, false, plaintext, entry.Policy); err != nil {
+				log.Printf("[PUBLISHER] Failed to publish to %s: %v", entry.Topic, err)
+			}
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Waits for public.key, connects to the compiled-in broker & follows epoch rotations in /keys
+func connect() *secureclient.SecureClient {
 	publicKeyBytes, err := waitForKey(publicKeyPath)
 	if err != nil {
 		log.Fatalf("Failed to load public key: %v", err)
 	}
+	log.Printf("Loaded public key of system %s", keyfile.SystemID(publicKeyBytes))
 
 	// Create & connect MQTT client using wrapper through broker address & client ID
 	client, err := clientmqtt.NewMQTT(brokerURL, clientID)
@@ -36,15 +133,90 @@ func main() {
 	secureClient := secureclient.NewSecureClient(client, &abe.PublisherABE{}, &abe.SubscriberABE{},
 		&aescryptography.AESCryptography{}, publicKeyBytes, nil)
 
-	for {
-		plaintext := []byte(fmt.Sprintf("Message at %s", time.Now().Format(time.RFC3339)))
+	// Tag envelopes with the current epoch & follow rotations
+	keyID, err := currentKeyID()
+	if err != nil {
+		log.Fatalf("[PUBLISHER] Failed to load epoch index: %v", err)
+	}
+	if publicKeyBytes, err = loadPublicKey(keyID); err != nil {
+		log.Fatalf("[PUBLISHER] %v", err)
+	}
+	secureClient.SetPublicKey(keyID, publicKeyBytes)
+	go watchEpochs(secureClient, keyID)
+	return secureClient
+}
+
+// Connects to the bundle's broker with its public key. A rotation takes a new bundle.
+func connectProvisioned() *secureclient.SecureClient {
+	client, err := clientmqtt.NewMQTTWithOptions(provisioned.Options())
+	if err != nil {
+		log.Fatalf("[PUBLISHER] Failed to connect to broker: %v", err)
+	}
+	log.Printf("[PUBLISHER] Provisioned as %s for system %s, epoch %s", provisioned.Subject, provisioned.SystemID, provisioned.KeyID)
 
-		// Publish payload to topic
-		if err := secureClient.PublishSecure(topic, 0, false, plaintext, policy); err != nil {
-			log.Printf("[PUBLISHER] Failed to publish: %v", err)
+	secureClient := secureclient.NewSecureClient(client, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, nil, nil)
+	secureClient.SetNamespacePublicKey(provisioned.Namespace, provisioned.KeyID, provisioned.PublicKey)
+	return secureClient
+}
+
+// Namespace envelopes are published to: the bundle's, the default one when running from /keys
+func publishNamespace() string {
+	if provisioned == nil {
+		return ""
+	}
+	return provisioned.Namespace
+}
+
+// Topics to publish to & their policies: the bundle's, otherwise from the topic policy
+// configuration if there is one. Filter entries only serve access reviews and are skipped.
+func publishTopics() ([]*accessreview.TopicPolicy, error) {
+	if provisioned != nil {
+		topics := make([]*accessreview.TopicPolicy, 0, len(provisioned.Topics))
+		for _, entry := range provisioned.Topics {
+			topics = append(topics, &accessreview.TopicPolicy{Topic: entry.Topic, Policy: entry.Policy})
 		}
+		return topics, nil
+	}
 
-		time.Sleep(5 * time.Second)
+	config, err := accessreview.LoadTopicPolicies(topicsPath)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return []*accessreview.TopicPolicy{{Topic: topic, Policy: policy}}, nil
+	}
+
+	var topics []*accessreview.TopicPolicy
+	for _, entry := range config.Topics {
+		if entry.Publishable() {
+			topics = append(topics, entry)
+		}
+	}
+	log.Printf("[PUBLISHER] Publishing to %d topic(s) from %s", len(topics), topicsPath)
+	return topics, nil
+}
+
+// Polls the issued-key registry & the epoch index, so unreachable policies are re-checked
+// after every issuance & rotation
+func watchRegistry(warner *accessreview.UnreachableWarner) {
+	var modTime time.Time
+	var keyID string
+	for {
+		info, err := os.Stat(registryPath)
+		latest, keyErr := currentKeyID()
+		if keyErr != nil {
+			log.Printf("[PUBLISHER] Keeping previous registry: %v", keyErr)
+		} else if err == nil && (!info.ModTime().Equal(modTime) || latest != keyID) {
+			holders, err := accessreview.LoadHolders(registryPath)
+			if err != nil {
+				log.Printf("[PUBLISHER] Keeping previous registry: %v", err)
+			} else {
+				warner.SetHolders(holders, latest)
+				modTime, keyID = info.ModTime(), latest
+			}
+		}
+		time.Sleep(30 * time.Second)
 	}
 }
 
@@ -54,12 +226,12 @@ func waitForKey(path string) ([]byte, error) {
 	log.Printf("Waiting for key file: %s", path)
 
 	for {
-		data, err := os.ReadFile(path)
+		file, err := keyfile.Read(path, keyfile.Public)
 		if err == nil {
-			return data, nil
+			return file.Key, nil
 		}
 
-		if !os.IsNotExist(err) {
+		if !errors.Is(err, fs.ErrNotExist) {
 			return nil, fmt.Errorf("unexpected error reading %s: %w", path, err)
 		}
 
@@ -67,3 +239,197 @@ func waitForKey(path string) ([]byte, error) {
 		time.Sleep(2 * time.Second)
 	}
 }
+
+// Returns the key ID of the current epoch, "" if the system predates epochs
+func currentKeyID() (string, error) {
+	index, err := epoch.Load(keysDir)
+	if err != nil || index == nil {
+		return "", err
+	}
+	current, err := index.CurrentEpoch()
+	if err != nil {
+		return "", err
+	}
+	return current.KeyID, nil
+}
+
+// Polls the epoch index & switches to the newest public key after a rotation
+func watchEpochs(secureClient *secureclient.SecureClient, keyID string) {
+	for {
+		time.Sleep(30 * time.Second)
+
+		latest, err := currentKeyID()
+		if err != nil {
+			log.Printf("[PUBLISHER] Failed to reload epoch index: %v", err)
+			continue
+		}
+		if latest == keyID {
+			continue
+		}
+
+		publicKeyBytes, err := loadPublicKey(latest)
+		if err != nil {
+			log.Printf("[PUBLISHER] Epoch %s announced but public key not usable yet: %v", latest, err)
+			continue
+		}
+		secureClient.SetPublicKey(latest, publicKeyBytes)
+		keyID = latest
+		log.Printf("[PUBLISHER] Switched to epoch %s", keyID)
+	}
+}
+
+// Reads public.key & checks it belongs to epoch keyID, so a key from another system or epoch is never used
+func loadPublicKey(keyID string) ([]byte, error) {
+	file, err := keyfile.Read(publicKeyPath, keyfile.Public)
+	if err != nil {
+		return nil, err
+	}
+	if file.KeyID != "" && keyID != "" && file.KeyID != keyID {
+		return nil, fmt.Errorf("%s belongs to epoch %s, the current epoch is %s", publicKeyPath, file.KeyID, keyID)
+	}
+	return file.Key, nil
+}
+
+// Reads a document signed by the authority, returns false if it does not exist (yet).
+// A provisioned publisher reads the copy in its bundle instead.
+func loadSigned(path, docType string, out any) (bool, error) {
+	if provisioned != nil {
+		return provisioned.LoadDocument(filepath.Base(path), docType, out)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	signingKey, err := os.ReadFile(signingKeyPath)
+	if err != nil {
+		return false, fmt.Errorf("read %s: %w", signingKeyPath, err)
+	}
+	if err := signed.Verify(ed25519.PublicKey(signingKey), docType, data, out); err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	return true, nil
+}
+
+// Loads the signed attribute version table, nil if nothing was ever revoked
+func loadVersionTable() (*accesspolicy.VersionTable, error) {
+	var table accesspolicy.VersionTable
+	found, err := loadSigned(versionsPath, accesspolicy.VersionTableDocument, &table)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// Polls the version table & applies revocations published by the authority
+func watchVersions(rewriter *accesspolicy.VersionRewriter) {
+	var updatedAt time.Time
+	for {
+		time.Sleep(30 * time.Second)
+
+		table, err := loadVersionTable()
+		if err != nil {
+			log.Printf("[PUBLISHER] Keeping previous attribute versions: %v", err)
+			continue
+		}
+		if table == nil || !table.UpdatedAt.After(updatedAt) {
+			continue
+		}
+		rewriter.SetTable(table)
+		updatedAt = table.UpdatedAt
+		log.Printf("[PUBLISHER] Loaded attribute versions from %s", table.UpdatedAt.Format(time.RFC3339))
+	}
+}
+
+// Loads the signed attribute schema, nil if the authority has not set one
+func loadSchema() (*accesspolicy.Schema, error) {
+	var schema accesspolicy.Schema
+	found, err := loadSigned(schemaPath, accesspolicy.SchemaDocument, &schema)
+	if err != nil || !found {
+		return nil, err
+	}
+	if err := schema.Compile(); err != nil {
+		return nil, fmt.Errorf("%s: %w", schemaPath, err)
+	}
+	return &schema, nil
+}
+
+// Polls the attribute schema & applies updates published by the authority
+func watchSchema(validator *accesspolicy.SchemaValidator) {
+	var updatedAt time.Time
+	for {
+		time.Sleep(30 * time.Second)
+
+		schema, err := loadSchema()
+		if err != nil {
+			log.Printf("[PUBLISHER] Keeping previous attribute schema: %v", err)
+			continue
+		}
+		if schema == nil || !schema.UpdatedAt.After(updatedAt) {
+			continue
+		}
+		validator.SetSchema(schema)
+		updatedAt = schema.UpdatedAt
+		log.Printf("[PUBLISHER] Loaded attribute schema from %s", schema.UpdatedAt.Format(time.RFC3339))
+	}
+}
+
+// Loads the signed escrow clause, nil if the authority has not set one
+func loadEscrow() (*escrow.Escrow, error) {
+	var config escrow.Escrow
+	found, err := loadSigned(escrowPath, escrow.Document, &config)
+	if err != nil || !found {
+		return nil, err
+	}
+	if err := config.Check(); err != nil {
+		return nil, fmt.Errorf("%s: %w", escrowPath, err)
+	}
+	return &config, nil
+}
+
+// Polls the escrow clause & applies updates published by the authority
+func watchEscrow(rewriter *escrow.Rewriter) {
+	var updatedAt time.Time
+	for {
+		time.Sleep(30 * time.Second)
+
+		config, err := loadEscrow()
+		if err != nil {
+			log.Printf("[PUBLISHER] Keeping previous escrow clause: %v", err)
+			continue
+		}
+		if config == nil || !config.UpdatedAt.After(updatedAt) {
+			continue
+		}
+		rewriter.SetEscrow(config)
+		updatedAt = config.UpdatedAt
+		log.Printf("[PUBLISHER] Loaded escrow clause %q from %s", config.Clause, config.UpdatedAt.Format(time.RFC3339))
+	}
+}
+
+// Enables period clauses if the authority has published a period configuration
+func enablePeriods(secureClient *secureclient.SecureClient) bool {
+	var config accesspolicy.PeriodConfig
+	found, err := loadSigned(periodsPath, accesspolicy.PeriodConfigDocument, &config)
+	if err != nil {
+		log.Printf("[PUBLISHER] Failed to load period configuration: %v", err)
+		return false
+	}
+	if !found {
+		return false
+	}
+	secureClient.AddNamespacePolicyRewriter(publishNamespace(), accesspolicy.NewPeriodRewriter(config.Granularity))
+	log.Printf("[PUBLISHER] Time-bound keys enabled, adding %s period clauses", config.Granularity)
+	return true
+}
+
+// Polls until the authority issues its first time-bound key
+func watchPeriods(secureClient *secureclient.SecureClient) {
+	for !enablePeriods(secureClient) {
+		time.Sleep(30 * time.Second)
+	}
+}
@@ -0,0 +1,26 @@
+package accesspolicy
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// CanaryPolicy returns a policy the key issued for attrs satisfies, to test the key against a
+// public key: its subject identifier if it has one, otherwise all of its attributes.
+// Values are encoded with versions, which may be nil.
+func CanaryPolicy(attrs map[string]string, versions *VersionTable) (string, error) {
+	encoded := versions.EncodeAll(attrs)
+	if id, ok := encoded[SubjectAttribute]; ok {
+		encoded = map[string]string{SubjectAttribute: id}
+	}
+	if len(encoded) == 0 {
+		return "", fmt.Errorf("accesspolicy: no attributes to build a canary policy from")
+	}
+
+	var leaves []Node
+	for _, name := range slices.Sorted(maps.Keys(encoded)) {
+		leaves = append(leaves, Attr{Name: name, Value: encoded[name]})
+	}
+	return And(leaves...).String(), nil
+}
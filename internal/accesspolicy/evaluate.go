@@ -0,0 +1,59 @@
+package accesspolicy
+
+import "slices"
+
+// Satisfies reports whether a key holding attrs can decrypt under the policy.
+// Attributes are compared as given: pass logical values for logical policies.
+// A multi-valued attribute satisfies a leaf naming any of its values.
+// Like tkn20, negations apply to leaves: a negated leaf is satisfied only by a key holding
+// the attribute with another value, never by a key lacking it. Keys hold the values of a
+// multi-valued attribute as member attributes only, so they never satisfy a negated leaf either.
+func Satisfies(node Node, attrs map[string]string) bool {
+	return satisfies(node, attrs, false)
+}
+
+// Evaluates node, or its negation pushed down to the leaves by De Morgan's laws
+func satisfies(node Node, attrs map[string]string, negated bool) bool {
+	switch n := node.(type) {
+	case Attr:
+		value, ok := attrs[n.Name]
+		if !ok {
+			return false
+		}
+		values := Values(value)
+		if negated && len(values) > 1 {
+			return false
+		}
+		return slices.Contains(values, n.Value) != negated
+	case Gate:
+		if (n.Op == "and") != negated {
+			return satisfies(n.Left, attrs, negated) && satisfies(n.Right, attrs, negated)
+		}
+		return satisfies(n.Left, attrs, negated) || satisfies(n.Right, attrs, negated)
+	case Not:
+		return satisfies(n.Operand, attrs, !negated)
+	}
+	return false
+}
+
+// NegatedAttrs lists the attribute leaves a "not" applies to, in order of appearance.
+// Double negations cancel out.
+func NegatedAttrs(node Node) []Attr {
+	var out []Attr
+	collectNegated(node, false, &out)
+	return out
+}
+
+func collectNegated(node Node, negated bool, out *[]Attr) {
+	switch n := node.(type) {
+	case Attr:
+		if negated {
+			*out = append(*out, n)
+		}
+	case Gate:
+		collectNegated(n.Left, negated, out)
+		collectNegated(n.Right, negated, out)
+	case Not:
+		collectNegated(n.Operand, !negated, out)
+	}
+}
@@ -0,0 +1,17 @@
+package accesspolicy
+
+type IPolicyRewriter interface {
+	// Rewrites a publisher's policy before it is used for encryption
+	// Takes as input: the policy as given to PublishSecure (or by the previous rewriter)
+	// Outputs: the policy to encrypt under, or an error to reject the publish
+	Rewrite(policy string) (string, error)
+}
+
+type ITopicPolicyRewriter interface {
+	IPolicyRewriter
+
+	// Like Rewrite, for rewriters that depend on the topic published to
+	// Takes as input: the topic & the policy as given to PublishSecure (or by the previous rewriter)
+	// Outputs: the policy to encrypt under, or an error to reject the publish
+	RewriteTopic(topic, policy string) (string, error)
+}
@@ -0,0 +1,57 @@
+package accesspolicy
+
+import (
+	"slices"
+	"strings"
+)
+
+const (
+	// Separates the values of a multi-valued attribute in logical attribute maps, e.g. "site": "milan,rome"
+	ValueSeparator = ","
+
+	// Joins name & value into the attribute a multi-valued key holds per value, e.g. site__in__rome
+	memberSeparator = "__in__"
+)
+
+// Values splits a logical attribute value into its values, one for single-valued attributes
+func Values(value string) []string {
+	return strings.Split(value, ValueSeparator)
+}
+
+// JoinValues returns the canonical logical value of an attribute holding values: sorted, without duplicates
+func JoinValues(values []string) string {
+	return strings.Join(slices.Compact(slices.Sorted(slices.Values(values))), ValueSeparator)
+}
+
+// MemberAttribute names the attribute a multi-valued key holds for one of its values.
+// tkn20 keys hold one value per attribute, so each value of a multi-valued attribute
+// becomes an attribute of its own.
+func MemberAttribute(name, value string) string {
+	return name + memberSeparator + value
+}
+
+// In builds the policy any holder of one of the values satisfies, like "name in (v1, v2)"
+func In(name string, values ...string) Node {
+	leaves := make([]Node, 0, len(values))
+	for _, value := range values {
+		leaves = append(leaves, Attr{Name: name, Value: value})
+	}
+	return Or(leaves...)
+}
+
+// ExpandSets rewrites "name in (v1, v2)" into the or-expressions tkn20 understands.
+// Policies without sets are returned unchanged.
+func ExpandSets(raw string) (string, error) {
+	tokens, err := tokenize(raw)
+	if err != nil {
+		return "", err
+	}
+	if !slices.Contains(tokens, "in") {
+		return raw, nil
+	}
+	node, err := Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return node.String(), nil
+}
@@ -0,0 +1,128 @@
+package accesspolicy
+
+import (
+	"fmt"
+	"time"
+)
+
+// Size of the validity buckets encoded into keys & policies
+type Granularity string
+
+const (
+	Month Granularity = "month"
+	Week  Granularity = "week"
+)
+
+const (
+	// Value of every period attribute, the label alone carries the bucket
+	PeriodValue = "valid"
+
+	// Period attribute of keys without validity window, it never expires
+	PermanentPeriod = "period_permanent"
+
+	// Type of the signed document announcing the system-wide period granularity
+	PeriodConfigDocument = "period-config"
+)
+
+// System-wide period setting published by the authority once time-bound keys are in use
+type PeriodConfig struct {
+	Granularity Granularity `json:"granularity"`
+}
+
+// Validity window of a time-bound key, NotAfter is the end of its last period (exclusive)
+type Validity struct {
+	Granularity Granularity `json:"granularity"`
+	NotBefore   time.Time   `json:"not_before"`
+	NotAfter    time.Time   `json:"not_after"`
+	Periods     []string    `json:"periods"`
+}
+
+// ParseGranularity validates a granularity name
+func ParseGranularity(raw string) (Granularity, error) {
+	switch g := Granularity(raw); g {
+	case Month, Week:
+		return g, nil
+	}
+	return "", fmt.Errorf("accesspolicy: unknown period %q (use %q or %q)", raw, Month, Week)
+}
+
+// PeriodLabel returns the attribute label of the bucket containing t, e.g. period_m2026_10 or period_w2026_42
+func PeriodLabel(g Granularity, t time.Time) string {
+	t = t.UTC()
+	if g == Week {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("period_w%d_%02d", year, week)
+	}
+	return fmt.Sprintf("period_m%d_%02d", t.Year(), int(t.Month()))
+}
+
+// NewValidity covers every bucket from the one containing from up to the one containing until
+func NewValidity(g Granularity, from, until time.Time) (*Validity, error) {
+	if until.Before(from) {
+		return nil, fmt.Errorf("accesspolicy: validity ends (%s) before it starts (%s)", until.Format(time.RFC3339), from.Format(time.RFC3339))
+	}
+
+	start := bucketStart(g, from)
+	validity := &Validity{Granularity: g, NotBefore: start}
+	for t := start; !t.After(until.UTC()); t = nextBucket(g, t) {
+		validity.Periods = append(validity.Periods, PeriodLabel(g, t))
+		validity.NotAfter = nextBucket(g, t)
+	}
+	return validity, nil
+}
+
+// Attributes returns the period attributes to add to a key
+func (strct *Validity) Attributes() map[string]string {
+	attrs := make(map[string]string, len(strct.Periods))
+	for _, label := range strct.Periods {
+		attrs[label] = PeriodValue
+	}
+	return attrs
+}
+
+// PeriodAttributes returns the period attributes of a key with validity, nil for permanent keys
+func PeriodAttributes(validity *Validity) map[string]string {
+	if validity == nil {
+		return map[string]string{PermanentPeriod: PeriodValue}
+	}
+	return validity.Attributes()
+}
+
+func bucketStart(g Granularity, t time.Time) time.Time {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if g == Week {
+		// ISO weeks start on Monday
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func nextBucket(g Granularity, start time.Time) time.Time {
+	if g == Week {
+		return start.AddDate(0, 0, 7)
+	}
+	return start.AddDate(0, 1, 0)
+}
+
+// ANDs the current period into every policy, so keys whose validity window ended stop matching.
+// Permanent keys match any period through their permanent period attribute.
+type PeriodRewriter struct {
+	granularity Granularity
+	now         func() time.Time
+}
+
+func NewPeriodRewriter(g Granularity) *PeriodRewriter {
+	return &PeriodRewriter{granularity: g, now: time.Now}
+}
+
+func (strct *PeriodRewriter) Rewrite(raw string) (string, error) {
+	node, err := Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	period := Attr{Name: PeriodLabel(strct.granularity, strct.now()), Value: PeriodValue}
+	permanent := Attr{Name: PermanentPeriod, Value: PeriodValue}
+	return And(node, Or(period, permanent)).String(), nil
+}
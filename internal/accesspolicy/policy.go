@@ -0,0 +1,272 @@
+package accesspolicy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// A parsed CP-ABE policy in the tkn20 syntax, e.g. "(role: operator) and not (site: milan)"
+type Node interface {
+	String() string
+}
+
+// Leaf "name: value"
+type Attr struct {
+	Name  string
+	Value string
+}
+
+// Binary gate, Op is "and" or "or"
+type Gate struct {
+	Op    string
+	Left  Node
+	Right Node
+}
+
+type Not struct {
+	Operand Node
+}
+
+func (strct Attr) String() string {
+	return fmt.Sprintf("(%s: %s)", strct.Name, strct.Value)
+}
+
+func (strct Gate) String() string {
+	return fmt.Sprintf("(%s %s %s)", strct.Left, strct.Op, strct.Right)
+}
+
+func (strct Not) String() string {
+	return fmt.Sprintf("not %s", strct.Operand)
+}
+
+// And joins nodes with "and", nil nodes are skipped
+func And(nodes ...Node) Node {
+	return join("and", nodes)
+}
+
+// Or joins nodes with "or", nil nodes are skipped
+func Or(nodes ...Node) Node {
+	return join("or", nodes)
+}
+
+func join(op string, nodes []Node) Node {
+	var out Node
+	for _, n := range nodes {
+		if n == nil {
+			continue
+		}
+		if out == nil {
+			out = n
+			continue
+		}
+		out = Gate{Op: op, Left: out, Right: n}
+	}
+	return out
+}
+
+// Map rebuilds the tree, replacing every attribute leaf with fn's result
+func Map(node Node, fn func(Attr) (Node, error)) (Node, error) {
+	switch n := node.(type) {
+	case Attr:
+		return fn(n)
+	case Gate:
+		left, err := Map(n.Left, fn)
+		if err != nil {
+			return nil, err
+		}
+		right, err := Map(n.Right, fn)
+		if err != nil {
+			return nil, err
+		}
+		return Gate{Op: n.Op, Left: left, Right: right}, nil
+	case Not:
+		operand, err := Map(n.Operand, fn)
+		if err != nil {
+			return nil, err
+		}
+		return Not{Operand: operand}, nil
+	}
+	return nil, fmt.Errorf("accesspolicy: unknown node %T", node)
+}
+
+// Attrs lists every attribute leaf, in order of appearance
+func Attrs(node Node) []Attr {
+	var out []Attr
+	_, _ = Map(node, func(a Attr) (Node, error) {
+		out = append(out, a)
+		return a, nil
+	})
+	return out
+}
+
+// Parse reads a policy in the same grammar tkn20 accepts:
+// or-expressions of and-expressions of optionally negated "(...)" groups or "name: value" leaves.
+// Sets "name in (v1, v2)" are accepted as well and read as "(name: v1) or (name: v2)".
+func Parse(raw string) (Node, error) {
+	tokens, err := tokenize(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{tokens: tokens}
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != "" {
+		return nil, fmt.Errorf("accesspolicy: unexpected %q", p.peek())
+	}
+	return node, nil
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+func (strct *parser) peek() string {
+	if strct.pos < len(strct.tokens) {
+		return strct.tokens[strct.pos]
+	}
+	return ""
+}
+
+func (strct *parser) next() string {
+	token := strct.peek()
+	strct.pos++
+	return token
+}
+
+func (strct *parser) or() (Node, error) {
+	left, err := strct.and()
+	if err != nil {
+		return nil, err
+	}
+	for strct.peek() == "or" {
+		strct.next()
+		right, err := strct.and()
+		if err != nil {
+			return nil, err
+		}
+		left = Gate{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (strct *parser) and() (Node, error) {
+	left, err := strct.not()
+	if err != nil {
+		return nil, err
+	}
+	for strct.peek() == "and" {
+		strct.next()
+		right, err := strct.not()
+		if err != nil {
+			return nil, err
+		}
+		left = Gate{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (strct *parser) not() (Node, error) {
+	if strct.peek() == "not" {
+		strct.next()
+		operand, err := strct.not()
+		if err != nil {
+			return nil, err
+		}
+		return Not{Operand: operand}, nil
+	}
+	return strct.primary()
+}
+
+func (strct *parser) primary() (Node, error) {
+	token := strct.next()
+	if token == "(" {
+		node, err := strct.or()
+		if err != nil {
+			return nil, err
+		}
+		if strct.next() != ")" {
+			return nil, fmt.Errorf("accesspolicy: expected ')' after expression")
+		}
+		return node, nil
+	}
+
+	if !IsIdentifier(token) {
+		return nil, fmt.Errorf("accesspolicy: expected attribute, got %q", token)
+	}
+	if strct.peek() == "in" {
+		strct.next()
+		return strct.set(token)
+	}
+	if strct.next() != ":" {
+		return nil, fmt.Errorf("accesspolicy: expected ':' after %q", token)
+	}
+	value := strct.next()
+	if !IsIdentifier(value) {
+		return nil, fmt.Errorf("accesspolicy: expected value for %q, got %q", token, value)
+	}
+	return Attr{Name: token, Value: value}, nil
+}
+
+// Reads the "(v1, v2)" part of a set, at least one value
+func (strct *parser) set(name string) (Node, error) {
+	if strct.next() != "(" {
+		return nil, fmt.Errorf("accesspolicy: expected '(' after %q in", name)
+	}
+	var values []string
+	for {
+		value := strct.next()
+		if !IsIdentifier(value) {
+			return nil, fmt.Errorf("accesspolicy: expected value in set of %q, got %q", name, value)
+		}
+		values = append(values, value)
+
+		switch strct.next() {
+		case ",":
+			continue
+		case ")":
+			return In(name, values...), nil
+		default:
+			return nil, fmt.Errorf("accesspolicy: expected ',' or ')' in set of %q", name)
+		}
+	}
+}
+
+func tokenize(raw string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(raw); {
+		c := raw[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == ':' || c == ',':
+			tokens = append(tokens, string(c))
+			i++
+		case isIdentChar(c):
+			start := i
+			for i < len(raw) && isIdentChar(raw[i]) {
+				i++
+			}
+			tokens = append(tokens, raw[start:i])
+		default:
+			return nil, fmt.Errorf("accesspolicy: unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+// IsIdentifier reports whether token can be used as an attribute name or value in policies
+func IsIdentifier(token string) bool {
+	if token == "" || token == "and" || token == "or" || token == "not" {
+		return false
+	}
+	return strings.IndexFunc(token, func(r rune) bool { return r > 0x7f || !isIdentChar(byte(r)) }) < 0
+}
+
+// Same character set as the tkn20 lexer: letters, digits & '_'
+func isIdentChar(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_'
+}
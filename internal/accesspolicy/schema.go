@@ -0,0 +1,172 @@
+package accesspolicy
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Type of the signed document the authority publishes the attribute schema in
+const SchemaDocument = "attribute-schema"
+
+// Reserved prefix of the period attributes the authority adds to time-bound keys
+const periodPrefix = "period_"
+
+// Which values an attribute accepts. Values enumerates them, Pattern is a regular expression
+// every value must match in full; with neither, any value is accepted.
+type AttributeRule struct {
+	Values   []string `json:"values,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Required bool     `json:"required,omitempty"`
+
+	pattern *regexp.Regexp
+}
+
+// Attribute names the authority issues keys for & the values each one accepts
+type Schema struct {
+	Attributes map[string]*AttributeRule `json:"attributes"`
+	UpdatedAt  time.Time                 `json:"updated_at"`
+}
+
+// Compile checks the schema itself & prepares its patterns. Must be called before use.
+func (strct *Schema) Compile() error {
+	if len(strct.Attributes) == 0 {
+		return fmt.Errorf("accesspolicy: schema defines no attributes")
+	}
+	for name, rule := range strct.Attributes {
+		if err := checkIdentifier(name); err != nil {
+			return fmt.Errorf("accesspolicy: schema attribute %q: %w", name, err)
+		}
+		if strings.HasPrefix(name, periodPrefix) {
+			return fmt.Errorf("accesspolicy: schema attribute %q: the %s prefix is reserved for validity periods", name, periodPrefix)
+		}
+		if name == SubjectAttribute || name == TraceAttribute {
+			return fmt.Errorf("accesspolicy: schema attribute %q is reserved for key identifiers", name)
+		}
+		if rule == nil {
+			rule = &AttributeRule{}
+			strct.Attributes[name] = rule
+		}
+		for _, value := range rule.Values {
+			if err := checkIdentifier(value); err != nil {
+				return fmt.Errorf("accesspolicy: schema value %s=%q: %w", name, value, err)
+			}
+		}
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("accesspolicy: schema pattern of %q: %w", name, err)
+			}
+			rule.pattern = pattern
+		}
+	}
+	return nil
+}
+
+// CheckAttributes validates a key's attribute set: only known names, allowed values (each
+// value of multi-valued attributes), & every required attribute present. Reserved attributes
+// are always accepted.
+// A nil schema accepts everything.
+func (strct *Schema) CheckAttributes(attrs map[string]string) error {
+	if strct == nil {
+		return nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(attrs)) {
+		if IsReserved(name) {
+			continue
+		}
+		for _, value := range Values(attrs[name]) {
+			if err := strct.checkValue(name, value); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(strct.Attributes)) {
+		if _, ok := attrs[name]; !ok && strct.Attributes[name].Required {
+			return fmt.Errorf("accesspolicy: required attribute %q is missing", name)
+		}
+	}
+	return nil
+}
+
+// CheckPolicy validates every attribute a policy references against the schema.
+// Reserved attributes are set by the authority, they are always accepted.
+func (strct *Schema) CheckPolicy(node Node) error {
+	if strct == nil {
+		return nil
+	}
+	for _, attr := range Attrs(node) {
+		if IsReserved(attr.Name) {
+			continue
+		}
+		if err := strct.checkValue(attr.Name, attr.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (strct *Schema) checkValue(name, value string) error {
+	rule, ok := strct.Attributes[name]
+	if !ok {
+		return fmt.Errorf("accesspolicy: unknown attribute %q", name)
+	}
+	if len(rule.Values) > 0 && !slices.Contains(rule.Values, value) {
+		return fmt.Errorf("accesspolicy: %s=%q is not one of %v", name, value, rule.Values)
+	}
+	if rule.pattern != nil && !rule.pattern.MatchString(value) {
+		return fmt.Errorf("accesspolicy: %s=%q does not match %q", name, value, rule.Pattern)
+	}
+	return nil
+}
+
+// Rejects policies referencing attributes or values outside the schema, before any rewrite.
+// Register it as the first rewriter; policies pass unchanged until a schema is set.
+type SchemaValidator struct {
+	mu     sync.RWMutex
+	schema *Schema
+}
+
+func NewSchemaValidator(schema *Schema) *SchemaValidator {
+	return &SchemaValidator{schema: schema}
+}
+
+// Replaces the schema used for future checks
+func (strct *SchemaValidator) SetSchema(schema *Schema) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	strct.schema = schema
+}
+
+func (strct *SchemaValidator) Rewrite(raw string) (string, error) {
+	strct.mu.RLock()
+	schema := strct.schema
+	strct.mu.RUnlock()
+
+	if schema == nil {
+		return raw, nil
+	}
+	node, err := Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if err := schema.CheckPolicy(node); err != nil {
+		return "", err
+	}
+	return raw, nil
+}
+
+// Names & values must be valid tkn20 policy identifiers
+func checkIdentifier(s string) error {
+	if !IsIdentifier(s) {
+		return fmt.Errorf("only letters, digits and _ are allowed")
+	}
+	if strings.Contains(s, versionSeparator) {
+		return fmt.Errorf("%q is reserved for attribute versions", versionSeparator)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package accesspolicy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Reserved attribute the authority adds to every key, holding the subject's unique identifier
+	SubjectAttribute = "subject_id"
+
+	// Reserved attribute holding a key's hidden tracing identifier
+	TraceAttribute = "trace_id"
+)
+
+// NewSubjectID returns a fresh random subject identifier. Identifiers are never reused:
+// a subject issued a key again after revocation gets a new one.
+func NewSubjectID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("accesspolicy: generate subject ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// IsReserved reports whether an attribute name is set by the authority itself & may not be
+// requested for a key: the subject & tracing identifiers, period & member attributes
+func IsReserved(name string) bool {
+	return name == SubjectAttribute || name == TraceAttribute || strings.HasPrefix(name, periodPrefix) ||
+		strings.Contains(name, memberSeparator)
+}
+
+// ForSubjects builds a policy only the keys of the given subject identifiers satisfy.
+// With a non-empty policy, those keys must satisfy it as well.
+func ForSubjects(subjectIDs []string, policy string) (string, error) {
+	if len(subjectIDs) == 0 {
+		return "", fmt.Errorf("accesspolicy: no subjects given")
+	}
+	var subjects []Node
+	for _, id := range subjectIDs {
+		if !IsIdentifier(id) {
+			return "", fmt.Errorf("accesspolicy: invalid subject ID %q", id)
+		}
+		subjects = append(subjects, Attr{Name: SubjectAttribute, Value: id})
+	}
+
+	var restriction Node
+	if policy != "" {
+		node, err := Parse(policy)
+		if err != nil {
+			return "", err
+		}
+		restriction = node
+	}
+	return And(Or(subjects...), restriction).String(), nil
+}
@@ -0,0 +1,137 @@
+package accesspolicy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Separates an attribute value from its version in issued keys & rewritten policies
+const versionSeparator = "__v"
+
+// Current version of every attribute value that has been revoked at least once.
+// Values missing from the table are at version 0 and are used unchanged.
+// MultiValued lists the attributes some key holds several values of.
+type VersionTable struct {
+	Versions    map[string]map[string]int `json:"versions"`
+	MultiValued map[string]bool           `json:"multi_valued,omitempty"`
+	UpdatedAt   time.Time                 `json:"updated_at"`
+}
+
+// Version returns the current version of name=value
+func (strct *VersionTable) Version(name, value string) int {
+	if strct == nil {
+		return 0
+	}
+	return strct.Versions[name][value]
+}
+
+// Bump moves name=value to its next version, invalidating every key issued for the old one
+func (strct *VersionTable) Bump(name, value string) int {
+	if strct.Versions == nil {
+		strct.Versions = make(map[string]map[string]int)
+	}
+	if strct.Versions[name] == nil {
+		strct.Versions[name] = make(map[string]int)
+	}
+	strct.Versions[name][value]++
+	strct.UpdatedAt = time.Now().UTC()
+	return strct.Versions[name][value]
+}
+
+// Encode returns the value as it appears in keys & policies, e.g. "operator__v3"
+func (strct *VersionTable) Encode(name, value string) string {
+	if v := strct.Version(name, value); v > 0 {
+		return fmt.Sprintf("%s%s%d", value, versionSeparator, v)
+	}
+	return value
+}
+
+// EncodeAll encodes every attribute of a key with its current version.
+// Each value of a multi-valued attribute becomes its own member attribute.
+func (strct *VersionTable) EncodeAll(attrs map[string]string) map[string]string {
+	out := make(map[string]string, len(attrs))
+	for name, value := range attrs {
+		values := Values(value)
+		if len(values) == 1 {
+			out[name] = strct.Encode(name, value)
+			continue
+		}
+		for _, v := range values {
+			out[MemberAttribute(name, v)] = strct.Encode(name, v)
+		}
+	}
+	return out
+}
+
+// IsMultiValued reports whether some key holds several values of name
+func (strct *VersionTable) IsMultiValued(name string) bool {
+	return strct != nil && strct.MultiValued[name]
+}
+
+// MarkMultiValued records that keys hold several values of name, so policies match member
+// attributes too. Reports whether the table changed.
+func (strct *VersionTable) MarkMultiValued(name string) bool {
+	if strct.MultiValued[name] {
+		return false
+	}
+	if strct.MultiValued == nil {
+		strct.MultiValued = make(map[string]bool)
+	}
+	strct.MultiValued[name] = true
+	strct.UpdatedAt = time.Now().UTC()
+	return true
+}
+
+// Rewrites policies like "(role: operator)" into their versioned form "(role: operator__v3)".
+// Leaves of multi-valued attributes also match the member attribute, e.g.
+// "((role: operator__v3) or (role__in__operator: operator__v3))". Negating them is rejected.
+// The table can be swapped at runtime when the authority publishes a new one.
+type VersionRewriter struct {
+	mu    sync.RWMutex
+	table *VersionTable
+}
+
+func NewVersionRewriter(table *VersionTable) *VersionRewriter {
+	return &VersionRewriter{table: table}
+}
+
+// Replaces the version table used for future rewrites
+func (strct *VersionRewriter) SetTable(table *VersionTable) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	strct.table = table
+}
+
+func (strct *VersionRewriter) Rewrite(raw string) (string, error) {
+	strct.mu.RLock()
+	table := strct.table
+	strct.mu.RUnlock()
+
+	node, err := Parse(raw)
+	if err != nil {
+		return "", err
+	}
+
+	// A negated leaf needs the plain attribute, which keys holding several values lack
+	for _, a := range NegatedAttrs(node) {
+		if table.IsMultiValued(a.Name) {
+			return "", fmt.Errorf("accesspolicy: cannot negate multi-valued attribute %q, list the allowed values instead", a.Name)
+		}
+	}
+
+	rewritten, err := Map(node, func(a Attr) (Node, error) {
+		encoded := Attr{Name: a.Name, Value: table.Encode(a.Name, a.Value)}
+		if !table.IsMultiValued(a.Name) {
+			return encoded, nil
+		}
+		return Or(encoded, Attr{Name: MemberAttribute(a.Name, a.Value), Value: encoded.Value}), nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return rewritten.String(), nil
+}
+
+// Type of the signed document the authority publishes the version table in
+const VersionTableDocument = "attribute-versions"
@@ -0,0 +1,191 @@
+package accessreview
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+)
+
+const (
+	// Where the publisher's topic to policy mapping lives, next to the system keys
+	TopicPoliciesFile = "topic_policies.json"
+
+	// The authority's issued-key registry
+	RegistryFile = "registry.json"
+)
+
+// The policy messages on a topic are encrypted under. Topic may be an MQTT filter (+, #)
+// for lookups; publishers only publish to plain topics. Publishers lists the broker users
+// allowed to publish to it.
+type TopicPolicy struct {
+	Topic      string   `json:"topic"`
+	Policy     string   `json:"policy"`
+	Publishers []string `json:"publishers,omitempty"`
+
+	node accesspolicy.Node
+}
+
+// Topic to policy configuration shared by publishers & access reviews
+type TopicPolicies struct {
+	Topics []*TopicPolicy `json:"topics"`
+}
+
+// Loads & parses the topic policies, nil if the file does not exist
+func LoadTopicPolicies(path string) (*TopicPolicies, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("accessreview: read %s: %w", path, err)
+	}
+
+	var config TopicPolicies
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("accessreview: parse %s: %w", path, err)
+	}
+	for _, topic := range config.Topics {
+		if topic.Topic == "" {
+			return nil, fmt.Errorf("accessreview: %s: entry without topic", path)
+		}
+		if topic.node, err = accesspolicy.Parse(topic.Policy); err != nil {
+			return nil, fmt.Errorf("accessreview: %s: policy of %s: %w", path, topic.Topic, err)
+		}
+	}
+	return &config, nil
+}
+
+// Parsed policy, set by LoadTopicPolicies
+func (strct *TopicPolicy) Node() accesspolicy.Node {
+	return strct.node
+}
+
+// Reports whether the entry is a plain topic a publisher can publish to
+func (strct *TopicPolicy) Publishable() bool {
+	return !strings.ContainsAny(strct.Topic, "+#")
+}
+
+// Returns the first entry whose topic or filter matches topic
+func (strct *TopicPolicies) PolicyFor(topic string) (*TopicPolicy, bool) {
+	if strct == nil {
+		return nil, false
+	}
+	for _, entry := range strct.Topics {
+		if MatchTopic(entry.Topic, topic) {
+			return entry, true
+		}
+	}
+	return nil, false
+}
+
+// MatchTopic reports whether an MQTT topic filter matches topic
+func MatchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// An issued key as recorded in the authority's registry, with just what reviews need
+type Holder struct {
+	Subject     string                 `json:"subject"`
+	KeyFile     string                 `json:"key_file,omitempty"`
+	DeviceID    string                 `json:"device_id,omitempty"`
+	Attributes  map[string]string      `json:"attributes"`
+	KeyID       string                 `json:"key_id,omitempty"`
+	Validity    *accesspolicy.Validity `json:"validity,omitempty"`
+	Permanent   bool                   `json:"permanent,omitempty"`
+	Fingerprint string                 `json:"fingerprint,omitempty"`
+	Revoked     bool                   `json:"revoked,omitempty"`
+}
+
+// Loads every key of the registry, nil if nothing was issued yet
+func LoadHolders(path string) ([]Holder, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("accessreview: read %s: %w", path, err)
+	}
+
+	var registry struct {
+		Entries []Holder `json:"entries"`
+	}
+	if err := json.Unmarshal(data, &registry); err != nil {
+		return nil, fmt.Errorf("accessreview: parse %s: %w", path, err)
+	}
+	return registry.Entries, nil
+}
+
+// SubjectIDs resolves subject names to the identifiers their current keys carry, for
+// publishing to single subjects. Revoked subjects & keys without identifier are errors.
+func SubjectIDs(holders []Holder, subjects ...string) ([]string, error) {
+	ids := make([]string, 0, len(subjects))
+	for _, subject := range subjects {
+		id := ""
+		for _, holder := range holders {
+			if holder.Subject == subject && !holder.Revoked {
+				id = holder.Attributes[accesspolicy.SubjectAttribute]
+			}
+		}
+		if id == "" {
+			return nil, fmt.Errorf("accessreview: no active key with subject identifier for %q", subject)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Reports whether the key is neither revoked, outside its validity window at now nor issued
+// under another epoch than keyID, the current one ("" on systems without epochs). Keys of
+// archived epochs only read messages published before their rotation.
+func (strct *Holder) Usable(keyID string, now time.Time) bool {
+	if strct.Revoked || strct.KeyID != keyID {
+		return false
+	}
+	if strct.Validity != nil && (now.Before(strct.Validity.NotBefore) || !now.Before(strct.Validity.NotAfter)) {
+		return false
+	}
+	return true
+}
+
+// Reports whether the key can read messages published under the logical policy at now.
+// Period attributes count, so policies naming periods are evaluated too; permanent keys
+// issued before the permanent period attribute existed match no period clause.
+func (strct *Holder) CanRead(node accesspolicy.Node, keyID string, now time.Time) bool {
+	if !strct.Usable(keyID, now) {
+		return false
+	}
+	attrs := maps.Clone(strct.Attributes)
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	if strct.Validity != nil || strct.Permanent {
+		maps.Copy(attrs, accesspolicy.PeriodAttributes(strct.Validity))
+	}
+	return accesspolicy.Satisfies(node, attrs)
+}
+
+// Readers returns the holders of epoch keyID that can read messages published under the policy at now
+func Readers(node accesspolicy.Node, holders []Holder, keyID string, now time.Time) []Holder {
+	var readers []Holder
+	for _, holder := range holders {
+		if holder.CanRead(node, keyID, now) {
+			readers = append(readers, holder)
+		}
+	}
+	return readers
+}
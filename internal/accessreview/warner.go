@@ -0,0 +1,51 @@
+package accessreview
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+)
+
+// Warns when a publish policy is satisfied by no issued key, so messages nobody can read
+// are noticed. Policies pass unchanged; register it before rewriters that version attributes.
+type UnreachableWarner struct {
+	mu      sync.Mutex
+	holders []Holder
+	keyID   string
+	loaded  bool
+	warned  map[string]bool
+}
+
+func NewUnreachableWarner() *UnreachableWarner {
+	return &UnreachableWarner{warned: make(map[string]bool)}
+}
+
+// Replaces the issued keys policies are checked against, only those of the current epoch keyID
+// count, & warns again about unreachable policies
+func (strct *UnreachableWarner) SetHolders(holders []Holder, keyID string) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	strct.holders, strct.keyID = holders, keyID
+	strct.loaded = true
+	clear(strct.warned)
+}
+
+func (strct *UnreachableWarner) Rewrite(raw string) (string, error) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+
+	if !strct.loaded || strct.warned[raw] {
+		return raw, nil
+	}
+	node, err := accesspolicy.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	if len(Readers(node, strct.holders, strct.keyID, time.Now().UTC())) == 0 {
+		log.Printf("[WARNING] No issued key satisfies policy %q, nobody can read these messages", raw)
+		strct.warned[raw] = true
+	}
+	return raw, nil
+}
@@ -34,9 +34,14 @@ func (strct *AESCryptography) GenerateKey() ([]byte, error) {
 // 1. Topic -> Prevents copying ciphertext to another topic and still decrypting
 // 2. Policy -> Prevents swapping policy strings while keeping ciphertext
 // 3. Version -> Prevents mixing versions
-func (strct *AESCryptography) BuildAAD(topic, policy, version string) []byte {
+// 4. Context -> Optional envelope fields as "name=value" (e.g. key ID), appended only when present
+func (strct *AESCryptography) BuildAAD(topic, policy, version string, context ...string) []byte {
 	// Concatenate with '|' delimiter so fields are distinguishable.
-	return []byte(fmt.Sprintf("%s|%s|%s", version, topic, policy))
+	aad := fmt.Sprintf("%s|%s|%s", version, topic, policy)
+	for _, field := range context {
+		aad += "|" + field
+	}
+	return []byte(aad)
 }
 
 // Encrypt plaintext with AES
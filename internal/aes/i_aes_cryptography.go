@@ -3,7 +3,7 @@ package aescryptography
 type IAESCryptography interface {
 	GenerateKey() ([]byte, error)
 
-	BuildAAD(topic, policy, version string) []byte
+	BuildAAD(topic, policy, version string, context ...string) []byte
 
 	Encrypt(key, plaintext, aad []byte) (iv, ciphertext []byte, err error)
 
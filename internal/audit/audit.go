@@ -0,0 +1,215 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Hash chained to by the first event of a log
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// One authority operation. Hash covers every other field, including PrevHash, so changing,
+// removing or reordering any event breaks the chain from that point on.
+type Event struct {
+	Seq         int               `json:"seq"`
+	Time        time.Time         `json:"time"`
+	Operation   string            `json:"operation"`
+	Operator    string            `json:"operator"`
+	Subject     string            `json:"subject,omitempty"`
+	KeyFile     string            `json:"key_file,omitempty"`
+	DeviceID    string            `json:"device_id,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	KeyID       string            `json:"key_id,omitempty"`
+	Fingerprint string            `json:"fingerprint,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+	PrevHash    string            `json:"prev_hash"`
+	Hash        string            `json:"hash"`
+}
+
+// An append-only JSON Lines file, one event per line
+type Log struct {
+	path string
+}
+
+func Open(path string) *Log {
+	return &Log{path: path}
+}
+
+// Append chains event to the last one in the log & writes it.
+// Seq, Time, PrevHash & Hash are filled in; the file is locked while appending.
+func (strct *Log) Append(event Event) (*Event, error) {
+	return strct.AppendThen(event, nil)
+}
+
+// AppendThen appends event like Append & calls then with the written event before the log is
+// unlocked, so whatever then records about the last event, e.g. a signed head, never falls
+// behind a concurrent append
+func (strct *Log) AppendThen(event Event, then func(*Event) error) (*Event, error) {
+	file, err := os.OpenFile(strct.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("audit: open %s: %w", strct.path, err)
+	}
+	defer file.Close()
+
+	if err := lock(file); err != nil {
+		return nil, fmt.Errorf("audit: lock %s: %w", strct.path, err)
+	}
+	defer unlock(file)
+
+	last, err := lastEvent(file)
+	if err != nil {
+		return nil, err
+	}
+	event.Seq, event.PrevHash = 1, genesisHash
+	if last != nil {
+		event.Seq, event.PrevHash = last.Seq+1, last.Hash
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	if event.Hash, err = hashEvent(event); err != nil {
+		return nil, err
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return nil, fmt.Errorf("audit: marshal event: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+		return nil, fmt.Errorf("audit: seek %s: %w", strct.path, err)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("audit: write %s: %w", strct.path, err)
+	}
+	if err := file.Sync(); err != nil {
+		return nil, fmt.Errorf("audit: sync %s: %w", strct.path, err)
+	}
+	if then != nil {
+		if err := then(&event); err != nil {
+			return nil, err
+		}
+	}
+	return &event, nil
+}
+
+// Verify walks the whole chain & returns its last event, nil for an empty or missing log.
+// The error names the first event whose hash or link does not match.
+func (strct *Log) Verify() (*Event, error) {
+	var last *Event
+	err := strct.each(func(event *Event) error {
+		prevHash, seq := genesisHash, 1
+		if last != nil {
+			prevHash, seq = last.Hash, last.Seq+1
+		}
+		if event.Seq != seq {
+			return fmt.Errorf("audit: event %d: expected sequence number %d", event.Seq, seq)
+		}
+		if event.PrevHash != prevHash {
+			return fmt.Errorf("audit: event %d: does not chain to the previous event", event.Seq)
+		}
+		hash, err := hashEvent(*event)
+		if err != nil {
+			return err
+		}
+		if hash != event.Hash {
+			return fmt.Errorf("audit: event %d: content does not match its hash", event.Seq)
+		}
+		last = event
+		return nil
+	})
+	return last, err
+}
+
+// Export writes the events at or after since as JSON Lines, e.g. for a SIEM
+func (strct *Log) Export(w io.Writer, since time.Time) (int, error) {
+	count := 0
+	err := strct.each(func(event *Event) error {
+		if event.Time.Before(since) {
+			return nil
+		}
+		line, err := json.Marshal(event)
+		if err != nil {
+			return fmt.Errorf("audit: marshal event %d: %w", event.Seq, err)
+		}
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			return fmt.Errorf("audit: export: %w", err)
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func (strct *Log) each(fn func(*Event) error) error {
+	file, err := os.Open(strct.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("audit: open %s: %w", strct.path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("audit: %s line %d: %w", strct.path, line, err)
+		}
+		if err := fn(&event); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("audit: read %s: %w", strct.path, err)
+	}
+	return nil
+}
+
+// Reads the last event of an open log, nil if it is empty
+func lastEvent(file *os.File) (*Event, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("audit: seek: %w", err)
+	}
+	var last []byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("audit: read log: %w", err)
+	}
+	if last == nil {
+		return nil, nil
+	}
+	var event Event
+	if err := json.Unmarshal(last, &event); err != nil {
+		return nil, fmt.Errorf("audit: parse last event: %w", err)
+	}
+	return &event, nil
+}
+
+// SHA-256 over the event's JSON with Hash left empty
+func hashEvent(event Event) (string, error) {
+	event.Hash = ""
+	data, err := json.Marshal(event)
+	if err != nil {
+		return "", fmt.Errorf("audit: marshal event %d: %w", event.Seq, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package audit
+
+import "os"
+
+// Without flock, appends from concurrent authority commands are not serialized
+func lock(file *os.File) error {
+	return nil
+}
+
+func unlock(file *os.File) {}
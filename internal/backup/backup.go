@@ -0,0 +1,301 @@
+package backup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"securemqtt/internal/keystore"
+	"securemqtt/internal/namespace"
+	"securemqtt/internal/signed"
+)
+
+const (
+	// Type of the signed document an archive is wrapped in
+	Document = "authority-backup"
+
+	// Archive format version
+	Version = 1
+
+	// Key derivation from the passphrase: PBKDF2-HMAC-SHA256
+	kdfName       = "pbkdf2-sha256"
+	kdfIterations = 600000
+	saltSize      = 16
+	keySize       = 32
+
+	// Passphrases shorter than this are refused when sealing
+	MinPassphrase = 12
+)
+
+// One file of the keys directory. Name is relative & slash separated, e.g. epochs/e1/public.key.
+type File struct {
+	Name string      `json:"name"`
+	Mode fs.FileMode `json:"mode"`
+	Data []byte      `json:"data"`
+}
+
+// Everything an archive holds, once decrypted
+type Contents struct {
+	CreatedAt time.Time `json:"created_at"`
+	Namespace string    `json:"namespace,omitempty"`
+	Files     []File    `json:"files"`
+}
+
+// The signed part of an archive: KDF parameters & the AES-256-GCM encrypted contents.
+// Signer is the authority signing key, so an archive can be checked before it is decrypted.
+type sealed struct {
+	Version    int       `json:"version"`
+	CreatedAt  time.Time `json:"created_at"`
+	Signer     []byte    `json:"signer"`
+	KDF        string    `json:"kdf"`
+	Iterations int       `json:"iterations"`
+	Salt       []byte    `json:"salt"`
+	Nonce      []byte    `json:"nonce"`
+	Ciphertext []byte    `json:"ciphertext"`
+}
+
+// Collect reads every regular file below dir, except the key store's lock & temporary files.
+// The default namespace's directory is the keys root: the other namespaces below it are left out,
+// they are backed up on their own.
+func Collect(dir, ns string, now time.Time) (*Contents, error) {
+	contents := &Contents{CreatedAt: now.UTC(), Namespace: ns}
+	err := walkFiles(dir, ns, func(path string, entry fs.DirEntry) error {
+		if keystore.Internal(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		contents.Files = append(contents.Files, File{Name: filepath.ToSlash(name), Mode: info.Mode().Perm(), Data: data})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("backup: collect %s: %w", dir, err)
+	}
+	sort.Slice(contents.Files, func(i, j int) bool { return contents.Files[i].Name < contents.Files[j].Name })
+	return contents, nil
+}
+
+// Find returns the file called name, nil if the archive does not hold it
+func (strct *Contents) Find(name string) *File {
+	for i := range strct.Files {
+		if strct.Files[i].Name == name {
+			return &strct.Files[i]
+		}
+	}
+	return nil
+}
+
+// Extract writes every file below dir, atomically replacing files of the same name.
+// Files of other namespaces are refused, they are never part of an archive.
+func (strct *Contents) Extract(dir string) error {
+	for _, file := range strct.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Name)) {
+			return fmt.Errorf("backup: refusing to extract %q outside %s", file.Name, dir)
+		}
+		if strings.HasPrefix(file.Name, namespace.Dir+"/") {
+			return fmt.Errorf("backup: refusing to extract %q into another namespace", file.Name)
+		}
+		if err := keystore.WriteFile(filepath.Join(dir, filepath.FromSlash(file.Name)), file.Data, file.Mode.Perm()); err != nil {
+			return fmt.Errorf("backup: %w", err)
+		}
+	}
+	return nil
+}
+
+// Prune removes the files below dir the archive does not hold, so a restored directory holds
+// exactly the archive: later epochs, issued keys or queued requests do not outlive the restore.
+// Lock & temporary files and other namespaces are kept. Returns the removed names.
+func (strct *Contents) Prune(dir string) ([]string, error) {
+	keep := make(map[string]bool, len(strct.Files))
+	for _, file := range strct.Files {
+		keep[file.Name] = true
+	}
+
+	var removed []string
+	parents := make(map[string]bool)
+	err := walkFiles(dir, strct.Namespace, func(path string, entry fs.DirEntry) error {
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if keep[filepath.ToSlash(name)] || keystore.Internal(entry.Name()) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed = append(removed, filepath.ToSlash(name))
+		parents[filepath.Dir(path)] = true
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("backup: prune %s: %w", dir, err)
+	}
+
+	// Directories left empty go too, deepest first; non-empty ones fail to remove & stay
+	dirs := make([]string, 0, len(parents))
+	for parent := range parents {
+		for ; parent != dir && strings.HasPrefix(parent, dir); parent = filepath.Dir(parent) {
+			dirs = append(dirs, parent)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return len(dirs[i]) > len(dirs[j]) })
+	for _, empty := range dirs {
+		_ = os.Remove(empty)
+	}
+	sort.Strings(removed)
+	return removed, nil
+}
+
+// Calls fn for every regular file below dir, skipping the other namespaces when dir is the
+// default namespace's keys root
+func walkFiles(dir, ns string, fn func(path string, entry fs.DirEntry) error) error {
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ns == "" && entry.IsDir() && path == filepath.Join(dir, namespace.Dir) {
+			return filepath.SkipDir
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		return fn(path, entry)
+	})
+}
+
+// Seal encrypts contents under a key derived from passphrase & signs the result with signingKey
+func Seal(contents *Contents, passphrase []byte, signingKey ed25519.PrivateKey) ([]byte, error) {
+	if len(strings.TrimSpace(string(passphrase))) < MinPassphrase {
+		return nil, fmt.Errorf("backup: passphrase must be at least %d characters", MinPassphrase)
+	}
+	plaintext, err := json.Marshal(contents)
+	if err != nil {
+		return nil, fmt.Errorf("backup: marshal contents: %w", err)
+	}
+	defer clear(plaintext)
+
+	archive := sealed{
+		Version:    Version,
+		CreatedAt:  contents.CreatedAt,
+		Signer:     signingKey.Public().(ed25519.PublicKey),
+		KDF:        kdfName,
+		Iterations: kdfIterations,
+		Salt:       make([]byte, saltSize),
+	}
+	if _, err := io.ReadFull(rand.Reader, archive.Salt); err != nil {
+		return nil, fmt.Errorf("backup: salt: %w", err)
+	}
+	gcm, err := archive.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	archive.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, archive.Nonce); err != nil {
+		return nil, fmt.Errorf("backup: nonce: %w", err)
+	}
+	archive.Ciphertext = gcm.Seal(nil, archive.Nonce, plaintext, archive.aad())
+
+	return signed.Sign(signingKey, Document, archive)
+}
+
+// Signer returns the signing key an archive claims to be signed with, without verifying it
+func Signer(data []byte) (ed25519.PublicKey, error) {
+	var doc signed.Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("backup: parse archive: %w", err)
+	}
+	var archive sealed
+	if err := json.Unmarshal(doc.Payload, &archive); err != nil {
+		return nil, fmt.Errorf("backup: parse archive: %w", err)
+	}
+	if len(archive.Signer) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("backup: archive has no signing key")
+	}
+	return ed25519.PublicKey(archive.Signer), nil
+}
+
+// Open verifies an archive against trusted & decrypts it.
+// The signature is checked before the passphrase is used, so a tampered archive is never decrypted.
+func Open(data, passphrase []byte, trusted ed25519.PublicKey) (*Contents, error) {
+	var archive sealed
+	if err := signed.Verify(trusted, Document, data, &archive); err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	if !ed25519.PublicKey(archive.Signer).Equal(trusted) {
+		return nil, fmt.Errorf("backup: archive names signing key %s, verified with %s",
+			signed.Fingerprint(archive.Signer), signed.Fingerprint(trusted))
+	}
+	if archive.Version != Version || archive.KDF != kdfName {
+		return nil, fmt.Errorf("backup: unsupported archive version %d (%s)", archive.Version, archive.KDF)
+	}
+
+	gcm, err := archive.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, archive.Nonce, archive.Ciphertext, archive.aad())
+	if err != nil {
+		return nil, fmt.Errorf("backup: wrong passphrase or corrupted archive")
+	}
+	defer clear(plaintext)
+
+	var contents Contents
+	if err := json.Unmarshal(plaintext, &contents); err != nil {
+		return nil, fmt.Errorf("backup: decode contents: %w", err)
+	}
+	if !contents.CreatedAt.Equal(archive.CreatedAt) {
+		return nil, fmt.Errorf("backup: contents do not match the archive header")
+	}
+	return &contents, nil
+}
+
+// AES-256-GCM keyed from the passphrase with the archive's KDF parameters
+func (strct *sealed) cipher(passphrase []byte) (cipher.AEAD, error) {
+	if strct.Iterations < 1 || len(strct.Salt) != saltSize {
+		return nil, fmt.Errorf("backup: invalid key derivation parameters")
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), strct.Salt, strct.Iterations, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("backup: derive key: %w", err)
+	}
+	defer clear(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("backup: cipher init failed: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("backup: GCM init failed: %w", err)
+	}
+	return gcm, nil
+}
+
+// Binds the ciphertext to the archive header it was sealed with
+func (strct *sealed) aad() []byte {
+	return fmt.Appendf(nil, "%s|%d|%s|%s|%d|%x", Document, strct.Version, strct.CreatedAt.Format(time.RFC3339Nano),
+		strct.KDF, strct.Iterations, strct.Signer)
+}
@@ -0,0 +1,200 @@
+package brokeracl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"securemqtt/internal/accessreview"
+	"securemqtt/internal/delegation"
+	"securemqtt/internal/enrollment"
+)
+
+const (
+	// Directory under /keys the generated broker configuration is written to
+	Dir = "broker"
+
+	// Mosquitto acl_file & dynamic security plugin configuration
+	ACLFile             = "acl"
+	DynamicSecurityFile = "dynamic-security.json"
+
+	// Broker users of the authority & of publishers of topics that name none
+	AuthorityUser    = "authority"
+	DefaultPublisher = "publisher"
+)
+
+// Topics one broker user may subscribe to & publish to
+type UserRules struct {
+	Read  []string
+	Write []string
+}
+
+// Broker permissions mirroring cryptographic access: a user may read a topic only if its key
+// satisfies the topic's policy, & write it only if listed as one of its publishers
+type Rules struct {
+	Users map[string]*UserRules
+}
+
+// Generate derives broker permissions from the topic policies & the keys of epoch keyID at now.
+// Enrolled keys are granted to their device ID, other keys to their subject.
+func Generate(config *accessreview.TopicPolicies, holders []accessreview.Holder, keyID string, now time.Time) (*Rules, error) {
+	rules := &Rules{Users: make(map[string]*UserRules)}
+	rules.user(AuthorityUser).Write = []string{enrollment.ReplyTopicPrefix + "#", enrollment.RequestTopicFilter, enrollment.ReissueTopicPrefix + "#",
+		delegation.ReplyTopicPrefix + "#", delegation.RequestTopicFilter}
+	rules.user(AuthorityUser).Read = []string{enrollment.RequestTopicFilter, delegation.RequestTopicFilter}
+
+	if config == nil {
+		return rules, nil
+	}
+	for _, entry := range config.Topics {
+		publishers := entry.Publishers
+		if len(publishers) == 0 {
+			publishers = []string{DefaultPublisher}
+		}
+		for _, publisher := range publishers {
+			if err := checkUsername(publisher); err != nil {
+				return nil, fmt.Errorf("brokeracl: publisher of %s: %w", entry.Topic, err)
+			}
+			rules.user(publisher).Write = append(rules.user(publisher).Write, entry.Topic)
+		}
+
+		for _, reader := range accessreview.Readers(entry.Node(), holders, keyID, now) {
+			username := Username(&reader)
+			if err := checkUsername(username); err != nil {
+				return nil, fmt.Errorf("brokeracl: key of %s: %w", reader.Subject, err)
+			}
+			rules.user(username).Read = append(rules.user(username).Read, entry.Topic)
+		}
+	}
+	return rules, nil
+}
+
+// Broker user a key is granted to: the enrolled device, or the subject
+func Username(holder *accessreview.Holder) string {
+	if holder.DeviceID != "" {
+		return holder.DeviceID
+	}
+	return holder.Subject
+}
+
+func (strct *Rules) user(username string) *UserRules {
+	rules, ok := strct.Users[username]
+	if !ok {
+		rules = &UserRules{}
+		strct.Users[username] = rules
+	}
+	return rules
+}
+
+// MosquittoACL renders the rules as a mosquitto acl_file. Devices may always request a key
+// for themselves & receive the reply or a re-issue notice, matching enrollment topics by username; site
+// sub-authorities likewise use the delegation topics of their own name.
+func (strct *Rules) MosquittoACL() []byte {
+	var out bytes.Buffer
+	out.WriteString("# Generated by the authority from registry.json and topic_policies.json, do not edit\n\n")
+	fmt.Fprintf(&out, "pattern write %s%%u\n", enrollment.RequestTopicPrefix)
+	fmt.Fprintf(&out, "pattern read %s%%u\n", enrollment.ReplyTopicPrefix)
+	fmt.Fprintf(&out, "pattern read %s%%u\n", enrollment.ReissueTopicPrefix)
+	fmt.Fprintf(&out, "pattern write %s%%u/+\n", delegation.RequestTopicPrefix)
+	fmt.Fprintf(&out, "pattern readwrite %s%%u/+\n", delegation.ReplyTopicPrefix)
+
+	for _, username := range slices.Sorted(maps.Keys(strct.Users)) {
+		rules := strct.Users[username]
+		fmt.Fprintf(&out, "\nuser %s\n", username)
+		for _, topic := range unique(rules.Read) {
+			fmt.Fprintf(&out, "topic read %s\n", topic)
+		}
+		for _, topic := range unique(rules.Write) {
+			fmt.Fprintf(&out, "topic write %s\n", topic)
+		}
+	}
+	return out.Bytes()
+}
+
+// Configuration of the mosquitto dynamic security plugin
+type dynamicSecurity struct {
+	DefaultACLAccess map[string]bool `json:"defaultACLAccess"`
+	Clients          []dynsecClient  `json:"clients"`
+	Groups           []any           `json:"groups"`
+	Roles            []dynsecRole    `json:"roles"`
+}
+
+type dynsecClient struct {
+	Username string          `json:"username"`
+	Roles    []dynsecRoleRef `json:"roles"`
+}
+
+type dynsecRoleRef struct {
+	Rolename string `json:"rolename"`
+}
+
+type dynsecRole struct {
+	Rolename string      `json:"rolename"`
+	ACLs     []dynsecACL `json:"acls"`
+}
+
+type dynsecACL struct {
+	ACLType string `json:"acltype"`
+	Topic   string `json:"topic"`
+	Allow   bool   `json:"allow"`
+}
+
+// DynamicSecurity renders the rules as dynamic security plugin configuration: one role per
+// user, which may also request a key for itself, & everything not granted denied.
+// Client passwords are not part of it, set them with mosquitto_ctrl after loading.
+func (strct *Rules) DynamicSecurity() ([]byte, error) {
+	config := dynamicSecurity{
+		DefaultACLAccess: map[string]bool{
+			"publishClientSend":    false,
+			"publishClientReceive": false,
+			"subscribe":            false,
+			"unsubscribe":          true,
+		},
+		Clients: []dynsecClient{},
+		Groups:  []any{},
+		Roles:   []dynsecRole{},
+	}
+
+	for _, username := range slices.Sorted(maps.Keys(strct.Users)) {
+		rules := strct.Users[username]
+		read := append(slices.Clone(rules.Read), enrollment.ReplyTopic(username), enrollment.ReissueTopic(username))
+		write := append(slices.Clone(rules.Write), enrollment.RequestTopic(username))
+
+		role := dynsecRole{Rolename: "user-" + username, ACLs: []dynsecACL{}}
+		for _, topic := range unique(read) {
+			role.ACLs = append(role.ACLs,
+				dynsecACL{ACLType: "subscribePattern", Topic: topic, Allow: true},
+				dynsecACL{ACLType: "publishClientReceive", Topic: topic, Allow: true})
+		}
+		for _, topic := range unique(write) {
+			role.ACLs = append(role.ACLs, dynsecACL{ACLType: "publishClientSend", Topic: topic, Allow: true})
+		}
+		config.Roles = append(config.Roles, role)
+		config.Clients = append(config.Clients, dynsecClient{
+			Username: username,
+			Roles:    []dynsecRoleRef{{Rolename: role.Rolename}},
+		})
+	}
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("brokeracl: marshal dynamic security: %w", err)
+	}
+	return data, nil
+}
+
+// Usernames end up in line-based ACL files & topic patterns
+func checkUsername(username string) error {
+	if username == "" || strings.ContainsAny(username, " \t\r\n+#/%") {
+		return fmt.Errorf("%q is not a usable broker username", username)
+	}
+	return nil
+}
+
+func unique(topics []string) []string {
+	return slices.Compact(slices.Sorted(slices.Values(topics)))
+}
@@ -1,6 +1,8 @@
 package clientmqtt
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"securemqtt/internal"
 	"time"
@@ -12,13 +14,34 @@ type MQTT struct {
 	mqttClient paho.Client
 }
 
+// Broker endpoints, tried in order, & the CA certificates (PEM) TLS endpoints must chain to.
+// Without CACert the system roots are used.
+type Options struct {
+	BrokerURLs []string
+	ClientID   string
+	CACert     []byte
+}
+
 // Constructor
 func NewMQTT(brokerURL string, clientID string) (IMQTT, error) {
+	return NewMQTTWithOptions(Options{BrokerURLs: []string{brokerURL}, ClientID: clientID})
+}
+
+func NewMQTTWithOptions(opts Options) (IMQTT, error) {
 
 	options := paho.NewClientOptions().
-		AddBroker(brokerURL).
-		SetClientID(clientID).
+		SetClientID(opts.ClientID).
 		SetAutoReconnect(true)
+	for _, brokerURL := range opts.BrokerURLs {
+		options.AddBroker(brokerURL)
+	}
+	if len(opts.CACert) > 0 {
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(opts.CACert) {
+			return nil, fmt.Errorf("CA certificate is not PEM")
+		}
+		options.SetTLSConfig(&tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12})
+	}
 
 	mqttClient := paho.NewClient(options)
 
@@ -0,0 +1,67 @@
+package delegation
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"log"
+	"time"
+
+	"securemqtt/internal"
+	"securemqtt/internal/clientmqtt"
+	"securemqtt/internal/enrollment"
+)
+
+// Issue asks the root authority for a key within the credential's scope & blocks until it is
+// delivered, sealed to this request. A timeout of 0 waits forever.
+// The site hands the returned bundle to the device, e.g. with enrollment.SaveBundle.
+func Issue(mqttClient clientmqtt.IMQTT, credential []byte, authorityKey ed25519.PublicKey,
+	identity ed25519.PrivateKey, request IssueRequest, timeout time.Duration) (*enrollment.KeyBundle, error) {
+
+	pending, verified, message, err := NewIssueRequest(credential, authorityKey, identity, request)
+	if err != nil {
+		return nil, err
+	}
+	replyTopic := ReplyTopic(verified.Delegate, pending.RequestID())
+
+	bundles := make(chan *enrollment.KeyBundle, 1)
+	if err := mqttClient.Subscribe(replyTopic, 1, func(msg internal.Message) {
+		if len(msg.Envelope) == 0 {
+			return
+		}
+		bundle, err := pending.Open(msg.Envelope, authorityKey)
+		if err != nil {
+			log.Printf("[DELEGATION] Ignoring delivery: %v", err)
+			return
+		}
+		select {
+		case bundles <- bundle:
+		default:
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("delegation: subscribe %s: %w", replyTopic, err)
+	}
+
+	// Retained, so the root authority sees the request even if it starts serving later
+	if err := mqttClient.Publish(RequestTopic(verified.Delegate, pending.RequestID()), 1, true, message); err != nil {
+		return nil, fmt.Errorf("delegation: publish request: %w", err)
+	}
+	log.Printf("[DELEGATION] %s requested a key for %s, request %s", verified.Delegate, request.Subject, pending.RequestID())
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case bundle := <-bundles:
+		if bundle.Subject != request.Subject {
+			return nil, fmt.Errorf("delegation: delivered key is for %q, not %q", bundle.Subject, request.Subject)
+		}
+		// The reply is retained per request, clear it once received
+		if err := mqttClient.Publish(replyTopic, 1, true, nil); err != nil {
+			log.Printf("[DELEGATION] Failed to clear %s: %v", replyTopic, err)
+		}
+		return bundle, nil
+	case <-expired:
+		return nil, fmt.Errorf("delegation: no key delivered within %s", timeout)
+	}
+}
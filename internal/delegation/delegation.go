@@ -0,0 +1,273 @@
+package delegation
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/enrollment"
+	"securemqtt/internal/signed"
+)
+
+const (
+	// Type of the signed document a credential is issued in
+	CredentialDocument = "delegation-credential"
+
+	// Sub-authorities publish issue requests, retained, on RequestTopicPrefix + delegate + "/" + request ID
+	RequestTopicPrefix = "delegation/requests/"
+
+	// Topic filter the root authority serves requests of all delegates on
+	RequestTopicFilter = RequestTopicPrefix + "+/+"
+
+	// Prefix of the per-request topic the root authority delivers encrypted keys on
+	ReplyTopicPrefix = "delegation/reply/"
+
+	// Requests older than this are refused, so a captured request cannot be replayed later
+	MaxRequestAge = 10 * time.Minute
+)
+
+// Attribute rights of a sub-authority: the values it may issue per attribute name.
+// Every key it issues must hold each scoped attribute with allowed values, & nothing else,
+// e.g. {"site": ["rome"], "role": ["operator", "guest"]}.
+type Scope map[string][]string
+
+// What the root authority grants a site-level issuance service
+type Credential struct {
+	ID          string    `json:"id"`
+	Delegate    string    `json:"delegate"`
+	DelegateKey []byte    `json:"delegate_key"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Scope       Scope     `json:"scope"`
+	NotAfter    time.Time `json:"not_after"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// A key a sub-authority asks the root authority for.
+// EnrollmentID names the enrollment request sent along, whose ephemeral HPKE key the
+// issued key is sealed to.
+type IssueRequest struct {
+	Subject      string            `json:"subject"`
+	Attributes   map[string]string `json:"attributes"`
+	ValidFrom    string            `json:"valid_from,omitempty"`
+	ValidUntil   string            `json:"valid_until,omitempty"`
+	Period       string            `json:"period,omitempty"`
+	EnrollmentID string            `json:"enrollment_id"`
+	CreatedAt    time.Time         `json:"created_at"`
+}
+
+// Request as sent over MQTT: the credential, an enrollment request for the reply & the
+// issue request, both signed by the delegate key
+type SignedIssueRequest struct {
+	Credential []byte `json:"credential"`
+	Enrollment []byte `json:"enrollment"`
+	Request    []byte `json:"request"`
+	Signature  []byte `json:"signature"`
+}
+
+// A request that passed Authorize
+type Authorized struct {
+	Credential   *Credential
+	Request      *IssueRequest
+	Enrollment   *enrollment.Request
+	EnrollmentID string
+}
+
+// RequestTopic returns the topic a delegate publishes one issue request on
+func RequestTopic(delegate, requestID string) string {
+	return RequestTopicPrefix + delegate + "/" + requestID
+}
+
+// ReplyTopic returns the topic the key for one issue request is delivered on
+func ReplyTopic(delegate, requestID string) string {
+	return ReplyTopicPrefix + delegate + "/" + requestID
+}
+
+// NewCredentialID returns a random credential identifier
+func NewCredentialID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("delegation: generate credential ID: %w", err)
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Check rejects empty scopes, reserved attributes & names or values policies cannot express
+func (strct Scope) Check() error {
+	if len(strct) == 0 {
+		return fmt.Errorf("delegation: empty scope")
+	}
+	for name, values := range strct {
+		if !accesspolicy.IsIdentifier(name) || accesspolicy.IsReserved(name) {
+			return fmt.Errorf("delegation: invalid scope attribute %q", name)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("delegation: scope attribute %q allows no value", name)
+		}
+		for _, value := range values {
+			if !accesspolicy.IsIdentifier(value) {
+				return fmt.Errorf("delegation: invalid value %q for scope attribute %q", value, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Permits reports why attrs are outside the scope, nil if a delegate may issue them.
+// Each value of multi-valued attributes must be allowed.
+func (strct Scope) Permits(attrs map[string]string) error {
+	for name, value := range attrs {
+		allowed, ok := strct[name]
+		if !ok {
+			return fmt.Errorf("delegation: attribute %q is outside the delegated scope", name)
+		}
+		for _, v := range accesspolicy.Values(value) {
+			if !slices.Contains(allowed, v) {
+				return fmt.Errorf("delegation: %s=%s is outside the delegated scope", name, v)
+			}
+		}
+	}
+	for name := range strct {
+		if _, ok := attrs[name]; !ok {
+			return fmt.Errorf("delegation: keys must hold scoped attribute %q", name)
+		}
+	}
+	return nil
+}
+
+// Human readable form, e.g. "role in (guest, operator) and site in (rome)"
+func (strct Scope) String() string {
+	names := make([]string, 0, len(strct))
+	for name := range strct {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s in (%s)", name, strings.Join(strct[name], ", ")))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// Sign issues the credential as a document signed by the root authority
+func (strct *Credential) Sign(authorityKey ed25519.PrivateKey) ([]byte, error) {
+	return signed.Sign(authorityKey, CredentialDocument, strct)
+}
+
+// VerifyCredential checks a credential's signature & content, not its expiry
+func VerifyCredential(authorityKey ed25519.PublicKey, data []byte) (*Credential, error) {
+	var credential Credential
+	if err := signed.Verify(authorityKey, CredentialDocument, data, &credential); err != nil {
+		return nil, err
+	}
+	if credential.ID == "" || credential.Delegate == "" || strings.ContainsAny(credential.Delegate, "/+#") {
+		return nil, fmt.Errorf("delegation: credential without valid ID or delegate")
+	}
+	if len(credential.DelegateKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("delegation: credential with invalid delegate key")
+	}
+	if err := credential.Scope.Check(); err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// NewIssueRequest signs request with the delegate key & bundles it with the credential &
+// a fresh enrollment request for the reply. The credential is verified first, so a site
+// notices a wrong or expired credential before asking.
+func NewIssueRequest(credentialData []byte, authorityKey ed25519.PublicKey, identity ed25519.PrivateKey,
+	request IssueRequest) (*enrollment.Pending, *Credential, []byte, error) {
+
+	credential, err := VerifyCredential(authorityKey, credentialData)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !bytes.Equal(credential.DelegateKey, identity.Public().(ed25519.PublicKey)) {
+		return nil, nil, nil, fmt.Errorf("delegation: credential was issued to another delegate key")
+	}
+	if !time.Now().Before(credential.NotAfter) {
+		return nil, nil, nil, fmt.Errorf("delegation: credential expired at %s", credential.NotAfter.Format(time.RFC3339))
+	}
+	if err := credential.Scope.Permits(request.Attributes); err != nil {
+		return nil, nil, nil, err
+	}
+
+	pending, enrollmentRequest, err := enrollment.NewRequest(credential.Delegate, identity)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	request.EnrollmentID = pending.RequestID()
+	request.CreatedAt = time.Now().UTC()
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("delegation: marshal request: %w", err)
+	}
+
+	message, err := json.Marshal(SignedIssueRequest{
+		Credential: credentialData,
+		Enrollment: enrollmentRequest,
+		Request:    requestBytes,
+		Signature:  ed25519.Sign(identity, requestBytes),
+	})
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("delegation: marshal signed request: %w", err)
+	}
+	return pending, credential, message, nil
+}
+
+// Authorize checks everything the root authority needs before running KeyGen: the credential
+// is its own & unexpired, the request is signed by the credential's delegate key & fresh, &
+// the attributes are within scope. Revocation of credentials & replay of request IDs are
+// the caller's to check.
+func Authorize(message []byte, authorityKey ed25519.PublicKey, now time.Time) (*Authorized, error) {
+	var signedRequest SignedIssueRequest
+	if err := json.Unmarshal(message, &signedRequest); err != nil {
+		return nil, fmt.Errorf("delegation: parse request: %w", err)
+	}
+
+	credential, err := VerifyCredential(authorityKey, signedRequest.Credential)
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(credential.NotAfter) {
+		return nil, fmt.Errorf("delegation: credential %s expired at %s", credential.ID, credential.NotAfter.Format(time.RFC3339))
+	}
+
+	// The reply key must come from the delegate itself
+	enrollmentRequest, enrollmentID, err := enrollment.VerifyRequest(signedRequest.Enrollment)
+	if err != nil {
+		return nil, err
+	}
+	if enrollmentRequest.DeviceID != credential.Delegate || !bytes.Equal(enrollmentRequest.IdentityKey, credential.DelegateKey) {
+		return nil, fmt.Errorf("delegation: reply key not requested by delegate %s", credential.Delegate)
+	}
+
+	if !ed25519.Verify(credential.DelegateKey, signedRequest.Request, signedRequest.Signature) {
+		return nil, fmt.Errorf("delegation: invalid request signature")
+	}
+	var request IssueRequest
+	if err := json.Unmarshal(signedRequest.Request, &request); err != nil {
+		return nil, fmt.Errorf("delegation: parse request: %w", err)
+	}
+	if request.EnrollmentID != enrollmentID {
+		return nil, fmt.Errorf("delegation: request does not belong to its reply key")
+	}
+	if age := now.Sub(request.CreatedAt); age > MaxRequestAge || age < -MaxRequestAge {
+		return nil, fmt.Errorf("delegation: request created at %s is stale", request.CreatedAt.Format(time.RFC3339))
+	}
+	if request.Subject == "" {
+		return nil, fmt.Errorf("delegation: request without subject")
+	}
+	if err := credential.Scope.Permits(request.Attributes); err != nil {
+		return nil, err
+	}
+
+	return &Authorized{Credential: credential, Request: &request, Enrollment: enrollmentRequest, EnrollmentID: enrollmentID}, nil
+}
@@ -0,0 +1,146 @@
+package enrollment
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"securemqtt/internal"
+	"securemqtt/internal/clientmqtt"
+)
+
+// LoadOrCreateIdentity loads the device's Ed25519 identity key, creating it on first start.
+// It lives in device-local storage, never on the authority's volume.
+func LoadOrCreateIdentity(path string) (ed25519.PrivateKey, error) {
+	seed, err := os.ReadFile(path)
+	if err == nil {
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("enrollment: %s: invalid identity key size %d", path, len(seed))
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("enrollment: read %s: %w", path, err)
+	}
+
+	_, identity, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: generate identity key: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("enrollment: mkdir %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, identity.Seed(), 0600); err != nil {
+		return nil, fmt.Errorf("enrollment: write %s: %w", path, err)
+	}
+	return identity, nil
+}
+
+// Enroll publishes a signed key request for deviceID and blocks until the authority
+// delivers an approved key on the device's reply topic. A timeout of 0 waits forever.
+func Enroll(mqttClient clientmqtt.IMQTT, deviceID string, identity ed25519.PrivateKey,
+	authorityKey ed25519.PublicKey, timeout time.Duration) (*KeyBundle, error) {
+
+	pending, request, err := NewRequest(deviceID, identity)
+	if err != nil {
+		return nil, err
+	}
+
+	bundles := make(chan *KeyBundle, 1)
+	if err := mqttClient.Subscribe(ReplyTopic(deviceID), 1, func(msg internal.Message) {
+		bundle, err := pending.Open(msg.Envelope, authorityKey)
+		if err != nil {
+			// Stale deliveries for earlier requests are expected, keep waiting
+			log.Printf("[ENROLL] Ignoring delivery: %v", err)
+			return
+		}
+		select {
+		case bundles <- bundle:
+		default:
+		}
+	}); err != nil {
+		return nil, fmt.Errorf("enrollment: subscribe %s: %w", ReplyTopic(deviceID), err)
+	}
+
+	// Retained, so the authority sees the request even if it starts listening later
+	if err := mqttClient.Publish(RequestTopic(deviceID), 1, true, request); err != nil {
+		return nil, fmt.Errorf("enrollment: publish request: %w", err)
+	}
+	log.Printf("[ENROLL] Requested key for %s, request %s, identity %s",
+		deviceID, pending.RequestID(), identityFingerprint(identity))
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case bundle := <-bundles:
+		return bundle, nil
+	case <-expired:
+		return nil, fmt.Errorf("enrollment: no key delivered within %s", timeout)
+	}
+}
+
+// WatchReissue calls fn for every verified re-issue notice for deviceID. Notices are retained
+// until the authority delivered the new key, so a device that was offline still gets them.
+func WatchReissue(mqttClient clientmqtt.IMQTT, deviceID string, authorityKey ed25519.PublicKey, fn func(*Notice)) error {
+	if err := mqttClient.Subscribe(ReissueTopic(deviceID), 1, func(msg internal.Message) {
+		// Empty retained messages are notices the authority already answered
+		if len(msg.Envelope) == 0 {
+			return
+		}
+		notice, err := VerifyNotice(msg.Envelope, authorityKey, deviceID)
+		if err != nil {
+			log.Printf("[ENROLL] Ignoring re-issue notice: %v", err)
+			return
+		}
+		fn(notice)
+	}); err != nil {
+		return fmt.Errorf("enrollment: subscribe %s: %w", ReissueTopic(deviceID), err)
+	}
+	return nil
+}
+
+func identityFingerprint(identity ed25519.PrivateKey) string {
+	request := Request{IdentityKey: identity.Public().(ed25519.PublicKey)}
+	return request.IdentityFingerprint()
+}
+
+// SaveBundle stores a delivered key in device-local storage, readable by the owner only
+func SaveBundle(path string, bundle *KeyBundle) error {
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return fmt.Errorf("enrollment: marshal bundle: %w", err)
+	}
+	defer clear(data)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("enrollment: mkdir %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("enrollment: write %s: %w", path, err)
+	}
+	return nil
+}
+
+// LoadBundle reads a key saved by SaveBundle. Returns nil without error if the device never enrolled.
+func LoadBundle(path string) (*KeyBundle, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: read %s: %w", path, err)
+	}
+	defer clear(data)
+
+	var bundle KeyBundle
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		return nil, fmt.Errorf("enrollment: parse %s: %w", path, err)
+	}
+	return &bundle, nil
+}
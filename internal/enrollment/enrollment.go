@@ -0,0 +1,280 @@
+package enrollment
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/signed"
+
+	"github.com/cloudflare/circl/hpke"
+	"github.com/cloudflare/circl/kem"
+)
+
+const (
+	// Devices publish signed key requests, retained, on RequestTopicPrefix + device ID
+	RequestTopicPrefix = "enroll/requests/"
+
+	// Topic filter the authority listens on for requests of all devices
+	RequestTopicFilter = RequestTopicPrefix + "+"
+
+	// Prefix of the per-device topic the authority delivers encrypted keys on
+	ReplyTopicPrefix = "enroll/reply/"
+
+	// Type of the signed document the authority wraps every delivery in
+	DeliveryDocument = "enrollment-delivery"
+
+	// Prefix of the per-device topic the authority asks an enrolled device to request a new key on
+	ReissueTopicPrefix = "enroll/reissue/"
+
+	// Type of the signed document a re-issue notice is wrapped in
+	NoticeDocument = "enrollment-reissue"
+)
+
+// HPKE suite for key delivery: X25519 KEM, HKDF-SHA256, AES-128-GCM
+var (
+	suite     = hpke.NewSuite(hpke.KEM_X25519_HKDF_SHA256, hpke.KDF_HKDF_SHA256, hpke.AEAD_AES128GCM)
+	kemScheme = hpke.KEM_X25519_HKDF_SHA256.Scheme()
+)
+
+// A device's request for an attribute key.
+// HPKEPublicKey is ephemeral, generated for this request only; IdentityKey is the
+// device's long-lived Ed25519 key that signs the request.
+type Request struct {
+	DeviceID      string    `json:"device_id"`
+	HPKEPublicKey []byte    `json:"hpke_public_key"`
+	IdentityKey   []byte    `json:"identity_key"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Request as sent over MQTT: the JSON request & the identity key's signature over it
+type SignedRequest struct {
+	Request   []byte `json:"request"`
+	Signature []byte `json:"signature"`
+}
+
+// What the device receives once an operator approved its request.
+// Encapsulated & Ciphertext are the HPKE output, sealed to the request's ephemeral key.
+type Delivery struct {
+	RequestID    string `json:"request_id"`
+	DeviceID     string `json:"device_id"`
+	Encapsulated []byte `json:"encapsulated"`
+	Ciphertext   []byte `json:"ciphertext"`
+}
+
+// The sealed content of a delivery
+type KeyBundle struct {
+	Subject      string                 `json:"subject"`
+	KeyID        string                 `json:"key_id,omitempty"`
+	AttributeKey []byte                 `json:"attribute_key"`
+	Validity     *accesspolicy.Validity `json:"validity,omitempty"`
+	Statement    []byte                 `json:"statement,omitempty"`
+
+	// System public key the key was issued under, so the device can self-test the key
+	PublicKey []byte `json:"public_key,omitempty"`
+}
+
+// Asks an enrolled device to request a new key, e.g. after the system keys were replaced.
+// Replaces is the fingerprint of the key to replace, so a device that already holds a newer one ignores it.
+type Notice struct {
+	DeviceID string    `json:"device_id"`
+	KeyID    string    `json:"key_id,omitempty"`
+	Replaces string    `json:"replaces"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+// Device-side state of a pending request, the HPKE private key never leaves memory
+type Pending struct {
+	requestID  string
+	deviceID   string
+	privateKey kem.PrivateKey
+}
+
+// RequestTopic returns the topic a device publishes its key request on
+func RequestTopic(deviceID string) string {
+	return RequestTopicPrefix + deviceID
+}
+
+// ReplyTopic returns the topic a device's key is delivered on
+func ReplyTopic(deviceID string) string {
+	return ReplyTopicPrefix + deviceID
+}
+
+// ReissueTopic returns the topic a device is asked to request a new key on
+func ReissueTopic(deviceID string) string {
+	return ReissueTopicPrefix + deviceID
+}
+
+// NewRequest creates a signed key request with a fresh ephemeral HPKE key pair
+func NewRequest(deviceID string, identity ed25519.PrivateKey) (*Pending, []byte, error) {
+	if deviceID == "" {
+		return nil, nil, fmt.Errorf("enrollment: device ID is required")
+	}
+
+	publicKey, privateKey, err := kemScheme.GenerateKeyPair()
+	if err != nil {
+		return nil, nil, fmt.Errorf("enrollment: generate HPKE key: %w", err)
+	}
+	publicKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		return nil, nil, fmt.Errorf("enrollment: marshal HPKE key: %w", err)
+	}
+
+	requestBytes, err := json.Marshal(Request{
+		DeviceID:      deviceID,
+		HPKEPublicKey: publicKeyBytes,
+		IdentityKey:   identity.Public().(ed25519.PublicKey),
+		CreatedAt:     time.Now().UTC(),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("enrollment: marshal request: %w", err)
+	}
+
+	message, err := json.Marshal(SignedRequest{
+		Request:   requestBytes,
+		Signature: ed25519.Sign(identity, requestBytes),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("enrollment: marshal signed request: %w", err)
+	}
+
+	return &Pending{requestID: requestID(requestBytes), deviceID: deviceID, privateKey: privateKey}, message, nil
+}
+
+// VerifyRequest checks a request's signature against the identity key it carries.
+// This proves possession of that key; the operator still compares IdentityFingerprint
+// with the device out of band before approving.
+func VerifyRequest(message []byte) (*Request, string, error) {
+	var signedRequest SignedRequest
+	if err := json.Unmarshal(message, &signedRequest); err != nil {
+		return nil, "", fmt.Errorf("enrollment: parse request: %w", err)
+	}
+
+	var request Request
+	if err := json.Unmarshal(signedRequest.Request, &request); err != nil {
+		return nil, "", fmt.Errorf("enrollment: parse request: %w", err)
+	}
+	if request.DeviceID == "" {
+		return nil, "", fmt.Errorf("enrollment: request without device ID")
+	}
+	if len(request.IdentityKey) != ed25519.PublicKeySize ||
+		!ed25519.Verify(request.IdentityKey, signedRequest.Request, signedRequest.Signature) {
+		return nil, "", fmt.Errorf("enrollment: invalid request signature")
+	}
+	if _, err := kemScheme.UnmarshalBinaryPublicKey(request.HPKEPublicKey); err != nil {
+		return nil, "", fmt.Errorf("enrollment: invalid HPKE key: %w", err)
+	}
+
+	return &request, requestID(signedRequest.Request), nil
+}
+
+// IdentityFingerprint identifies the device's identity key for out-of-band comparison
+func (strct *Request) IdentityFingerprint() string {
+	return signed.Fingerprint(strct.IdentityKey)
+}
+
+// Seal encrypts a key bundle to the request's ephemeral HPKE key & signs the delivery
+// with the authority key, ready to publish on the device's reply topic
+func Seal(request *Request, requestID string, bundle KeyBundle, authorityKey ed25519.PrivateKey) ([]byte, error) {
+	publicKey, err := kemScheme.UnmarshalBinaryPublicKey(request.HPKEPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: invalid HPKE key: %w", err)
+	}
+
+	sender, err := suite.NewSender(publicKey, info(requestID))
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: HPKE sender: %w", err)
+	}
+	encapsulated, sealer, err := sender.Setup(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: HPKE setup: %w", err)
+	}
+
+	plaintext, err := json.Marshal(bundle)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: marshal bundle: %w", err)
+	}
+	defer clear(plaintext)
+
+	ciphertext, err := sealer.Seal(plaintext, []byte(request.DeviceID))
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: HPKE seal: %w", err)
+	}
+
+	return signed.Sign(authorityKey, DeliveryDocument, Delivery{
+		RequestID:    requestID,
+		DeviceID:     request.DeviceID,
+		Encapsulated: encapsulated,
+		Ciphertext:   ciphertext,
+	})
+}
+
+// Open verifies a delivery against the authority's signing key & decrypts it with the
+// pending request's ephemeral key. Deliveries for other requests are rejected.
+func (strct *Pending) Open(message []byte, authorityKey ed25519.PublicKey) (*KeyBundle, error) {
+	var delivery Delivery
+	if err := signed.Verify(authorityKey, DeliveryDocument, message, &delivery); err != nil {
+		return nil, err
+	}
+	if delivery.RequestID != strct.requestID || delivery.DeviceID != strct.deviceID {
+		return nil, fmt.Errorf("enrollment: delivery is for another request")
+	}
+
+	receiver, err := suite.NewReceiver(strct.privateKey, info(strct.requestID))
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: HPKE receiver: %w", err)
+	}
+	opener, err := receiver.Setup(delivery.Encapsulated)
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: HPKE setup: %w", err)
+	}
+	plaintext, err := opener.Open(delivery.Ciphertext, []byte(strct.deviceID))
+	if err != nil {
+		return nil, fmt.Errorf("enrollment: HPKE open: %w", err)
+	}
+	defer clear(plaintext)
+
+	var bundle KeyBundle
+	if err := json.Unmarshal(plaintext, &bundle); err != nil {
+		return nil, fmt.Errorf("enrollment: parse bundle: %w", err)
+	}
+	return &bundle, nil
+}
+
+// SignNotice signs a re-issue notice with the authority key, ready to publish retained on the device's re-issue topic
+func SignNotice(notice Notice, authorityKey ed25519.PrivateKey) ([]byte, error) {
+	return signed.Sign(authorityKey, NoticeDocument, notice)
+}
+
+// VerifyNotice checks a re-issue notice against the authority's signing key & that it is meant for deviceID
+func VerifyNotice(message []byte, authorityKey ed25519.PublicKey, deviceID string) (*Notice, error) {
+	var notice Notice
+	if err := signed.Verify(authorityKey, NoticeDocument, message, &notice); err != nil {
+		return nil, err
+	}
+	if notice.DeviceID != deviceID {
+		return nil, fmt.Errorf("enrollment: notice is for device %q", notice.DeviceID)
+	}
+	return &notice, nil
+}
+
+// RequestID returns the ID of the pending request, as shown to the approving operator
+func (strct *Pending) RequestID() string {
+	return strct.requestID
+}
+
+// Requests are identified by the hash of their signed content
+func requestID(requestBytes []byte) string {
+	sum := sha256.Sum256(requestBytes)
+	return hex.EncodeToString(sum[:8])
+}
+
+// HPKE info binds the derived keys to this protocol & request
+func info(requestID string) []byte {
+	return []byte("securemqtt enrollment v1|" + requestID)
+}
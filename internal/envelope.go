@@ -4,8 +4,23 @@ const SupportedVersion = "v1"
 
 type Envelope struct {
 	Version       string `json:"version"`
+	Namespace     string `json:"namespace,omitempty"`
+	KeyID         string `json:"key_id,omitempty"`
 	Policy        string `json:"policy"`
 	CPCipherText  string `json:"cp_ciphertext"`
 	IV            string `json:"iv"`
 	AESCiphertext string `json:"aes_ciphertext"`
 }
+
+// AADContext lists the optional envelope fields bound into the AES AAD.
+// Fields are only added when set, so envelopes without them keep the original AAD.
+func (strct *Envelope) AADContext() []string {
+	var context []string
+	if strct.Namespace != "" {
+		context = append(context, "namespace="+strct.Namespace)
+	}
+	if strct.KeyID != "" {
+		context = append(context, "key_id="+strct.KeyID)
+	}
+	return context
+}
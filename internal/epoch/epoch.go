@@ -0,0 +1,162 @@
+package epoch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"securemqtt/internal/keyfile"
+)
+
+const (
+	// Epoch index written by the authority next to the current system keys
+	IndexFile = "epochs.json"
+
+	// Directory holding the public key & issued keys of previous epochs, one subdirectory per key ID
+	ArchiveDir = "epochs"
+
+	// Public key of the current epoch, archived epochs keep theirs under the same name
+	PublicKeyFile = "public.key"
+)
+
+// A single versioned system key pair
+type Epoch struct {
+	Number    int        `json:"epoch"`
+	KeyID     string     `json:"key_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetireAt  *time.Time `json:"retire_at,omitempty"`
+	Retired   bool       `json:"retired,omitempty"`
+	Issued    []string   `json:"issued,omitempty"`
+}
+
+// The list of system key epochs, Current is the epoch new messages & keys use
+type Index struct {
+	Current int     `json:"current"`
+	Epochs  []Epoch `json:"epochs"`
+}
+
+// KeyID derives the key ID carried in envelopes from the epoch number
+func KeyID(number int) string {
+	return fmt.Sprintf("e%d", number)
+}
+
+// Load reads the epoch index from keysDir.
+// Returns nil without error if the system predates epochs.
+func Load(keysDir string) (*Index, error) {
+	path := filepath.Join(keysDir, IndexFile)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("epoch: read %s: %w", path, err)
+	}
+
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("epoch: parse %s: %w", path, err)
+	}
+	return &index, nil
+}
+
+// CurrentEpoch returns the epoch new messages should be encrypted under
+func (strct *Index) CurrentEpoch() (*Epoch, error) {
+	return strct.Find(strct.Current)
+}
+
+// Find returns the epoch with the given number
+func (strct *Index) Find(number int) (*Epoch, error) {
+	for i := range strct.Epochs {
+		if strct.Epochs[i].Number == number {
+			return &strct.Epochs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("epoch: unknown epoch %d", number)
+}
+
+// Active returns all epochs that have not been retired, oldest first
+func (strct *Index) Active() []Epoch {
+	var active []Epoch
+	for _, e := range strct.Epochs {
+		if !e.Retired {
+			active = append(active, e)
+		}
+	}
+	return active
+}
+
+// Due reports whether the epoch is scheduled for retirement at or before now
+func (strct *Epoch) Due(now time.Time) bool {
+	return !strct.Retired && strct.RetireAt != nil && !now.Before(*strct.RetireAt)
+}
+
+// ArchivePath returns the directory holding an archived epoch's files
+func ArchivePath(keysDir, keyID string) string {
+	return filepath.Join(keysDir, ArchiveDir, keyID)
+}
+
+// SubscriberKeys collects a subscriber's key file from the current epoch and from every
+// active archived epoch, by key ID. It also returns the current key ID, which is "" for
+// systems set up before epochs existed.
+func SubscriberKeys(keysDir, filename string) (string, map[string][]byte, error) {
+	index, err := Load(keysDir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	keys := make(map[string][]byte)
+	currentKeyID := ""
+	if index != nil {
+		current, err := index.CurrentEpoch()
+		if err != nil {
+			return "", nil, err
+		}
+		currentKeyID = current.KeyID
+
+		for _, e := range index.Active() {
+			if e.Number == index.Current {
+				continue
+			}
+			key, err := readAttributeKey(ArchivePath(keysDir, e.KeyID), filename, e.KeyID)
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return "", nil, fmt.Errorf("epoch: read %s key: %w", e.KeyID, err)
+			}
+			keys[e.KeyID] = key
+		}
+	}
+
+	key, err := readAttributeKey(keysDir, filename, currentKeyID)
+	if err == nil {
+		keys[currentKeyID] = key
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", nil, fmt.Errorf("epoch: read current key: %w", err)
+	}
+
+	return currentKeyID, keys, nil
+}
+
+// Reads an attribute key file from an epoch directory & checks it belongs to that epoch:
+// its key ID must match & its system ID must match the public key next to it.
+func readAttributeKey(dir, filename, keyID string) ([]byte, error) {
+	file, err := keyfile.Read(filepath.Join(dir, filename), keyfile.Attribute)
+	if err != nil {
+		return nil, err
+	}
+	if file.KeyID != "" && keyID != "" && file.KeyID != keyID {
+		return nil, fmt.Errorf("%s was issued for epoch %s, not %s", filename, file.KeyID, keyID)
+	}
+	if file.SystemID != "" {
+		public, err := keyfile.Read(filepath.Join(dir, PublicKeyFile), keyfile.Public)
+		if err == nil && keyfile.SystemID(public.Key) != file.SystemID {
+			return nil, fmt.Errorf("%s belongs to system %s, not %s", filename, file.SystemID, keyfile.SystemID(public.Key))
+		}
+	}
+	return file.Key, nil
+}
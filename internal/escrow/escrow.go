@@ -0,0 +1,110 @@
+package escrow
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/accessreview"
+)
+
+const (
+	// Type of the signed document the escrow clause is published in
+	Document = "escrow-policy"
+
+	// Published next to the public key, e.g. /keys/escrow.json
+	File = "escrow.json"
+)
+
+// The system-wide clause ORed into every policy, so the escrow (auditor) key can read any message.
+// OptOut lists topic filters published without it; an empty Clause disables escrow.
+type Escrow struct {
+	Clause    string    `json:"clause"`
+	OptOut    []string  `json:"opt_out,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	node accesspolicy.Node
+}
+
+// Check parses the clause & the opt-out filters
+func (strct *Escrow) Check() error {
+	for _, filter := range strct.OptOut {
+		if filter == "" {
+			return fmt.Errorf("escrow: invalid opt-out topic filter %q", filter)
+		}
+	}
+	if strct.Clause == "" {
+		strct.node = nil
+		return nil
+	}
+	node, err := accesspolicy.Parse(strct.Clause)
+	if err != nil {
+		return fmt.Errorf("escrow: clause: %w", err)
+	}
+	strct.node = node
+	return nil
+}
+
+// Node returns the parsed clause, nil when escrow is disabled
+func (strct *Escrow) Node() accesspolicy.Node {
+	return strct.node
+}
+
+// OptedOut reports whether messages on topic are published without the clause
+func (strct *Escrow) OptedOut(topic string) bool {
+	for _, filter := range strct.OptOut {
+		if accessreview.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply ORs the clause into policy, unless escrow is disabled or topic is opted out
+func (strct *Escrow) Apply(topic, policy string) (string, error) {
+	if strct.node == nil || (topic != "" && strct.OptedOut(topic)) {
+		return policy, nil
+	}
+	node, err := accesspolicy.Parse(policy)
+	if err != nil {
+		return "", err
+	}
+	return accesspolicy.Or(node, strct.node).String(), nil
+}
+
+// ORs the escrow clause into every policy published, the escrow can be swapped at runtime
+// when the authority publishes a new one. Register it before rewriters that version or
+// bind policies to periods, so the clause is rewritten like the rest of the policy.
+type Rewriter struct {
+	mu     sync.RWMutex
+	escrow *Escrow
+}
+
+// Constructor, a nil escrow leaves policies unchanged until SetEscrow
+func NewRewriter(escrow *Escrow) *Rewriter {
+	return &Rewriter{escrow: escrow}
+}
+
+func (strct *Rewriter) SetEscrow(escrow *Escrow) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	strct.escrow = escrow
+}
+
+// Rewrite applies the clause without knowing the topic, so opt-outs do not apply
+func (strct *Rewriter) Rewrite(policy string) (string, error) {
+	return strct.RewriteTopic("", policy)
+}
+
+func (strct *Rewriter) RewriteTopic(topic, policy string) (string, error) {
+	strct.mu.RLock()
+	escrow := strct.escrow
+	strct.mu.RUnlock()
+	if escrow == nil {
+		return policy, nil
+	}
+	return escrow.Apply(topic, policy)
+}
+
+var _ accesspolicy.ITopicPolicyRewriter = (*Rewriter)(nil)
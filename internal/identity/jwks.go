@@ -0,0 +1,174 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// One JSON Web Key, only the members needed for signature verification
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// Verification keys of an identity provider, as published in its JWKS document
+type KeySet struct {
+	keys []verificationKey
+}
+
+type verificationKey struct {
+	kid string
+	alg string
+	key crypto.PublicKey
+}
+
+// JWKS documents larger than this are refused, a real one is a few kilobytes
+const maxJWKSSize = 1 << 20
+
+// LoadJWKS reads a JWKS from a file, or fetches it when location is an http(s) URL
+func LoadJWKS(location string, timeout time.Duration) (*KeySet, error) {
+	if !strings.HasPrefix(location, "https://") && !strings.HasPrefix(location, "http://") {
+		data, err := os.ReadFile(location)
+		if err != nil {
+			return nil, fmt.Errorf("identity: read jwks: %w", err)
+		}
+		return ParseJWKS(data)
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, fmt.Errorf("identity: fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("identity: fetch jwks: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxJWKSSize))
+	if err != nil {
+		return nil, fmt.Errorf("identity: fetch jwks: %w", err)
+	}
+	return ParseJWKS(data)
+}
+
+// ParseJWKS reads the RSA, P-256 & Ed25519 signing keys of a JWKS document.
+// Encryption keys & key types we cannot verify with are skipped.
+func ParseJWKS(data []byte) (*KeySet, error) {
+	var doc struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("identity: parse jwks: %w", err)
+	}
+
+	set := &KeySet{}
+	for _, jwk := range doc.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, alg, err := jwk.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("identity: jwks key %q: %w", jwk.Kid, err)
+		}
+		if key == nil {
+			continue
+		}
+		if jwk.Alg != "" && jwk.Alg != alg {
+			return nil, fmt.Errorf("identity: jwks key %q: alg %s does not match a %s key", jwk.Kid, jwk.Alg, jwk.Kty)
+		}
+		set.keys = append(set.keys, verificationKey{kid: jwk.Kid, alg: alg, key: key})
+	}
+	if len(set.keys) == 0 {
+		return nil, fmt.Errorf("identity: jwks holds no usable signing key")
+	}
+	return set, nil
+}
+
+// Returns the key & the algorithm it verifies, nil for unsupported key types
+func (strct *JWK) publicKey() (crypto.PublicKey, string, error) {
+	switch strct.Kty {
+	case "RSA":
+		n, err := decodeInt(strct.N)
+		if err != nil {
+			return nil, "", fmt.Errorf("modulus: %w", err)
+		}
+		e, err := decodeInt(strct.E)
+		if err != nil {
+			return nil, "", fmt.Errorf("exponent: %w", err)
+		}
+		if n.BitLen() < 2048 || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31 {
+			return nil, "", fmt.Errorf("weak or malformed RSA key")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, "RS256", nil
+	case "EC":
+		if strct.Crv != "P-256" {
+			return nil, "", nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(strct.X)
+		if err != nil {
+			return nil, "", fmt.Errorf("x: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(strct.Y)
+		if err != nil {
+			return nil, "", fmt.Errorf("y: %w", err)
+		}
+		if len(x) != 32 || len(y) != 32 {
+			return nil, "", fmt.Errorf("malformed P-256 point")
+		}
+		point := append([]byte{4}, append(x, y...)...)
+		key, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, "", err
+		}
+		return key, "ES256", nil
+	case "OKP":
+		if strct.Crv != "Ed25519" {
+			return nil, "", nil
+		}
+		x, err := base64.RawURLEncoding.DecodeString(strct.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, "", fmt.Errorf("malformed Ed25519 key")
+		}
+		return ed25519.PublicKey(x), "EdDSA", nil
+	}
+	return nil, "", nil
+}
+
+func decodeInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// Keys a token signed with alg under kid may be verified with.
+// Tokens without kid try every key of the algorithm.
+func (strct *KeySet) candidates(kid, alg string) []crypto.PublicKey {
+	var out []crypto.PublicKey
+	for _, key := range strct.keys {
+		if key.alg == alg && (kid == "" || key.kid == kid) {
+			out = append(out, key.key)
+		}
+	}
+	return out
+}
@@ -0,0 +1,142 @@
+package identity
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+)
+
+// Claims identify the key holder with this claim unless configured otherwise
+const DefaultSubjectClaim = "sub"
+
+// Which identity provider the authority trusts & how its token claims become key attributes
+type Config struct {
+	Issuer   string `json:"issuer"`
+	Audience string `json:"audience"`
+
+	// JWKS file path or http(s) URL
+	JWKS string `json:"jwks"`
+
+	SubjectClaim  string `json:"subject_claim,omitempty"`
+	LeewaySeconds int    `json:"leeway_seconds,omitempty"`
+	Rules         []Rule `json:"rules"`
+}
+
+// Maps one claim to one attribute. Claim is a dotted path, string arrays give several values.
+// With Values, claim values are translated & values missing from the map are dropped;
+// without, they are copied as they are.
+// Several rules may feed the same attribute, their values are merged.
+type Rule struct {
+	Claim     string            `json:"claim"`
+	Attribute string            `json:"attribute"`
+	Values    map[string]string `json:"values,omitempty"`
+	Required  bool              `json:"required,omitempty"`
+}
+
+// Loads & checks a configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("identity: read config: %w", err)
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("identity: parse config: %w", err)
+	}
+	if err := config.Check(); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// Check rejects configurations that would accept any token or produce invalid attributes
+func (strct *Config) Check() error {
+	if strct.Issuer == "" || strct.Audience == "" || strct.JWKS == "" {
+		return fmt.Errorf("identity: config needs issuer, audience and jwks")
+	}
+	if len(strct.Rules) == 0 {
+		return fmt.Errorf("identity: config has no claim rules")
+	}
+	for i, rule := range strct.Rules {
+		if rule.Claim == "" {
+			return fmt.Errorf("identity: rule %d has no claim", i+1)
+		}
+		if !accesspolicy.IsIdentifier(rule.Attribute) || accesspolicy.IsReserved(rule.Attribute) {
+			return fmt.Errorf("identity: rule %d: invalid attribute %q", i+1, rule.Attribute)
+		}
+		for from, to := range rule.Values {
+			if !accesspolicy.IsIdentifier(to) {
+				return fmt.Errorf("identity: rule %d: %q maps to invalid value %q", i+1, from, to)
+			}
+		}
+	}
+	return nil
+}
+
+// Verifier for the configured provider, fetching its JWKS
+func (strct *Config) Verifier(timeout time.Duration) (*Verifier, error) {
+	keys, err := LoadJWKS(strct.JWKS, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Verifier{
+		Keys:     keys,
+		Issuer:   strct.Issuer,
+		Audience: strct.Audience,
+		Leeway:   time.Duration(strct.LeewaySeconds) * time.Second,
+	}, nil
+}
+
+// Subject returns the key holder a verified token identifies
+func (strct *Config) Subject(claims Claims) (string, error) {
+	name := strct.SubjectClaim
+	if name == "" {
+		name = DefaultSubjectClaim
+	}
+	values := claims.Strings(name)
+	if len(values) != 1 || values[0] == "" {
+		return "", fmt.Errorf("identity: token has no single %q claim", name)
+	}
+	return values[0], nil
+}
+
+// Attributes applies the rules to verified claims. Multi-valued results are joined the
+// way --attrs-json arrays are.
+func (strct *Config) Attributes(claims Claims) (map[string]string, error) {
+	collected := make(map[string][]string)
+	for _, rule := range strct.Rules {
+		var values []string
+		for _, value := range claims.Strings(rule.Claim) {
+			if rule.Values != nil {
+				mapped, ok := rule.Values[value]
+				if !ok {
+					continue
+				}
+				value = mapped
+			}
+			if !accesspolicy.IsIdentifier(value) {
+				return nil, fmt.Errorf("identity: claim %q value %q is not a valid attribute value", rule.Claim, value)
+			}
+			values = append(values, value)
+		}
+		if len(values) == 0 {
+			if rule.Required {
+				return nil, fmt.Errorf("identity: token gives no value for required attribute %q (claim %q)", rule.Attribute, rule.Claim)
+			}
+			continue
+		}
+		collected[rule.Attribute] = append(collected[rule.Attribute], values...)
+	}
+
+	attrs := make(map[string]string, len(collected))
+	for name, values := range collected {
+		attrs[name] = accesspolicy.JoinValues(values)
+	}
+	if len(attrs) == 0 {
+		return nil, fmt.Errorf("identity: no rule matched the token's claims")
+	}
+	return attrs, nil
+}
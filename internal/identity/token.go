@@ -0,0 +1,172 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Claims of a verified token, as decoded from its JSON payload
+type Claims map[string]any
+
+// Checks ID tokens (signed JWTs) of one identity provider: signature against its JWKS,
+// issuer, audience & validity window. Expiry is required.
+type Verifier struct {
+	Keys     *KeySet
+	Issuer   string
+	Audience string
+
+	// Tolerated clock skew, zero means none
+	Leeway time.Duration
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// Verify checks a compact serialized JWT & returns its claims
+func (strct *Verifier) Verify(token string, now time.Time) (Claims, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("identity: token is not a signed JWT")
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("identity: token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("identity: token signature: %w", err)
+	}
+	if err := strct.verifySignature(header, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("identity: token claims: %w", err)
+	}
+	if err := strct.checkClaims(claims, now); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func (strct *Verifier) verifySignature(header tokenHeader, signed, signature []byte) error {
+	if strct.Keys == nil {
+		return fmt.Errorf("identity: no verification keys")
+	}
+	keys := strct.Keys.candidates(header.Kid, header.Alg)
+	if len(keys) == 0 {
+		return fmt.Errorf("identity: no %q key with kid %q in the jwks", header.Alg, header.Kid)
+	}
+	digest := sha256.Sum256(signed)
+	for _, key := range keys {
+		var ok bool
+		switch key := key.(type) {
+		case *rsa.PublicKey:
+			ok = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+		case *ecdsa.PublicKey:
+			// JWS carries r || s, not ASN.1
+			if len(signature) == 64 {
+				r := new(big.Int).SetBytes(signature[:32])
+				s := new(big.Int).SetBytes(signature[32:])
+				ok = ecdsa.Verify(key, digest[:], r, s)
+			}
+		case ed25519.PublicKey:
+			ok = ed25519.Verify(key, signed, signature)
+		}
+		if ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("identity: invalid token signature")
+}
+
+func (strct *Verifier) checkClaims(claims Claims, now time.Time) error {
+	if iss, _ := claims["iss"].(string); strct.Issuer == "" || iss != strct.Issuer {
+		return fmt.Errorf("identity: token issuer %q, want %q", iss, strct.Issuer)
+	}
+	if strct.Audience == "" || !slices.Contains(claims.Strings("aud"), strct.Audience) {
+		return fmt.Errorf("identity: token is not for audience %q", strct.Audience)
+	}
+
+	exp, ok := claims.time("exp")
+	if !ok {
+		return fmt.Errorf("identity: token has no expiry")
+	}
+	if !now.Before(exp.Add(strct.Leeway)) {
+		return fmt.Errorf("identity: token expired at %s", exp.Format(time.RFC3339))
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(strct.Leeway).Before(nbf) {
+		return fmt.Errorf("identity: token not valid before %s", nbf.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Lookup returns the claim at a dotted path, e.g. "realm_access.roles"
+func (strct Claims) Lookup(path string) (any, bool) {
+	var value any = map[string]any(strct)
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// Strings returns a string or string-array claim as a list, numbers & booleans are formatted,
+// other values are skipped
+func (strct Claims) Strings(path string) []string {
+	value, ok := strct.Lookup(path)
+	if !ok {
+		return nil
+	}
+	items, isList := value.([]any)
+	if !isList {
+		items = []any{value}
+	}
+	var out []string
+	for _, item := range items {
+		switch item := item.(type) {
+		case string:
+			out = append(out, item)
+		case float64, bool:
+			out = append(out, fmt.Sprint(item))
+		}
+	}
+	return out
+}
+
+// Reads a NumericDate claim
+func (strct Claims) time(name string) (time.Time, bool) {
+	seconds, ok := strct[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0).UTC(), true
+}
@@ -0,0 +1,259 @@
+package keyfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// What a key file holds
+type Type string
+
+const (
+	Public    Type = "public"
+	Master    Type = "master"
+	Attribute Type = "attribute"
+
+	// Legacy files are raw MarshalBinary output, their type is unknown
+	Unknown Type = ""
+)
+
+// Current container version
+const Version = 1
+
+// Binary containers start with magic, a version byte & the big-endian header length
+var magic = []byte("SMQK")
+
+// Self-describing metadata stored in front of the key
+type Header struct {
+	Version     int               `json:"version"`
+	Type        Type              `json:"type"`
+	Namespace   string            `json:"namespace,omitempty"`
+	SystemID    string            `json:"system_id,omitempty"`
+	KeyID       string            `json:"key_id,omitempty"`
+	Fingerprint string            `json:"fingerprint"`
+	CreatedAt   time.Time         `json:"created_at"`
+	Subject     string            `json:"subject,omitempty"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+}
+
+// A key & its header. Header.Version is 0 for legacy raw files.
+type File struct {
+	Header
+	Key []byte
+}
+
+// New wraps a serialized key, computing its fingerprint
+func New(keyType Type, key []byte) *File {
+	return &File{
+		Header: Header{
+			Version:     Version,
+			Type:        keyType,
+			Fingerprint: Fingerprint(key),
+			CreatedAt:   time.Now().UTC(),
+		},
+		Key: key,
+	}
+}
+
+// Fingerprint is the SHA-256 of the serialized key, hex encoded
+func Fingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:])
+}
+
+// SystemID identifies the system (& epoch) a public key belongs to, by its fingerprint prefix
+func SystemID(publicKey []byte) string {
+	return Fingerprint(publicKey)[:16]
+}
+
+// Legacy reports whether the file was read from a raw key without header
+func (strct *File) Legacy() bool {
+	return strct.Version == 0
+}
+
+// Encode serializes the binary container
+func (strct *File) Encode() ([]byte, error) {
+	header, err := json.Marshal(strct.Header)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile: marshal header: %w", err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(magic)
+	buf.WriteByte(Version)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(header)))
+	buf.Write(header)
+	buf.Write(strct.Key)
+	return buf.Bytes(), nil
+}
+
+// Armor serializes the armored text variant: a PEM block with the header as PEM headers
+func (strct *File) Armor() ([]byte, error) {
+	headers := map[string]string{
+		"Version":     fmt.Sprint(strct.Version),
+		"Fingerprint": strct.Fingerprint,
+		"Created-At":  strct.CreatedAt.Format(time.RFC3339),
+	}
+	if strct.Namespace != "" {
+		headers["Namespace"] = strct.Namespace
+	}
+	if strct.SystemID != "" {
+		headers["System-ID"] = strct.SystemID
+	}
+	if strct.KeyID != "" {
+		headers["Key-ID"] = strct.KeyID
+	}
+	if strct.Subject != "" {
+		headers["Subject"] = strct.Subject
+	}
+	if len(strct.Attributes) > 0 {
+		attrs, err := json.Marshal(strct.Attributes)
+		if err != nil {
+			return nil, fmt.Errorf("keyfile: marshal attributes: %w", err)
+		}
+		headers["Attributes"] = string(attrs)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: pemType(strct.Type), Headers: headers, Bytes: strct.Key}), nil
+}
+
+// Decode reads a binary container, an armored file or a legacy raw key
+func Decode(data []byte) (*File, error) {
+	switch {
+	case bytes.HasPrefix(data, magic):
+		return decodeBinary(data)
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("-----BEGIN ")):
+		return decodeArmored(data)
+	}
+	return &File{Header: Header{Fingerprint: Fingerprint(data)}, Key: data}, nil
+}
+
+// Read decodes a key file & checks it holds the expected type of key.
+// Legacy raw files are accepted for any type.
+func Read(path string, want Type) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile: read %s: %w", path, err)
+	}
+	file, err := Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("keyfile: %s: %w", path, err)
+	}
+	if !file.Legacy() && file.Type != want {
+		return nil, fmt.Errorf("keyfile: %s holds a %s key, expected a %s key", path, file.Type, want)
+	}
+	return file, nil
+}
+
+func decodeBinary(data []byte) (*File, error) {
+	rest := data[len(magic):]
+	if len(rest) < 5 {
+		return nil, fmt.Errorf("keyfile: truncated header")
+	}
+	if version := int(rest[0]); version != Version {
+		return nil, fmt.Errorf("keyfile: unsupported version %d", version)
+	}
+	length := binary.BigEndian.Uint32(rest[1:5])
+	rest = rest[5:]
+	if uint64(length) > uint64(len(rest)) {
+		return nil, fmt.Errorf("keyfile: truncated header")
+	}
+
+	file := &File{Key: rest[length:]}
+	if err := json.Unmarshal(rest[:length], &file.Header); err != nil {
+		return nil, fmt.Errorf("keyfile: parse header: %w", err)
+	}
+	return file, file.check()
+}
+
+func decodeArmored(data []byte) (*File, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("keyfile: invalid armored key")
+	}
+	keyType, ok := strings.CutPrefix(block.Type, "SECUREMQTT ")
+	keyType, found := strings.CutSuffix(keyType, " KEY")
+	if !ok || !found {
+		return nil, fmt.Errorf("keyfile: unexpected armor type %q", block.Type)
+	}
+
+	file := &File{Key: block.Bytes}
+	file.Type = Type(strings.ToLower(keyType))
+	file.Namespace = block.Headers["Namespace"]
+	file.SystemID = block.Headers["System-ID"]
+	file.KeyID = block.Headers["Key-ID"]
+	file.Subject = block.Headers["Subject"]
+	file.Fingerprint = block.Headers["Fingerprint"]
+	if _, err := fmt.Sscan(block.Headers["Version"], &file.Version); err != nil || file.Version != Version {
+		return nil, fmt.Errorf("keyfile: unsupported version %q", block.Headers["Version"])
+	}
+	if created := block.Headers["Created-At"]; created != "" {
+		t, err := time.Parse(time.RFC3339, created)
+		if err != nil {
+			return nil, fmt.Errorf("keyfile: parse creation time: %w", err)
+		}
+		file.CreatedAt = t
+	}
+	if attrs := block.Headers["Attributes"]; attrs != "" {
+		if err := json.Unmarshal([]byte(attrs), &file.Attributes); err != nil {
+			return nil, fmt.Errorf("keyfile: parse attributes: %w", err)
+		}
+	}
+	return file, file.check()
+}
+
+// The fingerprint guards against a corrupted or spliced key
+func (strct *File) check() error {
+	if !slices.Contains([]Type{Public, Master, Attribute}, strct.Type) {
+		return fmt.Errorf("keyfile: unknown key type %q", strct.Type)
+	}
+	if strct.Fingerprint != Fingerprint(strct.Key) {
+		return fmt.Errorf("keyfile: key does not match its fingerprint")
+	}
+	return nil
+}
+
+// Describe renders the header for humans, one field per line
+func (strct *File) Describe() string {
+	var b strings.Builder
+	if strct.Legacy() {
+		fmt.Fprintf(&b, "format:      legacy raw key (no header)\n")
+	} else {
+		fmt.Fprintf(&b, "format:      container v%d\n", strct.Version)
+		fmt.Fprintf(&b, "type:        %s\n", strct.Type)
+	}
+	fmt.Fprintf(&b, "fingerprint: %s\n", strct.Fingerprint)
+	fmt.Fprintf(&b, "size:        %d bytes\n", len(strct.Key))
+	if strct.Namespace != "" {
+		fmt.Fprintf(&b, "namespace:   %s\n", strct.Namespace)
+	}
+	if strct.SystemID != "" {
+		fmt.Fprintf(&b, "system:      %s\n", strct.SystemID)
+	}
+	if strct.KeyID != "" {
+		fmt.Fprintf(&b, "key id:      %s\n", strct.KeyID)
+	}
+	if !strct.CreatedAt.IsZero() {
+		fmt.Fprintf(&b, "created:     %s\n", strct.CreatedAt.Format(time.RFC3339))
+	}
+	if strct.Subject != "" {
+		fmt.Fprintf(&b, "subject:     %s\n", strct.Subject)
+	}
+	for _, name := range slices.Sorted(maps.Keys(strct.Attributes)) {
+		fmt.Fprintf(&b, "attribute:   %s=%s\n", name, strct.Attributes[name])
+	}
+	return b.String()
+}
+
+func pemType(keyType Type) string {
+	return "SECUREMQTT " + strings.ToUpper(string(keyType)) + " KEY"
+}
@@ -0,0 +1,161 @@
+package keystore
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"securemqtt/internal/namespace"
+)
+
+const (
+	// Lock file serializing commands that change a keys directory
+	LockFile = ".lock"
+
+	// Prefix of the temporary files a write goes through before it is renamed into place
+	tempPrefix = ".tmp-"
+
+	// Temporary files younger than this may belong to a write in progress
+	staleAfter = time.Minute
+
+	// Permissions of secret files (master key, signing key, issued keys) & of everything else
+	SecretPerm fs.FileMode = 0600
+	PublicPerm fs.FileMode = 0644
+)
+
+// A keys directory whose files are replaced atomically: a reader or a crash sees the old
+// content or the new one, never a truncated file
+type Store struct {
+	dir string
+}
+
+func New(dir string) *Store {
+	return &Store{dir: dir}
+}
+
+// Dir returns the directory the store writes to
+func (strct *Store) Dir() string {
+	return strct.dir
+}
+
+// Write replaces name, relative to the store directory, with data
+func (strct *Store) Write(name string, data []byte, perm fs.FileMode) error {
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("keystore: refusing to write %q outside %s", name, strct.dir)
+	}
+	return WriteFile(filepath.Join(strct.dir, name), data, perm)
+}
+
+// WriteFile writes data to a temporary file next to path, syncs it & renames it over path.
+// The directory is synced too, so the rename survives a crash.
+func WriteFile(path string, data []byte, perm fs.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("keystore: mkdir %s: %w", dir, err)
+	}
+	temp, err := os.CreateTemp(dir, tempPrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("keystore: write %s: %w", path, err)
+	}
+	committed := false
+	defer func() {
+		if !committed {
+			temp.Close()
+			os.Remove(temp.Name())
+		}
+	}()
+
+	if err := temp.Chmod(perm); err != nil {
+		return fmt.Errorf("keystore: chmod %s: %w", path, err)
+	}
+	if _, err := temp.Write(data); err != nil {
+		return fmt.Errorf("keystore: write %s: %w", path, err)
+	}
+	if err := temp.Sync(); err != nil {
+		return fmt.Errorf("keystore: sync %s: %w", path, err)
+	}
+	if err := temp.Close(); err != nil {
+		return fmt.Errorf("keystore: write %s: %w", path, err)
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return fmt.Errorf("keystore: rename %s: %w", path, err)
+	}
+	committed = true
+	return syncDir(dir)
+}
+
+// StagingPath returns where the next version of path is written before Commit puts it in place.
+// Staged files are temporary files: Recover removes the ones an interrupted command left behind.
+func StagingPath(path string) string {
+	return filepath.Join(filepath.Dir(path), tempPrefix+"staged-"+filepath.Base(path))
+}
+
+// Commit renames the staged version of path over path & syncs the directory
+func Commit(path string) error {
+	if err := os.Rename(StagingPath(path), path); err != nil {
+		return fmt.Errorf("keystore: commit %s: %w", path, err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Recover removes temporary files interrupted writes left below the store directory & returns
+// their names. Files younger than a minute are kept, they may belong to a write in progress.
+// The other namespaces below the default namespace's keys root are left alone, their writes are
+// serialized by their own lock.
+func (strct *Store) Recover() ([]string, error) {
+	var removed []string
+	err := filepath.WalkDir(strct.dir, func(path string, entry fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() && path == filepath.Join(strct.dir, namespace.Dir) {
+			return filepath.SkipDir
+		}
+		if entry.IsDir() || !IsTemp(entry.Name()) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleAfter {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(strct.dir, path)
+		removed = append(removed, filepath.ToSlash(name))
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("keystore: recover %s: %w", strct.dir, err)
+	}
+	return removed, nil
+}
+
+// IsTemp reports whether a file name is a temporary file of an unfinished write
+func IsTemp(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+// Internal reports whether a file name belongs to the store's bookkeeping rather than to its keys
+func Internal(name string) bool {
+	return name == LockFile || IsTemp(name)
+}
+
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("keystore: sync %s: %w", dir, err)
+	}
+	defer file.Close()
+	// Some platforms & file systems cannot sync directories, the rename itself already happened
+	if err := file.Sync(); err != nil && !isSyncUnsupported(err) {
+		return fmt.Errorf("keystore: sync %s: %w", dir, err)
+	}
+	return nil
+}
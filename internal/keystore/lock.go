@@ -0,0 +1,39 @@
+package keystore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Held lock on a keys directory, released by Unlock or when the process exits
+type Lock struct {
+	file *os.File
+}
+
+// Lock waits until no other command holds the store's lock file & takes it
+func (strct *Store) Lock() (*Lock, error) {
+	if err := os.MkdirAll(strct.dir, 0755); err != nil {
+		return nil, fmt.Errorf("keystore: mkdir %s: %w", strct.dir, err)
+	}
+	path := filepath.Join(strct.dir, LockFile)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("keystore: open %s: %w", path, err)
+	}
+	if err := lock(file); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("keystore: lock %s: %w", path, err)
+	}
+	return &Lock{file: file}, nil
+}
+
+// Unlock releases the lock; calling it again does nothing
+func (strct *Lock) Unlock() {
+	if strct == nil || strct.file == nil {
+		return
+	}
+	unlock(strct.file)
+	strct.file.Close()
+	strct.file = nil
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package keystore
+
+import "os"
+
+// Without flock, commands changing the keys directory are not serialized
+func lock(file *os.File) error {
+	return nil
+}
+
+func unlock(file *os.File) {}
+
+// Directories cannot be synced on these platforms
+func isSyncUnsupported(err error) bool {
+	return true
+}
@@ -0,0 +1,22 @@
+//go:build unix
+
+package keystore
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// Serializes commands that change the keys directory
+func lock(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+func unlock(file *os.File) {
+	_ = syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
+
+func isSyncUnsupported(err error) bool {
+	return errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTSUP)
+}
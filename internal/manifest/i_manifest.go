@@ -0,0 +1,32 @@
+package manifest
+
+import (
+	"encoding/json"
+
+	"securemqtt/internal/accesspolicy"
+)
+
+type IChecker interface {
+	// Rejects a key file name the authority must not write
+	KeyFile(name string) error
+
+	// Parses the attributes object of a JSON row
+	// Takes as input: the raw object, string or array of strings per attribute
+	// Outputs: the attributes, as accesspolicy stores them
+	ParseAttributes(raw json.RawMessage) (map[string]string, error)
+
+	// Validates the attributes of a row of either format against the authority's rules & schema
+	CheckAttributes(attrs map[string]string) error
+
+	// Works out the validity window of a row, nil for a permanent key
+	Validity(period, validFrom, validUntil string) (*accesspolicy.Validity, error)
+}
+
+type IIssuer interface {
+	// Generates the key of a valid item in memory, nothing is written yet
+	// Outputs: the fingerprint of the key
+	Prepare(item *Item) (string, error)
+
+	// Writes the prepared keys of items, all of them or none
+	Commit(items []*Item) error
+}
@@ -0,0 +1,280 @@
+package manifest
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/keystore"
+)
+
+// Status of a row in the output index
+const (
+	StatusPending   = "pending"
+	StatusInvalid   = "invalid"
+	StatusFailed    = "failed"
+	StatusIssued    = "issued"
+	StatusNotIssued = "not_issued"
+)
+
+// One subject to issue a key for.
+// In CSV manifests every column except subject, out, valid_from, valid_until & period
+// is an attribute, empty cells are skipped & a cell holds one value. A column repeated in the
+// header gives the attribute several values, e.g. site,site with rome,milan.
+// Attrs holds the attributes of CSV rows, JSON rows keep them raw until validated.
+type Row struct {
+	Line       int               `json:"-"`
+	Subject    string            `json:"subject"`
+	Out        string            `json:"out"`
+	Attributes json.RawMessage   `json:"attributes"`
+	ValidFrom  string            `json:"valid_from"`
+	ValidUntil string            `json:"valid_until"`
+	Period     string            `json:"period"`
+	Attrs      map[string]string `json:"-"`
+}
+
+// One line of the output index written after a bulk issuance
+type Result struct {
+	Line        int    `json:"line"`
+	Subject     string `json:"subject"`
+	KeyFile     string `json:"key_file,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// A validated row, ready for KeyGen
+type Item struct {
+	Row      Row
+	Validity *accesspolicy.Validity
+	Result   *Result
+}
+
+// Parse reads a .csv or .json manifest
+func Parse(path string) ([]Row, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("manifest: open: %w", err)
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return ParseCSV(file)
+	case ".json":
+		return ParseJSON(file)
+	}
+	return nil, fmt.Errorf("manifest: must be a .csv or .json file")
+}
+
+// ParseJSON reads an array of rows, numbered from 1
+func ParseJSON(r io.Reader) ([]Row, error) {
+	var rows []Row
+	if err := json.NewDecoder(r).Decode(&rows); err != nil {
+		return nil, fmt.Errorf("manifest: parse: %w", err)
+	}
+	for i := range rows {
+		rows[i].Line = i + 1
+	}
+	return rows, nil
+}
+
+// ParseCSV reads a header line & one row per line, numbered by their line in the file
+func ParseCSV(r io.Reader) ([]Row, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("manifest: read header: %w", err)
+	}
+	for i := range header {
+		header[i] = strings.TrimSpace(header[i])
+	}
+
+	var rows []Row
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("manifest: parse line %d: %w", line, err)
+		}
+
+		row := Row{Line: line, Attrs: make(map[string]string)}
+		values := make(map[string][]string)
+		for i, column := range header {
+			value := strings.TrimSpace(record[i])
+			switch column {
+			case "subject":
+				row.Subject = value
+			case "out":
+				row.Out = value
+			case "valid_from":
+				row.ValidFrom = value
+			case "valid_until":
+				row.ValidUntil = value
+			case "period":
+				row.Period = value
+			default:
+				if strings.Contains(value, accesspolicy.ValueSeparator) {
+					return nil, fmt.Errorf("manifest: line %d: %s value %q holds a %q, repeat the column for several values",
+						line, column, value, accesspolicy.ValueSeparator)
+				}
+				if value != "" {
+					values[column] = append(values[column], value)
+				}
+			}
+		}
+		for name, list := range values {
+			row.Attrs[name] = accesspolicy.JoinValues(list)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// Validate checks every row before anything is issued: required & unique subjects and key
+// files, attributes & validity as checker accepts them, one period size for the manifest.
+// Returns the valid items and one result per row, invalid rows carry their error.
+func Validate(rows []Row, checker IChecker) ([]*Item, []*Result) {
+	var items []*Item
+	results := make([]*Result, 0, len(rows))
+	subjects := make(map[string]int)
+	files := make(map[string]int)
+	var granularity accesspolicy.Granularity
+
+	for _, row := range rows {
+		result := &Result{Line: row.Line, Subject: row.Subject, Status: StatusPending}
+		results = append(results, result)
+
+		fail := func(format string, args ...any) {
+			result.Status = StatusInvalid
+			result.Error = fmt.Sprintf(format, args...)
+		}
+
+		if row.Subject == "" {
+			fail("subject is required")
+			continue
+		}
+		if line, dup := subjects[row.Subject]; dup {
+			fail("duplicate subject, first seen on line %d", line)
+			continue
+		}
+		subjects[row.Subject] = row.Line
+
+		if row.Out == "" {
+			row.Out = row.Subject + ".key"
+		}
+		result.KeyFile = row.Out
+		if err := checker.KeyFile(row.Out); err != nil {
+			fail("%v", err)
+			continue
+		}
+		if line, dup := files[row.Out]; dup {
+			fail("duplicate key file, first seen on line %d", line)
+			continue
+		}
+		files[row.Out] = row.Line
+
+		if row.Attrs == nil {
+			attrs, err := checker.ParseAttributes(row.Attributes)
+			if err != nil {
+				fail("attributes: %v", err)
+				continue
+			}
+			row.Attrs = attrs
+		}
+		if err := checker.CheckAttributes(row.Attrs); err != nil {
+			fail("attributes: %v", err)
+			continue
+		}
+
+		validity, err := checker.Validity(row.Period, row.ValidFrom, row.ValidUntil)
+		if err != nil {
+			fail("validity: %v", err)
+			continue
+		}
+		if validity != nil {
+			if granularity != "" && validity.Granularity != granularity {
+				fail("validity: mixes %s and %s periods", granularity, validity.Granularity)
+				continue
+			}
+			granularity = validity.Granularity
+		}
+
+		items = append(items, &Item{Row: row, Validity: validity, Result: result})
+	}
+	return items, results
+}
+
+// Issue issues keys for all valid items.
+// All-or-nothing unless partial is set: every key is generated in memory first and only
+// written if all of them succeeded. With partial, each item is issued on its own and
+// failures are only reported.
+func Issue(items []*Item, partial bool, issuer IIssuer) error {
+	var prepared []*Item
+	for _, item := range items {
+		fingerprint, err := issuer.Prepare(item)
+		if err == nil && partial {
+			err = issuer.Commit([]*Item{item})
+		}
+		if err != nil {
+			item.Result.Status = StatusFailed
+			item.Result.Error = err.Error()
+			if !partial {
+				return fmt.Errorf("line %d (%s): %w", item.Row.Line, item.Row.Subject, err)
+			}
+			continue
+		}
+		item.Result.Fingerprint = fingerprint
+		prepared = append(prepared, item)
+		if partial {
+			item.Result.Status = StatusIssued
+		}
+	}
+	if partial || len(prepared) == 0 {
+		return nil
+	}
+
+	if err := issuer.Commit(prepared); err != nil {
+		for _, item := range prepared {
+			item.Result.Status = StatusFailed
+			item.Result.Error = err.Error()
+		}
+		return err
+	}
+	for _, item := range prepared {
+		item.Result.Status = StatusIssued
+	}
+	return nil
+}
+
+// Finish marks rows that were never reached as not issued & counts the issued ones
+func Finish(results []*Result) int {
+	issued := 0
+	for _, result := range results {
+		switch result.Status {
+		case StatusPending:
+			result.Status = StatusNotIssued
+		case StatusIssued:
+			issued++
+		}
+	}
+	return issued
+}
+
+// WriteIndex writes the output index mapping subjects to key files & fingerprints
+func WriteIndex(path string, results []*Result) error {
+	data, err := json.MarshalIndent(results, "", "  ")
+	if err != nil {
+		return fmt.Errorf("manifest: marshal index: %w", err)
+	}
+	return keystore.WriteFile(path, data, keystore.PublicPerm)
+}
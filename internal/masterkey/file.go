@@ -0,0 +1,41 @@
+package masterkey
+
+import (
+	"fmt"
+
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/keystore"
+)
+
+// Keeps the master key in a key file container, readable by its owner only
+type FileStore struct {
+	Path      string
+	Namespace string
+}
+
+func (strct *FileStore) Setup(keyID string) ([]byte, error) {
+	publicKey, masterKey, systemID, err := Generate()
+	if err != nil {
+		return nil, err
+	}
+	defer clear(masterKey)
+
+	file := keyfile.New(keyfile.Master, masterKey)
+	file.Namespace, file.SystemID, file.KeyID = strct.Namespace, systemID, keyID
+	data, err := file.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if err := keystore.WriteFile(strct.Path, data, keystore.SecretPerm); err != nil {
+		return nil, fmt.Errorf("masterkey: %w", err)
+	}
+	return publicKey, nil
+}
+
+func (strct *FileStore) Open() (IMasterKey, error) {
+	file, err := keyfile.Read(strct.Path, keyfile.Master)
+	if err != nil {
+		return nil, err
+	}
+	return FromBytes(file.Key, file.SystemID)
+}
@@ -0,0 +1,21 @@
+package masterkey
+
+type IMasterKey interface {
+	// Issues an attribute key
+	// Takes as input: the attributes the key holds, already encoded
+	// Outputs: the serialized attribute key
+	KeyGen(attributes map[string]string) ([]byte, error)
+
+	// System the master key belongs to, "" if the backend does not record it
+	SystemID() string
+}
+
+type IMasterKeyStore interface {
+	// Generates a new system key pair & keeps its master key, replacing the previous one
+	// Takes as input: the epoch key ID of the new pair
+	// Outputs: the serialized public key, the only half that leaves the store
+	Setup(keyID string) ([]byte, error)
+
+	// Opens the kept master key for issuance
+	Open() (IMasterKey, error)
+}
@@ -0,0 +1,64 @@
+package masterkey
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"securemqtt/internal/keyfile"
+
+	"github.com/cloudflare/circl/abe/cpabe/tkn20"
+)
+
+// A master key held in this process's memory
+type local struct {
+	key      tkn20.SystemSecretKey
+	systemID string
+}
+
+// FromKey wraps a master key the caller already holds, e.g. one reconstructed from shares
+func FromKey(key tkn20.SystemSecretKey, systemID string) IMasterKey {
+	return &local{key: key, systemID: systemID}
+}
+
+// FromBytes parses a serialized master key
+func FromBytes(masterBytes []byte, systemID string) (IMasterKey, error) {
+	var key tkn20.SystemSecretKey
+	if err := key.UnmarshalBinary(masterBytes); err != nil {
+		return nil, fmt.Errorf("masterkey: unmarshal master secret key: %w", err)
+	}
+	return FromKey(key, systemID), nil
+}
+
+func (strct *local) KeyGen(attributes map[string]string) ([]byte, error) {
+	var attrs tkn20.Attributes
+	attrs.FromMap(attributes)
+
+	privateKey, err := strct.key.KeyGen(rand.Reader, attrs)
+	if err != nil {
+		return nil, fmt.Errorf("masterkey: KeyGen failed: %w", err)
+	}
+	privateKeyBytes, err := privateKey.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("masterkey: marshal attribute key: %w", err)
+	}
+	return privateKeyBytes, nil
+}
+
+func (strct *local) SystemID() string {
+	return strct.systemID
+}
+
+// Generate creates a system key pair & returns both halves serialized, with the system ID
+func Generate() (publicKey, masterKey []byte, systemID string, err error) {
+	public, master, err := tkn20.Setup(rand.Reader)
+	if err != nil {
+		return nil, nil, "", fmt.Errorf("masterkey: setup failed: %w", err)
+	}
+	if publicKey, err = public.MarshalBinary(); err != nil {
+		return nil, nil, "", fmt.Errorf("masterkey: marshal public key: %w", err)
+	}
+	if masterKey, err = master.MarshalBinary(); err != nil {
+		return nil, nil, "", fmt.Errorf("masterkey: marshal master secret key: %w", err)
+	}
+	return publicKey, masterKey, keyfile.SystemID(publicKey), nil
+}
@@ -0,0 +1,181 @@
+package masterkey
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"securemqtt/internal/keystore"
+)
+
+const (
+	// Sealed file format version
+	SealedVersion = 1
+
+	// Key derivation from the passphrase: PBKDF2-HMAC-SHA256
+	kdfName       = "pbkdf2-sha256"
+	kdfIterations = 600000
+	saltSize      = 16
+	keySize       = 32
+
+	// Passphrases shorter than this are refused when sealing
+	MinPassphrase = 12
+)
+
+// What a sealed master key file tells without its passphrase
+type SealedHeader struct {
+	Version    int       `json:"version"`
+	Namespace  string    `json:"namespace,omitempty"`
+	SystemID   string    `json:"system_id"`
+	KeyID      string    `json:"key_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	KDF        string    `json:"kdf"`
+	Iterations int       `json:"iterations"`
+	Salt       []byte    `json:"salt"`
+	Nonce      []byte    `json:"nonce"`
+}
+
+type sealedFile struct {
+	SealedHeader
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Keeps the master key encrypted under a passphrase (AES-256-GCM, key derived with PBKDF2).
+// Passphrase is asked for only when the key is sealed or opened, confirm is set when sealing.
+type SealedStore struct {
+	Path       string
+	Namespace  string
+	Passphrase func(confirm bool) ([]byte, error)
+}
+
+func (strct *SealedStore) Setup(keyID string) ([]byte, error) {
+	passphrase, err := strct.Passphrase(true)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(passphrase)
+	if len(strings.TrimSpace(string(passphrase))) < MinPassphrase {
+		return nil, fmt.Errorf("masterkey: passphrase must be at least %d characters", MinPassphrase)
+	}
+
+	publicKey, masterKey, systemID, err := Generate()
+	if err != nil {
+		return nil, err
+	}
+	defer clear(masterKey)
+
+	sealed := sealedFile{SealedHeader: SealedHeader{
+		Version:    SealedVersion,
+		Namespace:  strct.Namespace,
+		SystemID:   systemID,
+		KeyID:      keyID,
+		CreatedAt:  time.Now().UTC(),
+		KDF:        kdfName,
+		Iterations: kdfIterations,
+		Salt:       make([]byte, saltSize),
+	}}
+	if _, err := io.ReadFull(rand.Reader, sealed.Salt); err != nil {
+		return nil, fmt.Errorf("masterkey: salt: %w", err)
+	}
+	gcm, err := sealed.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	sealed.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, sealed.Nonce); err != nil {
+		return nil, fmt.Errorf("masterkey: nonce: %w", err)
+	}
+	sealed.Ciphertext = gcm.Seal(nil, sealed.Nonce, masterKey, sealed.aad())
+
+	data, err := json.MarshalIndent(sealed, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("masterkey: marshal sealed key: %w", err)
+	}
+	if err := keystore.WriteFile(strct.Path, data, keystore.SecretPerm); err != nil {
+		return nil, fmt.Errorf("masterkey: %w", err)
+	}
+	return publicKey, nil
+}
+
+func (strct *SealedStore) Open() (IMasterKey, error) {
+	sealed, err := readSealed(strct.Path)
+	if err != nil {
+		return nil, err
+	}
+	passphrase, err := strct.Passphrase(false)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(passphrase)
+
+	gcm, err := sealed.cipher(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	masterKey, err := gcm.Open(nil, sealed.Nonce, sealed.Ciphertext, sealed.aad())
+	if err != nil {
+		return nil, fmt.Errorf("masterkey: wrong passphrase or corrupted %s", strct.Path)
+	}
+	defer clear(masterKey)
+	return FromBytes(masterKey, sealed.SystemID)
+}
+
+// ReadSealedHeader reads the unencrypted header of a sealed master key
+func ReadSealedHeader(path string) (*SealedHeader, error) {
+	sealed, err := readSealed(path)
+	if err != nil {
+		return nil, err
+	}
+	return &sealed.SealedHeader, nil
+}
+
+func readSealed(path string) (*sealedFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("masterkey: read %s: %w", path, err)
+	}
+	var sealed sealedFile
+	if err := json.Unmarshal(data, &sealed); err != nil {
+		return nil, fmt.Errorf("masterkey: parse %s: %w", path, err)
+	}
+	if sealed.Version != SealedVersion || sealed.KDF != kdfName {
+		return nil, fmt.Errorf("masterkey: %s: unsupported sealed key version %d (%s)", path, sealed.Version, sealed.KDF)
+	}
+	return &sealed, nil
+}
+
+// AES-256-GCM keyed from the passphrase with the file's KDF parameters
+func (strct *sealedFile) cipher(passphrase []byte) (cipher.AEAD, error) {
+	if strct.Iterations < 1 || len(strct.Salt) != saltSize {
+		return nil, fmt.Errorf("masterkey: invalid key derivation parameters")
+	}
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), strct.Salt, strct.Iterations, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("masterkey: derive key: %w", err)
+	}
+	defer clear(key)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("masterkey: cipher init failed: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("masterkey: GCM init failed: %w", err)
+	}
+	return gcm, nil
+}
+
+// Binds the ciphertext to the header, so the system & epoch it names cannot be swapped
+func (strct *sealedFile) aad() []byte {
+	return fmt.Appendf(nil, "sealed-master-key|%d|%s|%s|%s|%s|%d", strct.Version, strct.Namespace, strct.SystemID,
+		strct.KeyID, strct.KDF, strct.Iterations)
+}
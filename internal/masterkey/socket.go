@@ -0,0 +1,274 @@
+package masterkey
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"securemqtt/internal/namespace"
+)
+
+const (
+	// How long one request to the key holder may take, key generation included
+	socketTimeout = 30 * time.Second
+
+	// Largest request the key holder reads
+	maxRequest = 1 << 20
+)
+
+// One request to the key holder: setup, keygen or system. Each connection carries one request.
+// Namespace picks the master key, every namespace has its own. Replace allows a setup to destroy
+// the master key of the namespace; SystemID names the system that key must belong to (setup
+// with Replace, any if empty) or the system a keygen is for.
+type request struct {
+	Op         string            `json:"op"`
+	Namespace  string            `json:"namespace,omitempty"`
+	SystemID   string            `json:"system_id,omitempty"`
+	KeyID      string            `json:"key_id,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Replace    bool              `json:"replace,omitempty"`
+}
+
+type response struct {
+	Error     string `json:"error,omitempty"`
+	PublicKey []byte `json:"public_key,omitempty"`
+	Key       []byte `json:"key,omitempty"`
+	SystemID  string `json:"system_id,omitempty"`
+}
+
+// Master key of Namespace held by a key-holder daemon behind a Unix socket; it never leaves the daemon.
+// Without Replace, Setup is refused by a key holder that already has a master key for Namespace.
+// With Replace & SystemID set, only the master key of that system may be replaced.
+type SocketStore struct {
+	Path      string
+	Namespace string
+	SystemID  string
+	Replace   bool
+}
+
+func (strct *SocketStore) Setup(keyID string) ([]byte, error) {
+	resp, err := call(strct.Path, request{Op: "setup", Namespace: strct.Namespace, SystemID: strct.SystemID, KeyID: keyID, Replace: strct.Replace})
+	if err != nil {
+		return nil, err
+	}
+	return resp.PublicKey, nil
+}
+
+func (strct *SocketStore) Open() (IMasterKey, error) {
+	resp, err := call(strct.Path, request{Op: "system", Namespace: strct.Namespace})
+	if err != nil {
+		return nil, err
+	}
+	return &remote{path: strct.Path, namespace: strct.Namespace, systemID: resp.SystemID}, nil
+}
+
+// Master key of a key-holder daemon, every KeyGen is a request.
+// The key holder refuses it once the namespace's master key belongs to another system.
+type remote struct {
+	path      string
+	namespace string
+	systemID  string
+}
+
+func (strct *remote) KeyGen(attributes map[string]string) ([]byte, error) {
+	resp, err := call(strct.path, request{Op: "keygen", Namespace: strct.namespace, SystemID: strct.systemID, Attributes: attributes})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Key, nil
+}
+
+func (strct *remote) SystemID() string {
+	return strct.systemID
+}
+
+func call(path string, req request) (*response, error) {
+	conn, err := net.DialTimeout("unix", path, socketTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("masterkey: connect to key holder %s: %w", path, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(socketTimeout))
+
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return nil, fmt.Errorf("masterkey: send %s request: %w", req.Op, err)
+	}
+	var resp response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("masterkey: read %s response: %w", req.Op, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("masterkey: key holder: %s", resp.Error)
+	}
+	return &resp, nil
+}
+
+// Answers key-holder requests with the master keys of the stores, which stay in this process.
+// Every namespace has its own store, so a setup in one never touches another's master key.
+type Server struct {
+	stores func(namespace string) IMasterKeyStore
+	logf   func(format string, args ...any)
+
+	mu   sync.Mutex
+	keys map[string]IMasterKey
+}
+
+// NewServer opens the master key of the default namespace if there is one, so a wrong
+// passphrase fails at start; other namespaces are opened on their first request
+func NewServer(stores func(namespace string) IMasterKeyStore, logf func(format string, args ...any)) (*Server, error) {
+	server := &Server{stores: stores, logf: logf, keys: make(map[string]IMasterKey)}
+	if _, err := server.key(""); err != nil {
+		return nil, err
+	}
+	if server.keys[""] == nil {
+		logf("No master key yet, waiting for a setup request")
+	}
+	return server, nil
+}
+
+// Master key of namespace, nil if it has none yet
+func (strct *Server) key(ns string) (IMasterKey, error) {
+	if key, ok := strct.keys[ns]; ok {
+		return key, nil
+	}
+	key, err := strct.stores(ns).Open()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	strct.keys[ns] = key
+	return key, nil
+}
+
+// Listen creates the socket at path, readable & writable by its owner only.
+// A socket left by an earlier run is replaced.
+func Listen(path string) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == os.ModeSocket {
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("masterkey: listen on %s: %w", path, err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("masterkey: chmod %s: %w", path, err)
+	}
+	return listener, nil
+}
+
+// Serve answers requests until the listener is closed
+func (strct *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("masterkey: accept: %w", err)
+		}
+		go strct.handle(conn)
+	}
+}
+
+func (strct *Server) handle(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(socketTimeout))
+
+	var req request
+	var resp *response
+	if err := json.NewDecoder(io.LimitReader(conn, maxRequest)).Decode(&req); err != nil {
+		resp = &response{Error: "invalid request: " + err.Error()}
+	} else {
+		var err error
+		if resp, err = strct.answer(req); err != nil {
+			strct.logf("Refused %s request: %v", req.Op, err)
+			resp = &response{Error: err.Error()}
+		}
+	}
+	_ = json.NewEncoder(conn).Encode(resp)
+}
+
+func (strct *Server) answer(req request) (*response, error) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+
+	if err := namespace.Validate(req.Namespace); err != nil {
+		return nil, err
+	}
+	held, err := strct.key(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	switch req.Op {
+	case "setup":
+		// A replaced master key is gone for good, only an explicit forced setup or rotation
+		// of the system it belongs to may do it
+		if held != nil && !req.Replace {
+			return nil, fmt.Errorf("already holding the master key of system %s%s, run the authority's --setup --force or --rotate to replace it",
+				held.SystemID(), describeNamespace(req.Namespace))
+		}
+		if held != nil && req.SystemID != "" && held.SystemID() != req.SystemID {
+			return nil, fmt.Errorf("holding the master key of system %s%s, not of system %s the authority replaces",
+				held.SystemID(), describeNamespace(req.Namespace), req.SystemID)
+		}
+		store := strct.stores(req.Namespace)
+		publicKey, err := store.Setup(req.KeyID)
+		if err != nil {
+			return nil, err
+		}
+		delete(strct.keys, req.Namespace)
+		if held, err = store.Open(); err != nil {
+			return nil, err
+		}
+		strct.keys[req.Namespace] = held
+		strct.logf("Generated system keys of system %s%s, epoch %s", held.SystemID(), describeNamespace(req.Namespace), req.KeyID)
+		return &response{PublicKey: publicKey, SystemID: held.SystemID()}, nil
+	case "system", "keygen":
+		if held == nil {
+			return nil, fmt.Errorf("no master key%s, run the authority's setup first", describeNamespace(req.Namespace))
+		}
+		if req.Op == "system" {
+			return &response{SystemID: held.SystemID()}, nil
+		}
+		if req.SystemID != held.SystemID() {
+			return nil, fmt.Errorf("holding the master key of system %s%s, not of system %s", held.SystemID(), describeNamespace(req.Namespace), req.SystemID)
+		}
+		key, err := held.KeyGen(req.Attributes)
+		if err != nil {
+			return nil, err
+		}
+		strct.logf("Issued a key of system %s%s holding %s", held.SystemID(), describeNamespace(req.Namespace), describe(req.Attributes))
+		return &response{Key: key}, nil
+	default:
+		return nil, fmt.Errorf("unknown operation %q", req.Op)
+	}
+}
+
+// Namespace for messages, nothing for the default one
+func describeNamespace(ns string) string {
+	if ns == "" {
+		return ""
+	}
+	return fmt.Sprintf(" in namespace %s", ns)
+}
+
+// Attribute names in a stable order for the log. Values stay out of it, some are secret (trace IDs).
+func describe(attributes map[string]string) string {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
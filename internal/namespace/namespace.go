@@ -0,0 +1,37 @@
+package namespace
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// Directory under the keys root holding one subdirectory per named namespace.
+// The default namespace ("") keeps using the keys root itself.
+const Dir = "namespaces"
+
+// Validate checks a namespace name: lower-case letters, digits, '-' & '_', at most 63 characters
+func Validate(name string) error {
+	if name == "" {
+		return nil
+	}
+	if len(name) > 63 {
+		return fmt.Errorf("namespace: %q is longer than 63 characters", name)
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case (c == '-' || c == '_') && i > 0:
+		default:
+			return fmt.Errorf("namespace: %q may only contain a-z, 0-9, '-' and '_' and must start with a letter or digit", name)
+		}
+	}
+	return nil
+}
+
+// Path returns the directory holding a namespace's system keys, issued keys & registry
+func Path(keysRoot, name string) string {
+	if name == "" {
+		return keysRoot
+	}
+	return filepath.Join(keysRoot, Dir, name)
+}
@@ -0,0 +1,183 @@
+package provisioning
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/clientmqtt"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/signed"
+)
+
+const (
+	// Type of the signed document a bundle is wrapped in
+	Document = "provisioning-bundle"
+
+	// Bundle format version
+	Version = 1
+
+	// Devices a bundle provisions
+	RolePublisher  = "publisher"
+	RoleSubscriber = "subscriber"
+
+	// Environment of the generic binaries: the bundle file & the base64 authority signing key it must be signed with
+	BundleEnv       = "PROVISION_BUNDLE"
+	AuthorityKeyEnv = "PROVISION_AUTHORITY_KEY"
+)
+
+// Where a device connects to
+type Broker struct {
+	URLs     []string `json:"urls"`
+	ClientID string   `json:"client_id"`
+
+	// PEM certificates the broker's TLS certificate must chain to, system roots if empty
+	CACert []byte `json:"ca_cert,omitempty"`
+}
+
+// A topic a publisher publishes to under Policy, or a topic filter a subscriber reads
+type Topic struct {
+	Topic  string `json:"topic"`
+	Policy string `json:"policy,omitempty"`
+}
+
+// Everything a generic publisher or subscriber needs to run, signed by the authority.
+// Documents holds signed authority documents publishers apply (attribute versions, schema,
+// escrow clause, periods) by file name, each verified on its own when loaded.
+type Bundle struct {
+	Version      int                    `json:"version"`
+	Role         string                 `json:"role"`
+	Subject      string                 `json:"subject"`
+	Namespace    string                 `json:"namespace,omitempty"`
+	SystemID     string                 `json:"system_id"`
+	KeyID        string                 `json:"key_id,omitempty"`
+	PublicKey    []byte                 `json:"public_key"`
+	AttributeKey []byte                 `json:"attribute_key,omitempty"`
+	Statement    []byte                 `json:"statement,omitempty"`
+	Validity     *accesspolicy.Validity `json:"validity,omitempty"`
+	Broker       Broker                 `json:"broker"`
+	Topics       []Topic                `json:"topics"`
+	Documents    map[string][]byte      `json:"documents,omitempty"`
+	CreatedAt    time.Time              `json:"created_at"`
+
+	// Key the bundle was verified with, set by Load
+	authorityKey ed25519.PublicKey
+}
+
+// Check rejects bundles a device could not run with
+func (strct *Bundle) Check() error {
+	if strct.Version != Version {
+		return fmt.Errorf("provisioning: unsupported bundle version %d", strct.Version)
+	}
+	if strct.Subject == "" || strct.Broker.ClientID == "" {
+		return fmt.Errorf("provisioning: bundle without subject or client ID")
+	}
+	if len(strct.PublicKey) == 0 || keyfile.SystemID(strct.PublicKey) != strct.SystemID {
+		return fmt.Errorf("provisioning: public key does not belong to system %s", strct.SystemID)
+	}
+	switch strct.Role {
+	case RoleSubscriber:
+		if len(strct.AttributeKey) == 0 {
+			return fmt.Errorf("provisioning: subscriber bundle without attribute key")
+		}
+	case RolePublisher:
+		if len(strct.AttributeKey) > 0 {
+			return fmt.Errorf("provisioning: publisher bundle must not hold an attribute key")
+		}
+	default:
+		return fmt.Errorf("provisioning: unknown role %q", strct.Role)
+	}
+	if len(strct.Broker.URLs) == 0 {
+		return fmt.Errorf("provisioning: bundle without broker")
+	}
+	if len(strct.Broker.CACert) > 0 && !x509.NewCertPool().AppendCertsFromPEM(strct.Broker.CACert) {
+		return fmt.Errorf("provisioning: CA certificate is not PEM")
+	}
+	if len(strct.Topics) == 0 {
+		return fmt.Errorf("provisioning: bundle without topics")
+	}
+	for _, topic := range strct.Topics {
+		if topic.Topic == "" {
+			return fmt.Errorf("provisioning: empty topic")
+		}
+		if strct.Role != RolePublisher {
+			continue
+		}
+		if strings.ContainsAny(topic.Topic, "+#") {
+			return fmt.Errorf("provisioning: publishers cannot publish to filter %s", topic.Topic)
+		}
+		if _, err := accesspolicy.Parse(topic.Policy); err != nil {
+			return fmt.Errorf("provisioning: policy of %s: %w", topic.Topic, err)
+		}
+	}
+	return nil
+}
+
+// Sign checks bundle & wraps it in a document signed by the authority
+func Sign(privateKey ed25519.PrivateKey, bundle *Bundle) ([]byte, error) {
+	if err := bundle.Check(); err != nil {
+		return nil, err
+	}
+	return signed.Sign(privateKey, Document, bundle)
+}
+
+// Load reads a bundle & verifies it was signed with authorityKey
+func Load(path string, authorityKey ed25519.PublicKey) (*Bundle, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("provisioning: read %s: %w", path, err)
+	}
+	defer clear(data)
+
+	var bundle Bundle
+	if err := signed.Verify(authorityKey, Document, data, &bundle); err != nil {
+		return nil, fmt.Errorf("provisioning: %s: %w", path, err)
+	}
+	if err := bundle.Check(); err != nil {
+		return nil, err
+	}
+	bundle.authorityKey = authorityKey
+	return &bundle, nil
+}
+
+// FromEnv loads the bundle named by PROVISION_BUNDLE, nil if it is not set.
+// PROVISION_AUTHORITY_KEY is required with it: a bundle is never trusted on its own word.
+func FromEnv() (*Bundle, error) {
+	path := os.Getenv(BundleEnv)
+	if path == "" {
+		return nil, nil
+	}
+	authorityKey, err := base64.StdEncoding.DecodeString(os.Getenv(AuthorityKeyEnv))
+	if err != nil || len(authorityKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("provisioning: %s must hold the base64 authority signing key", AuthorityKeyEnv)
+	}
+	return Load(path, authorityKey)
+}
+
+// AuthorityKey returns the signing key the bundle was verified with, which also signs its statement & documents
+func (strct *Bundle) AuthorityKey() ed25519.PublicKey {
+	return strct.authorityKey
+}
+
+// LoadDocument verifies the bundled document name & decodes it into out.
+// Returns false if the authority had not published it when the bundle was made.
+func (strct *Bundle) LoadDocument(name, docType string, out any) (bool, error) {
+	data, ok := strct.Documents[name]
+	if !ok {
+		return false, nil
+	}
+	if err := signed.Verify(strct.authorityKey, docType, data, out); err != nil {
+		return false, fmt.Errorf("provisioning: bundled %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// Options connects to the bundle's broker
+func (strct *Bundle) Options() clientmqtt.Options {
+	return clientmqtt.Options{BrokerURLs: strct.Broker.URLs, ClientID: strct.Broker.ClientID, CACert: strct.Broker.CACert}
+}
@@ -0,0 +1,10 @@
+package secureclient
+
+import "securemqtt/internal"
+
+// Wraps a local callback as an auditor
+type DecryptAuditorFunc func(topic string, envelope *internal.Envelope) error
+
+func (strct DecryptAuditorFunc) Decrypted(topic string, envelope *internal.Envelope) error {
+	return strct(topic, envelope)
+}
@@ -0,0 +1,37 @@
+package secureclient
+
+import (
+	"log"
+	"time"
+)
+
+// Records when the subscriber key's validity window ends (e.g. after a re-issue)
+func (strct *SecureClient) SetKeyExpiry(notAfter time.Time) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	strct.keyNotAfter = notAfter
+}
+
+// Starts a background check that warns once the subscriber key is within warnBefore of
+// the end of its last period. Messages published after that are unreadable with this key.
+func (strct *SecureClient) WarnBeforeExpiry(warnBefore time.Duration) {
+	go func() {
+		for {
+			strct.mu.RLock()
+			notAfter := strct.keyNotAfter
+			strct.mu.RUnlock()
+
+			remaining := time.Until(notAfter)
+			switch {
+			case notAfter.IsZero():
+			case remaining <= 0:
+				log.Printf("[SUBSCRIBER] Key expired at %s, request a new key from the authority", notAfter.Format(time.RFC3339))
+			case remaining <= warnBefore:
+				log.Printf("[SUBSCRIBER] Key expires in %s (at %s), request a new key from the authority",
+					remaining.Round(time.Minute), notAfter.Format(time.RFC3339))
+			}
+
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -0,0 +1,10 @@
+package secureclient
+
+import "securemqtt/internal"
+
+type IDecryptAuditor interface {
+	// Records that a message was decrypted, before its plaintext is handed to the handler
+	// Takes as input: the topic & the envelope that was decrypted
+	// Outputs: an error to withhold the plaintext, e.g. when the audit log cannot be written
+	Decrypted(topic string, envelope *internal.Envelope) error
+}
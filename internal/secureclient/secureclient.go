@@ -5,11 +5,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
 	"securemqtt/internal"
 	"securemqtt/internal/abe"
+	"securemqtt/internal/accesspolicy"
 	aescryptography "securemqtt/internal/aes"
 	"securemqtt/internal/clientmqtt"
+	"securemqtt/internal/statement"
 )
 
 type SecureClient struct {
@@ -17,8 +21,27 @@ type SecureClient struct {
 	publisherABE    abe.IPublisherABE
 	subscriberABE   abe.ISubscriberABE
 	aesCryptography aescryptography.IAESCryptography
-	publicKeyBytes  []byte
 	privateKeyBytes []byte
+
+	// Keys & rewriters per namespace, "" is the default namespace
+	mu          sync.RWMutex
+	namespaces  map[string]*namespaceKeys
+	keyNotAfter time.Time
+	statements  []*statement.Statement
+
+	// Told about every decryption before the plaintext is handed out, nil for none
+	auditor IDecryptAuditor
+}
+
+// What the client holds for one namespace (tenant system)
+type namespaceKeys struct {
+	// Key epochs: the key ID published with publicKeyBytes & subscriber keys per key ID
+	keyID          string
+	publicKeyBytes []byte
+	privateKeys    map[string][]byte
+
+	// Applied to every publish policy, in registration order
+	policyRewriters []accesspolicy.IPolicyRewriter
 }
 
 // Constructor
@@ -35,14 +58,141 @@ func NewSecureClient(
 		publisherABE:    publisherABE,
 		subscriberABE:   subscriberABE,
 		aesCryptography: aesCryptography,
-		publicKeyBytes:  publicKeyBytes,
 		privateKeyBytes: privateKeyBytes,
+		namespaces: map[string]*namespaceKeys{
+			"": {publicKeyBytes: publicKeyBytes, privateKeys: make(map[string][]byte)},
+		},
+	}
+}
+
+// Switches publishing to a (newer) system public key, identified by keyID in every envelope
+func (strct *SecureClient) SetPublicKey(keyID string, publicKeyBytes []byte) {
+	strct.SetNamespacePublicKey("", keyID, publicKeyBytes)
+}
+
+// Registers the subscriber key for an epoch, so envelopes carrying keyID decrypt with it
+func (strct *SecureClient) AddPrivateKey(keyID string, privateKeyBytes []byte) {
+	strct.AddNamespacePrivateKey("", keyID, privateKeyBytes)
+}
+
+// Drops the subscriber key of a retired epoch
+func (strct *SecureClient) RemovePrivateKey(keyID string) {
+	strct.RemoveNamespacePrivateKey("", keyID)
+}
+
+// Registers a rewriter applied to every policy before encryption, after the ones already registered
+func (strct *SecureClient) AddPolicyRewriter(rewriter accesspolicy.IPolicyRewriter) {
+	strct.AddNamespacePolicyRewriter("", rewriter)
+}
+
+// Registers an auditor that must record every decryption before its plaintext is handed out,
+// e.g. on the client holding the escrow key
+func (strct *SecureClient) SetDecryptAuditor(auditor IDecryptAuditor) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	strct.auditor = auditor
+}
+
+// Sets the public key messages published to a namespace are encrypted under
+func (strct *SecureClient) SetNamespacePublicKey(namespace, keyID string, publicKeyBytes []byte) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	keys := strct.namespace(namespace)
+	keys.keyID = keyID
+	keys.publicKeyBytes = publicKeyBytes
+}
+
+// Registers a subscriber key of a namespace's epoch
+func (strct *SecureClient) AddNamespacePrivateKey(namespace, keyID string, privateKeyBytes []byte) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	strct.namespace(namespace).privateKeys[keyID] = privateKeyBytes
+}
+
+// Drops a subscriber key of a namespace's retired epoch
+func (strct *SecureClient) RemoveNamespacePrivateKey(namespace, keyID string) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	delete(strct.namespace(namespace).privateKeys, keyID)
+}
+
+// Registers a rewriter for policies published to a namespace, each namespace has its own
+// attribute versions, schema & periods
+func (strct *SecureClient) AddNamespacePolicyRewriter(namespace string, rewriter accesspolicy.IPolicyRewriter) {
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	keys := strct.namespace(namespace)
+	keys.policyRewriters = append(keys.policyRewriters, rewriter)
+}
+
+// Returns the keys of a namespace, creating them on first use. Callers hold mu.
+func (strct *SecureClient) namespace(namespace string) *namespaceKeys {
+	keys, ok := strct.namespaces[namespace]
+	if !ok {
+		keys = &namespaceKeys{privateKeys: make(map[string][]byte)}
+		strct.namespaces[namespace] = keys
+	}
+	return keys
+}
+
+// Expands "name in (...)" sets, then runs the policy through every rewriter registered for the namespace.
+// Topic-aware rewriters also get the topic published to.
+func (strct *SecureClient) rewritePolicy(namespace, topic, raw string) (string, error) {
+	raw, err := accesspolicy.ExpandSets(raw)
+	if err != nil {
+		return "", err
 	}
+
+	strct.mu.RLock()
+	var rewriters []accesspolicy.IPolicyRewriter
+	if keys, ok := strct.namespaces[namespace]; ok {
+		rewriters = keys.policyRewriters
+	}
+	strct.mu.RUnlock()
+
+	for _, rewriter := range rewriters {
+		var rewritten string
+		if topicRewriter, ok := rewriter.(accesspolicy.ITopicPolicyRewriter); ok {
+			rewritten, err = topicRewriter.RewriteTopic(topic, raw)
+		} else {
+			rewritten, err = rewriter.Rewrite(raw)
+		}
+		if err != nil {
+			return "", err
+		}
+		raw = rewritten
+	}
+	return raw, nil
+}
+
+// Picks the subscriber key for an envelope's namespace & key ID.
+// In the default namespace, envelopes without key ID, or with one we hold no key for, fall
+// back to the constructor key. Other namespaces only use keys registered for them.
+func (strct *SecureClient) privateKeyFor(namespace, keyID string) []byte {
+	strct.mu.RLock()
+	defer strct.mu.RUnlock()
+	keys, ok := strct.namespaces[namespace]
+	if ok {
+		if privateKeyBytes, ok := keys.privateKeys[keyID]; ok && (keyID != "" || namespace != "") {
+			return privateKeyBytes
+		}
+	}
+	if namespace != "" {
+		return nil
+	}
+	return strct.privateKeyBytes
 }
 
 // Encrypts plaintext under policy & publishes envelope to topic
 func (strct *SecureClient) PublishSecure(topic string, qos byte, retained bool,
 	plaintext []byte, policy string) error {
+	return strct.PublishSecureNamespace("", topic, qos, retained, plaintext, policy)
+}
+
+// Encrypts plaintext under policy with a namespace's public key & publishes envelope to topic.
+// The namespace is carried in the envelope & bound into the AAD.
+func (strct *SecureClient) PublishSecureNamespace(namespace, topic string, qos byte, retained bool,
+	plaintext []byte, policy string) error {
 
 	// Generate session key
 	sessionKey, err := strct.aesCryptography.GenerateKey()
@@ -50,28 +200,49 @@ func (strct *SecureClient) PublishSecure(topic string, qos byte, retained bool,
 		return fmt.Errorf("%s PublishSecure: key generation.", err)
 	}
 
+	// Rewrite the policy (e.g. to current attribute versions), the result is what the envelope carries
+	policy, err = strct.rewritePolicy(namespace, topic, policy)
+	if err != nil {
+		return fmt.Errorf("%s PublishSecure: policy rewrite.", err)
+	}
+
+	// Snapshot the current epoch so key ID & public key always match
+	strct.mu.RLock()
+	var keyID string
+	var publicKeyBytes []byte
+	if keys, ok := strct.namespaces[namespace]; ok {
+		keyID, publicKeyBytes = keys.keyID, keys.publicKeyBytes
+	}
+	strct.mu.RUnlock()
+	if publicKeyBytes == nil {
+		return fmt.Errorf("no public key for namespace %q PublishSecure.", namespace)
+	}
+
 	// Encrypt session key under with CP-ABE under some policy
-	cpCipherTextBytes, err := strct.publisherABE.EncryptKey(strct.publicKeyBytes, policy, sessionKey)
+	cpCipherTextBytes, err := strct.publisherABE.EncryptKey(publicKeyBytes, policy, sessionKey)
 	if err != nil {
 		return fmt.Errorf("%s PublishSecure: ABE encrypt.", err)
 	}
 
-	// Build AAD as "version|topic|policy", then encrypt plaintext with AES
-	aad := strct.aesCryptography.BuildAAD(topic, policy, internal.SupportedVersion)
+	envelope := internal.Envelope{
+		Version:   internal.SupportedVersion,
+		Namespace: namespace,
+		KeyID:     keyID,
+		Policy:    policy,
+	}
+
+	// Build AAD as "version|topic|policy[|namespace=...][|key_id=...]", then encrypt plaintext with AES
+	aad := strct.aesCryptography.BuildAAD(topic, policy, envelope.Version, envelope.AADContext()...)
 
 	iv, aesCipherTextBytes, err := strct.aesCryptography.Encrypt(sessionKey, plaintext, aad)
 	if err != nil {
 		return fmt.Errorf("%s PublishSecure: AES encrypt", err)
 	}
 
-	// Build & serialize envelope
-	envelope := internal.Envelope{
-		Version:       internal.SupportedVersion,
-		Policy:        policy,
-		CPCipherText:  base64.StdEncoding.EncodeToString(cpCipherTextBytes),
-		IV:            base64.StdEncoding.EncodeToString(iv),
-		AESCiphertext: base64.StdEncoding.EncodeToString(aesCipherTextBytes),
-	}
+	// Complete & serialize envelope
+	envelope.CPCipherText = base64.StdEncoding.EncodeToString(cpCipherTextBytes)
+	envelope.IV = base64.StdEncoding.EncodeToString(iv)
+	envelope.AESCiphertext = base64.StdEncoding.EncodeToString(aesCipherTextBytes)
 
 	// Turn into JSON
 	envelopeJSON, err := json.Marshal(envelope)
@@ -84,11 +255,15 @@ func (strct *SecureClient) PublishSecure(topic string, qos byte, retained bool,
 			"  Topic        : %s\n"+
 			"  Policy       : %s\n"+
 			"  Version      : %s\n"+
+			"  Namespace    : %s\n"+
+			"  Key ID       : %s\n"+
 			"  CP-ABE CT    : %d bytes\n"+
 			"  AES CT       : %d bytes\n",
 		topic,
 		policy,
 		envelope.Version,
+		envelope.Namespace,
+		envelope.KeyID,
 		len(cpCipherTextBytes),
 		len(aesCipherTextBytes),
 	)
@@ -116,8 +291,13 @@ func (strct *SecureClient) SubscribeSecure(topic string, qos byte,
 			return
 		}
 
-		// Decrypt session key with CP-ABE
-		sessionKey, err := strct.subscriberABE.DecryptKey(strct.privateKeyBytes, cpCipherTextBytes)
+		// Decrypt session key with CP-ABE, using the key of the envelope's namespace & epoch
+		privateKeyBytes := strct.privateKeyFor(envelope.Namespace, envelope.KeyID)
+		if privateKeyBytes == nil {
+			log.Printf("[SUBSCRIBER] No key for namespace %q, dropping message on %s", envelope.Namespace, msg.Topic)
+			return
+		}
+		sessionKey, err := strct.subscriberABE.DecryptKey(privateKeyBytes, cpCipherTextBytes)
 		if err != nil {
 			log.Printf(
 				"[SUBSCRIBER] Access Denied\n"+
@@ -143,7 +323,7 @@ func (strct *SecureClient) SubscribeSecure(topic string, qos byte,
 		}
 
 		// Rebuild AAD
-		aad := strct.aesCryptography.BuildAAD(msg.Topic, envelope.Policy, envelope.Version)
+		aad := strct.aesCryptography.BuildAAD(msg.Topic, envelope.Policy, envelope.Version, envelope.AADContext()...)
 
 		// Decrypt ciphertext with AES
 		plaintext, err := strct.aesCryptography.Decrypt(sessionKey, iv, aesCipherTextBytes, aad)
@@ -158,6 +338,16 @@ func (strct *SecureClient) SubscribeSecure(topic string, qos byte,
 			return
 		}
 
+		strct.mu.RLock()
+		auditor := strct.auditor
+		strct.mu.RUnlock()
+		if auditor != nil {
+			if err := auditor.Decrypted(msg.Topic, &envelope); err != nil {
+				log.Printf("[SUBSCRIBER] Withholding message on %s, decryption could not be audited: %v", msg.Topic, err)
+				return
+			}
+		}
+
 		log.Printf(
 			"[SUBSCRIBER] Message Decrypted\n"+
 				"  Topic   : %s\n"+
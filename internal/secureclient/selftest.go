@@ -0,0 +1,70 @@
+package secureclient
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/statement"
+)
+
+// ErrKeyMismatch is returned by SelfTest when a subscriber key does not belong to the public key
+var ErrKeyMismatch = errors.New("secureclient: subscriber key does not belong to the system public key")
+
+// SelfTest checks that the subscriber key for keyID belongs to publicKeyBytes (nil: the public key
+// the client publishes with) by encrypting a random canary under a policy the key satisfies & decrypting it.
+// The policy names the subject identifier from the key's attribute statement, which must be loaded first.
+// A key from an earlier setup or another authority fails with ErrKeyMismatch instead of
+// reporting "Access Denied" for every message.
+func (strct *SecureClient) SelfTest(keyID string, publicKeyBytes []byte) error {
+	privateKeyBytes := strct.privateKeyFor("", keyID)
+	if privateKeyBytes == nil {
+		return fmt.Errorf("secureclient: self-test: no subscriber key %q", keyID)
+	}
+
+	strct.mu.RLock()
+	if publicKeyBytes == nil {
+		publicKeyBytes = strct.namespaces[""].publicKeyBytes
+	}
+	var attested *statement.Statement
+	for _, held := range strct.statements {
+		if held.Namespace == "" && held.Describes(privateKeyBytes) {
+			attested = held
+		}
+	}
+	strct.mu.RUnlock()
+
+	if publicKeyBytes == nil {
+		return fmt.Errorf("secureclient: self-test: no public key to test key %q against", keyID)
+	}
+	if attested == nil {
+		return fmt.Errorf("secureclient: self-test: no attribute statement for key %q, load one first", keyID)
+	}
+	// Subscribers do not know attribute versions, the subject identifier is never versioned
+	if attested.Attributes[accesspolicy.SubjectAttribute] == "" {
+		return fmt.Errorf("secureclient: self-test: key %q has no subject identifier to test with", keyID)
+	}
+	policy, err := accesspolicy.CanaryPolicy(attested.Attributes, nil)
+	if err != nil {
+		return fmt.Errorf("secureclient: self-test: %w", err)
+	}
+
+	canary := make([]byte, 16)
+	if _, err := rand.Read(canary); err != nil {
+		return fmt.Errorf("secureclient: self-test: %w", err)
+	}
+	ciphertext, err := strct.publisherABE.EncryptKey(publicKeyBytes, policy, canary)
+	if err != nil {
+		return fmt.Errorf("secureclient: self-test: %w", err)
+	}
+	decrypted, err := strct.subscriberABE.DecryptKey(privateKeyBytes, ciphertext)
+	if err != nil || !bytes.Equal(decrypted, canary) {
+		return fmt.Errorf("%w: key %q of %s cannot read a canary for its own attributes under system %s; "+
+			"it was issued by an earlier setup or another authority, request a new key",
+			ErrKeyMismatch, keyID, attested.Subject, keyfile.SystemID(publicKeyBytes))
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package secureclient
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"slices"
+
+	"securemqtt/internal/statement"
+)
+
+// Verifies an attribute statement against the authority's signing key & keeps it, so the
+// client can report which attributes its keys carry. The statement must describe a subscriber
+// key the client holds; it replaces an earlier statement for the same namespace & key ID.
+// Time-bound statements also set the key expiry.
+func (strct *SecureClient) LoadAttributeStatement(data []byte, authorityKey ed25519.PublicKey) (*statement.Statement, error) {
+	loaded, err := statement.Verify(authorityKey, data)
+	if err != nil {
+		return nil, fmt.Errorf("secureclient: attribute statement: %w", err)
+	}
+
+	strct.mu.Lock()
+	defer strct.mu.Unlock()
+	if !strct.holdsKey(loaded) {
+		return nil, fmt.Errorf("secureclient: attribute statement for %s describes a key this client does not hold", loaded.Subject)
+	}
+
+	strct.statements = slices.DeleteFunc(strct.statements, func(held *statement.Statement) bool {
+		return held.Namespace == loaded.Namespace && held.KeyID == loaded.KeyID
+	})
+	strct.statements = append(strct.statements, loaded)
+	if loaded.Validity != nil {
+		strct.keyNotAfter = loaded.Validity.NotAfter
+	}
+	return loaded, nil
+}
+
+// Verified attribute statements of the keys the client holds, in load order
+func (strct *SecureClient) AttributeStatements() []statement.Statement {
+	strct.mu.RLock()
+	defer strct.mu.RUnlock()
+	statements := make([]statement.Statement, 0, len(strct.statements))
+	for _, held := range strct.statements {
+		statements = append(statements, *held)
+	}
+	return statements
+}
+
+// Reports whether the statement describes the constructor key or a registered key. Callers hold mu.
+func (strct *SecureClient) holdsKey(loaded *statement.Statement) bool {
+	if loaded.Namespace == "" && len(strct.privateKeyBytes) > 0 && loaded.Describes(strct.privateKeyBytes) {
+		return true
+	}
+	keys, ok := strct.namespaces[loaded.Namespace]
+	if !ok {
+		return false
+	}
+	privateKeyBytes, ok := keys.privateKeys[loaded.KeyID]
+	return ok && len(privateKeyBytes) > 0 && loaded.Describes(privateKeyBytes)
+}
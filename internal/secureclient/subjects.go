@@ -0,0 +1,25 @@
+package secureclient
+
+import (
+	"fmt"
+
+	"securemqtt/internal/accesspolicy"
+)
+
+// Publishes plaintext readable only by the keys of the given subject identifiers (the
+// subject_id attribute of their keys). A non-empty policy must be satisfied as well.
+func (strct *SecureClient) PublishToSubjects(topic string, qos byte, retained bool,
+	plaintext []byte, subjectIDs []string, policy string) error {
+	return strct.PublishToSubjectsNamespace("", topic, qos, retained, plaintext, subjectIDs, policy)
+}
+
+// Publishes plaintext to subjects of a namespace, see PublishToSubjects
+func (strct *SecureClient) PublishToSubjectsNamespace(namespace, topic string, qos byte, retained bool,
+	plaintext []byte, subjectIDs []string, policy string) error {
+
+	subjectPolicy, err := accesspolicy.ForSubjects(subjectIDs, policy)
+	if err != nil {
+		return fmt.Errorf("%s PublishToSubjects: policy.", err)
+	}
+	return strct.PublishSecureNamespace(namespace, topic, qos, retained, plaintext, subjectPolicy)
+}
@@ -0,0 +1,179 @@
+package shamir
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Maximum number of shares, indexes are single non-zero bytes
+const MaxShares = 255
+
+// A single custodian share of a secret
+// Index is the x coordinate (1..255) & Data holds one y coordinate per secret byte
+type Share struct {
+	Index     byte
+	Threshold byte
+	Data      []byte
+}
+
+// Split secret into n shares, any k of which can reconstruct it.
+// Every byte of the secret is shared independently over GF(2^8).
+func Split(secret []byte, n, k int) ([]Share, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("shamir: empty secret")
+	}
+	if k < 2 {
+		return nil, fmt.Errorf("shamir: threshold must be at least 2")
+	}
+	if n < k {
+		return nil, fmt.Errorf("shamir: shares (%d) must be >= threshold (%d)", n, k)
+	}
+	if n > MaxShares {
+		return nil, fmt.Errorf("shamir: at most %d shares supported", MaxShares)
+	}
+
+	shares := make([]Share, n)
+	for i := range shares {
+		shares[i] = Share{
+			Index:     byte(i + 1),
+			Threshold: byte(k),
+			Data:      make([]byte, len(secret)),
+		}
+	}
+
+	// One random polynomial of degree k-1 per secret byte, constant term = secret byte
+	coefficients := make([]byte, k)
+	for pos, b := range secret {
+		coefficients[0] = b
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, fmt.Errorf("shamir: random coefficients: %w", err)
+		}
+		for i := range shares {
+			shares[i].Data[pos] = evaluate(coefficients, shares[i].Index)
+		}
+	}
+	clear(coefficients)
+
+	return shares, nil
+}
+
+// Combine reconstructs the secret from at least Threshold shares.
+func Combine(shares []Share) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("shamir: no shares given")
+	}
+
+	threshold := int(shares[0].Threshold)
+	length := len(shares[0].Data)
+	seen := make(map[byte]bool, len(shares))
+	for _, s := range shares {
+		if s.Index == 0 {
+			return nil, fmt.Errorf("shamir: invalid share index 0")
+		}
+		if seen[s.Index] {
+			return nil, fmt.Errorf("shamir: duplicate share %d", s.Index)
+		}
+		seen[s.Index] = true
+		if int(s.Threshold) != threshold || len(s.Data) != length {
+			return nil, fmt.Errorf("shamir: shares belong to different secrets")
+		}
+	}
+	if len(shares) < threshold {
+		return nil, fmt.Errorf("shamir: need %d shares, got %d", threshold, len(shares))
+	}
+
+	// Only threshold shares are needed, extra ones are ignored
+	shares = shares[:threshold]
+
+	secret := make([]byte, length)
+	for pos := range secret {
+		// Lagrange interpolation at x = 0
+		var value byte
+		for i, si := range shares {
+			basis := byte(1)
+			for j, sj := range shares {
+				if i == j {
+					continue
+				}
+				basis = mul(basis, div(sj.Index, sj.Index^si.Index))
+			}
+			value ^= mul(si.Data[pos], basis)
+		}
+		secret[pos] = value
+	}
+
+	return secret, nil
+}
+
+// String encodes the share as "index/threshold/base64(data)", a single line
+// that custodians can store in a file or paste into an interactive prompt.
+func (s Share) String() string {
+	return fmt.Sprintf("%d/%d/%s", s.Index, s.Threshold, base64.StdEncoding.EncodeToString(s.Data))
+}
+
+// ParseShare decodes the output of Share.String
+func ParseShare(raw string) (Share, error) {
+	parts := strings.SplitN(strings.TrimSpace(raw), "/", 3)
+	if len(parts) != 3 {
+		return Share{}, fmt.Errorf("shamir: malformed share")
+	}
+
+	index, err := strconv.ParseUint(parts[0], 10, 8)
+	if err != nil || index == 0 {
+		return Share{}, fmt.Errorf("shamir: invalid share index %q", parts[0])
+	}
+	threshold, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil || threshold < 2 {
+		return Share{}, fmt.Errorf("shamir: invalid share threshold %q", parts[1])
+	}
+	data, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Share{}, fmt.Errorf("shamir: share data: %w", err)
+	}
+
+	return Share{Index: byte(index), Threshold: byte(threshold), Data: data}, nil
+}
+
+// Horner evaluation of the polynomial at x
+func evaluate(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = mul(result, x) ^ coefficients[i]
+	}
+	return result
+}
+
+// Multiplication in GF(2^8) with the AES reduction polynomial
+func mul(a, b byte) byte {
+	var product byte
+	for b > 0 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return product
+}
+
+// Division in GF(2^8), b must be non-zero
+func div(a, b byte) byte {
+	return mul(a, inverse(b))
+}
+
+// Multiplicative inverse, b^254 = b^-1 in GF(2^8)
+func inverse(b byte) byte {
+	result := byte(1)
+	for range 254 {
+		result = mul(result, b)
+	}
+	return result
+}
@@ -0,0 +1,71 @@
+package signed
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// A JSON payload signed by the authority.
+// Type is covered by the signature so one kind of document cannot be passed off as another.
+type Document struct {
+	Type      string `json:"type"`
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// GenerateKey creates a new authority signing key pair
+func GenerateKey() (ed25519.PublicKey, ed25519.PrivateKey, error) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signed: generate key: %w", err)
+	}
+	return publicKey, privateKey, nil
+}
+
+// Fingerprint identifies a signing public key, e.g. in logs & metadata
+func Fingerprint(publicKey ed25519.PublicKey) string {
+	sum := sha256.Sum256(publicKey)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sign serializes payload as JSON & wraps it in a signed document of the given type
+func Sign(privateKey ed25519.PrivateKey, docType string, payload any) ([]byte, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("signed: marshal payload: %w", err)
+	}
+
+	doc := Document{
+		Type:      docType,
+		Payload:   payloadBytes,
+		Signature: ed25519.Sign(privateKey, message(docType, payloadBytes)),
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// Verify checks a signed document's type & signature, then decodes its payload into out
+func Verify(publicKey ed25519.PublicKey, docType string, data []byte, out any) error {
+	var doc Document
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("signed: parse document: %w", err)
+	}
+	if doc.Type != docType {
+		return fmt.Errorf("signed: expected %q document, got %q", docType, doc.Type)
+	}
+	if len(publicKey) != ed25519.PublicKeySize || !ed25519.Verify(publicKey, message(doc.Type, doc.Payload), doc.Signature) {
+		return fmt.Errorf("signed: invalid signature on %q document", docType)
+	}
+	if err := json.Unmarshal(doc.Payload, out); err != nil {
+		return fmt.Errorf("signed: decode payload: %w", err)
+	}
+	return nil
+}
+
+// Signed bytes: type, NUL separator, payload
+func message(docType string, payload []byte) []byte {
+	return append([]byte(docType+"\x00"), payload...)
+}
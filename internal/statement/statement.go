@@ -0,0 +1,58 @@
+package statement
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/signed"
+)
+
+const (
+	// Type of the signed document a statement is issued in
+	Document = "attribute-statement"
+
+	// Statements are written next to the key they describe, e.g. sub1.key.statement.json
+	FileSuffix = ".statement.json"
+)
+
+// What the authority attests about an issued key: who holds it & which attributes it carries.
+// Attributes are the logical values, without versions or period attributes.
+type Statement struct {
+	Subject        string                 `json:"subject"`
+	Namespace      string                 `json:"namespace,omitempty"`
+	KeyID          string                 `json:"key_id,omitempty"`
+	KeyFingerprint string                 `json:"key_fingerprint"`
+	Attributes     map[string]string      `json:"attributes"`
+	Validity       *accesspolicy.Validity `json:"validity,omitempty"`
+	IssuedAt       time.Time              `json:"issued_at"`
+}
+
+// Sign issues the statement as a document signed by the authority
+func (strct *Statement) Sign(authorityKey ed25519.PrivateKey) ([]byte, error) {
+	return signed.Sign(authorityKey, Document, strct)
+}
+
+// Verify checks a statement's signature against the authority's signing key
+func Verify(authorityKey ed25519.PublicKey, data []byte) (*Statement, error) {
+	var statement Statement
+	if err := signed.Verify(authorityKey, Document, data, &statement); err != nil {
+		return nil, err
+	}
+	return &statement, nil
+}
+
+// Describes reports whether the statement was issued for this serialized attribute key
+func (strct *Statement) Describes(key []byte) bool {
+	return strct.KeyFingerprint == keyfile.Fingerprint(key)
+}
+
+// CheckKey fails unless the statement was issued for this serialized attribute key
+func (strct *Statement) CheckKey(key []byte) error {
+	if !strct.Describes(key) {
+		return fmt.Errorf("statement: issued for key %s, not %s", strct.KeyFingerprint, keyfile.Fingerprint(key))
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package subscriber
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"securemqtt/internal/enrollment"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/secureclient"
+)
+
+// Reuses the key delivered on an earlier start, otherwise requests one & waits for approval.
+// The authority's signing key comes from ENROLL_AUTHORITY_KEY (base64, printed by --enroll-listen).
+func (strct *subscriber) enrollKey(deviceID string) (*enrollment.KeyBundle, error) {
+	bundle, err := enrollment.LoadBundle(filepath.Join(strct.config.DeviceDir, bundleFile))
+	if err != nil || bundle != nil {
+		return bundle, err
+	}
+
+	log.Printf("Waiting for an operator to approve enrollment of %s", deviceID)
+	return strct.requestKey(deviceID)
+}
+
+// Requests a key with the device's identity, waits for the delivery & saves it
+func (strct *subscriber) requestKey(deviceID string) (*enrollment.KeyBundle, error) {
+	authorityKey, err := enrollmentAuthorityKey()
+	if err != nil {
+		return nil, err
+	}
+	identity, err := enrollment.LoadOrCreateIdentity(filepath.Join(strct.config.DeviceDir, identityFile))
+	if err != nil {
+		return nil, err
+	}
+
+	bundle, err := enrollment.Enroll(strct.client, deviceID, identity, authorityKey, 0)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Enrolled as %s", bundle.Subject)
+	return bundle, enrollment.SaveBundle(filepath.Join(strct.config.DeviceDir, bundleFile), bundle)
+}
+
+// Requests a new key when the authority announces that the enrolled one is re-issued.
+// The replaced key stays registered, so messages published before the switch still decrypt.
+func (strct *subscriber) watchReissue(deviceID string, bundle *enrollment.KeyBundle) {
+	authorityKey, err := enrollmentAuthorityKey()
+	if err != nil {
+		log.Printf("Cannot watch for re-issued keys: %v", err)
+		return
+	}
+
+	var mu sync.Mutex
+	current, requesting := keyfile.Fingerprint(bundle.AttributeKey), false
+	if err := enrollment.WatchReissue(strct.client, deviceID, authorityKey, func(notice *enrollment.Notice) {
+		mu.Lock()
+		defer mu.Unlock()
+		if notice.Replaces != current || requesting {
+			return
+		}
+		requesting = true
+		log.Printf("Authority re-issued the key of %s for epoch %s, requesting it", deviceID, notice.KeyID)
+
+		// Enrollment blocks until the delivery arrives, which this callback must not wait for
+		go func() {
+			bundle, err := strct.requestKey(deviceID)
+			mu.Lock()
+			defer mu.Unlock()
+			requesting = false
+			if err != nil {
+				log.Printf("Re-enrollment failed: %v", err)
+				return
+			}
+			current = keyfile.Fingerprint(bundle.AttributeKey)
+			strct.secure.AddPrivateKey(bundle.KeyID, bundle.AttributeKey)
+			if bundle.Validity != nil {
+				strct.secure.SetKeyExpiry(bundle.Validity.NotAfter)
+			}
+			strct.loadEnrolledStatement(bundle)
+		}()
+	}); err != nil {
+		log.Printf("Cannot watch for re-issued keys: %v", err)
+	}
+}
+
+// Loads the attribute statement delivered with an enrolled key
+func (strct *subscriber) loadEnrolledStatement(bundle *enrollment.KeyBundle) {
+	if len(bundle.Statement) == 0 {
+		return
+	}
+	authorityKey, err := enrollmentAuthorityKey()
+	if err != nil {
+		log.Printf("Cannot verify attribute statement: %v", err)
+		return
+	}
+	if err := logAttributeStatement(strct.secure, bundle.Statement, authorityKey); err != nil {
+		log.Printf("Rejected attribute statement: %v", err)
+	}
+}
+
+// Reads the authority's signing key from ENROLL_AUTHORITY_KEY
+func enrollmentAuthorityKey() (ed25519.PublicKey, error) {
+	authorityKey, err := base64.StdEncoding.DecodeString(os.Getenv("ENROLL_AUTHORITY_KEY"))
+	if err != nil || len(authorityKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("subscriber: ENROLL_AUTHORITY_KEY must hold the base64 authority signing key")
+	}
+	return authorityKey, nil
+}
+
+// Verifies a statement & logs the attributes the authority attests for the key
+func logAttributeStatement(secure *secureclient.SecureClient, data []byte, authorityKey ed25519.PublicKey) error {
+	held, err := secure.LoadAttributeStatement(data, authorityKey)
+	if err != nil {
+		return err
+	}
+	log.Printf("Key %s of %s holds attributes %v", held.KeyID, held.Subject, held.Attributes)
+	return nil
+}
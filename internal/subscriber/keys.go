@@ -0,0 +1,116 @@
+package subscriber
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/epoch"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/statement"
+)
+
+// Waits until at least one epoch holds a key for this subscriber
+func (strct *subscriber) waitForKeys() (string, map[string][]byte, error) {
+	log.Printf("Waiting for key file: %s", strct.config.KeyFile)
+
+	for {
+		currentKeyID, keys, err := epoch.SubscriberKeys(strct.config.KeysDir, strct.config.KeyFile)
+		if err != nil {
+			return "", nil, fmt.Errorf("subscriber: read %s: %w", strct.config.KeyFile, err)
+		}
+		if len(keys) > 0 {
+			return currentKeyID, keys, nil
+		}
+		log.Printf("Key not ready yet, retrying in 2s...")
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// Picks up keys re-issued for a new epoch & drops keys of retired epochs
+func (strct *subscriber) watchEpochs(keys map[string][]byte, statementData []byte) {
+	for {
+		time.Sleep(30 * time.Second)
+
+		_, latest, err := epoch.SubscriberKeys(strct.config.KeysDir, strct.config.KeyFile)
+		if err != nil {
+			log.Printf("Failed to reload epoch keys: %v", err)
+			continue
+		}
+		for keyID, keyBytes := range latest {
+			if _, ok := keys[keyID]; !ok {
+				log.Printf("Loaded key for epoch %s", keyID)
+			}
+			strct.secure.AddPrivateKey(keyID, keyBytes)
+		}
+		for keyID := range keys {
+			if _, ok := latest[keyID]; !ok {
+				strct.secure.RemovePrivateKey(keyID)
+				log.Printf("Dropped key for retired epoch %s", keyID)
+			}
+		}
+		keys = latest
+		strct.loadKeyExpiry()
+		statementData = strct.loadKeyStatement(statementData)
+	}
+}
+
+// Reads the validity sidecar the authority writes for time-bound keys, if any
+func (strct *subscriber) loadKeyExpiry() {
+	data, err := os.ReadFile(filepath.Join(strct.config.KeysDir, strct.config.KeyFile+".validity.json"))
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to read key validity: %v", err)
+		return
+	}
+
+	var validity accesspolicy.Validity
+	if err := json.Unmarshal(data, &validity); err != nil {
+		log.Printf("Failed to parse key validity: %v", err)
+		return
+	}
+	strct.secure.SetKeyExpiry(validity.NotAfter)
+}
+
+// Loads the attribute statement the authority writes next to the key, if it changed since
+// previous. Returns the statement in effect, so a failed reload is retried on the next call.
+func (strct *subscriber) loadKeyStatement(previous []byte) []byte {
+	data, err := os.ReadFile(filepath.Join(strct.config.KeysDir, strct.config.KeyFile+statement.FileSuffix))
+	if os.IsNotExist(err) || bytes.Equal(data, previous) {
+		return previous
+	}
+	if err != nil {
+		log.Printf("Failed to read attribute statement: %v", err)
+		return previous
+	}
+	authorityKey, err := os.ReadFile(filepath.Join(strct.config.KeysDir, signingKeyFile))
+	if err != nil {
+		log.Printf("Failed to read authority signing key: %v", err)
+		return previous
+	}
+	if err := logAttributeStatement(strct.secure, data, authorityKey); err != nil {
+		log.Printf("Rejected attribute statement: %v", err)
+		return previous
+	}
+	return data
+}
+
+// System public key of the epoch keyID from the keys volume, nil if it cannot be read
+func (strct *subscriber) loadPublicKey(keyID string) []byte {
+	file, err := keyfile.Read(filepath.Join(strct.config.KeysDir, epoch.PublicKeyFile), keyfile.Public)
+	if err == nil && file.KeyID != keyID {
+		file, err = keyfile.Read(filepath.Join(epoch.ArchivePath(strct.config.KeysDir, keyID), epoch.PublicKeyFile), keyfile.Public)
+	}
+	if err != nil {
+		log.Printf("Failed to read public key: %v", err)
+		return nil
+	}
+	return file.Key
+}
@@ -0,0 +1,178 @@
+package subscriber
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"securemqtt/internal/abe"
+	aescryptography "securemqtt/internal/aes"
+	"securemqtt/internal/clientmqtt"
+	"securemqtt/internal/enrollment"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/provisioning"
+	"securemqtt/internal/secureclient"
+)
+
+const (
+	// Authority signing key on the keys volume, verifies attribute statements
+	signingKeyFile = "authority_sign.pub"
+
+	// Device-local files of enrolled subscribers
+	identityFile = "identity.key"
+	bundleFile   = "enrolled.json"
+
+	// Time-bound keys warn this long before their last period ends
+	expiryWarning = 7 * 24 * time.Hour
+)
+
+// What sets one subscriber binary apart from another
+type Config struct {
+	KeysDir   string
+	KeyFile   string
+	BrokerURL string
+	ClientID  string
+	Topic     string
+
+	// Device-local storage for enrolled subscribers, never the authority's volume
+	DeviceDir string
+
+	// Called with every message the key decrypts, LogMessage if nil
+	Handler func(topic string, plaintext []byte)
+}
+
+// A running subscriber & the client its keys are registered with
+type subscriber struct {
+	config Config
+	client clientmqtt.IMQTT
+	secure *secureclient.SecureClient
+}
+
+// Run connects & subscribes until the process ends, it only returns on failure.
+// With PROVISION_BUNDLE set broker, key & topics all come from the authority's signed bundle,
+// with ENROLL_DEVICE_ID the key is requested over MQTT, otherwise it is read from the keys volume.
+func Run(config Config) error {
+	provisioned, err := provisioning.FromEnv()
+	if err != nil {
+		return fmt.Errorf("subscriber: load provisioning bundle: %w", err)
+	}
+	if provisioned != nil {
+		return RunProvisioned(provisioned)
+	}
+	if config.Handler == nil {
+		config.Handler = LogMessage
+	}
+
+	client, err := clientmqtt.NewMQTT(config.BrokerURL, config.ClientID)
+	if err != nil {
+		return fmt.Errorf("subscriber: connect to broker: %w", err)
+	}
+	strct := &subscriber{config: config, client: client}
+
+	deviceID := os.Getenv("ENROLL_DEVICE_ID")
+	var bundle *enrollment.KeyBundle
+	var currentKeyID string
+	var keys map[string][]byte
+	if deviceID != "" {
+		if bundle, err = strct.enrollKey(deviceID); err != nil {
+			return err
+		}
+		currentKeyID, keys = bundle.KeyID, map[string][]byte{bundle.KeyID: bundle.AttributeKey}
+	} else if currentKeyID, keys, err = strct.waitForKeys(); err != nil {
+		return err
+	}
+
+	strct.secure = secureclient.NewSecureClient(client, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, nil, keys[currentKeyID])
+
+	// Keep one key per epoch, so messages from before a rotation stay readable
+	for keyID, keyBytes := range keys {
+		strct.secure.AddPrivateKey(keyID, keyBytes)
+	}
+
+	if bundle != nil {
+		if bundle.Validity != nil {
+			strct.secure.SetKeyExpiry(bundle.Validity.NotAfter)
+		}
+		strct.loadEnrolledStatement(bundle)
+		if err := selfTestKey(strct.secure, bundle.KeyID, bundle.PublicKey); err != nil {
+			return err
+		}
+		strct.watchReissue(deviceID, bundle)
+	} else {
+		// Keys read from the keys volume also follow epoch rotations
+		strct.loadKeyExpiry()
+		statementData := strct.loadKeyStatement(nil)
+		if err := selfTestKey(strct.secure, currentKeyID, strct.loadPublicKey(currentKeyID)); err != nil {
+			return err
+		}
+		go strct.watchEpochs(keys, statementData)
+	}
+	strct.secure.WarnBeforeExpiry(expiryWarning)
+
+	if err := strct.secure.SubscribeSecure(config.Topic, 0, config.Handler); err != nil {
+		return fmt.Errorf("subscriber: subscribe %s: %w", config.Topic, err)
+	}
+	select {}
+}
+
+// RunProvisioned runs from a provisioning bundle alone: nothing is read from the keys volume
+// & nothing compiled in is used. Rotations & re-issued keys reach the device as a new bundle.
+func RunProvisioned(bundle *provisioning.Bundle) error {
+	client, err := clientmqtt.NewMQTTWithOptions(bundle.Options())
+	if err != nil {
+		return fmt.Errorf("subscriber: connect to broker: %w", err)
+	}
+	log.Printf("Provisioned as %s for system %s, epoch %s", bundle.Subject, bundle.SystemID, bundle.KeyID)
+
+	secure := secureclient.NewSecureClient(client, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, nil, bundle.AttributeKey)
+	secure.AddNamespacePrivateKey(bundle.Namespace, bundle.KeyID, bundle.AttributeKey)
+	if bundle.Validity != nil {
+		secure.SetKeyExpiry(bundle.Validity.NotAfter)
+	}
+	if len(bundle.Statement) > 0 {
+		if err := logAttributeStatement(secure, bundle.Statement, bundle.AuthorityKey()); err != nil {
+			log.Printf("Rejected attribute statement: %v", err)
+		}
+	}
+	if err := selfTestKey(secure, bundle.KeyID, bundle.PublicKey); err != nil {
+		return err
+	}
+	secure.WarnBeforeExpiry(expiryWarning)
+
+	for _, entry := range bundle.Topics {
+		if err := secure.SubscribeSecure(entry.Topic, 0, LogMessage); err != nil {
+			return fmt.Errorf("subscriber: subscribe %s: %w", entry.Topic, err)
+		}
+	}
+	select {}
+}
+
+// LogMessage logs a message the key decrypted
+func LogMessage(topic string, plaintext []byte) {
+	log.Printf("  Result    : ✓ SUCCESS")
+	log.Printf("  Topic     : %s", topic)
+	log.Printf("  Plaintext : %s", plaintext)
+}
+
+// Refuses to start with a key that cannot decrypt for this system, instead of denying every message.
+// Skipped when the statement or public key needed for the test is not available.
+func selfTestKey(secure *secureclient.SecureClient, keyID string, publicKey []byte) error {
+	if publicKey == nil {
+		log.Printf("Skipping key self-test: no system public key")
+		return nil
+	}
+	err := secure.SelfTest(keyID, publicKey)
+	switch {
+	case errors.Is(err, secureclient.ErrKeyMismatch):
+		return fmt.Errorf("subscriber: key self-test failed: %w", err)
+	case err != nil:
+		log.Printf("Skipping key self-test: %v", err)
+	default:
+		log.Printf("Key self-test passed for system %s", keyfile.SystemID(publicKey))
+	}
+	return nil
+}
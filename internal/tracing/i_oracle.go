@@ -0,0 +1,9 @@
+package tracing
+
+type IOracle interface {
+	// Hands a probe envelope to the suspected decoder
+	// Takes as input: the envelope exactly as it would be published
+	// Outputs: the decrypted plaintext, nil if the decoder could not decrypt it,
+	// or an error if the decoder could not be queried at all
+	Decrypt(envelope []byte) ([]byte, error)
+}
@@ -0,0 +1,53 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+// Wraps a local callback as an oracle
+type FuncOracle func(envelope []byte) ([]byte, error)
+
+func (strct FuncOracle) Decrypt(envelope []byte) ([]byte, error) {
+	return strct(envelope)
+}
+
+// Queries a decoder process: the envelope is written to its stdin, a zero exit status with
+// the plaintext on stdout means it decrypted, any other exit status means it did not
+type ProcessOracle struct {
+	Command []string
+	Timeout time.Duration
+}
+
+func (strct *ProcessOracle) Decrypt(envelope []byte) ([]byte, error) {
+	if len(strct.Command) == 0 {
+		return nil, fmt.Errorf("tracing: no oracle command")
+	}
+	ctx := context.Background()
+	if strct.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, strct.Timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, strct.Command[0], strct.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(envelope)
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return stdout.Bytes(), nil
+	case ctx.Err() != nil:
+		return nil, fmt.Errorf("tracing: oracle timed out after %s", strct.Timeout)
+	case errors.As(err, &exitErr):
+		return nil, nil
+	}
+	return nil, fmt.Errorf("tracing: run oracle: %w", err)
+}
@@ -0,0 +1,144 @@
+package tracing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"securemqtt/internal"
+	"securemqtt/internal/accesspolicy"
+)
+
+// Reserved attribute carrying a key's hidden tracing identifier. Unlike subject_id it is
+// kept out of key headers, statements & the registry's attributes.
+const Attribute = accesspolicy.TraceAttribute
+
+// NewTraceID returns a fresh random tracing identifier
+func NewTraceID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("tracing: generate trace ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// A key that may have been built into the decoder
+type Suspect struct {
+	Subject string
+	TraceID string
+}
+
+// Encrypts a probe plaintext under a policy into an envelope, as a publisher would
+type Encrypter func(plaintext []byte, policy string) ([]byte, error)
+
+// One probe sent to the oracle: which suspects its policy admitted & whether the decoder decrypted it
+type Probe struct {
+	Subjects  []string
+	Decrypted bool
+}
+
+// Outcome of a trace: the subject whose key the decoder uses, nil if no suspect's key
+// explains its answers, & every probe sent
+type Result struct {
+	Suspect *Suspect
+	Probes  []Probe
+}
+
+// Trace narrows the suspects down to the one whose key the decoder uses, by binary search:
+// each probe is readable only by the trace IDs of a subset of the suspects. A non-empty
+// policy is ANDed into every probe, so probes look like the traffic the decoder expects.
+func Trace(oracle IOracle, encrypt Encrypter, suspects []Suspect, policy string) (*Result, error) {
+	if len(suspects) == 0 {
+		return nil, fmt.Errorf("tracing: no traceable suspects")
+	}
+	var restriction accesspolicy.Node
+	if policy != "" {
+		node, err := accesspolicy.Parse(policy)
+		if err != nil {
+			return nil, err
+		}
+		restriction = node
+	}
+
+	result := &Result{}
+	probe := func(subset []Suspect) (bool, error) {
+		decrypted, err := probeSubset(oracle, encrypt, subset, restriction)
+		if err != nil {
+			return false, err
+		}
+		subjects := make([]string, len(subset))
+		for i, suspect := range subset {
+			subjects[i] = suspect.Subject
+		}
+		result.Probes = append(result.Probes, Probe{Subjects: subjects, Decrypted: decrypted})
+		return decrypted, nil
+	}
+
+	// The decoder must read probes for all suspects, or it holds none of their keys
+	decrypted, err := probe(suspects)
+	if err != nil || !decrypted {
+		return result, err
+	}
+
+	candidates := suspects
+	for len(candidates) > 1 {
+		half := len(candidates) / 2
+		decrypted, err := probe(candidates[:half])
+		if err != nil {
+			return result, err
+		}
+		if decrypted {
+			candidates = candidates[:half]
+			continue
+		}
+		candidates = candidates[half:]
+	}
+
+	// Confirm the last candidate alone, a decoder answering inconsistently is not traced
+	decrypted, err = probe(candidates)
+	if err != nil || !decrypted {
+		return result, err
+	}
+	result.Suspect = &candidates[0]
+	return result, nil
+}
+
+// Sends one probe readable by the subset's trace IDs & checks the decoder returned its plaintext
+func probeSubset(oracle IOracle, encrypt Encrypter, subset []Suspect, restriction accesspolicy.Node) (bool, error) {
+	var traceIDs []accesspolicy.Node
+	for _, suspect := range subset {
+		traceIDs = append(traceIDs, accesspolicy.Attr{Name: Attribute, Value: suspect.TraceID})
+	}
+	policy := accesspolicy.And(restriction, accesspolicy.Or(traceIDs...)).String()
+
+	plaintext := make([]byte, 32)
+	if _, err := rand.Read(plaintext); err != nil {
+		return false, fmt.Errorf("tracing: probe plaintext: %w", err)
+	}
+	envelope, err := encrypt(plaintext, policy)
+	if err != nil {
+		return false, fmt.Errorf("tracing: encrypt probe: %w", err)
+	}
+
+	got, err := oracle.Decrypt(envelope)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(got, plaintext), nil
+}
+
+// Records the last envelope published through it, so probes are built by a SecureClient
+// exactly like real traffic without reaching a broker
+type CaptureMQTT struct {
+	Envelope []byte
+}
+
+func (strct *CaptureMQTT) Publish(topic string, qos byte, retained bool, payload []byte) error {
+	strct.Envelope = payload
+	return nil
+}
+
+func (strct *CaptureMQTT) Subscribe(topic string, qos byte, handler func(internal.Message)) error {
+	return fmt.Errorf("tracing: capture client cannot subscribe")
+}
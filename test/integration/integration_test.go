@@ -2,16 +2,26 @@ package integration
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/json"
+	"fmt"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"securemqtt/internal"
 	"securemqtt/internal/abe"
+	"securemqtt/internal/accesspolicy"
 	aescryptography "securemqtt/internal/aes"
 	clientmqtt "securemqtt/internal/clientmqtt"
+	"securemqtt/internal/delegation"
+	"securemqtt/internal/enrollment"
+	"securemqtt/internal/escrow"
+	"securemqtt/internal/keyfile"
 	secureclient "securemqtt/internal/secureclient"
+	"securemqtt/internal/tracing"
 
 	"github.com/cloudflare/circl/abe/cpabe/tkn20"
 )
@@ -306,3 +316,612 @@ func TestSecureClient_EndToEnd_TamperedEnvelopeVersion_FailsAESAuth(t *testing.T
 		t.Fatalf("handler should not be called when envelope version is tampered (AES-GCM auth must fail)")
 	}
 }
+
+func TestSecureClient_EndToEnd_KeyEpochs_SelectsKeyByID(t *testing.T) {
+	oldPubKeyBytes, oldPrivKeyBytes, _ := setupABEKeys(t)
+	newPubKeyBytes, newPrivKeyBytes, _ := setupABEKeys(t)
+
+	broker := newMemMQTT()
+
+	publisher := secureclient.NewSecureClient(
+		broker,
+		&abe.PublisherABE{},
+		&abe.SubscriberABE{},
+		&aescryptography.AESCryptography{},
+		oldPubKeyBytes,
+		nil,
+	)
+	publisher.SetPublicKey("e1", oldPubKeyBytes)
+
+	// Subscriber holds keys for both epochs, the constructor key is the newest one
+	subscriber := secureclient.NewSecureClient(
+		broker,
+		&abe.PublisherABE{},
+		&abe.SubscriberABE{},
+		&aescryptography.AESCryptography{},
+		nil,
+		newPrivKeyBytes,
+	)
+	subscriber.AddPrivateKey("e1", oldPrivKeyBytes)
+	subscriber.AddPrivateKey("e2", newPrivKeyBytes)
+
+	var received []string
+	if err := subscriber.SubscribeSecure(testTopic, 0, func(topic string, pt []byte) {
+		received = append(received, string(pt))
+	}); err != nil {
+		t.Fatalf("SubscribeSecure() error: %v", err)
+	}
+
+	if err := publisher.PublishSecure(testTopic, 0, false, []byte("before rotation"), testPolicy); err != nil {
+		t.Fatalf("PublishSecure() error: %v", err)
+	}
+
+	publisher.SetPublicKey("e2", newPubKeyBytes)
+	if err := publisher.PublishSecure(testTopic, 0, false, []byte("after rotation"), testPolicy); err != nil {
+		t.Fatalf("PublishSecure() error: %v", err)
+	}
+
+	// After retiring e1, its messages can no longer be read
+	subscriber.RemovePrivateKey("e1")
+	publisher.SetPublicKey("e1", oldPubKeyBytes)
+	if err := publisher.PublishSecure(testTopic, 0, false, []byte("retired epoch"), testPolicy); err != nil {
+		t.Fatalf("PublishSecure() error: %v", err)
+	}
+
+	if len(received) != 2 || received[0] != "before rotation" || received[1] != "after rotation" {
+		t.Fatalf("unexpected messages: %q", received)
+	}
+}
+
+func TestSecureClient_EndToEnd_TamperedEnvelopeKeyID_FailsAESAuth(t *testing.T) {
+	pubKeyBytes, goodPrivKeyBytes, _ := setupABEKeys(t)
+
+	broker := newMemMQTT()
+
+	// Strip the key ID => subscriber falls back to its default key, but AAD mismatches
+	broker.onPublish = func(topic string, payload []byte) []byte {
+		var env internal.Envelope
+		if err := json.Unmarshal(payload, &env); err != nil {
+			return payload
+		}
+		env.KeyID = ""
+		b, err := json.Marshal(env)
+		if err != nil {
+			return payload
+		}
+		return b
+	}
+
+	publisher := secureclient.NewSecureClient(
+		broker,
+		&abe.PublisherABE{},
+		&abe.SubscriberABE{},
+		&aescryptography.AESCryptography{},
+		nil,
+		nil,
+	)
+	publisher.SetPublicKey("e1", pubKeyBytes)
+
+	subscriber := secureclient.NewSecureClient(
+		broker,
+		&abe.PublisherABE{},
+		&abe.SubscriberABE{},
+		&aescryptography.AESCryptography{},
+		nil,
+		goodPrivKeyBytes,
+	)
+
+	called := false
+	if err := subscriber.SubscribeSecure(testTopic, 0, func(topic string, pt []byte) {
+		called = true
+	}); err != nil {
+		t.Fatalf("SubscribeSecure() error: %v", err)
+	}
+
+	if err := publisher.PublishSecure(testTopic, 0, false, []byte("payload"), testPolicy); err != nil {
+		t.Fatalf("PublishSecure() error: %v", err)
+	}
+
+	if called {
+		t.Fatalf("handler should not be called when envelope key ID is tampered (AES-GCM auth must fail)")
+	}
+}
+
+func TestSecureClient_EndToEnd_Namespaces_SelectsKeyByNamespace(t *testing.T) {
+	acmePubKeyBytes, acmePrivKeyBytes, _ := setupABEKeys(t)
+	globexPubKeyBytes, globexPrivKeyBytes, _ := setupABEKeys(t)
+
+	broker := newMemMQTT()
+
+	publisher := secureclient.NewSecureClient(
+		broker,
+		&abe.PublisherABE{},
+		&abe.SubscriberABE{},
+		&aescryptography.AESCryptography{},
+		nil,
+		nil,
+	)
+	publisher.SetNamespacePublicKey("acme", "e1", acmePubKeyBytes)
+	publisher.SetNamespacePublicKey("globex", "e1", globexPubKeyBytes)
+
+	// Both namespaces use key ID e1, only the namespace tells the keys apart
+	subscriber := secureclient.NewSecureClient(
+		broker,
+		&abe.PublisherABE{},
+		&abe.SubscriberABE{},
+		&aescryptography.AESCryptography{},
+		nil,
+		nil,
+	)
+	subscriber.AddNamespacePrivateKey("acme", "e1", acmePrivKeyBytes)
+	subscriber.AddNamespacePrivateKey("globex", "e1", globexPrivKeyBytes)
+
+	var received []string
+	if err := subscriber.SubscribeSecure(testTopic, 0, func(topic string, pt []byte) {
+		received = append(received, string(pt))
+	}); err != nil {
+		t.Fatalf("SubscribeSecure() error: %v", err)
+	}
+
+	for _, ns := range []string{"acme", "globex"} {
+		if err := publisher.PublishSecureNamespace(ns, testTopic, 0, false, []byte("for "+ns), testPolicy); err != nil {
+			t.Fatalf("PublishSecureNamespace(%s) error: %v", ns, err)
+		}
+	}
+	if err := publisher.PublishSecureNamespace("initech", testTopic, 0, false, []byte("unknown"), testPolicy); err == nil {
+		t.Fatalf("expected publishing to a namespace without public key to fail")
+	}
+
+	if len(received) != 2 || received[0] != "for acme" || received[1] != "for globex" {
+		t.Fatalf("unexpected messages: %q", received)
+	}
+}
+
+func TestSecureClient_EndToEnd_TamperedEnvelopeNamespace_FailsAESAuth(t *testing.T) {
+	pubKeyBytes, goodPrivKeyBytes, _ := setupABEKeys(t)
+
+	broker := newMemMQTT()
+
+	// Relabel the namespace => subscriber picks the same key, but AAD mismatches
+	broker.onPublish = func(topic string, payload []byte) []byte {
+		var env internal.Envelope
+		if err := json.Unmarshal(payload, &env); err != nil {
+			return payload
+		}
+		env.Namespace = "globex"
+		b, err := json.Marshal(env)
+		if err != nil {
+			return payload
+		}
+		return b
+	}
+
+	publisher := secureclient.NewSecureClient(
+		broker,
+		&abe.PublisherABE{},
+		&abe.SubscriberABE{},
+		&aescryptography.AESCryptography{},
+		nil,
+		nil,
+	)
+	publisher.SetNamespacePublicKey("acme", "e1", pubKeyBytes)
+
+	subscriber := secureclient.NewSecureClient(
+		broker,
+		&abe.PublisherABE{},
+		&abe.SubscriberABE{},
+		&aescryptography.AESCryptography{},
+		nil,
+		nil,
+	)
+	subscriber.AddNamespacePrivateKey("acme", "e1", goodPrivKeyBytes)
+	subscriber.AddNamespacePrivateKey("globex", "e1", goodPrivKeyBytes)
+
+	called := false
+	if err := subscriber.SubscribeSecure(testTopic, 0, func(topic string, pt []byte) {
+		called = true
+	}); err != nil {
+		t.Fatalf("SubscribeSecure() error: %v", err)
+	}
+
+	if err := publisher.PublishSecureNamespace("acme", testTopic, 0, false, []byte("payload"), testPolicy); err != nil {
+		t.Fatalf("PublishSecureNamespace() error: %v", err)
+	}
+
+	if called {
+		t.Fatalf("handler should not be called when envelope namespace is tampered (AES-GCM auth must fail)")
+	}
+}
+
+func TestSecureClient_PublishToSubjects_ReachesOnlyThatSubject(t *testing.T) {
+	publicKey, systemSecretKey, err := tkn20.Setup(rand.Reader)
+	if err != nil {
+		t.Fatalf("tkn20.Setup() error: %v", err)
+	}
+	pubKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		t.Fatalf("publicKey.MarshalBinary() error: %v", err)
+	}
+
+	subjectIDs := []string{"4f1c0a9e2b7d4c11a3e5f60718293a4b", "9b2e7c4d1f0a4e38b6c5d7e8f9a0b1c2"}
+	broker := newMemMQTT()
+	received := make([]bool, len(subjectIDs))
+	for i, id := range subjectIDs {
+		attrs := tkn20.Attributes{}
+		attrs.FromMap(map[string]string{"role": "operator", accesspolicy.SubjectAttribute: id})
+		key, err := systemSecretKey.KeyGen(rand.Reader, attrs)
+		if err != nil {
+			t.Fatalf("KeyGen() error: %v", err)
+		}
+		keyBytes, err := key.MarshalBinary()
+		if err != nil {
+			t.Fatalf("key.MarshalBinary() error: %v", err)
+		}
+
+		subscriber := secureclient.NewSecureClient(broker, &abe.PublisherABE{}, &abe.SubscriberABE{},
+			&aescryptography.AESCryptography{}, nil, keyBytes)
+		if err := subscriber.SubscribeSecure(testTopic, 0, func(string, []byte) { received[i] = true }); err != nil {
+			t.Fatalf("SubscribeSecure() error: %v", err)
+		}
+	}
+
+	publisher := secureclient.NewSecureClient(broker, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, pubKeyBytes, nil)
+	if err := publisher.PublishToSubjects(testTopic, 0, false, []byte("only for the first"), subjectIDs[:1], "(role: operator)"); err != nil {
+		t.Fatalf("PublishToSubjects() error: %v", err)
+	}
+
+	if !received[0] || received[1] {
+		t.Fatalf("received = %v, want only the first subject", received)
+	}
+
+	// Both subjects hold role operator, but not guest
+	received[0] = false
+	if err := publisher.PublishToSubjects(testTopic, 0, false, []byte("nobody"), subjectIDs, "(role: guest)"); err != nil {
+		t.Fatalf("PublishToSubjects() error: %v", err)
+	}
+	if received[0] || received[1] {
+		t.Fatalf("received = %v, want no subject", received)
+	}
+}
+
+func TestSecureClient_MultiValuedKey_DecryptsAnyOfItsValues(t *testing.T) {
+	publicKey, systemSecretKey, err := tkn20.Setup(rand.Reader)
+	if err != nil {
+		t.Fatalf("tkn20.Setup() error: %v", err)
+	}
+	pubKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		t.Fatalf("publicKey.MarshalBinary() error: %v", err)
+	}
+
+	// A technician covering two sites, as the authority encodes it
+	table := &accesspolicy.VersionTable{}
+	table.MarkMultiValued("site")
+	attrs := tkn20.Attributes{}
+	attrs.FromMap(table.EncodeAll(map[string]string{"role": "operator", "site": "milan,rome"}))
+	key, err := systemSecretKey.KeyGen(rand.Reader, attrs)
+	if err != nil {
+		t.Fatalf("KeyGen() error: %v", err)
+	}
+	keyBytes, err := key.MarshalBinary()
+	if err != nil {
+		t.Fatalf("key.MarshalBinary() error: %v", err)
+	}
+
+	broker := newMemMQTT()
+	var received []string
+	subscriber := secureclient.NewSecureClient(broker, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, nil, keyBytes)
+	if err := subscriber.SubscribeSecure(testTopic, 0, func(_ string, plaintext []byte) {
+		received = append(received, string(plaintext))
+	}); err != nil {
+		t.Fatalf("SubscribeSecure() error: %v", err)
+	}
+
+	publisher := secureclient.NewSecureClient(broker, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, pubKeyBytes, nil)
+	publisher.AddPolicyRewriter(accesspolicy.NewVersionRewriter(table))
+	for _, policy := range []string{
+		"(role: operator) and (site: rome)",
+		"site in (paris, milan)",
+		"site in (paris, berlin)",
+	} {
+		if err := publisher.PublishSecure(testTopic, 0, false, []byte(policy), policy); err != nil {
+			t.Fatalf("PublishSecure(%q) error: %v", policy, err)
+		}
+	}
+
+	if len(received) != 2 || received[0] != "(role: operator) and (site: rome)" || received[1] != "site in (paris, milan)" {
+		t.Fatalf("received = %q, want the rome & milan messages only", received)
+	}
+}
+
+func TestTrace_IdentifiesLeakedKey(t *testing.T) {
+	publicKey, systemSecretKey, err := tkn20.Setup(rand.Reader)
+	if err != nil {
+		t.Fatalf("tkn20.Setup() error: %v", err)
+	}
+	pubKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		t.Fatalf("publicKey.MarshalBinary() error: %v", err)
+	}
+
+	var suspects []tracing.Suspect
+	var leakedKey []byte
+	for i := range 5 {
+		traceID, err := tracing.NewTraceID()
+		if err != nil {
+			t.Fatalf("NewTraceID() error: %v", err)
+		}
+		suspects = append(suspects, tracing.Suspect{Subject: fmt.Sprintf("sub%d", i), TraceID: traceID})
+
+		attrs := tkn20.Attributes{}
+		attrs.FromMap(map[string]string{"role": "operator", tracing.Attribute: traceID})
+		key, err := systemSecretKey.KeyGen(rand.Reader, attrs)
+		if err != nil {
+			t.Fatalf("KeyGen() error: %v", err)
+		}
+		if i == 3 {
+			if leakedKey, err = key.MarshalBinary(); err != nil {
+				t.Fatalf("key.MarshalBinary() error: %v", err)
+			}
+		}
+	}
+
+	// The pirate decoder: a subscriber built from the leaked key, queried as a black box
+	broker := newMemMQTT()
+	decoder := secureclient.NewSecureClient(broker, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, nil, leakedKey)
+	var decrypted []byte
+	if err := decoder.SubscribeSecure(testTopic, 0, func(_ string, pt []byte) { decrypted = pt }); err != nil {
+		t.Fatalf("SubscribeSecure() error: %v", err)
+	}
+	oracle := tracing.FuncOracle(func(envelope []byte) ([]byte, error) {
+		decrypted = nil
+		err := broker.Publish(testTopic, 0, false, envelope)
+		return decrypted, err
+	})
+
+	capture := &tracing.CaptureMQTT{}
+	prober := secureclient.NewSecureClient(capture, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, pubKeyBytes, nil)
+	encrypt := func(plaintext []byte, policy string) ([]byte, error) {
+		err := prober.PublishSecure(testTopic, 0, false, plaintext, policy)
+		return capture.Envelope, err
+	}
+
+	result, err := tracing.Trace(oracle, encrypt, suspects, "(role: operator)")
+	if err != nil {
+		t.Fatalf("Trace() error: %v", err)
+	}
+	if result.Suspect == nil || result.Suspect.Subject != "sub3" {
+		t.Fatalf("Trace() suspect = %+v, want sub3 (probes %+v)", result.Suspect, result.Probes)
+	}
+
+	// A decoder built from none of the suspects' keys is not pinned on anyone
+	result, err = tracing.Trace(oracle, encrypt, suspects[:3], "")
+	if err != nil {
+		t.Fatalf("Trace() error: %v", err)
+	}
+	if result.Suspect != nil {
+		t.Fatalf("Trace() suspect = %+v, want none", result.Suspect)
+	}
+}
+
+func TestDelegation_SiteIssuesWithinScope(t *testing.T) {
+	publicKey, systemSecretKey, err := tkn20.Setup(rand.Reader)
+	if err != nil {
+		t.Fatalf("tkn20.Setup() error: %v", err)
+	}
+	pubKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		t.Fatalf("publicKey.MarshalBinary() error: %v", err)
+	}
+	authorityPub, authorityKey, _ := ed25519.GenerateKey(rand.Reader)
+	sitePub, siteKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	credential, err := (&delegation.Credential{
+		ID: "c1", Delegate: "rome-site", DelegateKey: sitePub,
+		Scope:    delegation.Scope{"site": {"rome"}, "role": {"operator", "guest"}},
+		NotAfter: time.Now().Add(time.Hour),
+	}).Sign(authorityKey)
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+
+	// A stand-in root authority: authorizes every request, then runs KeyGen & seals the key
+	broker := newMemMQTT()
+	broker.onPublish = func(topic string, payload []byte) []byte {
+		if !strings.HasPrefix(topic, delegation.RequestTopicPrefix) || len(payload) == 0 {
+			return payload
+		}
+		authorized, err := delegation.Authorize(payload, authorityPub, time.Now())
+		if err != nil {
+			t.Errorf("Authorize() error: %v", err)
+			return payload
+		}
+		attrs := tkn20.Attributes{}
+		attrs.FromMap(authorized.Request.Attributes)
+		key, err := systemSecretKey.KeyGen(rand.Reader, attrs)
+		if err != nil {
+			t.Errorf("KeyGen() error: %v", err)
+			return payload
+		}
+		keyBytes, _ := key.MarshalBinary()
+		delivery, err := enrollment.Seal(authorized.Enrollment, authorized.EnrollmentID,
+			enrollment.KeyBundle{Subject: authorized.Request.Subject, AttributeKey: keyBytes}, authorityKey)
+		if err != nil {
+			t.Errorf("Seal() error: %v", err)
+			return payload
+		}
+		go broker.Publish(delegation.ReplyTopic(authorized.Credential.Delegate, authorized.EnrollmentID), 1, true, delivery)
+		return payload
+	}
+
+	bundle, err := delegation.Issue(broker, credential, authorityPub, siteKey, delegation.IssueRequest{
+		Subject:    "dev-7",
+		Attributes: map[string]string{"site": "rome", "role": "operator"},
+	}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Issue() error: %v", err)
+	}
+
+	// The delivered key reads what rome operators may read
+	var received []byte
+	subscriber := secureclient.NewSecureClient(broker, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, nil, bundle.AttributeKey)
+	if err := subscriber.SubscribeSecure(testTopic, 0, func(_ string, plaintext []byte) { received = plaintext }); err != nil {
+		t.Fatalf("SubscribeSecure() error: %v", err)
+	}
+	publisher := secureclient.NewSecureClient(broker, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, pubKeyBytes, nil)
+	if err := publisher.PublishSecure(testTopic, 0, false, []byte("hello rome"), testPolicy); err != nil {
+		t.Fatalf("PublishSecure() error: %v", err)
+	}
+	if string(received) != "hello rome" {
+		t.Fatalf("received %q, want %q", received, "hello rome")
+	}
+
+	// Out-of-scope requests never leave the site
+	if _, err := delegation.Issue(broker, credential, authorityPub, siteKey, delegation.IssueRequest{
+		Subject:    "dev-8",
+		Attributes: map[string]string{"site": "milan", "role": "operator"},
+	}, time.Second); err == nil {
+		t.Fatalf("expected an out-of-scope request to fail")
+	}
+}
+
+func TestEnrollment_ReissueNotice_DeviceRequestsNewKey(t *testing.T) {
+	authorityPub, authorityKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, identity, _ := ed25519.GenerateKey(rand.Reader)
+	oldKey := []byte("key of epoch e1")
+
+	// A stand-in authority: answers requests from the recorded identity with the e2 key
+	broker := newMemMQTT()
+	recorded := (&enrollment.Request{IdentityKey: identity.Public().(ed25519.PublicKey)}).IdentityFingerprint()
+	broker.onPublish = func(topic string, payload []byte) []byte {
+		if topic != enrollment.RequestTopic("dev-1") || len(payload) == 0 {
+			return payload
+		}
+		request, id, err := enrollment.VerifyRequest(payload)
+		if err != nil || request.IdentityFingerprint() != recorded {
+			t.Errorf("unexpected request: %v", err)
+			return payload
+		}
+		delivery, err := enrollment.Seal(request, id, enrollment.KeyBundle{Subject: "dev-1", KeyID: "e2", AttributeKey: []byte("key of epoch e2")}, authorityKey)
+		if err != nil {
+			t.Errorf("Seal() error: %v", err)
+			return payload
+		}
+		go broker.Publish(enrollment.ReplyTopic("dev-1"), 1, true, delivery)
+		return payload
+	}
+
+	bundles := make(chan *enrollment.KeyBundle, 1)
+	if err := enrollment.WatchReissue(broker, "dev-1", authorityPub, func(notice *enrollment.Notice) {
+		if notice.Replaces != keyfile.Fingerprint(oldKey) {
+			return
+		}
+		go func() {
+			bundle, err := enrollment.Enroll(broker, "dev-1", identity, authorityPub, 5*time.Second)
+			if err != nil {
+				t.Errorf("Enroll() error: %v", err)
+				return
+			}
+			bundles <- bundle
+		}()
+	}); err != nil {
+		t.Fatalf("WatchReissue() error: %v", err)
+	}
+
+	// Notices for another key, or not signed by the authority, are ignored
+	_, forgerKey, _ := ed25519.GenerateKey(rand.Reader)
+	forged, _ := enrollment.SignNotice(enrollment.Notice{DeviceID: "dev-1", KeyID: "e2", Replaces: keyfile.Fingerprint(oldKey)}, forgerKey)
+	broker.Publish(enrollment.ReissueTopic("dev-1"), 1, true, forged)
+	stale, _ := enrollment.SignNotice(enrollment.Notice{DeviceID: "dev-1", KeyID: "e2", Replaces: "other"}, authorityKey)
+	broker.Publish(enrollment.ReissueTopic("dev-1"), 1, true, stale)
+	select {
+	case bundle := <-bundles:
+		t.Fatalf("device re-enrolled on an invalid notice: %+v", bundle)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	notice, err := enrollment.SignNotice(enrollment.Notice{DeviceID: "dev-1", KeyID: "e2", Replaces: keyfile.Fingerprint(oldKey)}, authorityKey)
+	if err != nil {
+		t.Fatalf("SignNotice() error: %v", err)
+	}
+	broker.Publish(enrollment.ReissueTopic("dev-1"), 1, true, notice)
+	select {
+	case bundle := <-bundles:
+		if bundle.KeyID != "e2" || string(bundle.AttributeKey) != "key of epoch e2" {
+			t.Fatalf("bundle mismatch: %+v", bundle)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("device did not receive its re-issued key")
+	}
+}
+
+func TestEscrow_AuditorReadsEveryPolicy(t *testing.T) {
+	publicKey, systemSecretKey, err := tkn20.Setup(rand.Reader)
+	if err != nil {
+		t.Fatalf("tkn20.Setup() error: %v", err)
+	}
+	pubKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		t.Fatalf("publicKey.MarshalBinary() error: %v", err)
+	}
+
+	// The auditor's key was revoked once, so the clause must be versioned like any other policy
+	table := &accesspolicy.VersionTable{}
+	table.Bump("role", "auditor")
+	attrs := tkn20.Attributes{}
+	attrs.FromMap(table.EncodeAll(map[string]string{"role": "auditor"}))
+	key, err := systemSecretKey.KeyGen(rand.Reader, attrs)
+	if err != nil {
+		t.Fatalf("KeyGen() error: %v", err)
+	}
+	auditorKey, err := key.MarshalBinary()
+	if err != nil {
+		t.Fatalf("key.MarshalBinary() error: %v", err)
+	}
+
+	broker := newMemMQTT()
+	var received, audited []string
+	auditor := secureclient.NewSecureClient(broker, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, nil, auditorKey)
+	auditor.SetDecryptAuditor(secureclient.DecryptAuditorFunc(func(topic string, envelope *internal.Envelope) error {
+		audited = append(audited, topic)
+		if topic == "blocked" {
+			return fmt.Errorf("audit log unavailable")
+		}
+		return nil
+	}))
+	for _, topic := range []string{testTopic, "debug/x", "blocked"} {
+		if err := auditor.SubscribeSecure(topic, 0, func(topic string, _ []byte) { received = append(received, topic) }); err != nil {
+			t.Fatalf("SubscribeSecure() error: %v", err)
+		}
+	}
+
+	config := &escrow.Escrow{Clause: "(role: auditor)", OptOut: []string{"debug/#"}}
+	if err := config.Check(); err != nil {
+		t.Fatalf("Check() error: %v", err)
+	}
+	publisher := secureclient.NewSecureClient(broker, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, pubKeyBytes, nil)
+	publisher.AddPolicyRewriter(escrow.NewRewriter(config))
+	publisher.AddPolicyRewriter(accesspolicy.NewVersionRewriter(table))
+	for _, topic := range []string{testTopic, "debug/x", "blocked"} {
+		if err := publisher.PublishSecure(topic, 0, false, []byte("secret"), testPolicy); err != nil {
+			t.Fatalf("PublishSecure(%s) error: %v", topic, err)
+		}
+	}
+
+	// The opted-out topic stays unreadable, the unaudited decryption is withheld
+	if len(received) != 1 || received[0] != testTopic {
+		t.Fatalf("received = %v, want only %s", received, testTopic)
+	}
+	if len(audited) != 2 || audited[0] != testTopic || audited[1] != "blocked" {
+		t.Fatalf("audited = %v", audited)
+	}
+}
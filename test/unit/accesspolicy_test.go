@@ -0,0 +1,444 @@
+package unit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"securemqtt/internal/abe"
+	"securemqtt/internal/accesspolicy"
+
+	"github.com/cloudflare/circl/abe/cpabe/tkn20"
+)
+
+func TestAccessPolicy_Parse_RoundTripsThroughTKN20(t *testing.T) {
+	policies := []string{
+		`(role: operator) and (site: rome)`,
+		`role: operator or site: milan and not (role: guest)`,
+		`not ((role: guest) or (site: milan))`,
+	}
+
+	for _, raw := range policies {
+		node, err := accesspolicy.Parse(raw)
+		if err != nil {
+			t.Fatalf("Parse(%q) error: %v", raw, err)
+		}
+
+		var original, printed tkn20.Policy
+		if err := original.FromString(raw); err != nil {
+			t.Fatalf("tkn20 FromString(%q) error: %v", raw, err)
+		}
+		if err := printed.FromString(node.String()); err != nil {
+			t.Fatalf("tkn20 rejects printed policy %q: %v", node.String(), err)
+		}
+		if !original.Equal(&printed) {
+			t.Fatalf("printed policy %q differs from %q", node.String(), raw)
+		}
+	}
+}
+
+func TestAccessPolicy_Parse_Malformed_Fails(t *testing.T) {
+	for _, raw := range []string{`((role: operator) and`, `role operator`, `(role: operator) (site: rome)`, `role: opérateur`} {
+		if _, err := accesspolicy.Parse(raw); err == nil {
+			t.Fatalf("expected failure for %q; got nil error", raw)
+		}
+	}
+}
+
+func TestVersionRewriter_RevokedKeyNoLongerMatches(t *testing.T) {
+	pubKeyBytes, oldKeyBytes, _, policy, sessionKey := setupABE(t)
+
+	table := &accesspolicy.VersionTable{}
+	table.Bump("role", "operator")
+
+	rewritten, err := accesspolicy.NewVersionRewriter(table).Rewrite(policy)
+	if err != nil {
+		t.Fatalf("Rewrite() error: %v", err)
+	}
+	if want := `((role: operator__v1) and (site: rome))`; rewritten != want {
+		t.Fatalf("rewritten policy: got %q want %q", rewritten, want)
+	}
+
+	ct, err := (&abe.PublisherABE{}).EncryptKey(pubKeyBytes, rewritten, sessionKey)
+	if err != nil {
+		t.Fatalf("EncryptKey() error: %v", err)
+	}
+	if _, err := (&abe.SubscriberABE{}).DecryptKey(oldKeyBytes, ct); err == nil {
+		t.Fatalf("expected key issued before the version bump to fail; got nil error")
+	}
+
+	// A key encoded with the current versions satisfies the rewritten policy
+	encoded := table.EncodeAll(map[string]string{"role": "operator", "site": "rome"})
+	var attrs tkn20.Attributes
+	attrs.FromMap(encoded)
+	var p tkn20.Policy
+	if err := p.FromString(rewritten); err != nil {
+		t.Fatalf("FromString() error: %v", err)
+	}
+	if !p.Satisfaction(attrs) {
+		t.Fatalf("re-issued attributes %v do not satisfy %q", encoded, rewritten)
+	}
+}
+
+func TestValidity_MonthBuckets_CrossYearBoundary(t *testing.T) {
+	from := time.Date(2026, 11, 20, 12, 0, 0, 0, time.UTC)
+	until := time.Date(2027, 1, 3, 0, 0, 0, 0, time.UTC)
+
+	validity, err := accesspolicy.NewValidity(accesspolicy.Month, from, until)
+	if err != nil {
+		t.Fatalf("NewValidity() error: %v", err)
+	}
+
+	want := []string{"period_m2026_11", "period_m2026_12", "period_m2027_01"}
+	if len(validity.Periods) != len(want) {
+		t.Fatalf("periods: got %v want %v", validity.Periods, want)
+	}
+	for i := range want {
+		if validity.Periods[i] != want[i] {
+			t.Fatalf("periods: got %v want %v", validity.Periods, want)
+		}
+	}
+	if !validity.NotAfter.Equal(time.Date(2027, 2, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected NotAfter: %s", validity.NotAfter)
+	}
+
+	if _, err := accesspolicy.NewValidity(accesspolicy.Month, until, from); err == nil {
+		t.Fatalf("expected failure for window ending before it starts; got nil error")
+	}
+}
+
+func TestPeriodRewriter_OnlyCurrentPeriodKeysMatch(t *testing.T) {
+	rewritten, err := accesspolicy.NewPeriodRewriter(accesspolicy.Week).Rewrite(`(role: operator)`)
+	if err != nil {
+		t.Fatalf("Rewrite() error: %v", err)
+	}
+
+	var p tkn20.Policy
+	if err := p.FromString(rewritten); err != nil {
+		t.Fatalf("FromString(%q) error: %v", rewritten, err)
+	}
+
+	now := time.Now()
+	current, err := accesspolicy.NewValidity(accesspolicy.Week, now, now.AddDate(0, 0, 14))
+	if err != nil {
+		t.Fatalf("NewValidity() error: %v", err)
+	}
+	expired, err := accesspolicy.NewValidity(accesspolicy.Week, now.AddDate(0, 0, -60), now.AddDate(0, 0, -14))
+	if err != nil {
+		t.Fatalf("NewValidity() error: %v", err)
+	}
+
+	for name, validity := range map[string]*accesspolicy.Validity{"current": current, "expired": expired} {
+		attrs := validity.Attributes()
+		attrs["role"] = "operator"
+
+		var tkAttrs tkn20.Attributes
+		tkAttrs.FromMap(attrs)
+		if got, want := p.Satisfaction(tkAttrs), name == "current"; got != want {
+			t.Fatalf("%s key satisfies %q: got %v want %v", name, rewritten, got, want)
+		}
+	}
+}
+
+func TestPeriodRewriter_PermanentKeysKeepDecrypting(t *testing.T) {
+	publicKey, systemSecretKey, err := tkn20.Setup(rand.Reader)
+	if err != nil {
+		t.Fatalf("tkn20.Setup() error: %v", err)
+	}
+	publicKeyBytes, err := publicKey.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary() error: %v", err)
+	}
+
+	now := time.Now()
+	current, err := accesspolicy.NewValidity(accesspolicy.Month, now, now.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatalf("NewValidity() error: %v", err)
+	}
+	expired, err := accesspolicy.NewValidity(accesspolicy.Month, now.AddDate(0, -6, 0), now.AddDate(0, -3, 0))
+	if err != nil {
+		t.Fatalf("NewValidity() error: %v", err)
+	}
+
+	// Permanent operator & escrow keys, issued before & after a time-bound key enabled periods
+	keys := []struct {
+		name     string
+		role     string
+		validity *accesspolicy.Validity
+		want     bool
+	}{
+		{"permanent", "operator", nil, true},
+		{"escrow", "auditor", nil, true},
+		{"time-bound", "operator", current, true},
+		{"expired", "operator", expired, false},
+	}
+
+	policy := `(role: operator) or (role: auditor)`
+	rewritten, err := accesspolicy.NewPeriodRewriter(accesspolicy.Month).Rewrite(policy)
+	if err != nil {
+		t.Fatalf("Rewrite() error: %v", err)
+	}
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		t.Fatalf("rand.Read() error: %v", err)
+	}
+	ct, err := (&abe.PublisherABE{}).EncryptKey(publicKeyBytes, rewritten, sessionKey)
+	if err != nil {
+		t.Fatalf("EncryptKey(%q) error: %v", rewritten, err)
+	}
+
+	for _, key := range keys {
+		attrs := accesspolicy.PeriodAttributes(key.validity)
+		attrs["role"] = key.role
+		var tkAttrs tkn20.Attributes
+		tkAttrs.FromMap(attrs)
+		attributeKey, err := systemSecretKey.KeyGen(rand.Reader, tkAttrs)
+		if err != nil {
+			t.Fatalf("KeyGen(%s) error: %v", key.name, err)
+		}
+		keyBytes, err := attributeKey.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(%s) error: %v", key.name, err)
+		}
+
+		got, err := (&abe.SubscriberABE{}).DecryptKey(keyBytes, ct)
+		if key.want && (err != nil || !bytes.Equal(got, sessionKey)) {
+			t.Fatalf("%s key cannot decrypt %q: %v", key.name, rewritten, err)
+		}
+		if !key.want && err == nil {
+			t.Fatalf("%s key decrypted %q", key.name, rewritten)
+		}
+	}
+}
+
+func testSchema(t *testing.T) *accesspolicy.Schema {
+	t.Helper()
+	schema := &accesspolicy.Schema{Attributes: map[string]*accesspolicy.AttributeRule{
+		"role": {Values: []string{"operator", "guest"}, Required: true},
+		"site": {Pattern: "[a-z]+"},
+	}}
+	if err := schema.Compile(); err != nil {
+		t.Fatalf("Compile() error: %v", err)
+	}
+	return schema
+}
+
+func TestSchema_CheckAttributes(t *testing.T) {
+	schema := testSchema(t)
+
+	if err := schema.CheckAttributes(map[string]string{"role": "operator", "site": "rome"}); err != nil {
+		t.Fatalf("valid attributes rejected: %v", err)
+	}
+	for _, attrs := range []map[string]string{
+		{"role": "operater"},
+		{"role": "operator", "site": "Rome1"},
+		{"role": "operator", "zone": "a"},
+		{"site": "rome"},
+	} {
+		if err := schema.CheckAttributes(attrs); err == nil {
+			t.Fatalf("expected %v to be rejected", attrs)
+		}
+	}
+}
+
+func TestSchemaValidator_RejectsUnknownPolicyAttributes(t *testing.T) {
+	validator := accesspolicy.NewSchemaValidator(nil)
+	if _, err := validator.Rewrite("(role: operater)"); err != nil {
+		t.Fatalf("policy rejected without a schema: %v", err)
+	}
+
+	validator.SetSchema(testSchema(t))
+	raw := "(role: operator) and ((site: rome) or (period_m2026_10: valid))"
+	got, err := validator.Rewrite(raw)
+	if err != nil || got != raw {
+		t.Fatalf("Rewrite(%q) = %q, %v; want unchanged", raw, got, err)
+	}
+	for _, policy := range []string{"(role: operater)", "(rolle: operator)", "(site: Rome)"} {
+		if _, err := validator.Rewrite(policy); err == nil {
+			t.Fatalf("expected %q to be rejected", policy)
+		}
+	}
+}
+
+func TestSchema_Compile_RejectsReservedNames(t *testing.T) {
+	for _, schema := range []*accesspolicy.Schema{
+		{Attributes: map[string]*accesspolicy.AttributeRule{"period_x": {}}},
+		{Attributes: map[string]*accesspolicy.AttributeRule{"role": {Values: []string{"operator__v1"}}}},
+		{Attributes: map[string]*accesspolicy.AttributeRule{"site": {Pattern: "("}}},
+	} {
+		if err := schema.Compile(); err == nil {
+			t.Fatalf("expected %v to be rejected", schema.Attributes)
+		}
+	}
+}
+
+func TestForSubjects(t *testing.T) {
+	policy, err := accesspolicy.ForSubjects([]string{"a1", "b2"}, "(role: operator)")
+	if err != nil {
+		t.Fatalf("ForSubjects() error: %v", err)
+	}
+	if want := "(((subject_id: a1) or (subject_id: b2)) and (role: operator))"; policy != want {
+		t.Fatalf("ForSubjects() = %q, want %q", policy, want)
+	}
+
+	if policy, err = accesspolicy.ForSubjects([]string{"a1"}, ""); err != nil || policy != "(subject_id: a1)" {
+		t.Fatalf("ForSubjects() = %q, %v", policy, err)
+	}
+	if _, err := accesspolicy.ForSubjects(nil, "(role: operator)"); err == nil {
+		t.Fatalf("expected empty subject list to be rejected")
+	}
+	if _, err := accesspolicy.ForSubjects([]string{"a1) or (role: guest"}, ""); err == nil {
+		t.Fatalf("expected invalid subject ID to be rejected")
+	}
+}
+
+func TestSchema_AcceptsReservedAttributes(t *testing.T) {
+	schema := testSchema(t)
+	attrs := map[string]string{"role": "operator", "site": "rome", accesspolicy.SubjectAttribute: "a1"}
+	if err := schema.CheckAttributes(attrs); err != nil {
+		t.Fatalf("CheckAttributes() error: %v", err)
+	}
+	node, err := accesspolicy.Parse("(subject_id: a1) and (role: operator)")
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	if err := schema.CheckPolicy(node); err != nil {
+		t.Fatalf("CheckPolicy() error: %v", err)
+	}
+}
+
+func TestAccessPolicy_Parse_Sets(t *testing.T) {
+	node, err := accesspolicy.Parse(`site in (rome, milan) and role: operator`)
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	if want := `(((site: rome) or (site: milan)) and (role: operator))`; node.String() != want {
+		t.Fatalf("Parse() = %q, want %q", node.String(), want)
+	}
+
+	expanded, err := accesspolicy.ExpandSets(`site in (rome)`)
+	if err != nil || expanded != `(site: rome)` {
+		t.Fatalf("ExpandSets() = %q, %v", expanded, err)
+	}
+	if unchanged, _ := accesspolicy.ExpandSets(`role: operator`); unchanged != `role: operator` {
+		t.Fatalf("ExpandSets() rewrote a policy without sets: %q", unchanged)
+	}
+
+	for _, raw := range []string{`site in ()`, `site in (rome,)`, `site in rome`, `site in (rome milan)`} {
+		if _, err := accesspolicy.Parse(raw); err == nil {
+			t.Fatalf("expected failure for %q; got nil error", raw)
+		}
+	}
+}
+
+func TestVersionRewriter_MultiValuedKeyMatchesAnyValue(t *testing.T) {
+	attrs := map[string]string{"role": "operator", "site": accesspolicy.JoinValues([]string{"rome", "milan", "rome"})}
+	if attrs["site"] != "milan,rome" {
+		t.Fatalf("JoinValues() = %q, want sorted unique values", attrs["site"])
+	}
+
+	table := &accesspolicy.VersionTable{}
+	if !table.MarkMultiValued("site") || table.MarkMultiValued("site") {
+		t.Fatalf("MarkMultiValued() must only report the first marking")
+	}
+	table.Bump("site", "milan")
+
+	encoded := table.EncodeAll(attrs)
+	if encoded["site__in__milan"] != "milan__v1" || encoded["site__in__rome"] != "rome" {
+		t.Fatalf("EncodeAll() = %v", encoded)
+	}
+	var keyAttrs tkn20.Attributes
+	keyAttrs.FromMap(encoded)
+
+	rewriter := accesspolicy.NewVersionRewriter(table)
+	for raw, want := range map[string]bool{
+		`(site: rome) and (role: operator)`: true,
+		`(site: milan)`:                     true,
+		`site in (paris, milan)`:            true,
+		`(site: paris)`:                     false,
+	} {
+		expanded, err := accesspolicy.ExpandSets(raw)
+		if err != nil {
+			t.Fatalf("ExpandSets(%q) error: %v", raw, err)
+		}
+		rewritten, err := rewriter.Rewrite(expanded)
+		if err != nil {
+			t.Fatalf("Rewrite(%q) error: %v", raw, err)
+		}
+		var p tkn20.Policy
+		if err := p.FromString(rewritten); err != nil {
+			t.Fatalf("FromString(%q) error: %v", rewritten, err)
+		}
+		if got := p.Satisfaction(keyAttrs); got != want {
+			t.Fatalf("key satisfies %q: got %v want %v", rewritten, got, want)
+		}
+
+		node, _ := accesspolicy.Parse(raw)
+		if got := accesspolicy.Satisfies(node, attrs); got != want {
+			t.Fatalf("Satisfies(%q): got %v want %v", raw, got, want)
+		}
+	}
+}
+
+func TestVersionRewriter_RejectsNegatedMultiValuedAttributes(t *testing.T) {
+	table := &accesspolicy.VersionTable{}
+	table.MarkMultiValued("site")
+	rewriter := accesspolicy.NewVersionRewriter(table)
+
+	for _, raw := range []string{`not (site: paris)`, `(role: operator) and not ((site: paris) or (role: guest))`} {
+		if _, err := rewriter.Rewrite(raw); err == nil {
+			t.Fatalf("expected Rewrite(%q) to reject negating site; got nil error", raw)
+		}
+	}
+	if _, err := rewriter.Rewrite(`(site: rome) and not (role: guest)`); err != nil {
+		t.Fatalf("Rewrite() of a negated single-valued attribute error: %v", err)
+	}
+
+	// Like tkn20, a key holding several values never satisfies a negated leaf
+	attrs := map[string]string{"role": "operator", "site": accesspolicy.JoinValues([]string{"rome", "milan"})}
+	var keyAttrs tkn20.Attributes
+	keyAttrs.FromMap(table.EncodeAll(attrs))
+	var p tkn20.Policy
+	if err := p.FromString(`not (site: paris)`); err != nil {
+		t.Fatalf("FromString() error: %v", err)
+	}
+	node, _ := accesspolicy.Parse(`not (site: paris)`)
+	if p.Satisfaction(keyAttrs) || accesspolicy.Satisfies(node, attrs) {
+		t.Fatalf("multi-valued key satisfies not (site: paris): tkn20 %v, Satisfies %v",
+			p.Satisfaction(keyAttrs), accesspolicy.Satisfies(node, attrs))
+	}
+}
+
+func TestCanaryPolicy_PrefersSubjectIdentifier(t *testing.T) {
+	table := &accesspolicy.VersionTable{}
+	table.MarkMultiValued("site")
+	table.Bump("role", "operator")
+
+	withID, err := accesspolicy.CanaryPolicy(map[string]string{"role": "operator", accesspolicy.SubjectAttribute: "abc123"}, table)
+	if err != nil {
+		t.Fatalf("CanaryPolicy() error: %v", err)
+	}
+	if want := `(subject_id: abc123)`; withID != want {
+		t.Fatalf("CanaryPolicy() = %q, want %q", withID, want)
+	}
+
+	attrs := map[string]string{"role": "operator", "site": "milan,rome"}
+	policy, err := accesspolicy.CanaryPolicy(attrs, table)
+	if err != nil {
+		t.Fatalf("CanaryPolicy() error: %v", err)
+	}
+	var keyAttrs tkn20.Attributes
+	keyAttrs.FromMap(table.EncodeAll(attrs))
+	var p tkn20.Policy
+	if err := p.FromString(policy); err != nil {
+		t.Fatalf("FromString(%q) error: %v", policy, err)
+	}
+	if !p.Satisfaction(keyAttrs) {
+		t.Fatalf("key attributes do not satisfy their canary policy %q", policy)
+	}
+
+	if _, err := accesspolicy.CanaryPolicy(nil, table); err == nil {
+		t.Fatalf("expected failure without attributes; got nil error")
+	}
+}
@@ -0,0 +1,162 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/accessreview"
+
+	"github.com/cloudflare/circl/abe/cpabe/tkn20"
+)
+
+func TestSatisfies(t *testing.T) {
+	attrs := map[string]string{"role": "operator", "site": "rome"}
+	tests := []struct {
+		policy string
+		want   bool
+	}{
+		{"(role: operator) and (site: rome)", true},
+		{"(role: operator) and (site: milan)", false},
+		{"(role: guest) or (site: rome)", true},
+		{"(role: operator) and not (site: milan)", true},
+		{"not (role: operator)", false},
+		{"(zone: north)", false},
+	}
+	for _, tt := range tests {
+		node, err := accesspolicy.Parse(tt.policy)
+		if err != nil {
+			t.Fatalf("Parse(%q) error: %v", tt.policy, err)
+		}
+		if got := accesspolicy.Satisfies(node, attrs); got != tt.want {
+			t.Errorf("Satisfies(%q) = %v, want %v", tt.policy, got, tt.want)
+		}
+	}
+}
+
+func TestSatisfies_NegationMatchesTKN20(t *testing.T) {
+	keys := []map[string]string{
+		{"role": "operator"},
+		{"role": "operator", "site": "rome"},
+		{"role": "operator", "site": "milan"},
+	}
+	policies := []string{
+		"(role: operator) and not (site: milan)",
+		"not ((site: milan) or (role: guest))",
+		"not ((site: milan) and (role: operator))",
+		"not (not (site: rome))",
+	}
+	for _, raw := range policies {
+		node, err := accesspolicy.Parse(raw)
+		if err != nil {
+			t.Fatalf("Parse(%q) error: %v", raw, err)
+		}
+		var policy tkn20.Policy
+		if err := policy.FromString(raw); err != nil {
+			t.Fatalf("tkn20 FromString(%q) error: %v", raw, err)
+		}
+		for _, attrs := range keys {
+			var tkAttrs tkn20.Attributes
+			tkAttrs.FromMap(attrs)
+			if got, want := accesspolicy.Satisfies(node, attrs), policy.Satisfaction(tkAttrs); got != want {
+				t.Errorf("Satisfies(%q, %v) = %v, tkn20 says %v", raw, attrs, got, want)
+			}
+		}
+	}
+
+	// A key without the negated attribute cannot decrypt, it proves nothing about it
+	node, err := accesspolicy.Parse("(role: operator) and not (site: milan)")
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	if accesspolicy.Satisfies(node, map[string]string{"role": "operator"}) {
+		t.Fatalf("key without site satisfies a policy negating site")
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"plant/rome/alarms", "plant/rome/alarms", true},
+		{"plant/rome/alarms", "plant/rome", false},
+		{"plant/+/alarms", "plant/milan/alarms", true},
+		{"plant/+/alarms", "plant/milan/status", false},
+		{"plant/#", "plant/rome/alarms", true},
+		{"plant/+", "plant/rome/alarms", false},
+	}
+	for _, tt := range tests {
+		if got := accessreview.MatchTopic(tt.filter, tt.topic); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v, want %v", tt.filter, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestReaders_SkipsRevokedExpiredAndArchivedKeys(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	expired, err := accesspolicy.NewValidity(accesspolicy.Month, now.AddDate(0, -3, 0), now.AddDate(0, -2, 0))
+	if err != nil {
+		t.Fatalf("NewValidity() error: %v", err)
+	}
+	current, err := accesspolicy.NewValidity(accesspolicy.Month, now.AddDate(0, 0, -1), now.AddDate(0, 1, 0))
+	if err != nil {
+		t.Fatalf("NewValidity() error: %v", err)
+	}
+	operator := map[string]string{"role": "operator"}
+	holders := []accessreview.Holder{
+		{Subject: "active", Attributes: operator, KeyID: "e2"},
+		{Subject: "revoked", Attributes: operator, KeyID: "e2", Revoked: true},
+		{Subject: "expired", Attributes: operator, KeyID: "e2", Validity: expired},
+		{Subject: "timebound", Attributes: operator, KeyID: "e2", Validity: current},
+		{Subject: "archived", Attributes: operator, KeyID: "e1"},
+		{Subject: "guest", Attributes: map[string]string{"role": "guest"}, KeyID: "e2"},
+	}
+
+	node, err := accesspolicy.Parse("(role: operator)")
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	readers := accessreview.Readers(node, holders, "e2", now)
+	if len(readers) != 2 || readers[0].Subject != "active" || readers[1].Subject != "timebound" {
+		t.Fatalf("Readers() = %+v, want active and timebound", readers)
+	}
+
+	// Without epochs only keys without key ID count
+	legacy := []accessreview.Holder{{Subject: "legacy", Attributes: operator}, holders[0]}
+	if readers := accessreview.Readers(node, legacy, "", now); len(readers) != 1 || readers[0].Subject != "legacy" {
+		t.Fatalf("Readers() without epochs = %+v, want legacy", readers)
+	}
+}
+
+func TestLoadTopicPolicies(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, accessreview.TopicPoliciesFile)
+
+	config, err := accessreview.LoadTopicPolicies(path)
+	if err != nil || config != nil {
+		t.Fatalf("LoadTopicPolicies(missing) = %v, %v; want nil, nil", config, err)
+	}
+
+	data := `{"topics": [{"topic": "plant/+/alarms", "policy": "(role: operator)"}, {"topic": "plant/rome/status", "policy": "(site: rome)"}]}`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	config, err = accessreview.LoadTopicPolicies(path)
+	if err != nil {
+		t.Fatalf("LoadTopicPolicies() error: %v", err)
+	}
+	entry, ok := config.PolicyFor("plant/rome/alarms")
+	if !ok || entry.Policy != "(role: operator)" || entry.Publishable() {
+		t.Fatalf("PolicyFor() = %+v, %v", entry, ok)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"topics": [{"topic": "a", "policy": "(role: "}]}`), 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	if _, err := accessreview.LoadTopicPolicies(path); err == nil {
+		t.Fatalf("expected invalid policy to be rejected")
+	}
+}
@@ -0,0 +1,123 @@
+package unit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"securemqtt/internal/audit"
+)
+
+func writeAuditEvents(t *testing.T, n int) (*audit.Log, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log := audit.Open(path)
+	for i := 0; i < n; i++ {
+		if _, err := log.Append(audit.Event{Operation: "issue", Operator: "alice", Subject: "sub1"}); err != nil {
+			t.Fatalf("Append() error: %v", err)
+		}
+	}
+	return log, path
+}
+
+func TestAudit_AppendVerify_ChainsEvents(t *testing.T) {
+	log, _ := writeAuditEvents(t, 3)
+
+	last, err := log.Verify()
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	if last == nil || last.Seq != 3 {
+		t.Fatalf("last event: got %+v, want seq 3", last)
+	}
+}
+
+func TestAudit_TamperedEvent_FailsVerify(t *testing.T) {
+	log, path := writeAuditEvents(t, 3)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	lines[1] = strings.Replace(lines[1], `"alice"`, `"mallory"`, 1)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0600); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	if _, err := log.Verify(); err == nil || !strings.Contains(err.Error(), "event 2") {
+		t.Fatalf("expected verification to fail at event 2, got %v", err)
+	}
+}
+
+func TestAudit_RemovedEvent_FailsVerify(t *testing.T) {
+	log, path := writeAuditEvents(t, 3)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	lines := strings.SplitAfter(string(data), "\n")
+	if err := os.WriteFile(path, []byte(lines[0]+lines[2]), 0600); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	if _, err := log.Verify(); err == nil {
+		t.Fatalf("expected verification to fail after removing an event")
+	}
+}
+
+func TestAudit_Export_FiltersBySince(t *testing.T) {
+	log, _ := writeAuditEvents(t, 2)
+
+	var out bytes.Buffer
+	count, err := log.Export(&out, time.Time{})
+	if err != nil {
+		t.Fatalf("Export() error: %v", err)
+	}
+	if count != 2 || strings.Count(out.String(), "\n") != 2 {
+		t.Fatalf("Export() wrote %d events: %q", count, out.String())
+	}
+
+	out.Reset()
+	if count, err = log.Export(&out, time.Now().Add(time.Hour)); err != nil || count != 0 {
+		t.Fatalf("Export(future) = %d, %v; want 0 events", count, err)
+	}
+}
+
+func TestAudit_AppendThen_KeepsHeadAtLastEvent(t *testing.T) {
+	log, _ := writeAuditEvents(t, 0)
+	head := filepath.Join(t.TempDir(), "head")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := log.AppendThen(audit.Event{Operation: "trace", Operator: "alice"}, func(appended *audit.Event) error {
+				return os.WriteFile(head, []byte(strconv.Itoa(appended.Seq)), 0600)
+			})
+			if err != nil {
+				t.Errorf("AppendThen() error: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	last, err := log.Verify()
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	data, err := os.ReadFile(head)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	if string(data) != strconv.Itoa(last.Seq) {
+		t.Fatalf("head: got seq %s, want %d", data, last.Seq)
+	}
+}
@@ -0,0 +1,162 @@
+package unit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"securemqtt/internal/backup"
+	"securemqtt/internal/signed"
+)
+
+var backupPassphrase = []byte("correct horse battery staple")
+
+func TestBackup_SealOpenRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(src, "epochs", "e1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		"master.key":           []byte("master"),
+		"registry.json":        []byte(`{"entries":[]}`),
+		"epochs/e1/public.key": []byte("old public"),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(src, filepath.FromSlash(name)), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contents, err := backup.Collect(src, "", time.Now())
+	if err != nil {
+		t.Fatalf("Collect() error: %v", err)
+	}
+	publicKey, privateKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := backup.Seal(contents, backupPassphrase, privateKey)
+	if err != nil {
+		t.Fatalf("Seal() error: %v", err)
+	}
+	if bytes.Contains(archive, []byte("registry")) {
+		t.Fatalf("archive leaks file names in plaintext")
+	}
+
+	signer, err := backup.Signer(archive)
+	if err != nil || !signer.Equal(publicKey) {
+		t.Fatalf("Signer() = %x, %v; want the sealing key", signer, err)
+	}
+	opened, err := backup.Open(archive, backupPassphrase, publicKey)
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+
+	dst := t.TempDir()
+	if err := opened.Extract(dst); err != nil {
+		t.Fatalf("Extract() error: %v", err)
+	}
+	for name, want := range files {
+		got, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(name)))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Fatalf("%s = %q, %v; want %q", name, got, err, want)
+		}
+	}
+	info, err := os.Stat(filepath.Join(dst, "master.key"))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("master.key mode = %v, %v; want 0600", info.Mode().Perm(), err)
+	}
+}
+
+func TestBackup_Open_RejectsWrongPassphraseSignerOrTampering(t *testing.T) {
+	contents := &backup.Contents{CreatedAt: time.Now().UTC(), Files: []backup.File{{Name: "master.key", Mode: 0600, Data: []byte("master")}}}
+	publicKey, privateKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublicKey, _, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := backup.Seal(contents, []byte("short"), privateKey); err == nil {
+		t.Fatalf("Seal() accepted a short passphrase")
+	}
+	archive, err := backup.Seal(contents, backupPassphrase, privateKey)
+	if err != nil {
+		t.Fatalf("Seal() error: %v", err)
+	}
+
+	if _, err := backup.Open(archive, []byte("wrong horse battery staple"), publicKey); err == nil {
+		t.Fatalf("Open() accepted a wrong passphrase")
+	}
+	if _, err := backup.Open(archive, backupPassphrase, otherPublicKey); err == nil {
+		t.Fatalf("Open() accepted an archive signed by another key")
+	}
+	tampered := bytes.Replace(archive, []byte(`"signature": "`), []byte(`"signature": "A`), 1)
+	if _, err := backup.Open(tampered, backupPassphrase, publicKey); err == nil {
+		t.Fatalf("Open() accepted a tampered archive")
+	}
+}
+
+func TestBackup_Extract_RejectsPathsOutsideDir(t *testing.T) {
+	contents := &backup.Contents{Files: []backup.File{{Name: "../escape.key", Mode: 0600, Data: []byte("x")}}}
+	if err := contents.Extract(t.TempDir()); err == nil {
+		t.Fatalf("Extract() wrote outside the target directory")
+	}
+}
+
+func TestBackup_DefaultNamespaceLeavesOtherNamespacesAlone(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		"public.key":                   "default public",
+		"epochs/e2/public.key":         "newer epoch",
+		"namespaces/tenant/master.key": "tenant master",
+		".lock":                        "",
+	}
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	contents, err := backup.Collect(root, "", time.Now())
+	if err != nil {
+		t.Fatalf("Collect() error: %v", err)
+	}
+	if contents.Find("namespaces/tenant/master.key") != nil || contents.Find(".lock") != nil {
+		t.Fatalf("Collect() archived another namespace or the lock: %v", contents.Files)
+	}
+	if contents.Find("public.key") == nil {
+		t.Fatalf("Collect() missed public.key")
+	}
+
+	foreign := &backup.Contents{Files: []backup.File{{Name: "namespaces/tenant/master.key", Mode: 0600, Data: []byte("x")}}}
+	if err := foreign.Extract(root); err == nil {
+		t.Fatalf("Extract() wrote into another namespace")
+	}
+
+	// Restoring an archive without the newer epoch removes it, other namespaces & the lock stay
+	older := &backup.Contents{Files: []backup.File{{Name: "public.key", Mode: 0600, Data: []byte("default public")}}}
+	removed, err := older.Prune(root)
+	if err != nil {
+		t.Fatalf("Prune() error: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != "epochs/e2/public.key" {
+		t.Fatalf("Prune() removed %v, want only epochs/e2/public.key", removed)
+	}
+	if _, err := os.Stat(filepath.Join(root, "epochs")); !os.IsNotExist(err) {
+		t.Fatalf("Prune() left the emptied epochs directory: %v", err)
+	}
+	for _, name := range []string{"public.key", "namespaces/tenant/master.key", ".lock"} {
+		if _, err := os.Stat(filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Fatalf("Prune() removed %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package unit
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"securemqtt/internal/accessreview"
+	"securemqtt/internal/brokeracl"
+)
+
+func testTopicPolicies(t *testing.T, data string) *accessreview.TopicPolicies {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), accessreview.TopicPoliciesFile)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	config, err := accessreview.LoadTopicPolicies(path)
+	if err != nil {
+		t.Fatalf("LoadTopicPolicies() error: %v", err)
+	}
+	return config
+}
+
+func TestBrokerACL_MirrorsPolicies(t *testing.T) {
+	config := testTopicPolicies(t, `{"topics": [
+		{"topic": "plant/rome/alarms", "policy": "(role: operator) and (site: rome)", "publishers": ["plc-rome"]},
+		{"topic": "plant/+/status", "policy": "(role: operator) or (role: guest)"}
+	]}`)
+	holders := []accessreview.Holder{
+		{Subject: "sub1", Attributes: map[string]string{"role": "operator", "site": "rome"}},
+		{Subject: "sub2", Attributes: map[string]string{"role": "guest", "site": "milan"}},
+		{Subject: "sub3", Attributes: map[string]string{"role": "operator", "site": "rome"}, Revoked: true},
+		{Subject: "dev", DeviceID: "dev-001", Attributes: map[string]string{"role": "guest"}},
+	}
+
+	rules, err := brokeracl.Generate(config, holders, "", time.Now().UTC())
+	if err != nil {
+		t.Fatalf("Generate() error: %v", err)
+	}
+	if got := rules.Users["sub1"].Read; !slices.Equal(got, []string{"plant/rome/alarms", "plant/+/status"}) {
+		t.Fatalf("sub1 reads %v", got)
+	}
+	if got := rules.Users["sub2"].Read; !slices.Equal(got, []string{"plant/+/status"}) {
+		t.Fatalf("sub2 reads %v", got)
+	}
+	if _, ok := rules.Users["sub3"]; ok {
+		t.Fatalf("revoked subject was granted access")
+	}
+	if _, ok := rules.Users["dev-001"]; !ok {
+		t.Fatalf("enrolled key not granted to its device ID")
+	}
+	if got := rules.Users["plc-rome"].Write; !slices.Equal(got, []string{"plant/rome/alarms"}) {
+		t.Fatalf("plc-rome writes %v", got)
+	}
+	if got := rules.Users[brokeracl.DefaultPublisher].Write; !slices.Equal(got, []string{"plant/+/status"}) {
+		t.Fatalf("default publisher writes %v", got)
+	}
+
+	acl := string(rules.MosquittoACL())
+	if !strings.Contains(acl, "user sub2\ntopic read plant/+/status\n") {
+		t.Fatalf("ACL file missing sub2 rules:\n%s", acl)
+	}
+
+	data, err := rules.DynamicSecurity()
+	if err != nil {
+		t.Fatalf("DynamicSecurity() error: %v", err)
+	}
+	var dynsec map[string]any
+	if err := json.Unmarshal(data, &dynsec); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if clients := dynsec["clients"].([]any); len(clients) != len(rules.Users) {
+		t.Fatalf("dynamic security has %d clients, want %d", len(clients), len(rules.Users))
+	}
+}
+
+func TestBrokerACL_RejectsUnusableUsernames(t *testing.T) {
+	config := testTopicPolicies(t, `{"topics": [{"topic": "a", "policy": "(role: operator)"}]}`)
+	holders := []accessreview.Holder{{Subject: "bad\nuser", Attributes: map[string]string{"role": "operator"}}}
+	if _, err := brokeracl.Generate(config, holders, "", time.Now().UTC()); err == nil {
+		t.Fatalf("expected subject with a newline to be rejected")
+	}
+}
@@ -0,0 +1,102 @@
+package unit
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"securemqtt/internal/delegation"
+)
+
+func testCredential(t *testing.T, authorityKey ed25519.PrivateKey, delegateKey ed25519.PublicKey, notAfter time.Time) []byte {
+	t.Helper()
+	credential := &delegation.Credential{
+		ID:          "c1",
+		Delegate:    "rome-site",
+		DelegateKey: delegateKey,
+		Scope:       delegation.Scope{"site": {"rome"}, "role": {"operator", "guest"}},
+		NotAfter:    notAfter,
+		IssuedAt:    time.Now().UTC(),
+	}
+	data, err := credential.Sign(authorityKey)
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	return data
+}
+
+func TestDelegationScope_Permits(t *testing.T) {
+	scope := delegation.Scope{"site": {"rome"}, "role": {"operator", "guest"}}
+	if err := scope.Permits(map[string]string{"site": "rome", "role": "guest,operator"}); err != nil {
+		t.Fatalf("Permits() error: %v", err)
+	}
+	for name, attrs := range map[string]map[string]string{
+		"other value":     {"site": "milan", "role": "operator"},
+		"other attribute": {"site": "rome", "role": "operator", "team": "a"},
+		"missing":         {"role": "operator"},
+		"one value out":   {"site": "rome", "role": "operator,admin"},
+	} {
+		if err := scope.Permits(attrs); err == nil {
+			t.Fatalf("expected %s to be outside the scope", name)
+		}
+	}
+	if err := (delegation.Scope{"subject_id": {"a"}}).Check(); err == nil {
+		t.Fatalf("expected a scope over a reserved attribute to be rejected")
+	}
+}
+
+func TestDelegation_Authorize(t *testing.T) {
+	authorityPub, authorityKey, _ := ed25519.GenerateKey(rand.Reader)
+	delegatePub, delegateKey, _ := ed25519.GenerateKey(rand.Reader)
+	credential := testCredential(t, authorityKey, delegatePub, time.Now().Add(time.Hour))
+	request := delegation.IssueRequest{Subject: "dev-7", Attributes: map[string]string{"site": "rome", "role": "operator"}}
+
+	_, _, message, err := delegation.NewIssueRequest(credential, authorityPub, delegateKey, request)
+	if err != nil {
+		t.Fatalf("NewIssueRequest() error: %v", err)
+	}
+	authorized, err := delegation.Authorize(message, authorityPub, time.Now())
+	if err != nil {
+		t.Fatalf("Authorize() error: %v", err)
+	}
+	if authorized.Credential.Delegate != "rome-site" || authorized.Request.Subject != "dev-7" || authorized.Enrollment.DeviceID != "rome-site" {
+		t.Fatalf("Authorize() = %+v", authorized)
+	}
+
+	// Stale requests & requests checked after the credential expired
+	if _, err := delegation.Authorize(message, authorityPub, time.Now().Add(delegation.MaxRequestAge+time.Minute)); err == nil {
+		t.Fatalf("expected a stale request to be refused")
+	}
+	if _, err := delegation.Authorize(message, authorityPub, time.Now().Add(2*time.Hour)); err == nil {
+		t.Fatalf("expected an expired credential to be refused")
+	}
+
+	// The site cannot widen its own request after signing it
+	var signedRequest delegation.SignedIssueRequest
+	json.Unmarshal(message, &signedRequest)
+	var widened delegation.IssueRequest
+	json.Unmarshal(signedRequest.Request, &widened)
+	widened.Attributes["site"] = "milan"
+	signedRequest.Request, _ = json.Marshal(widened)
+	tampered, _ := json.Marshal(signedRequest)
+	if _, err := delegation.Authorize(tampered, authorityPub, time.Now()); err == nil {
+		t.Fatalf("expected a tampered request to be refused")
+	}
+
+	// A credential of another authority, a stolen credential without the delegate key, out-of-scope requests
+	_, otherAuthority, _ := ed25519.GenerateKey(rand.Reader)
+	foreign := testCredential(t, otherAuthority, delegatePub, time.Now().Add(time.Hour))
+	if _, _, _, err := delegation.NewIssueRequest(foreign, authorityPub, delegateKey, request); err == nil {
+		t.Fatalf("expected a credential of another authority to be refused")
+	}
+	_, thiefKey, _ := ed25519.GenerateKey(rand.Reader)
+	if _, _, _, err := delegation.NewIssueRequest(credential, authorityPub, thiefKey, request); err == nil {
+		t.Fatalf("expected a credential used with another key to be refused")
+	}
+	request.Attributes = map[string]string{"site": "milan", "role": "operator"}
+	if _, _, _, err := delegation.NewIssueRequest(credential, authorityPub, delegateKey, request); err == nil {
+		t.Fatalf("expected an out-of-scope request to be refused")
+	}
+}
@@ -0,0 +1,150 @@
+package unit
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"securemqtt/internal/enrollment"
+	"securemqtt/internal/signed"
+)
+
+func TestEnrollment_SealOpen_RoundTrip(t *testing.T) {
+	_, identity, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	authorityPub, authorityKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	pending, message, err := enrollment.NewRequest("dev-001", identity)
+	if err != nil {
+		t.Fatalf("NewRequest() error: %v", err)
+	}
+	request, id, err := enrollment.VerifyRequest(message)
+	if err != nil {
+		t.Fatalf("VerifyRequest() error: %v", err)
+	}
+	if id != pending.RequestID() || request.DeviceID != "dev-001" {
+		t.Fatalf("request mismatch: id %q device %q", id, request.DeviceID)
+	}
+
+	attributeKey := []byte("attribute key bytes")
+	delivery, err := enrollment.Seal(request, id, enrollment.KeyBundle{Subject: "dev-001", KeyID: "e1", AttributeKey: attributeKey}, authorityKey)
+	if err != nil {
+		t.Fatalf("Seal() error: %v", err)
+	}
+	if bytes.Contains(delivery, attributeKey) {
+		t.Fatalf("delivery contains the attribute key in clear")
+	}
+
+	bundle, err := pending.Open(delivery, authorityPub)
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	if !bytes.Equal(bundle.AttributeKey, attributeKey) || bundle.KeyID != "e1" {
+		t.Fatalf("bundle mismatch: %+v", bundle)
+	}
+}
+
+func TestEnrollment_TamperedRequest_Fails(t *testing.T) {
+	_, identity, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	_, message, err := enrollment.NewRequest("dev-001", identity)
+	if err != nil {
+		t.Fatalf("NewRequest() error: %v", err)
+	}
+	var signedRequest enrollment.SignedRequest
+	if err := json.Unmarshal(message, &signedRequest); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	signedRequest.Request = bytes.Replace(signedRequest.Request, []byte("dev-001"), []byte("dev-002"), 1)
+	tampered, err := json.Marshal(signedRequest)
+	if err != nil {
+		t.Fatalf("Marshal() error: %v", err)
+	}
+	if _, _, err := enrollment.VerifyRequest(tampered); err == nil {
+		t.Fatalf("expected tampered request to fail verification")
+	}
+}
+
+func TestEnrollment_ForeignDelivery_Fails(t *testing.T) {
+	_, identity, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	authorityPub, authorityKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	_, forgerKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	pending, _, err := enrollment.NewRequest("dev-001", identity)
+	if err != nil {
+		t.Fatalf("NewRequest() error: %v", err)
+	}
+	_, otherMessage, err := enrollment.NewRequest("dev-001", identity)
+	if err != nil {
+		t.Fatalf("NewRequest() error: %v", err)
+	}
+	otherRequest, otherID, err := enrollment.VerifyRequest(otherMessage)
+	if err != nil {
+		t.Fatalf("VerifyRequest() error: %v", err)
+	}
+
+	// Delivery for an earlier request of the same device
+	stale, err := enrollment.Seal(otherRequest, otherID, enrollment.KeyBundle{Subject: "dev-001"}, authorityKey)
+	if err != nil {
+		t.Fatalf("Seal() error: %v", err)
+	}
+	if _, err := pending.Open(stale, authorityPub); err == nil {
+		t.Fatalf("expected delivery for another request to fail")
+	}
+
+	// Delivery not signed by the authority
+	forged, err := enrollment.Seal(otherRequest, otherID, enrollment.KeyBundle{Subject: "dev-001"}, forgerKey)
+	if err != nil {
+		t.Fatalf("Seal() error: %v", err)
+	}
+	if _, err := pending.Open(forged, authorityPub); err == nil {
+		t.Fatalf("expected delivery signed by another key to fail")
+	}
+}
+
+func TestEnrollment_ReissueNotice_ChecksSignerAndDevice(t *testing.T) {
+	authorityPub, authorityKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	otherPub, _, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	message, err := enrollment.SignNotice(enrollment.Notice{DeviceID: "dev-001", KeyID: "e2", Replaces: "abc"}, authorityKey)
+	if err != nil {
+		t.Fatalf("SignNotice() error: %v", err)
+	}
+	notice, err := enrollment.VerifyNotice(message, authorityPub, "dev-001")
+	if err != nil {
+		t.Fatalf("VerifyNotice() error: %v", err)
+	}
+	if notice.KeyID != "e2" || notice.Replaces != "abc" {
+		t.Fatalf("notice mismatch: %+v", notice)
+	}
+
+	if _, err := enrollment.VerifyNotice(message, otherPub, "dev-001"); err == nil {
+		t.Fatalf("expected a notice signed by another key to fail")
+	}
+	if _, err := enrollment.VerifyNotice(message, authorityPub, "dev-002"); err == nil {
+		t.Fatalf("expected a notice for another device to fail")
+	}
+}
@@ -0,0 +1,41 @@
+package unit
+
+import (
+	"testing"
+
+	"securemqtt/internal/escrow"
+)
+
+func TestEscrow_Apply(t *testing.T) {
+	config := &escrow.Escrow{Clause: "(role: auditor)", OptOut: []string{"debug/#"}}
+	if err := config.Check(); err != nil {
+		t.Fatalf("Check() error: %v", err)
+	}
+	rewriter := escrow.NewRewriter(config)
+
+	policy, err := rewriter.RewriteTopic("plant/rome", "(role: operator) and (site: rome)")
+	if err != nil {
+		t.Fatalf("RewriteTopic() error: %v", err)
+	}
+	if want := "(((role: operator) and (site: rome)) or (role: auditor))"; policy != want {
+		t.Fatalf("RewriteTopic() = %q, want %q", policy, want)
+	}
+
+	// Opted-out topics keep their policy, without a topic the clause always applies
+	if policy, _ := rewriter.RewriteTopic("debug/rome", "(role: operator)"); policy != "(role: operator)" {
+		t.Fatalf("opted-out topic got %q", policy)
+	}
+	if policy, _ := rewriter.Rewrite("(role: operator)"); policy != "((role: operator) or (role: auditor))" {
+		t.Fatalf("Rewrite() = %q", policy)
+	}
+
+	// An empty clause disables escrow
+	rewriter.SetEscrow(&escrow.Escrow{})
+	if policy, _ := rewriter.RewriteTopic("plant/rome", "(role: operator)"); policy != "(role: operator)" {
+		t.Fatalf("disabled escrow rewrote to %q", policy)
+	}
+
+	if err := (&escrow.Escrow{Clause: "role auditor"}).Check(); err == nil {
+		t.Fatalf("expected a malformed clause to be rejected")
+	}
+}
@@ -0,0 +1,174 @@
+package unit
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"securemqtt/internal/identity"
+)
+
+// Signs claims as a compact JWT with an Ed25519 or P-256 key
+func signToken(t *testing.T, kid string, key any, claims map[string]any) string {
+	t.Helper()
+	alg := "EdDSA"
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		alg = "ES256"
+	}
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("marshal claims: %v", err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signingInput))
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signingInput))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("ecdsa.Sign() error: %v", err)
+		}
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// A stand-in identity provider: one Ed25519 & one P-256 key, published as a JWKS
+func testIdentityProvider(t *testing.T) (ed25519.PrivateKey, *ecdsa.PrivateKey, []byte) {
+	t.Helper()
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey() error: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey() error: %v", err)
+	}
+	point, err := ecKey.PublicKey.Bytes()
+	if err != nil {
+		t.Fatalf("PublicKey.Bytes() error: %v", err)
+	}
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks, _ := json.Marshal(map[string]any{"keys": []identity.JWK{
+		{Kty: "OKP", Kid: "ed", Crv: "Ed25519", X: encode(edPub), Use: "sig"},
+		{Kty: "EC", Kid: "ec", Crv: "P-256", X: encode(point[1:33]), Y: encode(point[33:])},
+	}})
+	return edKey, ecKey, jwks
+}
+
+func testClaims(now time.Time) map[string]any {
+	return map[string]any{
+		"iss":        "https://idp.test",
+		"aud":        []string{"securemqtt", "other"},
+		"sub":        "alice",
+		"exp":        now.Add(time.Hour).Unix(),
+		"department": "maintenance",
+		"sites":      []string{"rome", "milan"},
+	}
+}
+
+func TestIdentity_Verify(t *testing.T) {
+	edKey, ecKey, jwks := testIdentityProvider(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.Write(jwks) }))
+	defer server.Close()
+
+	keys, err := identity.LoadJWKS(server.URL, time.Second)
+	if err != nil {
+		t.Fatalf("LoadJWKS() error: %v", err)
+	}
+	verifier := &identity.Verifier{Keys: keys, Issuer: "https://idp.test", Audience: "securemqtt"}
+	now := time.Now()
+
+	for kid, key := range map[string]any{"ed": edKey, "ec": ecKey} {
+		claims, err := verifier.Verify(signToken(t, kid, key, testClaims(now)), now)
+		if err != nil {
+			t.Fatalf("Verify(%s) error: %v", kid, err)
+		}
+		if claims["sub"] != "alice" {
+			t.Fatalf("Verify(%s) claims = %v", kid, claims)
+		}
+	}
+
+	expired := testClaims(now)
+	expired["exp"] = now.Add(-time.Minute).Unix()
+	wrongAudience := testClaims(now)
+	wrongAudience["aud"] = "other"
+	noExpiry := testClaims(now)
+	delete(noExpiry, "exp")
+	for name, claims := range map[string]map[string]any{"expired": expired, "audience": wrongAudience, "no expiry": noExpiry} {
+		if _, err := verifier.Verify(signToken(t, "ed", edKey, claims), now); err == nil {
+			t.Fatalf("expected %s token to be rejected", name)
+		}
+	}
+
+	// Tampered claims, a key the provider does not publish & an unsigned token
+	token := signToken(t, "ed", edKey, testClaims(now))
+	parts := strings.Split(token, ".")
+	forged := testClaims(now)
+	forged["department"] = "security"
+	payload, _ := json.Marshal(forged)
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + "."
+	for name, bad := range map[string]string{
+		"tampered": parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2],
+		"unknown":  signToken(t, "ed", otherKey, testClaims(now)),
+		"none":     none,
+	} {
+		if _, err := verifier.Verify(bad, now); err == nil {
+			t.Fatalf("expected %s token to be rejected", name)
+		}
+	}
+}
+
+func TestIdentity_ConfigAttributes(t *testing.T) {
+	config := &identity.Config{
+		Issuer: "https://idp.test", Audience: "securemqtt", JWKS: "jwks.json",
+		Rules: []identity.Rule{
+			{Claim: "department", Attribute: "role", Values: map[string]string{"maintenance": "operator"}, Required: true},
+			{Claim: "sites", Attribute: "site"},
+			{Claim: "missing", Attribute: "team"},
+		},
+	}
+	if err := config.Check(); err != nil {
+		t.Fatalf("Check() error: %v", err)
+	}
+
+	claims := identity.Claims{}
+	data, _ := json.Marshal(testClaims(time.Now()))
+	json.Unmarshal(data, &claims)
+
+	attrs, err := config.Attributes(claims)
+	if err != nil {
+		t.Fatalf("Attributes() error: %v", err)
+	}
+	if len(attrs) != 2 || attrs["role"] != "operator" || attrs["site"] != "milan,rome" {
+		t.Fatalf("Attributes() = %v", attrs)
+	}
+	if subject, err := config.Subject(claims); err != nil || subject != "alice" {
+		t.Fatalf("Subject() = %q, %v", subject, err)
+	}
+
+	// Unmapped departments give no role, which is required
+	claims["department"] = "visitors"
+	if _, err := config.Attributes(claims); err == nil {
+		t.Fatalf("expected a missing required attribute to fail")
+	}
+
+	config.Rules = append(config.Rules, identity.Rule{Claim: "sub", Attribute: "subject_id"})
+	if err := config.Check(); err == nil {
+		t.Fatalf("expected a rule for a reserved attribute to be rejected")
+	}
+}
@@ -0,0 +1,102 @@
+package unit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"securemqtt/internal/epoch"
+	"securemqtt/internal/keyfile"
+)
+
+func TestKeyfile_EncodeArmor_RoundTrip(t *testing.T) {
+	file := keyfile.New(keyfile.Attribute, []byte("attribute key bytes"))
+	file.SystemID, file.KeyID, file.Subject = "c836e341a06d0a14", "e2", "sub1"
+	file.Attributes = map[string]string{"role": "operator"}
+
+	binary, err := file.Encode()
+	if err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	armored, err := file.Armor()
+	if err != nil {
+		t.Fatalf("Armor() error: %v", err)
+	}
+
+	for name, data := range map[string][]byte{"binary": binary, "armored": armored} {
+		got, err := keyfile.Decode(data)
+		if err != nil {
+			t.Fatalf("%s: Decode() error: %v", name, err)
+		}
+		if got.Legacy() || got.Type != keyfile.Attribute || !bytes.Equal(got.Key, file.Key) {
+			t.Fatalf("%s: got %+v", name, got)
+		}
+		if got.KeyID != "e2" || got.SystemID != file.SystemID || got.Attributes["role"] != "operator" {
+			t.Fatalf("%s: header mismatch: %+v", name, got.Header)
+		}
+	}
+}
+
+func TestKeyfile_LegacyRawKey_IsReadAsIs(t *testing.T) {
+	_, goodKey, _, _, _ := setupABE(t)
+
+	got, err := keyfile.Decode(goodKey)
+	if err != nil {
+		t.Fatalf("Decode() error: %v", err)
+	}
+	if !got.Legacy() || !bytes.Equal(got.Key, goodKey) || got.Fingerprint != keyfile.Fingerprint(goodKey) {
+		t.Fatalf("legacy key not returned unchanged: %+v", got.Header)
+	}
+}
+
+func TestKeyfile_CorruptedOrWrongType_Fails(t *testing.T) {
+	dir := t.TempDir()
+	data, err := keyfile.New(keyfile.Public, []byte("public key bytes")).Encode()
+	if err != nil {
+		t.Fatalf("Encode() error: %v", err)
+	}
+	path := filepath.Join(dir, "public.key")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	if _, err := keyfile.Read(path, keyfile.Attribute); err == nil {
+		t.Fatalf("expected a public key to be rejected as attribute key")
+	}
+
+	data[len(data)-1] ^= 1
+	if _, err := keyfile.Decode(data); err == nil {
+		t.Fatalf("expected a corrupted key to fail its fingerprint check")
+	}
+}
+
+func TestEpoch_SubscriberKeys_RejectsKeyOfAnotherSystem(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, file *keyfile.File) {
+		data, err := file.Encode()
+		if err != nil {
+			t.Fatalf("Encode() error: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatalf("WriteFile() error: %v", err)
+		}
+	}
+
+	publicKey := []byte("public key of this system")
+	write(epoch.PublicKeyFile, keyfile.New(keyfile.Public, publicKey))
+
+	own := keyfile.New(keyfile.Attribute, []byte("own key"))
+	own.SystemID = keyfile.SystemID(publicKey)
+	write("own.key", own)
+	if _, keys, err := epoch.SubscriberKeys(dir, "own.key"); err != nil || !bytes.Equal(keys[""], own.Key) {
+		t.Fatalf("SubscriberKeys(own.key) = %v, %v", keys, err)
+	}
+
+	foreign := keyfile.New(keyfile.Attribute, []byte("foreign key"))
+	foreign.SystemID = keyfile.SystemID([]byte("public key of another system"))
+	write("foreign.key", foreign)
+	if _, _, err := epoch.SubscriberKeys(dir, "foreign.key"); err == nil {
+		t.Fatalf("expected a key of another system to be rejected")
+	}
+}
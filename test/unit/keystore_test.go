@@ -0,0 +1,166 @@
+package unit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"securemqtt/internal/backup"
+	"securemqtt/internal/keystore"
+	"securemqtt/internal/namespace"
+)
+
+func TestKeyStore_Write_ReplacesAtomicallyWithPermissions(t *testing.T) {
+	store := keystore.New(t.TempDir())
+	if err := store.Write("master.key", []byte("old"), keystore.PublicPerm); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if err := store.Write("master.key", []byte("new"), keystore.SecretPerm); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	if err := store.Write("broker/acl.conf", []byte("acl"), keystore.PublicPerm); err != nil {
+		t.Fatalf("Write() into a subdirectory error: %v", err)
+	}
+	if err := store.Write("../outside.key", []byte("x"), keystore.PublicPerm); err == nil {
+		t.Fatalf("expected write outside the store to fail; got nil error")
+	}
+
+	path := filepath.Join(store.Dir(), "master.key")
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "new" {
+		t.Fatalf("master.key = %q, %v", data, err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != keystore.SecretPerm {
+		t.Fatalf("master.key mode = %v, want %v", perm, keystore.SecretPerm)
+	}
+	entries, err := os.ReadDir(store.Dir())
+	if err != nil {
+		t.Fatalf("ReadDir() error: %v", err)
+	}
+	for _, entry := range entries {
+		if keystore.IsTemp(entry.Name()) {
+			t.Fatalf("temporary file %s left behind", entry.Name())
+		}
+	}
+}
+
+func TestKeyStore_Recover_RemovesStaleTemporaryFiles(t *testing.T) {
+	store := keystore.New(t.TempDir())
+	if err := store.Write("public.key", []byte("key"), keystore.PublicPerm); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	stale := filepath.Join(store.Dir(), "epochs", "e1", ".tmp-master.key-1")
+	fresh := filepath.Join(store.Dir(), ".tmp-registry.json-2")
+	// Another namespace's write, recovered under that namespace's own lock
+	other := filepath.Join(store.Dir(), namespace.Dir, "b", ".tmp-registry.json-3")
+	for _, path := range []string{stale, fresh, other} {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("MkdirAll() error: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("trunc"), 0600); err != nil {
+			t.Fatalf("WriteFile() error: %v", err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	for _, path := range []string{stale, other} {
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("Chtimes() error: %v", err)
+		}
+	}
+
+	removed, err := store.Recover()
+	if err != nil {
+		t.Fatalf("Recover() error: %v", err)
+	}
+	if len(removed) != 1 || removed[0] != "epochs/e1/.tmp-master.key-1" {
+		t.Fatalf("Recover() removed %v, want only the stale file", removed)
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("a write that may still be in progress was removed: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Fatalf("another namespace's file was removed: %v", err)
+	}
+
+	// Neither the lock nor temporary files end up in a backup
+	lock, err := store.Lock()
+	if err != nil {
+		t.Fatalf("Lock() error: %v", err)
+	}
+	defer lock.Unlock()
+	contents, err := backup.Collect(store.Dir(), "", time.Now())
+	if err != nil {
+		t.Fatalf("Collect() error: %v", err)
+	}
+	if len(contents.Files) != 1 || contents.Files[0].Name != "public.key" {
+		t.Fatalf("Collect() = %d file(s), want only public.key", len(contents.Files))
+	}
+}
+
+func TestKeyStore_Commit_PutsStagedFileInPlace(t *testing.T) {
+	store := keystore.New(t.TempDir())
+	path := filepath.Join(store.Dir(), "public.key")
+	if err := store.Write("public.key", []byte("old"), keystore.PublicPerm); err != nil {
+		t.Fatalf("Write() error: %v", err)
+	}
+	staging := keystore.StagingPath(path)
+	if filepath.Dir(staging) != store.Dir() || !keystore.IsTemp(filepath.Base(staging)) {
+		t.Fatalf("StagingPath() = %s, want a temporary file next to public.key", staging)
+	}
+	if err := keystore.WriteFile(staging, []byte("new"), keystore.PublicPerm); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old" {
+		t.Fatalf("public.key = %q before commit, want old", data)
+	}
+
+	if err := keystore.Commit(path); err != nil {
+		t.Fatalf("Commit() error: %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Fatalf("public.key = %q after commit, want new", data)
+	}
+	if _, err := os.Stat(staging); !os.IsNotExist(err) {
+		t.Fatalf("staged file left behind: %v", err)
+	}
+	if err := keystore.Commit(path); err == nil {
+		t.Fatalf("expected commit without a staged file to fail; got nil error")
+	}
+}
+
+func TestKeyStore_Lock_SerializesHolders(t *testing.T) {
+	store := keystore.New(filepath.Join(t.TempDir(), "keys"))
+	first, err := store.Lock()
+	if err != nil {
+		t.Fatalf("Lock() error: %v", err)
+	}
+
+	acquired := make(chan *keystore.Lock)
+	go func() {
+		second, err := store.Lock()
+		if err != nil {
+			t.Errorf("Lock() error: %v", err)
+		}
+		acquired <- second
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatalf("second Lock() returned while the first was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Unlock()
+	first.Unlock()
+
+	select {
+	case second := <-acquired:
+		second.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("second Lock() did not return after Unlock()")
+	}
+}
@@ -0,0 +1,317 @@
+package unit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"securemqtt/internal/accesspolicy"
+	"securemqtt/internal/manifest"
+)
+
+// Accepts any key file without a slash & attributes given as a flat JSON object of strings
+type fakeChecker struct{}
+
+func (strct *fakeChecker) KeyFile(name string) error {
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("invalid key file %q", name)
+	}
+	return nil
+}
+
+func (strct *fakeChecker) ParseAttributes(raw json.RawMessage) (map[string]string, error) {
+	var attrs map[string]string
+	if err := json.Unmarshal(raw, &attrs); err != nil {
+		return nil, err
+	}
+	return attrs, nil
+}
+
+func (strct *fakeChecker) CheckAttributes(attrs map[string]string) error {
+	if len(attrs) == 0 {
+		return fmt.Errorf("no attributes")
+	}
+	return nil
+}
+
+func (strct *fakeChecker) Validity(period, validFrom, validUntil string) (*accesspolicy.Validity, error) {
+	if validUntil == "" {
+		return nil, nil
+	}
+	notAfter, err := time.Parse("2006-01-02", validUntil)
+	if err != nil {
+		return nil, err
+	}
+	granularity := accesspolicy.Granularity(period)
+	if granularity == "" {
+		granularity = accesspolicy.Month
+	}
+	return &accesspolicy.Validity{NotAfter: notAfter, Granularity: granularity}, nil
+}
+
+// Fails Prepare for subjects in failPrepare & every Commit once failCommit is set
+type fakeIssuer struct {
+	failPrepare map[string]bool
+	failCommit  bool
+	committed   []string
+}
+
+func (strct *fakeIssuer) Prepare(item *manifest.Item) (string, error) {
+	if strct.failPrepare[item.Row.Subject] {
+		return "", errors.New("keygen failed")
+	}
+	return "fp-" + item.Row.Subject, nil
+}
+
+func (strct *fakeIssuer) Commit(items []*manifest.Item) error {
+	if strct.failCommit {
+		return errors.New("disk full")
+	}
+	for _, item := range items {
+		strct.committed = append(strct.committed, item.Row.Subject)
+	}
+	return nil
+}
+
+func TestManifest_ParseCSV_ReadsAttributeColumns(t *testing.T) {
+	rows, err := manifest.ParseCSV(strings.NewReader(
+		"subject, out, role, site, valid_until, site\n" +
+			"alice,,operator,rome,2026-12-31,milan\n" +
+			"bob,bob-1.key,guest,,,\n"))
+	if err != nil {
+		t.Fatalf("ParseCSV() error: %v", err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("len(rows) = %d, want 2", len(rows))
+	}
+
+	alice := rows[0]
+	if alice.Line != 2 || alice.Subject != "alice" || alice.Out != "" || alice.ValidUntil != "2026-12-31" {
+		t.Fatalf("alice = %+v", alice)
+	}
+	if alice.Attrs["role"] != "operator" {
+		t.Fatalf("alice role = %q, want operator", alice.Attrs["role"])
+	}
+	if got := accesspolicy.Values(alice.Attrs["site"]); len(got) != 2 || got[0] != "milan" || got[1] != "rome" {
+		t.Fatalf("alice site = %v, want [milan rome]", got)
+	}
+
+	bob := rows[1]
+	if bob.Line != 3 || bob.Out != "bob-1.key" {
+		t.Fatalf("bob = %+v", bob)
+	}
+	if _, ok := bob.Attrs["site"]; ok {
+		t.Fatalf("empty site cell became attribute %q", bob.Attrs["site"])
+	}
+}
+
+func TestManifest_ParseCSV_RejectsRaggedRows(t *testing.T) {
+	if _, err := manifest.ParseCSV(strings.NewReader("subject,role\nalice\n")); err == nil {
+		t.Fatalf("expected a row with a missing column to fail; got nil error")
+	}
+}
+
+func TestManifest_ParseCSV_RejectsCommasInValues(t *testing.T) {
+	_, err := manifest.ParseCSV(strings.NewReader("subject,site\nalice,\"rome,milan\"\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("ParseCSV() error = %v, want a comma in line 2 rejected", err)
+	}
+}
+
+func TestManifest_Parse_ReadsJSONByExtension(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "devices.json")
+	data := `[{"subject":"alice","attributes":{"role":"operator"}},{"subject":"bob","out":"b.key","period":"week"}]`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+
+	rows, err := manifest.Parse(path)
+	if err != nil {
+		t.Fatalf("Parse() error: %v", err)
+	}
+	if len(rows) != 2 || rows[0].Line != 1 || rows[1].Line != 2 {
+		t.Fatalf("rows = %+v", rows)
+	}
+	if rows[0].Attrs != nil || string(rows[0].Attributes) != `{"role":"operator"}` {
+		t.Fatalf("alice attributes = %s, attrs %v; want them raw until validated", rows[0].Attributes, rows[0].Attrs)
+	}
+	if rows[1].Out != "b.key" || rows[1].Period != "week" {
+		t.Fatalf("bob = %+v", rows[1])
+	}
+
+	other := filepath.Join(dir, "devices.txt")
+	if err := os.WriteFile(other, []byte(data), 0600); err != nil {
+		t.Fatalf("WriteFile() error: %v", err)
+	}
+	if _, err := manifest.Parse(other); err == nil {
+		t.Fatalf("expected a .txt manifest to fail; got nil error")
+	}
+}
+
+func TestManifest_Validate_ReportsEveryInvalidRow(t *testing.T) {
+	rows, err := manifest.ParseCSV(strings.NewReader(
+		"subject,out,role,valid_until,period\n" +
+			"alice,,operator,,\n" +
+			"alice,alice-2.key,operator,,\n" +
+			",x.key,operator,,\n" +
+			"bob,alice.key,guest,,\n" +
+			"carol,../carol.key,guest,,\n" +
+			"dave,,,,\n" +
+			"erin,,guest,2026-12-31,month\n" +
+			"frank,,guest,2026-12-31,week\n"))
+	if err != nil {
+		t.Fatalf("ParseCSV() error: %v", err)
+	}
+
+	items, results := manifest.Validate(rows, &fakeChecker{})
+	if len(results) != len(rows) {
+		t.Fatalf("len(results) = %d, want one per row (%d)", len(results), len(rows))
+	}
+	want := []struct{ status, err string }{
+		{manifest.StatusPending, ""},
+		{manifest.StatusInvalid, "duplicate subject, first seen on line 2"},
+		{manifest.StatusInvalid, "subject is required"},
+		{manifest.StatusInvalid, "duplicate key file, first seen on line 2"},
+		{manifest.StatusInvalid, "invalid key file"},
+		{manifest.StatusInvalid, "attributes: no attributes"},
+		{manifest.StatusPending, ""},
+		{manifest.StatusInvalid, "mixes month and week periods"},
+	}
+	for i, result := range results {
+		if result.Status != want[i].status || !strings.Contains(result.Error, want[i].err) {
+			t.Fatalf("line %d: status %s, error %q; want %s, %q", result.Line, result.Status, result.Error, want[i].status, want[i].err)
+		}
+	}
+
+	if len(items) != 2 || items[0].Row.Subject != "alice" || items[1].Row.Subject != "erin" {
+		t.Fatalf("items = %v, want alice & erin", items)
+	}
+	if items[0].Row.Out != "alice.key" || items[0].Result.KeyFile != "alice.key" {
+		t.Fatalf("alice key file = %q / %q, want the default alice.key", items[0].Row.Out, items[0].Result.KeyFile)
+	}
+	if items[0].Validity != nil || items[1].Validity == nil {
+		t.Fatalf("validity: alice %v, erin %v; want permanent & time-bound", items[0].Validity, items[1].Validity)
+	}
+}
+
+func TestManifest_Validate_ParsesJSONAttributes(t *testing.T) {
+	rows := []manifest.Row{
+		{Line: 1, Subject: "alice", Attributes: json.RawMessage(`{"role":"operator"}`)},
+		{Line: 2, Subject: "bob", Attributes: json.RawMessage(`{"role":1}`)},
+	}
+	items, results := manifest.Validate(rows, &fakeChecker{})
+	if len(items) != 1 || items[0].Row.Attrs["role"] != "operator" {
+		t.Fatalf("items = %v, want alice with role operator", items)
+	}
+	if results[1].Status != manifest.StatusInvalid || !strings.HasPrefix(results[1].Error, "attributes:") {
+		t.Fatalf("bob: status %s, error %q; want invalid attributes", results[1].Status, results[1].Error)
+	}
+}
+
+func validManifestItems(t *testing.T, subjects ...string) ([]*manifest.Item, []*manifest.Result) {
+	t.Helper()
+	var rows []manifest.Row
+	for i, subject := range subjects {
+		rows = append(rows, manifest.Row{Line: i + 1, Subject: subject, Attrs: map[string]string{"role": "operator"}})
+	}
+	items, results := manifest.Validate(rows, &fakeChecker{})
+	if len(items) != len(subjects) {
+		t.Fatalf("Validate() kept %d of %d rows", len(items), len(subjects))
+	}
+	return items, results
+}
+
+func TestManifest_Issue_AllOrNothing(t *testing.T) {
+	items, results := validManifestItems(t, "alice", "bob", "carol")
+	issuer := &fakeIssuer{failPrepare: map[string]bool{"bob": true}}
+
+	if err := manifest.Issue(items, false, issuer); err == nil || !strings.Contains(err.Error(), "line 2 (bob)") {
+		t.Fatalf("Issue() error = %v, want the failure of line 2 (bob)", err)
+	}
+	if len(issuer.committed) != 0 {
+		t.Fatalf("committed %v, want nothing written", issuer.committed)
+	}
+	if issued := manifest.Finish(results); issued != 0 {
+		t.Fatalf("Finish() = %d issued, want 0", issued)
+	}
+	for i, want := range []string{manifest.StatusNotIssued, manifest.StatusFailed, manifest.StatusNotIssued} {
+		if results[i].Status != want {
+			t.Fatalf("%s: status %s, want %s", results[i].Subject, results[i].Status, want)
+		}
+	}
+}
+
+func TestManifest_Issue_AllOrNothingCommitsOnce(t *testing.T) {
+	items, results := validManifestItems(t, "alice", "bob")
+	issuer := &fakeIssuer{}
+	if err := manifest.Issue(items, false, issuer); err != nil {
+		t.Fatalf("Issue() error: %v", err)
+	}
+	if strings.Join(issuer.committed, ",") != "alice,bob" {
+		t.Fatalf("committed %v, want alice & bob", issuer.committed)
+	}
+	if issued := manifest.Finish(results); issued != 2 {
+		t.Fatalf("Finish() = %d issued, want 2", issued)
+	}
+	if results[1].Fingerprint != "fp-bob" {
+		t.Fatalf("bob fingerprint = %q, want fp-bob", results[1].Fingerprint)
+	}
+
+	items, results = validManifestItems(t, "alice", "bob")
+	if err := manifest.Issue(items, false, &fakeIssuer{failCommit: true}); err == nil {
+		t.Fatalf("expected a failed commit to fail Issue(); got nil error")
+	}
+	for _, result := range results {
+		if result.Status != manifest.StatusFailed {
+			t.Fatalf("%s: status %s after a failed commit, want failed", result.Subject, result.Status)
+		}
+	}
+}
+
+func TestManifest_Issue_PartialIssuesEachValidRow(t *testing.T) {
+	items, results := validManifestItems(t, "alice", "bob", "carol")
+	issuer := &fakeIssuer{failPrepare: map[string]bool{"bob": true}}
+
+	if err := manifest.Issue(items, true, issuer); err != nil {
+		t.Fatalf("Issue() error: %v", err)
+	}
+	if strings.Join(issuer.committed, ",") != "alice,carol" {
+		t.Fatalf("committed %v, want alice & carol", issuer.committed)
+	}
+	if issued := manifest.Finish(results); issued != 2 {
+		t.Fatalf("Finish() = %d issued, want 2", issued)
+	}
+	if results[1].Status != manifest.StatusFailed || results[1].Error != "keygen failed" || results[1].Fingerprint != "" {
+		t.Fatalf("bob = %+v, want failed without fingerprint", results[1])
+	}
+}
+
+func TestManifest_WriteIndex_ListsEveryRow(t *testing.T) {
+	items, results := validManifestItems(t, "alice")
+	if err := manifest.Issue(items, false, &fakeIssuer{}); err != nil {
+		t.Fatalf("Issue() error: %v", err)
+	}
+	manifest.Finish(results)
+
+	path := filepath.Join(t.TempDir(), "devices.index.json")
+	if err := manifest.WriteIndex(path, results); err != nil {
+		t.Fatalf("WriteIndex() error: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("ReadFile() error: %v", err)
+	}
+	var index []manifest.Result
+	if err := json.Unmarshal(data, &index); err != nil {
+		t.Fatalf("Unmarshal() error: %v", err)
+	}
+	if len(index) != 1 || index[0].KeyFile != "alice.key" || index[0].Fingerprint != "fp-alice" || index[0].Status != manifest.StatusIssued {
+		t.Fatalf("index = %+v", index)
+	}
+}
@@ -0,0 +1,178 @@
+package unit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"securemqtt/internal/abe"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/masterkey"
+	"securemqtt/internal/namespace"
+)
+
+// Issues a key for (role: operator) & checks it decrypts what publicKey encrypts to it
+func checkMasterKey(t *testing.T, master masterkey.IMasterKey, publicKey []byte) {
+	t.Helper()
+	attributeKey, err := master.KeyGen(map[string]string{"role": "operator"})
+	if err != nil {
+		t.Fatalf("KeyGen() error: %v", err)
+	}
+	sessionKey := []byte("0123456789abcdef")
+	ciphertext, err := (&abe.PublisherABE{}).EncryptKey(publicKey, "(role: operator)", sessionKey)
+	if err != nil {
+		t.Fatalf("EncryptKey() error: %v", err)
+	}
+	decrypted, err := (&abe.SubscriberABE{}).DecryptKey(attributeKey, ciphertext)
+	if err != nil || !bytes.Equal(decrypted, sessionKey) {
+		t.Fatalf("issued key cannot decrypt for its public key: %v", err)
+	}
+	if master.SystemID() != keyfile.SystemID(publicKey) {
+		t.Fatalf("SystemID() = %q, want %q", master.SystemID(), keyfile.SystemID(publicKey))
+	}
+}
+
+func TestMasterKey_SealedStore_RoundTripAndRefusals(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	path := filepath.Join(t.TempDir(), "master.key.sealed")
+	store := &masterkey.SealedStore{Path: path, Passphrase: func(bool) ([]byte, error) { return bytes.Clone(passphrase), nil }}
+
+	publicKey, err := store.Setup("e1")
+	if err != nil {
+		t.Fatalf("Setup() error: %v", err)
+	}
+	master, err := store.Open()
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	checkMasterKey(t, master, publicKey)
+
+	header, err := masterkey.ReadSealedHeader(path)
+	if err != nil || header.KeyID != "e1" || header.SystemID != keyfile.SystemID(publicKey) {
+		t.Fatalf("ReadSealedHeader() = %+v, %v", header, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte(`"master`)) || info(t, path) != 0600 {
+		t.Fatalf("sealed file must be owner-only & hold no plaintext key fields")
+	}
+
+	wrong := &masterkey.SealedStore{Path: path, Passphrase: func(bool) ([]byte, error) { return []byte("not the passphrase"), nil }}
+	if _, err := wrong.Open(); err == nil {
+		t.Fatalf("expected wrong passphrase to fail; got nil error")
+	}
+
+	// The header is bound to the ciphertext: the key cannot be passed off as another epoch's
+	if err := os.WriteFile(path, bytes.Replace(data, []byte(`"key_id": "e1"`), []byte(`"key_id": "e2"`), 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Open(); err == nil {
+		t.Fatalf("expected tampered header to fail; got nil error")
+	}
+
+	short := &masterkey.SealedStore{Path: path, Passphrase: func(bool) ([]byte, error) { return []byte("short"), nil }}
+	if _, err := short.Setup("e1"); err == nil || !strings.Contains(err.Error(), "passphrase") {
+		t.Fatalf("expected short passphrase to be refused, got %v", err)
+	}
+}
+
+func TestMasterKey_SocketStore_KeyStaysWithKeyHolder(t *testing.T) {
+	// Unix socket paths are limited to ~100 bytes, t.TempDir() can be longer
+	dir, err := os.MkdirTemp("", "kh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	holderDir := filepath.Join(dir, "holder")
+
+	stores := func(ns string) masterkey.IMasterKeyStore {
+		return &masterkey.FileStore{Path: filepath.Join(namespace.Path(holderDir, ns), "master.key"), Namespace: ns}
+	}
+	server, err := masterkey.NewServer(stores, t.Logf)
+	if err != nil {
+		t.Fatalf("NewServer() error: %v", err)
+	}
+	listener, err := masterkey.Listen(filepath.Join(dir, "kh.sock"))
+	if err != nil {
+		t.Fatalf("Listen() error: %v", err)
+	}
+	defer listener.Close()
+	go server.Serve(listener)
+
+	store := &masterkey.SocketStore{Path: filepath.Join(dir, "kh.sock")}
+	if _, err := store.Open(); err == nil {
+		t.Fatalf("expected a key holder without master key to refuse; got nil error")
+	}
+	publicKey, err := store.Setup("e1")
+	if err != nil {
+		t.Fatalf("Setup() error: %v", err)
+	}
+	master, err := store.Open()
+	if err != nil {
+		t.Fatalf("Open() error: %v", err)
+	}
+	checkMasterKey(t, master, publicKey)
+
+	// Another authority's setup must not destroy the master key the key holder already has
+	if _, err := store.Setup("e1"); err == nil {
+		t.Fatalf("expected setup against a key holder with a master key to be refused; got nil error")
+	}
+	if reopened, err := store.Open(); err != nil || reopened.SystemID() != master.SystemID() {
+		t.Fatalf("refused setup changed the master key: %v", err)
+	}
+	// A forced setup in another namespace gets a master key of its own
+	other := &masterkey.SocketStore{Path: store.Path, Namespace: "tenant-b", Replace: true}
+	otherPublic, err := other.Setup("e1")
+	if err != nil {
+		t.Fatalf("Setup() in another namespace error: %v", err)
+	}
+	if keyfile.SystemID(otherPublic) == master.SystemID() {
+		t.Fatalf("namespaces share a master key")
+	}
+	if reopened, err := store.Open(); err != nil || reopened.SystemID() != master.SystemID() {
+		t.Fatalf("setup in another namespace changed the default master key: %v", err)
+	}
+	if _, err := (&masterkey.SocketStore{Path: store.Path, Namespace: "../x"}).Open(); err == nil {
+		t.Fatalf("expected an invalid namespace to be refused; got nil error")
+	}
+
+	// A replace names the system it replaces, & keygen the system it issues for
+	wrong := &masterkey.SocketStore{Path: store.Path, SystemID: keyfile.SystemID(otherPublic), Replace: true}
+	if _, err := wrong.Setup("e2"); err == nil {
+		t.Fatalf("expected a replace of another system's master key to be refused; got nil error")
+	}
+	replacing := &masterkey.SocketStore{Path: store.Path, SystemID: master.SystemID(), Replace: true}
+	replaced, err := replacing.Setup("e2")
+	if err != nil {
+		t.Fatalf("Setup() with Replace error: %v", err)
+	}
+	if keyfile.SystemID(replaced) == master.SystemID() {
+		t.Fatalf("Setup() with Replace kept the old master key")
+	}
+	if _, err := master.KeyGen(map[string]string{"role": "operator"}); err == nil {
+		t.Fatalf("expected keygen for the replaced system to be refused; got nil error")
+	}
+
+	if _, err := os.Stat(filepath.Join(holderDir, "master.key")); err != nil {
+		t.Fatalf("key holder did not keep the master key: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(holderDir, namespace.Dir, "tenant-b", "master.key")); err != nil {
+		t.Fatalf("key holder did not keep the namespace's master key apart: %v", err)
+	}
+	if info(t, filepath.Join(dir, "kh.sock"))&0077 != 0 {
+		t.Fatalf("socket must be reachable by its owner only")
+	}
+}
+
+func info(t *testing.T, path string) os.FileMode {
+	t.Helper()
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stat.Mode().Perm()
+}
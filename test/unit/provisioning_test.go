@@ -0,0 +1,128 @@
+package unit
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/provisioning"
+	"securemqtt/internal/signed"
+)
+
+// Subscriber bundle for a key of setupABE's system
+func newSubscriberBundle(t *testing.T) *provisioning.Bundle {
+	t.Helper()
+	publicKey, attributeKey, _, _, _ := setupABE(t)
+	return &provisioning.Bundle{
+		Version:      provisioning.Version,
+		Role:         provisioning.RoleSubscriber,
+		Subject:      "sub1",
+		SystemID:     keyfile.SystemID(publicKey),
+		KeyID:        "e1",
+		PublicKey:    publicKey,
+		AttributeKey: attributeKey,
+		Broker:       provisioning.Broker{URLs: []string{"tcp://broker:1883"}, ClientID: "sub1"},
+		Topics:       []provisioning.Topic{{Topic: "plant/+/alarms"}},
+		CreatedAt:    time.Now().UTC(),
+	}
+}
+
+func TestProvisioning_SignedBundle_RoundTripAndDocuments(t *testing.T) {
+	publicKey, privateKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	bundle := newSubscriberBundle(t)
+	document, err := signed.Sign(privateKey, "test-doc", signedPayload{Value: "hello"})
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	bundle.Documents = map[string][]byte{"test.json": document}
+
+	data, err := provisioning.Sign(privateKey, bundle)
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "sub1.bundle.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := provisioning.Load(path, publicKey)
+	if err != nil {
+		t.Fatalf("Load() error: %v", err)
+	}
+	if !bytes.Equal(loaded.AttributeKey, bundle.AttributeKey) || loaded.SystemID != bundle.SystemID || loaded.Broker.ClientID != "sub1" {
+		t.Fatalf("loaded bundle differs from the signed one")
+	}
+	if !bytes.Equal(loaded.AuthorityKey(), publicKey) {
+		t.Fatalf("AuthorityKey() is not the key the bundle was verified with")
+	}
+
+	var got signedPayload
+	if found, err := loaded.LoadDocument("test.json", "test-doc", &got); err != nil || !found || got.Value != "hello" {
+		t.Fatalf("LoadDocument() = %v, %v, %q", found, err, got.Value)
+	}
+	if found, err := loaded.LoadDocument("missing.json", "test-doc", &got); err != nil || found {
+		t.Fatalf("expected a document missing from the bundle to be not found, got %v, %v", found, err)
+	}
+}
+
+func TestProvisioning_WrongKeyOrTamperedBundle_Fails(t *testing.T) {
+	publicKey, privateKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	otherPublicKey, _, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	data, err := provisioning.Sign(privateKey, newSubscriberBundle(t))
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "sub1.bundle.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provisioning.Load(path, otherPublicKey); err == nil {
+		t.Fatalf("expected failure for a bundle of another authority; got nil error")
+	}
+
+	tampered := filepath.Join(dir, "tampered.bundle.json")
+	if err := os.WriteFile(tampered, bytes.Replace(data, []byte(`"payload": "`), []byte(`"payload": "A`), 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provisioning.Load(tampered, publicKey); err == nil {
+		t.Fatalf("expected failure for a tampered bundle; got nil error")
+	}
+}
+
+func TestProvisioning_Check_RejectsUnusableBundles(t *testing.T) {
+	_, privateKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	cases := map[string]func(*provisioning.Bundle){
+		"publisher with attribute key": func(b *provisioning.Bundle) { b.Role = provisioning.RolePublisher },
+		"subscriber without key":       func(b *provisioning.Bundle) { b.AttributeKey = nil },
+		"public key of another system": func(b *provisioning.Bundle) { b.SystemID = "0000000000000000" },
+		"no broker":                    func(b *provisioning.Bundle) { b.Broker.URLs = nil },
+		"CA that is not PEM":           func(b *provisioning.Bundle) { b.Broker.CACert = []byte("not a certificate") },
+		"publisher to a filter": func(b *provisioning.Bundle) {
+			b.Role, b.AttributeKey = provisioning.RolePublisher, nil
+			b.Topics = []provisioning.Topic{{Topic: "plant/+/alarms", Policy: "(role: operator)"}}
+		},
+	}
+	for name, change := range cases {
+		bundle := newSubscriberBundle(t)
+		change(bundle)
+		if _, err := provisioning.Sign(privateKey, bundle); err == nil {
+			t.Fatalf("%s: expected Sign() to refuse the bundle; got nil error", name)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package unit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"securemqtt/internal/shamir"
+)
+
+func TestShamir_AnyThresholdSubset_Reconstructs(t *testing.T) {
+	secret := make([]byte, 64)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatalf("rand.Read() error: %v", err)
+	}
+
+	shares, err := shamir.Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Split() error: %v", err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("unexpected share count: got %d want 5", len(shares))
+	}
+
+	subsets := [][]int{{0, 1, 2}, {2, 3, 4}, {4, 0, 2}, {0, 1, 2, 3, 4}}
+	for _, subset := range subsets {
+		var picked []shamir.Share
+		for _, i := range subset {
+			picked = append(picked, shares[i])
+		}
+
+		got, err := shamir.Combine(picked)
+		if err != nil {
+			t.Fatalf("Combine(%v) error: %v", subset, err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Fatalf("Combine(%v) mismatch", subset)
+		}
+	}
+}
+
+func TestShamir_BelowThreshold_Fails(t *testing.T) {
+	shares, err := shamir.Split([]byte("master secret"), 5, 3)
+	if err != nil {
+		t.Fatalf("Split() error: %v", err)
+	}
+
+	if _, err := shamir.Combine(shares[:2]); err == nil {
+		t.Fatalf("expected failure with fewer shares than threshold; got nil error")
+	}
+}
+
+func TestShamir_DuplicateShare_Fails(t *testing.T) {
+	shares, err := shamir.Split([]byte("master secret"), 3, 2)
+	if err != nil {
+		t.Fatalf("Split() error: %v", err)
+	}
+
+	if _, err := shamir.Combine([]shamir.Share{shares[0], shares[0]}); err == nil {
+		t.Fatalf("expected failure for duplicate share; got nil error")
+	}
+}
+
+func TestShamir_ShareString_RoundTrip(t *testing.T) {
+	shares, err := shamir.Split([]byte("master secret"), 3, 2)
+	if err != nil {
+		t.Fatalf("Split() error: %v", err)
+	}
+
+	parsed, err := shamir.ParseShare(shares[1].String() + "\n")
+	if err != nil {
+		t.Fatalf("ParseShare() error: %v", err)
+	}
+	if parsed.Index != shares[1].Index || parsed.Threshold != shares[1].Threshold || !bytes.Equal(parsed.Data, shares[1].Data) {
+		t.Fatalf("share round-trip mismatch")
+	}
+
+	if _, err := shamir.ParseShare("not-a-share"); err == nil {
+		t.Fatalf("expected failure for malformed share; got nil error")
+	}
+}
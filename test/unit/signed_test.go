@@ -0,0 +1,61 @@
+package unit
+
+import (
+	"bytes"
+	"testing"
+
+	"securemqtt/internal/signed"
+)
+
+type signedPayload struct {
+	Value string `json:"value"`
+}
+
+func TestSigned_RoundTrip(t *testing.T) {
+	publicKey, privateKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	doc, err := signed.Sign(privateKey, "test-doc", signedPayload{Value: "hello"})
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+
+	var got signedPayload
+	if err := signed.Verify(publicKey, "test-doc", doc, &got); err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	if got.Value != "hello" {
+		t.Fatalf("payload mismatch: got %q want %q", got.Value, "hello")
+	}
+}
+
+func TestSigned_WrongTypeOrKey_Fails(t *testing.T) {
+	publicKey, privateKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	otherPublicKey, _, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	doc, err := signed.Sign(privateKey, "test-doc", signedPayload{Value: "hello"})
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+
+	var got signedPayload
+	if err := signed.Verify(publicKey, "other-doc", doc, &got); err == nil {
+		t.Fatalf("expected failure for wrong document type; got nil error")
+	}
+	if err := signed.Verify(otherPublicKey, "test-doc", doc, &got); err == nil {
+		t.Fatalf("expected failure for wrong signing key; got nil error")
+	}
+
+	tampered := bytes.Replace(doc, []byte(`"payload": "`), []byte(`"payload": "A`), 1)
+	if err := signed.Verify(publicKey, "test-doc", tampered, &got); err == nil {
+		t.Fatalf("expected failure for tampered payload; got nil error")
+	}
+}
@@ -0,0 +1,176 @@
+package unit
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"time"
+
+	"securemqtt/internal/abe"
+	"securemqtt/internal/accesspolicy"
+	aescryptography "securemqtt/internal/aes"
+	"securemqtt/internal/keyfile"
+	"securemqtt/internal/secureclient"
+	"securemqtt/internal/signed"
+	"securemqtt/internal/statement"
+
+	"github.com/cloudflare/circl/abe/cpabe/tkn20"
+)
+
+func testStatement(key []byte) *statement.Statement {
+	return &statement.Statement{
+		Subject:        "sub1",
+		KeyID:          "e1",
+		KeyFingerprint: keyfile.Fingerprint(key),
+		Attributes:     map[string]string{"role": "operator", "site": "rome"},
+		IssuedAt:       time.Now().UTC(),
+	}
+}
+
+func TestStatement_SignVerify_RoundTrip(t *testing.T) {
+	_, goodKey, badKey, _, _ := setupABE(t)
+	authorityPub, authorityKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	data, err := testStatement(goodKey).Sign(authorityKey)
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	verified, err := statement.Verify(authorityPub, data)
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+	if verified.Subject != "sub1" || verified.Attributes["role"] != "operator" {
+		t.Fatalf("statement mismatch: %+v", verified)
+	}
+	if err := verified.CheckKey(goodKey); err != nil {
+		t.Fatalf("CheckKey() error: %v", err)
+	}
+	if err := verified.CheckKey(badKey); err == nil {
+		t.Fatalf("expected statement not to describe another key")
+	}
+}
+
+func TestStatement_Tampered_Fails(t *testing.T) {
+	_, goodKey, _, _, _ := setupABE(t)
+	authorityPub, authorityKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	_, forgerKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	data, err := testStatement(goodKey).Sign(authorityKey)
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	if _, err := statement.Verify(authorityPub, bytes.Replace(data, []byte(`"payload": "`), []byte(`"payload": "A`), 1)); err == nil {
+		t.Fatalf("expected tampered statement to fail verification")
+	}
+
+	forged, err := testStatement(goodKey).Sign(forgerKey)
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	if _, err := statement.Verify(authorityPub, forged); err == nil {
+		t.Fatalf("expected statement signed by another key to fail verification")
+	}
+}
+
+func TestSecureClient_LoadAttributeStatement(t *testing.T) {
+	pubKey, goodKey, badKey, _, _ := setupABE(t)
+	authorityPub, authorityKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+	client := secureclient.NewSecureClient(nil, &abe.PublisherABE{}, &abe.SubscriberABE{},
+		&aescryptography.AESCryptography{}, pubKey, goodKey)
+
+	foreign, err := testStatement(badKey).Sign(authorityKey)
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	if _, err := client.LoadAttributeStatement(foreign, authorityPub); err == nil {
+		t.Fatalf("expected statement for a key the client does not hold to be rejected")
+	}
+
+	held, err := testStatement(goodKey).Sign(authorityKey)
+	if err != nil {
+		t.Fatalf("Sign() error: %v", err)
+	}
+	if _, err := client.LoadAttributeStatement(held, authorityPub); err != nil {
+		t.Fatalf("LoadAttributeStatement() error: %v", err)
+	}
+	if _, err := client.LoadAttributeStatement(held, authorityPub); err != nil {
+		t.Fatalf("LoadAttributeStatement() error: %v", err)
+	}
+	statements := client.AttributeStatements()
+	if len(statements) != 1 || statements[0].Attributes["site"] != "rome" {
+		t.Fatalf("AttributeStatements() = %+v", statements)
+	}
+}
+
+func TestSecureClient_SelfTest_KeyOfAnotherSetupFails(t *testing.T) {
+	attrs := map[string]string{"role": "operator", accesspolicy.SubjectAttribute: "abc123"}
+	setup := func() (publicKey, attributeKey []byte) {
+		pub, master, err := tkn20.Setup(rand.Reader)
+		if err != nil {
+			t.Fatalf("tkn20.Setup() error: %v", err)
+		}
+		var keyAttrs tkn20.Attributes
+		keyAttrs.FromMap(attrs)
+		key, err := master.KeyGen(rand.Reader, keyAttrs)
+		if err != nil {
+			t.Fatalf("KeyGen() error: %v", err)
+		}
+		if publicKey, err = pub.MarshalBinary(); err != nil {
+			t.Fatalf("MarshalBinary() error: %v", err)
+		}
+		if attributeKey, err = key.MarshalBinary(); err != nil {
+			t.Fatalf("MarshalBinary() error: %v", err)
+		}
+		return publicKey, attributeKey
+	}
+	currentPub, currentKey := setup()
+	oldPub, oldKey := setup()
+	authorityPub, authorityKey, err := signed.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey() error: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name      string
+		key       []byte
+		publicKey []byte
+		mismatch  bool
+	}{
+		{"current setup", currentKey, currentPub, false},
+		{"earlier setup", oldKey, currentPub, true},
+		{"explicit public key", oldKey, oldPub, false},
+	} {
+		client := secureclient.NewSecureClient(nil, &abe.PublisherABE{}, &abe.SubscriberABE{},
+			&aescryptography.AESCryptography{}, currentPub, tc.key)
+		if err := client.SelfTest("", nil); err == nil || errors.Is(err, secureclient.ErrKeyMismatch) {
+			t.Fatalf("%s: expected self-test without a statement to be skipped, got %v", tc.name, err)
+		}
+
+		held := testStatement(tc.key)
+		held.Attributes = attrs
+		data, err := held.Sign(authorityKey)
+		if err != nil {
+			t.Fatalf("Sign() error: %v", err)
+		}
+		if _, err := client.LoadAttributeStatement(data, authorityPub); err != nil {
+			t.Fatalf("LoadAttributeStatement() error: %v", err)
+		}
+		err = client.SelfTest("", tc.publicKey)
+		if got := errors.Is(err, secureclient.ErrKeyMismatch); got != tc.mismatch || (err != nil && !tc.mismatch) {
+			t.Fatalf("%s: SelfTest() = %v, want mismatch %v", tc.name, err, tc.mismatch)
+		}
+	}
+}
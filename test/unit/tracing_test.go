@@ -0,0 +1,33 @@
+package unit
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"securemqtt/internal/tracing"
+)
+
+func TestProcessOracle(t *testing.T) {
+	echo := &tracing.ProcessOracle{Command: []string{"cat"}, Timeout: 5 * time.Second}
+	got, err := echo.Decrypt([]byte("envelope"))
+	if err != nil || !bytes.Equal(got, []byte("envelope")) {
+		t.Fatalf("Decrypt() = %q, %v; want the decoder's stdout", got, err)
+	}
+
+	refuse := &tracing.ProcessOracle{Command: []string{"sh", "-c", "exit 3"}, Timeout: 5 * time.Second}
+	got, err = refuse.Decrypt([]byte("envelope"))
+	if err != nil || got != nil {
+		t.Fatalf("Decrypt() = %q, %v; want nil plaintext without error", got, err)
+	}
+
+	slow := &tracing.ProcessOracle{Command: []string{"sleep", "5"}, Timeout: 50 * time.Millisecond}
+	if _, err := slow.Decrypt(nil); err == nil {
+		t.Fatalf("expected a decoder exceeding its timeout to fail")
+	}
+
+	missing := &tracing.ProcessOracle{Command: []string{"/nonexistent/decoder"}}
+	if _, err := missing.Decrypt(nil); err == nil {
+		t.Fatalf("expected a missing decoder to fail")
+	}
+}